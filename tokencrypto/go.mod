@@ -2,9 +2,13 @@ module tokentarpon/tokencrypto
 
 go 1.18
 
+require (
+	github.com/stretchr/testify v1.8.1
+	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d
+)
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.8.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
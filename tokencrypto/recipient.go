@@ -0,0 +1,215 @@
+package tokencrypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Recipient files are encrypted so that only the holder of an X25519 private
+// key can read them. A random file key encrypts the file, and is itself
+// sealed to the recipient's public key in the header:
+//
+//	header: "TTX1" | ephemeral X25519 public key (32) | sealed file key (48)
+//	chunk:  sealed length (4, big endian) | AES-256-GCM sealed chunk
+//
+// The file key is sealed with AES-256-GCM under a zero nonce and the key
+// HKDF-SHA256(X25519(ephemeral, recipient), salt: ephemeral public key |
+// recipient public key, info: "tokentarpon recipient file v1"), with the
+// magic as additional data. Chunks are sealed with the file key, each under a
+// nonce of its number from 0 as 11 big endian bytes and a final byte of 1 for
+// the last chunk, 0 otherwise, so a file that has been cut short is caught.
+
+const recipientFileMagic = "TTX1"
+const recipientKeyInfo = "tokentarpon recipient file v1"
+
+// RecipientKeySize is the size of X25519 public and private keys, before base64 encoding
+const RecipientKeySize = 32
+
+// the largest chunk a recipient file holds
+const maxRecipientChunkBytes = 16 * 1024 * 1024
+
+var (
+	ErrRecipientKey  = errors.New("recipient key must be a 32 byte X25519 key, base64 encoded")
+	ErrRecipientFile = errors.New("recipient file is malformed, cut short, or not encrypted to this key")
+)
+
+// GenerateRecipientKeys returns a new X25519 key pair, base64 encoded
+func GenerateRecipientKeys() (string, string, error) {
+	privateKey := make([]byte, RecipientKeySize)
+	if _, err := io.ReadFull(rand.Reader, privateKey); err != nil {
+		return "", "", err
+	}
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(publicKey), base64.StdEncoding.EncodeToString(privateKey), nil
+}
+
+// ParseRecipientKey decodes a base64 X25519 key
+func ParseRecipientKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != RecipientKeySize {
+		return nil, ErrRecipientKey
+	}
+	return key, nil
+}
+
+// NewRecipientFile makes a random file key, and the header that carries it
+// to the holder of the recipient's private key. The header starts the file,
+// followed by the chunks sealed with the file key.
+func NewRecipientFile(recipientPublicKey string) ([]byte, []byte, error) {
+	recipient, err := ParseRecipientKey(recipientPublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	ephemeralPrivate := make([]byte, RecipientKeySize)
+	fileKey := make([]byte, 32)
+	if _, err = io.ReadFull(rand.Reader, ephemeralPrivate); err != nil {
+		return nil, nil, err
+	}
+	if _, err = io.ReadFull(rand.Reader, fileKey); err != nil {
+		return nil, nil, err
+	}
+	ephemeralPublic, err := curve25519.X25519(ephemeralPrivate, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	// a low order recipient key gives an all zero secret, which X25519 rejects
+	shared, err := curve25519.X25519(ephemeralPrivate, recipient)
+	if err != nil {
+		return nil, nil, ErrRecipientKey
+	}
+
+	wrap, err := recipientWrapCipher(shared, ephemeralPublic, recipient)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := append([]byte(recipientFileMagic), ephemeralPublic...)
+	header = wrap.Seal(header, make([]byte, wrap.NonceSize()), fileKey, []byte(recipientFileMagic))
+	return fileKey, header, nil
+}
+
+// SealRecipientChunk encrypts a chunk of a recipient file with its file key,
+// returning it framed by its length. Chunks are numbered from 0 in the order
+// they are written, and only the last is final; it may be empty.
+func SealRecipientChunk(fileKey []byte, counter uint64, plaintext []byte, final bool) ([]byte, error) {
+	if len(plaintext) > maxRecipientChunkBytes-16 {
+		return nil, errors.New("recipient file chunk is too large")
+	}
+	aead, err := newGCM(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	framed := make([]byte, 4, 4+len(plaintext)+aead.Overhead())
+	framed = aead.Seal(framed, recipientChunkNonce(counter, final), plaintext, nil)
+	binary.BigEndian.PutUint32(framed[:4], uint32(len(framed)-4))
+	return framed, nil
+}
+
+// OpenRecipientFile decrypts a recipient file with the recipient's private
+// key, writing the plaintext out a chunk at a time. A chunk that fails to
+// open, or a file without its final chunk, is an ErrRecipientFile; what was
+// written before then should be thrown away.
+func OpenRecipientFile(file io.Reader, recipientPrivateKey string, plaintext io.Writer) error {
+	private, err := ParseRecipientKey(recipientPrivateKey)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, len(recipientFileMagic)+RecipientKeySize+32+16)
+	if _, err = io.ReadFull(file, header); err != nil || string(header[:4]) != recipientFileMagic {
+		return ErrRecipientFile
+	}
+	ephemeralPublic := header[4 : 4+RecipientKeySize]
+	recipient, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return ErrRecipientKey
+	}
+	shared, err := curve25519.X25519(private, ephemeralPublic)
+	if err != nil {
+		return ErrRecipientFile
+	}
+	wrap, err := recipientWrapCipher(shared, ephemeralPublic, recipient)
+	if err != nil {
+		return err
+	}
+	fileKey, err := wrap.Open(nil, make([]byte, wrap.NonceSize()), header[4+RecipientKeySize:], []byte(recipientFileMagic))
+	if err != nil {
+		return ErrRecipientFile
+	}
+	aead, err := newGCM(fileKey)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, 4)
+	for counter := uint64(0); ; counter++ {
+		if _, err = io.ReadFull(file, frame); err != nil {
+			// the final chunk never came
+			return ErrRecipientFile
+		}
+		size := binary.BigEndian.Uint32(frame)
+		if size < uint32(aead.Overhead()) || size > maxRecipientChunkBytes {
+			return ErrRecipientFile
+		}
+		sealed := make([]byte, size)
+		if _, err = io.ReadFull(file, sealed); err != nil {
+			return ErrRecipientFile
+		}
+
+		final := false
+		chunk, openerr := aead.Open(nil, recipientChunkNonce(counter, false), sealed, nil)
+		if openerr != nil {
+			chunk, openerr = aead.Open(nil, recipientChunkNonce(counter, true), sealed, nil)
+			final = true
+		}
+		if openerr != nil {
+			return ErrRecipientFile
+		}
+		if _, err = plaintext.Write(chunk); err != nil {
+			return err
+		}
+		if final {
+			// nothing may follow the final chunk
+			if _, err = io.ReadFull(file, frame[:1]); err != io.EOF {
+				return ErrRecipientFile
+			}
+			return nil
+		}
+	}
+}
+
+func recipientWrapCipher(shared []byte, ephemeralPublic []byte, recipient []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, ephemeralPublic...), recipient...)
+	wrapKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(recipientKeyInfo)), wrapKey); err != nil {
+		return nil, err
+	}
+	return newGCM(wrapKey)
+}
+
+func recipientChunkNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,74 @@
+package tokencrypto
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sealRecipientFile writes a recipient file of the chunks, the last one final
+func sealRecipientFile(t *testing.T, publicKey string, chunks []string) []byte {
+	fileKey, header, err := NewRecipientFile(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := append([]byte{}, header...)
+	for idx, chunk := range chunks {
+		sealed, sealerr := SealRecipientChunk(fileKey, uint64(idx), []byte(chunk), idx == len(chunks)-1)
+		if sealerr != nil {
+			t.Fatal(sealerr)
+		}
+		file = append(file, sealed...)
+	}
+	return file
+}
+
+func TestOpenRecipientFile(t *testing.T) {
+	publicKey, privateKey, err := GenerateRecipientKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPrivateKey, _ := GenerateRecipientKeys()
+
+	chunks := []string{"{\"uuid\": \"a1\", \"value\": \"4242424242424242\"}\n", "{\"uuid\": \"b2\", \"value\": \"ann@example.com\"}\n", ""}
+	file := sealRecipientFile(t, publicKey, chunks)
+	unfinished := sealRecipientFile(t, publicKey, chunks[:2])
+	unfinished = unfinished[:len(unfinished)-len(chunks[1])-20]
+	tampered := append([]byte{}, file...)
+	tampered[100] ^= 1
+
+	testScenarios := []struct {
+		givenFile       []byte
+		givenPrivateKey string
+		expectPlaintext string
+		expectErr       error
+	}{
+		{file, privateKey, chunks[0] + chunks[1], nil},
+		{file, otherPrivateKey, "", ErrRecipientFile},
+		{file, "not a key", "", ErrRecipientKey},
+		{tampered, privateKey, "", ErrRecipientFile},
+		{unfinished, privateKey, "", ErrRecipientFile},
+		{append(append([]byte{}, file...), file[84:]...), privateKey, "", ErrRecipientFile},
+		{file[:50], privateKey, "", ErrRecipientFile},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var plaintext bytes.Buffer
+			openerr := OpenRecipientFile(bytes.NewReader(scenario.givenFile), scenario.givenPrivateKey, &plaintext)
+			assert.Equal(t, scenario.expectErr, openerr)
+			if scenario.expectErr == nil {
+				assert.Equal(t, scenario.expectPlaintext, plaintext.String())
+			}
+		})
+	}
+
+	// the plaintext must not show through the file
+	assert.False(t, bytes.Contains(file, []byte("4242424242424242")))
+
+	// a key that isn't a point on the curve can't be encrypted to
+	_, _, err = NewRecipientFile("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+	assert.Equal(t, ErrRecipientKey, err)
+}
@@ -3,8 +3,10 @@ package tokencrypto
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"io"
@@ -24,6 +26,14 @@ func GetHashForString(value string) string {
 	return sha1_hash
 }
 
+// GetHMACForString returns a hex HMAC-SHA256 of the value using the key,
+// for values that must only be reproducible by holders of the key
+func GetHMACForString(value string, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 // Encryption functions credit
 // https://gist.github.com/17twenty/b7a050d6a3ed991db0433d4a1fc50de7
 func EncryptAES(plaintextValue string, keyValue string) (string, error) {
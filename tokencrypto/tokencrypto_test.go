@@ -65,6 +65,28 @@ func TestGetHashForString(t *testing.T) {
 
 }
 
+func TestGetHMACForString(t *testing.T) {
+
+	teststring := "This is a delishously hashable string!"
+	key := "a secret key"
+	mac := GetHMACForString(teststring, key)
+
+	// mac can't be empty
+	assert.NotEqual(t, mac, "")
+
+	// the same value and key must yield an identical mac
+	assert.Equal(t, GetHMACForString(teststring, key), mac)
+
+	// a different key must yield a different mac
+	assert.NotEqual(t, GetHMACForString(teststring, key+" "), mac)
+
+	// a different value must yield a different mac
+	assert.NotEqual(t, GetHMACForString(teststring+" ", key), mac)
+
+	// and the mac is not just the hash of the value
+	assert.NotEqual(t, GetHashForString(teststring), mac)
+}
+
 func TestEncryptAES(t *testing.T) {
 
 	plaintextValue := "this is some value!"
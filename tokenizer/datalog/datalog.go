@@ -0,0 +1,162 @@
+// Package datalog keeps the audit log, a record of the operations carried out
+// on tokens and domains. Each entry carries an HMAC of its contents and of
+// the entry before it, under a key derived from the master key, so an entry
+// that was altered, removed or slipped in after it was written can be
+// detected by anyone holding the key.
+package datalog
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+	"tokentarpon/tokencrypto"
+	"tokentarpon/tokenizer/datastore"
+	"tokentarpon/tokenizer/systemconfig"
+
+	"github.com/google/uuid"
+)
+
+var UnitTest = false
+
+var CollectionName = "auditlog"
+var entryRecordType = "auditentry"
+
+// actor recorded for operations the service runs on its own, e.g. scheduled purges
+const ActorSystem = "system"
+
+// the check key is derived from the master key under this label, so the
+// master key itself is never used for anything but encryption
+const checkKeyLabel = "tokentarpon audit log"
+
+// how often a write retries when another entry takes its place in the chain
+const maxChainAttempts = 10
+
+var encryptionKey = ""
+
+// entries are chained by sequence, so two can't claim the same place.
+// Entries written before the chain have no sequence and are left out.
+var Indexes = []datastore.DataIndex{
+	{Fields: []string{"sequence"}, Unique: true, Sparse: true},
+}
+
+type Entry struct {
+	Uuid       string            `bson:"uuid" json:"uuid"`
+	Action     string            `bson:"action" json:"action"`
+	DomainUuid string            `bson:"domainUuid" json:"domainUuid"`
+	Actor      string            `bson:"actor" json:"actor"`
+	Details    map[string]string `bson:"details" json:"details"`
+	Created    int64             `bson:"created" json:"created"`
+	Sequence   int64             `bson:"sequence" json:"sequence"`
+	Previous   string            `bson:"previous" json:"previous"`
+	Check      string            `bson:"check" json:"check"`
+}
+
+var (
+	ErrMissingAction = errors.New("data: audit entry needs an action")
+	ErrMissingKey    = errors.New("data: audit entries can't be checked without the master key")
+	ErrChainBusy     = errors.New("data: audit entry could not be added to the chain")
+)
+
+// Write stamps the entry with a uuid, time, its place in the chain and
+// its check, and stores it
+func Write(entry Entry) (Entry, error) {
+	if len(strings.TrimSpace(entry.Action)) == 0 {
+		return entry, ErrMissingAction
+	}
+	getEncryptionKey()
+	if len(encryptionKey) == 0 {
+		return entry, ErrMissingKey
+	}
+
+	entry.Uuid = uuid.New().String()
+	entry.Created = time.Now().Unix()
+
+	if UnitTest {
+		entry.Sequence = 1
+		entry.Check, _ = Checksum(entry)
+		return entry, nil
+	}
+
+	for attempt := 0; attempt < maxChainAttempts; attempt++ {
+		last, err := lastEntry()
+		if err != nil {
+			return entry, err
+		}
+		entry.Sequence = last.Sequence + 1
+		entry.Previous = last.Check
+		entry.Check, _ = Checksum(entry)
+
+		err = datastore.InsertRecordIn(CollectionName, entryRecordType, entry)
+		if err != datastore.ErrConflict {
+			return entry, err
+		}
+	}
+	return entry, ErrChainBusy
+}
+
+// Checksum is the HMAC of every field of the entry except the check itself,
+// which takes in the check of the entry before it
+func Checksum(entry Entry) (string, error) {
+	getEncryptionKey()
+	if len(encryptionKey) == 0 {
+		return "", ErrMissingKey
+	}
+	entry.Check = ""
+	j, _ := json.Marshal(entry)
+	return tokencrypto.GetHMACForString(string(j), checkKey()), nil
+}
+
+// Validate reports whether the entry still matches its check
+func Validate(entry Entry) bool {
+	check, err := Checksum(entry)
+	return err == nil && len(entry.Check) > 0 && check == entry.Check
+}
+
+// ValidateChain checks a run of entries in sequence order, each against its
+// own check and the one before it. It returns the index of the first entry
+// that fails, or -1 when they all hold.
+func ValidateChain(entries []Entry) int {
+	for i, entry := range entries {
+		if !Validate(entry) {
+			return i
+		}
+		if i > 0 && (entry.Sequence != entries[i-1].Sequence+1 || entry.Previous != entries[i-1].Check) {
+			return i
+		}
+	}
+	return -1
+}
+
+// lastEntry is the newest entry in the chain, or an empty entry
+// when there is none yet
+func lastEntry() (Entry, error) {
+	filter := []datastore.DataQueryGroup{{
+		Operator:    "and",
+		DataQueries: []datastore.DataQuery{{FieldName: "sequence", IsInt: true, IntValue: 1, Comparison: "gte"}},
+	}}
+	sortBy := []datastore.DataSort{{FieldName: "sequence", Descending: true}}
+	results, err := datastore.GetSortedRecordsIn(CollectionName, filter, "and", sortBy, 0, 1, Entry{})
+	if err != nil || len(results) == 0 {
+		return Entry{}, err
+	}
+	return results[0].(Entry), nil
+}
+
+func checkKey() string {
+	return tokencrypto.GetHMACForString(checkKeyLabel, encryptionKey)
+}
+
+func getEncryptionKey() error {
+	// don't keep getting the key if we already got it
+	if len(encryptionKey) > 0 {
+		return nil
+	}
+
+	configuration, configerr := systemconfig.Load()
+	if configerr != nil {
+		return configerr
+	}
+	encryptionKey = configuration.EncryptionKey
+	return nil
+}
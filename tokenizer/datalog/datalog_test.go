@@ -0,0 +1,107 @@
+package datalog
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	UnitTest = true
+	encryptionKey = ";kldfpo87-28374isu;dfjhZXJCVG786"
+	defer func() { encryptionKey = "" }()
+
+	_, err := Write(Entry{DomainUuid: "mydomain"})
+	if want, got := ErrMissingAction, err; want != got {
+		t.Errorf("expect error %#v but got %#v", want, got)
+	}
+
+	entry, err := Write(Entry{
+		Action:     "retention.purge",
+		DomainUuid: "mydomain",
+		Actor:      ActorSystem,
+		Details:    map[string]string{"purged": "12"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entry.Uuid) == 0 || entry.Created == 0 || entry.Sequence == 0 {
+		t.Errorf("expect entry to be stamped but got %#v", entry)
+	}
+	if !Validate(entry) {
+		t.Error("expect a freshly written entry to validate")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	UnitTest = true
+	encryptionKey = ";kldfpo87-28374isu;dfjhZXJCVG786"
+	defer func() { encryptionKey = "" }()
+
+	entry, _ := Write(Entry{
+		Action:  "retention.purge",
+		Details: map[string]string{"purged": "12"},
+	})
+
+	// changing any detail must break the check
+	entry.Details["purged"] = "1"
+	if Validate(entry) {
+		t.Error("expect an altered entry not to validate")
+	}
+
+	// as must dropping the check
+	entry.Details["purged"] = "12"
+	check := entry.Check
+	entry.Check = ""
+	if Validate(entry) {
+		t.Error("expect an entry without a check not to validate")
+	}
+
+	// and the check can't be redone without the key
+	entry.Check = check
+	encryptionKey = "another key entirely, not ours!!"
+	if Validate(entry) {
+		t.Error("expect an entry checked under another key not to validate")
+	}
+	encryptionKey = ""
+	if _, err := Checksum(entry); err != ErrMissingKey {
+		t.Errorf("expect error %#v but got %#v", ErrMissingKey, err)
+	}
+}
+
+func TestValidateChain(t *testing.T) {
+	encryptionKey = ";kldfpo87-28374isu;dfjhZXJCVG786"
+	defer func() { encryptionKey = "" }()
+
+	makeChain := func() []Entry {
+		var entries []Entry
+		previous := Entry{}
+		for i := 0; i < 3; i++ {
+			entry := Entry{Action: "token.erase", Sequence: previous.Sequence + 1, Previous: previous.Check}
+			entry.Check, _ = Checksum(entry)
+			entries = append(entries, entry)
+			previous = entry
+		}
+		return entries
+	}
+
+	testScenarios := []struct {
+		givenChange func([]Entry) []Entry
+		expectIndex int
+	}{
+		{func(entries []Entry) []Entry { return entries }, -1},
+		// an entry taken out
+		{func(entries []Entry) []Entry { return append(entries[:1], entries[2:]...) }, 1},
+		// entries put back in another order
+		{func(entries []Entry) []Entry { return []Entry{entries[0], entries[2], entries[1]} }, 1},
+		// an entry altered
+		{func(entries []Entry) []Entry { entries[2].Action = "token.create"; return entries }, 2},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if want, got := scenario.expectIndex, ValidateChain(scenario.givenChange(makeChain())); want != got {
+				t.Errorf("expect first broken entry %d but got %d", want, got)
+			}
+		})
+	}
+}
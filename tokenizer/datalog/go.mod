@@ -0,0 +1,34 @@
+module tokentarpon/tokenizer/datalog
+
+go 1.18
+
+require (
+	github.com/google/uuid v1.3.0
+	tokentarpon/tokencrypto v0.0.0-00010101000000-000000000000
+	tokentarpon/tokenizer/datastore v0.0.0-00010101000000-000000000000
+	tokentarpon/tokenizer/systemconfig v0.0.0-00010101000000-000000000000
+)
+
+require (
+	github.com/golang/snappy v0.0.1 // indirect
+	github.com/klauspost/compress v1.13.6 // indirect
+	github.com/montanaflynn/stats v0.0.0-20171201202039-1bf9dbcd8cbe // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
+	github.com/xdg-go/scram v1.1.1 // indirect
+	github.com/xdg-go/stringprep v1.0.3 // indirect
+	github.com/youmark/pkcs8 v0.0.0-20181117223130-1be2e3e5546d // indirect
+	go.mongodb.org/mongo-driver v1.10.0 // indirect
+	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d // indirect
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
+	golang.org/x/text v0.3.7 // indirect
+	tokentarpon/tokenizer/datastore/datastoremongo v0.0.0 // indirect
+)
+
+replace tokentarpon/tokencrypto => ../../tokencrypto
+
+replace tokentarpon/tokenizer/datastore => ../datastore
+
+replace tokentarpon/tokenizer/datastore/datastoremongo => ../datastore/datastoremongo
+
+replace tokentarpon/tokenizer/systemconfig => ../systemconfig
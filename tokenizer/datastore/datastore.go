@@ -12,6 +12,8 @@ import (
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var PageRecordCount int64 = 100
@@ -24,9 +26,30 @@ var mongoDatabase = ""
 
 // used for querying the db using grouped name-value pairs
 // e.g. DataQueries contains 2 DataQuery values
+// DataQueryGroups nests further groups under the same operator,
+// e.g. a or (b and c)
 type DataQueryGroup struct {
-	DataQueries []DataQuery `bson:"dataQueries" json:"dataQueries"`
-	Operator    string      `bson:"operator" json:"operator"`
+	DataQueries     []DataQuery      `bson:"dataQueries" json:"dataQueries"`
+	DataQueryGroups []DataQueryGroup `bson:"dataQueryGroups" json:"dataQueryGroups"`
+	Operator        string           `bson:"operator" json:"operator"`
+}
+
+// used for sorting query results, in order of the fields given
+type DataSort struct {
+	FieldName  string `bson:"fieldName" json:"fieldName"`
+	Descending bool   `bson:"descending" json:"descending"`
+}
+
+// used for creating indexes on a collection
+// Fields are indexed in order, a leading "-" sorts the field descending
+// ExpireAfterSeconds is only used when Expires is set, and needs a date field
+// Sparse leaves out records without the fields, so a unique index allows many of them
+type DataIndex struct {
+	Fields             []string `bson:"fields" json:"fields"`
+	Unique             bool     `bson:"unique" json:"unique"`
+	Sparse             bool     `bson:"sparse" json:"sparse"`
+	Expires            bool     `bson:"expires" json:"expires"`
+	ExpireAfterSeconds int32    `bson:"expireAfterSeconds" json:"expireAfterSeconds"`
 }
 
 type DataQuery struct {
@@ -38,6 +61,11 @@ type DataQuery struct {
 	IdValue       string `bson:"idValue" json:"idValue"`
 	CaseSensitive bool   `bson:"caseSensitive" json:"caseSensitive"`
 	Wildcard      bool   `bson:"wildcard" json:"wildcard"`
+	IsInt         bool   `bson:"isInt" json:"isInt"`
+	IntValue      int64  `bson:"intValue" json:"intValue"`
+	// Comparison is one of gt, gte, lt, lte; when empty the values must be equal.
+	// missing matches records that don't have the field at all
+	Comparison string `bson:"comparison" json:"comparison"`
 }
 
 var (
@@ -46,11 +74,17 @@ var (
 	ErrQueryError     = errors.New("data: query returned an error and may be malformed")
 	ErrConflict       = errors.New("data: record cannot be overwritten")
 	ErrNotFound       = errors.New("data: record not found")
+	ErrNotInserted    = errors.New("data: record was not inserted because an earlier record failed")
 )
 
 // GetRecord takes an incoming query against a target table/collection
 // And returns a single record in the form of an interface
 func GetRecord(queryParams []DataQueryGroup, record interface{}) error {
+	return GetRecordIn(CollectionName, queryParams, record)
+}
+
+// GetRecordIn is GetRecord against the named collection
+func GetRecordIn(collectionName string, queryParams []DataQueryGroup, record interface{}) error {
 
 	if err := getConfiguration(); err != nil {
 		return err
@@ -61,8 +95,8 @@ func GetRecord(queryParams []DataQueryGroup, record interface{}) error {
 		return err
 	}
 	filter := CreateMongoFilter(queryParams, "and")
-	result := datastoremongo.GetRecord(mongoDatabase, CollectionName, filter)
-	if nil == result {
+	result := datastoremongo.GetRecord(mongoDatabase, collectionName, filter)
+	if nil == result || result.Err() == mongo.ErrNoDocuments {
 		return ErrNotFound
 	} else if nil != result.Err() {
 		return result.Err()
@@ -75,6 +109,12 @@ func GetRecord(queryParams []DataQueryGroup, record interface{}) error {
 // And returns an array of records in the form of an array of interfaces
 func GetRecords(queryParams []DataQueryGroup,
 	operator string, start int64, limit int64, record interface{}) ([]interface{}, error) {
+	return GetRecordsIn(CollectionName, queryParams, operator, start, limit, record)
+}
+
+// GetRecordsIn is GetRecords against the named collection
+func GetRecordsIn(collectionName string, queryParams []DataQueryGroup,
+	operator string, start int64, limit int64, record interface{}) ([]interface{}, error) {
 
 	var results []interface{}
 
@@ -90,7 +130,7 @@ func GetRecords(queryParams []DataQueryGroup,
 
 	filter := CreateMongoFilter(queryParams, operator)
 	mongocursor, mongoerr := datastoremongo.GetRecords(mongoDatabase,
-		CollectionName, start, limit, filter)
+		collectionName, start, limit, filter)
 	if nil != mongoerr {
 		return results, mongoerr //ErrQueryError
 	}
@@ -110,7 +150,84 @@ func GetRecords(queryParams []DataQueryGroup,
 	return results, nil
 }
 
+// GetSortedRecords returns up to limit records matching the query,
+// ordered by the sort fields and skipping the first start records
+func GetSortedRecords(queryParams []DataQueryGroup, operator string,
+	sort []DataSort, start int64, limit int64, record interface{}) ([]interface{}, error) {
+	return GetSortedRecordsIn(CollectionName, queryParams, operator, sort, start, limit, record)
+}
+
+// GetSortedRecordsIn is GetSortedRecords against the named collection
+func GetSortedRecordsIn(collectionName string, queryParams []DataQueryGroup, operator string,
+	sort []DataSort, start int64, limit int64, record interface{}) ([]interface{}, error) {
+
+	var results []interface{}
+
+	if err := getConfiguration(); err != nil {
+		return results, err
+	}
+
+	connecterr := datastoremongo.Connect(mongoUri)
+	if connecterr != nil {
+		return results, ErrDatastoreError
+	}
+
+	sortFields := bson.D{}
+	for _, field := range sort {
+		if field.Descending {
+			sortFields = append(sortFields, bson.E{Key: field.FieldName, Value: -1})
+		} else {
+			sortFields = append(sortFields, bson.E{Key: field.FieldName, Value: 1})
+		}
+	}
+
+	filter := CreateMongoFilter(queryParams, operator)
+	mongocursor, mongoerr := datastoremongo.GetSortedRecords(mongoDatabase,
+		collectionName, start, limit, sortFields, filter)
+	if nil != mongoerr {
+		return results, mongoerr
+	}
+
+	myType := reflect.TypeOf(record)
+	records := reflect.MakeSlice(reflect.SliceOf(myType), 0, 0).Interface()
+	if err := mongocursor.All(datastoremongo.Ctx, &records); err != nil {
+		return nil, err
+	}
+
+	recordValues := reflect.ValueOf(records)
+	for i := 0; i < recordValues.Len(); i++ {
+		results = append(results, recordValues.Index(i).Interface())
+	}
+	return results, nil
+}
+
+// CountRecords returns the number of records matching the query
+func CountRecords(queryParams []DataQueryGroup, operator string) (int64, error) {
+	return CountRecordsIn(CollectionName, queryParams, operator)
+}
+
+// CountRecordsIn is CountRecords against the named collection
+func CountRecordsIn(collectionName string, queryParams []DataQueryGroup, operator string) (int64, error) {
+	if err := getConfiguration(); err != nil {
+		return 0, err
+	}
+
+	err := datastoremongo.Connect(mongoUri)
+	if err != nil {
+		return 0, ErrDatastoreError
+	}
+
+	filter := CreateMongoFilter(queryParams, operator)
+	return datastoremongo.CountRecords(mongoDatabase, collectionName, filter)
+}
+
 func InsertRecord(recordType string, document interface{}) error {
+	return InsertRecordIn(CollectionName, recordType, document)
+}
+
+// InsertRecordIn is InsertRecord against the named collection.
+// A document that collides with a unique index returns ErrConflict.
+func InsertRecordIn(collectionName string, recordType string, document interface{}) error {
 
 	if err := getConfiguration(); err != nil {
 		return err
@@ -121,18 +238,85 @@ func InsertRecord(recordType string, document interface{}) error {
 		return ErrDatastoreError
 	}
 
-	result, err := datastoremongo.InsertOne(mongoDatabase,
-		CollectionName, document)
+	_, err = datastoremongo.InsertOne(mongoDatabase,
+		collectionName, document)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+// InsertRecords writes the documents in a single bulk insert, without
+// reading them back. The returned map holds the error for each document
+// that was not inserted, keyed by its index in documents.
+// An ordered insert stops at the first failure, so every later document
+// is reported with ErrNotInserted.
+func InsertRecords(recordType string, documents []interface{}, ordered bool) (map[int]error, error) {
+	return InsertRecordsIn(CollectionName, recordType, documents, ordered)
+}
+
+// InsertRecordsIn is InsertRecords against the named collection
+func InsertRecordsIn(collectionName string, recordType string, documents []interface{}, ordered bool) (map[int]error, error) {
+
+	failed := make(map[int]error)
+	if len(documents) == 0 {
+		return failed, nil
+	}
+
+	if err := getConfiguration(); err != nil {
+		return failed, err
+	}
+
+	err := datastoremongo.Connect(mongoUri)
 	if err != nil {
-		return err //ErrQueryError
+		return failed, ErrDatastoreError
+	}
+
+	_, err = datastoremongo.InsertMany(mongoDatabase, collectionName, documents, ordered)
+	if err == nil {
+		return failed, nil
 	}
 
-	// Get the whole record-
-	// use the returned InsertedID (bson.ObjectID) from the mongo.InsertOneResult
-	var idString string = hexFromObjectId(result.InsertedID)
-	filter := makeIdQuery(idString)
-	geterr := GetRecord(filter, &document)
-	return geterr
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return failed, err
+	}
+	lastIndex := -1
+	for _, writeErr := range bulkErr.WriteErrors {
+		failed[writeErr.Index] = writeErr
+		if writeErr.Index > lastIndex {
+			lastIndex = writeErr.Index
+		}
+	}
+	if ordered && lastIndex >= 0 {
+		for idx := lastIndex + 1; idx < len(documents); idx++ {
+			failed[idx] = ErrNotInserted
+		}
+	}
+	return failed, nil
+}
+
+// InsertRecordsAtomic inserts all of the documents, or none of them
+// if any insert fails
+func InsertRecordsAtomic(recordType string, documents []interface{}) error {
+	return InsertRecordsAtomicIn(CollectionName, recordType, documents)
+}
+
+// InsertRecordsAtomicIn is InsertRecordsAtomic against the named collection
+func InsertRecordsAtomicIn(collectionName string, recordType string, documents []interface{}) error {
+
+	if err := getConfiguration(); err != nil {
+		return err
+	}
+
+	err := datastoremongo.Connect(mongoUri)
+	if err != nil {
+		return ErrDatastoreError
+	}
+
+	_, err = datastoremongo.InsertManyInTransaction(mongoDatabase,
+		collectionName, documents)
+	return err
 }
 
 func DeleteRecord(uuid string) error {
@@ -148,24 +332,88 @@ func DeleteRecord(uuid string) error {
 	return mongoerr
 }
 
-func DeleteRecords(queryParams []DataQueryGroup, operator string) error {
+// DeleteRecords removes every record matching the query,
+// returning the number of records removed
+func DeleteRecords(queryParams []DataQueryGroup, operator string) (int64, error) {
+	return DeleteRecordsIn(CollectionName, queryParams, operator)
+}
+
+// DeleteRecordsIn is DeleteRecords against the named collection
+func DeleteRecordsIn(collectionName string, queryParams []DataQueryGroup, operator string) (int64, error) {
 	if err := getConfiguration(); err != nil {
-		return err
+		return 0, err
 	}
 
 	err := datastoremongo.Connect(mongoUri)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	datastoremongo.PageRecordCount = PageRecordCount
 	filter := CreateMongoFilter(queryParams, operator)
-	mongoerr := datastoremongo.DeleteCollectionRecords(mongoDatabase, CollectionName, filter)
-	return mongoerr
+	deleted, mongoerr := datastoremongo.DeleteCollectionRecords(mongoDatabase, collectionName, filter)
+	return deleted, mongoerr
+}
+
+// IncrementRecord adds delta to a numeric field of the first record matching
+// the query, as a single atomic update. It returns the number of records
+// changed, so a query that includes a condition on the field can be used
+// to tell whether the update happened.
+func IncrementRecord(queryParams []DataQueryGroup, operator string,
+	fieldName string, delta int64) (int64, error) {
+	return IncrementRecordIn(CollectionName, queryParams, operator, fieldName, delta)
+}
+
+// IncrementRecordIn is IncrementRecord against the named collection
+func IncrementRecordIn(collectionName string, queryParams []DataQueryGroup, operator string,
+	fieldName string, delta int64) (int64, error) {
+	if err := getConfiguration(); err != nil {
+		return 0, err
+	}
+
+	err := datastoremongo.Connect(mongoUri)
+	if err != nil {
+		return 0, ErrDatastoreError
+	}
+
+	filter := CreateMongoFilter(queryParams, operator)
+	result, mongoerr := datastoremongo.IncrementOne(mongoDatabase, collectionName, filter, fieldName, delta)
+	if mongoerr != nil {
+		return 0, mongoerr
+	}
+	return result.ModifiedCount, nil
+}
+
+// UnsetFieldsIn removes the named fields from every record in the collection
+// matching the query, returning the number of records changed
+func UnsetFieldsIn(collectionName string, queryParams []DataQueryGroup, operator string,
+	fieldNames []string) (int64, error) {
+	if err := getConfiguration(); err != nil {
+		return 0, err
+	}
+
+	err := datastoremongo.Connect(mongoUri)
+	if err != nil {
+		return 0, ErrDatastoreError
+	}
+
+	filter := CreateMongoFilter(queryParams, operator)
+	result, mongoerr := datastoremongo.UnsetMany(mongoDatabase, collectionName, filter, fieldNames)
+	if mongoerr != nil {
+		return 0, mongoerr
+	}
+	return result.ModifiedCount, nil
 }
 
 func UpdateRecord(recordType string,
 	queryParams []DataQueryGroup, operator string,
 	document interface{}) (interface{}, error) {
+	return UpdateRecordIn(CollectionName, recordType, queryParams, operator, document)
+}
+
+// UpdateRecordIn is UpdateRecord against the named collection
+func UpdateRecordIn(collectionName string, recordType string,
+	queryParams []DataQueryGroup, operator string,
+	document interface{}) (interface{}, error) {
 
 	if err := getConfiguration(); err != nil {
 		return document, err
@@ -181,7 +429,7 @@ func UpdateRecord(recordType string,
 	// 	{"$set", bson.D{doc}},
 	// }
 
-	_, updateerr := datastoremongo.UpdateOne(mongoDatabase, CollectionName, filter, "and", document)
+	_, updateerr := datastoremongo.UpdateOne(mongoDatabase, collectionName, filter, "and", document)
 	if updateerr != nil {
 		//fmt.Println(result)
 		return nil, updateerr //ErrQueryError
@@ -189,6 +437,30 @@ func UpdateRecord(recordType string,
 	return document, nil
 }
 
+// UpdateRecordIfMatchedIn is UpdateRecordIn, returning the number of records
+// the query matched, so a query that includes a condition, e.g. on a revision,
+// can be used to tell whether the update happened
+func UpdateRecordIfMatchedIn(collectionName string, recordType string,
+	queryParams []DataQueryGroup, operator string,
+	document interface{}) (int64, error) {
+
+	if err := getConfiguration(); err != nil {
+		return 0, err
+	}
+
+	err := datastoremongo.Connect(mongoUri)
+	if err != nil {
+		return 0, ErrDatastoreError
+	}
+
+	filter := CreateMongoFilter(queryParams, operator)
+	result, updateerr := datastoremongo.UpdateOne(mongoDatabase, collectionName, filter, "and", document)
+	if updateerr != nil {
+		return 0, updateerr
+	}
+	return result.MatchedCount, nil
+}
+
 // func updateChecksum(recordType string, document interface{}) interface{} {
 
 // 	// update the Check hash
@@ -262,6 +534,37 @@ func UpdateRecord(recordType string,
 // 	return checkOk, err
 // }
 
+// EnsureIndexes creates the indexes on the named collection,
+// leaving any that already exist in place
+func EnsureIndexes(collectionName string, indexes []DataIndex) error {
+	if err := getConfiguration(); err != nil {
+		return err
+	}
+
+	err := datastoremongo.Connect(mongoUri)
+	if err != nil {
+		return ErrDatastoreError
+	}
+
+	models := make([]mongo.IndexModel, len(indexes))
+	for idx, index := range indexes {
+		keys := bson.D{}
+		for _, field := range index.Fields {
+			if strings.HasPrefix(field, "-") {
+				keys = append(keys, bson.E{Key: strings.TrimPrefix(field, "-"), Value: -1})
+			} else {
+				keys = append(keys, bson.E{Key: field, Value: 1})
+			}
+		}
+		indexOptions := options.Index().SetUnique(index.Unique).SetSparse(index.Sparse)
+		if index.Expires {
+			indexOptions.SetExpireAfterSeconds(index.ExpireAfterSeconds)
+		}
+		models[idx] = mongo.IndexModel{Keys: keys, Options: indexOptions}
+	}
+	return datastoremongo.CreateIndexes(mongoDatabase, collectionName, models)
+}
+
 // MakeSimpleQuery creates a simple name-value pair and generates
 // the array necessary to call any of the datastore Get functions
 func MakeSimpleQuery(fieldName string, fieldValue string, caseSensitive bool) []DataQueryGroup {
@@ -319,11 +622,11 @@ func CreateMongoFilter(queryValues []DataQueryGroup, operator string) bson.M {
 
 	resultValues := make(bson.A, len(queryValues))
 	for k, v := range queryValues {
-		if len(v.DataQueries) == 1 {
+		if len(v.DataQueries) == 1 && len(v.DataQueryGroups) == 0 {
 			// no need for the operator just create a simple bson.M query
 			result = createSimpleFilter(v.DataQueries[0])
 			resultValues[k] = result
-		} else if len(v.DataQueries) > 1 {
+		} else if len(v.DataQueries)+len(v.DataQueryGroups) > 0 {
 			result = createComplexFilter(v)
 			resultValues[k] = result
 		}
@@ -354,8 +657,14 @@ func createSimpleFilter(dataQuery DataQuery) bson.M {
 			// bson.ObjectIdHex(dataQuery.IdValue)
 			// bson.ObjectID(dataQuery.IdValue)}
 		}
+	} else if dataQuery.Comparison == "missing" {
+		bsonQuery = bson.M{dataQuery.FieldName: bson.M{"$exists": false}}
 	} else if dataQuery.IsBool {
 		bsonQuery = bson.M{dataQuery.FieldName: bson.M{"$eq": dataQuery.BoolValue}}
+	} else if dataQuery.IsInt {
+		bsonQuery = bson.M{dataQuery.FieldName: bson.M{comparisonOperator(dataQuery.Comparison): dataQuery.IntValue}}
+	} else if len(dataQuery.Comparison) > 0 {
+		bsonQuery = bson.M{dataQuery.FieldName: bson.M{comparisonOperator(dataQuery.Comparison): dataQuery.FieldValue}}
 	} else if dataQuery.Wildcard {
 		if dataQuery.CaseSensitive {
 			bsonQuery = bson.M{dataQuery.FieldName: bson.M{"$regex": dataQuery.FieldValue}}
@@ -385,11 +694,14 @@ func createSimpleFilter(dataQuery DataQuery) bson.M {
 func createComplexFilter(dataQueryGroup DataQueryGroup) bson.M {
 
 	var bsonQuery bson.M
-	subQueries := make(bson.A, len(dataQueryGroup.DataQueries))
+	subQueries := make(bson.A, 0, len(dataQueryGroup.DataQueries)+len(dataQueryGroup.DataQueryGroups))
 
-	for k, v := range dataQueryGroup.DataQueries {
+	for _, v := range dataQueryGroup.DataQueries {
 		//bsonA[k] = CreateSimpleFilter(v)
-		subQueries[k] = createSimpleFilter(v)
+		subQueries = append(subQueries, createSimpleFilter(v))
+	}
+	for _, g := range dataQueryGroup.DataQueryGroups {
+		subQueries = append(subQueries, createComplexFilter(g))
 	}
 
 	// bson.M{
@@ -406,6 +718,16 @@ func createComplexFilter(dataQueryGroup DataQueryGroup) bson.M {
 
 	return bsonQuery
 }
+
+// comparisonOperator maps a DataQuery comparison to its mongo operator
+func comparisonOperator(comparison string) string {
+	switch comparison {
+	case "gt", "gte", "lt", "lte":
+		return "$" + comparison
+	}
+	return "$eq"
+}
+
 func hexFromObjectId(id interface{}) string {
 	objectId := id.(primitive.ObjectID)
 	return objectId.Hex()
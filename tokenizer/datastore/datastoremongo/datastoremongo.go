@@ -86,6 +86,37 @@ func InsertOne(dataBase string, col string, doc interface{}) (*mongo.InsertOneRe
 	return result, err
 }
 
+// InsertMany writes all of the documents in one bulk insert.
+// An ordered insert stops at the first failure, an unordered one
+// attempts every document and reports each failure.
+func InsertMany(dataBase string, col string, docs []interface{}, ordered bool) (*mongo.InsertManyResult, error) {
+
+	collection := Client.Database(dataBase).Collection(col)
+	result, err := collection.InsertMany(Ctx, docs, options.InsertMany().SetOrdered(ordered))
+	return result, err
+}
+
+// InsertManyInTransaction inserts every document inside one multi-document
+// transaction, so either all of them are written or none are.
+// Transactions need mongodb to be running as a replica set.
+func InsertManyInTransaction(dataBase string, col string, docs []interface{}) (*mongo.InsertManyResult, error) {
+
+	collection := Client.Database(dataBase).Collection(col)
+	session, err := Client.StartSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.EndSession(Ctx)
+
+	result, err := session.WithTransaction(Ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return collection.InsertMany(sessCtx, docs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*mongo.InsertManyResult), nil
+}
+
 func UpdateOne(dataBase string, collectionName string,
 	filter bson.M, operator string, doc interface{}) (*mongo.UpdateResult, error) {
 
@@ -97,6 +128,17 @@ func UpdateOne(dataBase string, collectionName string,
 	return result, err
 }
 
+func UnsetMany(dataBase string, collectionName string,
+	filter bson.M, fieldNames []string) (*mongo.UpdateResult, error) {
+	collection := Client.Database(dataBase).Collection(collectionName)
+	fields := bson.M{}
+	for _, fieldName := range fieldNames {
+		fields[fieldName] = ""
+	}
+	result, err := collection.UpdateMany(Ctx, filter, bson.M{"$unset": fields})
+	return result, err
+}
+
 func DeleteRecordByUuid(dataBase string, collectionName string, uuid string) error {
 	collection := Client.Database(dataBase).Collection(collectionName)
 	filter := bson.M{"uuid": uuid}
@@ -104,10 +146,20 @@ func DeleteRecordByUuid(dataBase string, collectionName string, uuid string) err
 	return err
 }
 
-func DeleteCollectionRecords(dataBase string, collectionName string, filter bson.M) error {
+func DeleteCollectionRecords(dataBase string, collectionName string, filter bson.M) (int64, error) {
 	collection := Client.Database(dataBase).Collection(collectionName)
-	_, err := collection.DeleteMany(Ctx, filter)
-	return err
+	result, err := collection.DeleteMany(Ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func IncrementOne(dataBase string, collectionName string,
+	filter bson.M, fieldName string, delta int64) (*mongo.UpdateResult, error) {
+	collection := Client.Database(dataBase).Collection(collectionName)
+	result, err := collection.UpdateOne(Ctx, filter, bson.M{"$inc": bson.M{fieldName: delta}})
+	return result, err
 }
 
 func GetRecords(database string, collectionName string,
@@ -132,6 +184,32 @@ func GetRecords(database string, collectionName string,
 	return cursor, err
 }
 
+func CreateIndexes(dataBase string, collectionName string, models []mongo.IndexModel) error {
+	collection := Client.Database(dataBase).Collection(collectionName)
+	_, err := collection.Indexes().CreateMany(Ctx, models)
+	return err
+}
+
+// GetSortedRecords returns a cursor over up to limit records in sort order.
+// Unlike GetRecords, the limit is not capped at PageRecordCount,
+// so callers can read one record past a page to see if another page follows.
+func GetSortedRecords(database string, collectionName string,
+	start int64, limit int64, sort bson.D, filter bson.M) (*mongo.Cursor, error) {
+
+	collection := Client.Database(database).Collection(collectionName)
+	if start < 0 {
+		start = 0
+	}
+	findOptions := options.Find().SetSort(sort).SetSkip(start).SetLimit(limit)
+	cursor, err := collection.Find(Ctx, filter, findOptions)
+	return cursor, err
+}
+
+func CountRecords(database string, collectionName string, filter bson.M) (int64, error) {
+	collection := Client.Database(database).Collection(collectionName)
+	return collection.CountDocuments(Ctx, filter)
+}
+
 func GetRecord(database string, collectionName string, filter bson.M) *mongo.SingleResult {
 	collection := Client.Database(database).Collection(collectionName)
 	result := collection.FindOne(Ctx, filter)
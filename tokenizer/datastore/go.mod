@@ -3,10 +3,12 @@ module tokentarpon/tokenizer/datastore
 go 1.18
 
 require (
-	go.mongodb.org/mongo-driver v1.10.0 // indirect
+	go.mongodb.org/mongo-driver v1.10.0
 	tokentarpon/tokenizer/datastore/datastoremongo v0.0.0
 )
 
+require tokentarpon/tokenizer/systemconfig v0.0.0-00010101000000-000000000000
+
 require (
 	github.com/golang/snappy v0.0.1 // indirect
 	github.com/klauspost/compress v1.13.6 // indirect
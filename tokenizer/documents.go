@@ -0,0 +1,341 @@
+package tokenizer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FieldSelector picks the fields of a JSON document to tokenize or detokenize
+// with a JSONPath-style path, e.g. $.customer.email or $.cards[*].number.
+// Paths start at $ and step into objects by .name or ['name'], and into
+// arrays by [n]; * in place of a name or index takes every member.
+// ValueType is only used when tokenizing.
+type FieldSelector struct {
+	Path      string `bson:"path" json:"path"`
+	ValueType string `bson:"valueType" json:"valueType"`
+}
+
+// UnmarshalJSON takes a selector given as just its path, as well as the full object
+func (s *FieldSelector) UnmarshalJSON(data []byte) error {
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		s.Path = path
+		return nil
+	}
+	type selector FieldSelector
+	return json.Unmarshal(data, (*selector)(s))
+}
+
+// DocumentRequest is a JSON document along with the selectors for its sensitive fields
+type DocumentRequest struct {
+	Document  json.RawMessage `bson:"document" json:"document"`
+	Selectors []FieldSelector `bson:"selectors" json:"selectors"`
+}
+
+// DocumentFieldError reports a selected field that could not be detokenized
+type DocumentFieldError struct {
+	Path  string `bson:"path" json:"path"`
+	Error string `bson:"error" json:"error"`
+}
+
+// DocumentResult is the document with its selected fields swapped,
+// and the number of fields swapped. Errors is only set when detokenizing,
+// and Tokens, the tokens created for the fields, only when tokenizing.
+type DocumentResult struct {
+	Document json.RawMessage      `bson:"document" json:"document"`
+	Fields   int                  `bson:"fields" json:"fields"`
+	Errors   []DocumentFieldError `bson:"errors" json:"errors,omitempty"`
+	Partial  bool                 `bson:"partial" json:"partial,omitempty"`
+	Tokens   []Token              `bson:"-" json:"-"`
+}
+
+// one step of a parsed selector path
+type pathStep struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// a field found by a selector, with its concrete path and a way to replace it
+type documentField struct {
+	path      string
+	value     interface{}
+	valueType string
+	set       func(interface{})
+}
+
+var (
+	ErrInvalidDocument = errors.New("data: document must be valid JSON")
+	ErrNoSelectors     = errors.New("data: need selectors for the fields to swap")
+)
+
+// TokenizeDocument tokenizes every string or number field the selectors pick
+// out of the document, in a single batch, and returns the document with
+// each of those fields replaced by its token id. Fields the selectors don't
+// match, and null fields, are left alone. Every value is checked before any
+// token is created, so a malformed value fails the whole document with a
+// FieldError naming its path.
+func TokenizeDocument(domainUuid string, request DocumentRequest) (DocumentResult, error) {
+	var result DocumentResult
+	if len(strings.TrimSpace(domainUuid)) == 0 {
+		return result, errors.New("data: need domain id")
+	}
+	document, fields, err := selectDocumentFields(request)
+	if err != nil {
+		return result, err
+	}
+
+	if result.Tokens, err = tokenizeFields(domainUuid, fields); err != nil {
+		return result, err
+	}
+
+	result.Fields = len(fields)
+	result.Document, err = json.Marshal(document)
+	return result, err
+}
+
+// tokenizeFields checks every field's value, then tokenizes them all in a
+// single batch and replaces each field with its token id, returning the
+// tokens created. A field that can't be tokenized fails them all with a
+// FieldError naming its path, and the tokens are created all or none, so
+// a failure part way leaves no tokens behind.
+func tokenizeFields(domainUuid string, fields []documentField) ([]Token, error) {
+	tokens := make([]Token, len(fields))
+	maxValueBytes := GetRequestLimits(domainUuid).MaxValueBytes
+	for idx, field := range fields {
+		value, err := checkDocumentField(field, maxValueBytes)
+		if err != nil {
+			return nil, err
+		}
+		tokens[idx] = Token{DomainUuid: domainUuid, Value: value, ValueType: field.valueType}
+	}
+	if shrederr := checkDomainOpen(domainUuid); shrederr != nil {
+		return nil, shrederr
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	createdTokens, _, err := CreateTokensAtomic(domainUuid, tokens)
+	if err != nil {
+		return nil, err
+	}
+	// the created tokens line up with the fields
+	for idx, field := range fields {
+		field.set(createdTokens[idx].Uuid)
+	}
+	return createdTokens, nil
+}
+
+// checkDocumentField returns the field's value to tokenize, or a FieldError
+// naming its path when the value can't be tokenized as its value type, or
+// is over the domain's value limit
+func checkDocumentField(field documentField, maxValueBytes int64) (string, error) {
+	value, ok := documentFieldString(field.value)
+	if !ok {
+		return "", &FieldError{Field: field.path, Message: "must be a string or number to tokenize"}
+	}
+	if len(strings.TrimSpace(value)) == 0 {
+		return "", &FieldError{Field: field.path, Message: "must not be blank"}
+	}
+	if int64(len(value)) > maxValueBytes {
+		return "", &FieldError{Field: field.path, Message: valueTooBigMessage(maxValueBytes)}
+	}
+	if _, typeerr := NormalizeValue(strings.ToLower(strings.TrimSpace(field.valueType)), value); typeerr != nil {
+		var fielderr *FieldError
+		errors.As(typeerr, &fielderr)
+		return "", &FieldError{Field: field.path, Message: fielderr.Message}
+	}
+	return value, nil
+}
+
+// DetokenizeDocument replaces every token id the selectors pick out of the
+// document with its value, presented in the view. Fields whose token can't
+// be found are left as they are and listed in the result's errors.
+func DetokenizeDocument(domainUuid string, request DocumentRequest, view ValueView) (DocumentResult, error) {
+	var result DocumentResult
+	if len(strings.TrimSpace(domainUuid)) == 0 {
+		return result, errors.New("data: need domain id")
+	}
+	document, fields, err := selectDocumentFields(request)
+	if err != nil {
+		return result, err
+	}
+
+	var tokenFields []documentField
+	var uuids []string
+	for _, field := range fields {
+		tokenUuid, ok := field.value.(string)
+		if !ok {
+			result.Errors = append(result.Errors, DocumentFieldError{Path: field.path, Error: ErrCodeInvalidId})
+			continue
+		}
+		tokenFields = append(tokenFields, field)
+		uuids = append(uuids, tokenUuid)
+	}
+
+	if len(uuids) > 0 {
+		tokenValues, valueserr := GetTokenValues(TokenQuery{DomainUuid: domainUuid, Uuids: uuids, View: view})
+		if valueserr != nil {
+			return result, valueserr
+		}
+		for idx, field := range tokenFields {
+			tokenValue := tokenValues.Results[idx]
+			if len(tokenValue.Error) > 0 {
+				result.Errors = append(result.Errors, DocumentFieldError{Path: field.path, Error: tokenValue.Error})
+				continue
+			}
+			field.set(tokenValue.Value)
+			result.Fields++
+		}
+	}
+
+	result.Partial = len(result.Errors) > 0
+	result.Document, err = json.Marshal(document)
+	return result, err
+}
+
+// selectDocumentFields parses the document, keeping numbers as they were written,
+// and finds the fields each selector picks out, in selector order
+func selectDocumentFields(request DocumentRequest) (interface{}, []documentField, error) {
+	if len(request.Selectors) == 0 {
+		return nil, nil, ErrNoSelectors
+	}
+	var document interface{}
+	decoder := json.NewDecoder(bytes.NewReader(request.Document))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil || document == nil {
+		return nil, nil, ErrInvalidDocument
+	}
+
+	var fields []documentField
+	seen := make(map[string]bool)
+	for _, selector := range request.Selectors {
+		steps, err := parseSelector(selector.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		matchPath(document, steps, "$", nil, func(field documentField) {
+			// a field picked out by two selectors is only swapped once
+			if !seen[field.path] && field.value != nil {
+				seen[field.path] = true
+				field.valueType = selector.ValueType
+				fields = append(fields, field)
+			}
+		})
+	}
+	return document, fields, nil
+}
+
+// matchPath walks the steps from node, calling found for each field they reach
+func matchPath(node interface{}, steps []pathStep, path string, set func(interface{}), found func(documentField)) {
+	if len(steps) == 0 {
+		found(documentField{path: path, value: node, set: set})
+		return
+	}
+	step := steps[0]
+	switch container := node.(type) {
+	case map[string]interface{}:
+		if step.isIndex {
+			return
+		}
+		// keys are walked in order, so a document always gets its tokens in the same order
+		keys := make([]string, 0, len(container))
+		for key := range container {
+			if step.wildcard || key == step.key {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			key := key
+			setChild := func(value interface{}) { container[key] = value }
+			matchPath(container[key], steps[1:], path+selectorKey(key), setChild, found)
+		}
+	case []interface{}:
+		if !step.isIndex && !step.wildcard {
+			return
+		}
+		for idx, child := range container {
+			if step.wildcard || idx == step.index {
+				idx := idx
+				setChild := func(value interface{}) { container[idx] = value }
+				matchPath(child, steps[1:], path+"["+strconv.Itoa(idx)+"]", setChild, found)
+			}
+		}
+	}
+}
+
+// selectorKey writes an object key back as a path step
+func selectorKey(key string) string {
+	if len(key) > 0 && !strings.ContainsAny(key, ".[]'*\" ") {
+		return "." + key
+	}
+	return "['" + strings.ReplaceAll(key, "'", "\\'") + "']"
+}
+
+// parseSelector splits a path like $.a['b c'][0].* into its steps
+func parseSelector(path string) ([]pathStep, error) {
+	invalid := &FieldError{Field: "selectors", Message: "has an invalid path: " + path}
+	if !strings.HasPrefix(path, "$") {
+		return nil, invalid
+	}
+	var steps []pathStep
+	rest := path[1:]
+	for len(rest) > 0 {
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			return nil, invalid
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			name := rest[1 : end+1]
+			if len(name) == 0 {
+				return nil, invalid
+			}
+			steps = append(steps, pathStep{key: name, wildcard: name == "*"})
+			rest = rest[end+1:]
+		case rest[0] == '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, invalid
+			}
+			inner := rest[1:end]
+			if inner == "*" {
+				steps = append(steps, pathStep{wildcard: true})
+			} else if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				steps = append(steps, pathStep{key: inner[1 : len(inner)-1]})
+			} else if index, err := strconv.Atoi(inner); err == nil && index >= 0 {
+				steps = append(steps, pathStep{index: index, isIndex: true})
+			} else {
+				return nil, invalid
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, invalid
+		}
+	}
+	if len(steps) == 0 {
+		// the whole document can't be swapped for a token
+		return nil, invalid
+	}
+	return steps, nil
+}
+
+// documentFieldString returns a string or number field as the string to tokenize
+func documentFieldString(value interface{}) (string, bool) {
+	switch scalar := value.(type) {
+	case string:
+		return scalar, true
+	case json.Number:
+		return scalar.String(), true
+	}
+	return "", false
+}
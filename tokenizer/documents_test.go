@@ -0,0 +1,134 @@
+package tokenizer
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	testScenarios := []struct {
+		givenPath   string
+		expectSteps int
+		expectErr   bool
+	}{
+		{"$.customer.email", 2, false},
+		{"$.cards[*].number", 3, false},
+		{"$['home address'].line1", 2, false},
+		{"$.items[0]", 2, false},
+		{"$.*", 1, false},
+		{"$", 0, true},
+		{"customer.email", 0, true},
+		{"$..email", 0, true},
+		{"$.items[x]", 0, true},
+		{"$.items[0", 0, true},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			steps, err := parseSelector(scenario.givenPath)
+			if want, got := scenario.expectErr, err != nil; want != got {
+				t.Fatalf("expect error %t but got %#v", want, err)
+			}
+			if want, got := scenario.expectSteps, len(steps); want != got {
+				t.Errorf("expect %d steps but got %d", want, got)
+			}
+		})
+	}
+}
+
+func TestTokenizeDocument(t *testing.T) {
+	UnitTest = true
+	var request DocumentRequest
+	body := `{
+		"document": {"name": "Jane", "email": "Jane@Example.com", "cards": [{"number": 4242424242424242, "exp": "12/30"}, {"number": null}]},
+		"selectors": [{"path": "$.email", "valueType": "email"}, "$.cards[*].number", "$.missing"]
+	}`
+	if err := json.Unmarshal([]byte(body), &request); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := TokenizeDocument("mydomain", request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, result.Fields; want != got {
+		t.Fatalf("expect %d fields tokenized but got %d", want, got)
+	}
+
+	var document struct {
+		Name  string `json:"name"`
+		Email string `json:"email"`
+		Cards []struct {
+			Number interface{} `json:"number"`
+			Exp    string      `json:"exp"`
+		} `json:"cards"`
+	}
+	if err := json.Unmarshal(result.Document, &document); err != nil {
+		t.Fatal(err)
+	}
+	if document.Name != "Jane" || document.Cards[0].Exp != "12/30" || document.Cards[1].Number != nil {
+		t.Errorf("expect unselected fields to be left alone but got %s", result.Document)
+	}
+	if document.Email == "Jane@Example.com" || len(document.Email) == 0 {
+		t.Errorf("expect the email to be replaced by a token but got %#v", document.Email)
+	}
+	if _, ok := document.Cards[0].Number.(string); !ok {
+		t.Errorf("expect the card number to be replaced by a token but got %#v", document.Cards[0].Number)
+	}
+}
+
+func TestTokenizeDocumentRejectsFields(t *testing.T) {
+	UnitTest = true
+	testScenarios := []struct {
+		givenDocument string
+		givenSelector FieldSelector
+		expectField   string
+	}{
+		{`{"email": "not an email"}`, FieldSelector{Path: "$.email", ValueType: ValueTypeEmail}, "$.email"},
+		{`{"address": {"line1": "1 Main St"}}`, FieldSelector{Path: "$.address"}, "$.address"},
+		{`{"items": [" "]}`, FieldSelector{Path: "$.items[0]"}, "$.items[0]"},
+		{`{"email": "jane@example.com"}`, FieldSelector{Path: "email"}, "selectors"},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			request := DocumentRequest{Document: json.RawMessage(scenario.givenDocument), Selectors: []FieldSelector{scenario.givenSelector}}
+			_, err := TokenizeDocument("mydomain", request)
+			var fielderr *FieldError
+			if !errors.As(err, &fielderr) || fielderr.Field != scenario.expectField {
+				t.Errorf("expect an error for %s but got %#v", scenario.expectField, err)
+			}
+		})
+	}
+
+	if _, err := TokenizeDocument("mydomain", DocumentRequest{Document: json.RawMessage(`{"a": `), Selectors: []FieldSelector{{Path: "$.a"}}}); err != ErrInvalidDocument {
+		t.Errorf("expect error %#v but got %#v", ErrInvalidDocument, err)
+	}
+	if _, err := TokenizeDocument("mydomain", DocumentRequest{Document: json.RawMessage(`{"a": "b"}`)}); err != ErrNoSelectors {
+		t.Errorf("expect error %#v but got %#v", ErrNoSelectors, err)
+	}
+}
+
+func TestDetokenizeDocument(t *testing.T) {
+	UnitTest = true
+	request := DocumentRequest{
+		Document:  json.RawMessage(`{"email": "abc", "cards": [{"number": 42}]}`),
+		Selectors: []FieldSelector{{Path: "$.email"}, {Path: "$.cards[*].number"}},
+	}
+
+	result, err := DetokenizeDocument("mydomain", request, ValueView{Mode: ViewFull})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Partial || len(result.Errors) != 2 {
+		t.Fatalf("expect both fields to fail but got %#v", result)
+	}
+	if want, got := (DocumentFieldError{Path: "$.cards[0].number", Error: ErrCodeInvalidId}), result.Errors[0]; want != got {
+		t.Errorf("expect error %#v but got %#v", want, got)
+	}
+	if want, got := (DocumentFieldError{Path: "$.email", Error: ErrCodeNotFound}), result.Errors[1]; want != got {
+		t.Errorf("expect error %#v but got %#v", want, got)
+	}
+}
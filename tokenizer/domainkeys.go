@@ -0,0 +1,427 @@
+package tokenizer
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"tokentarpon/tokencrypto"
+	"tokentarpon/tokenizer/datalog"
+	"tokentarpon/tokenizer/datastore"
+	"tokentarpon/tokenizer/systemconfig"
+
+	"github.com/google/uuid"
+)
+
+var domainKeyCollectionName = "domainkeys"
+var domainKeyRecordType = "domainkey"
+var domainKeyBytes = 32
+var defaultDomainKeyCacheSeconds int64 = 60
+
+// a domain has a single key record, live or shredded
+var domainKeyIndexes = []datastore.DataIndex{
+	{Fields: []string{"domainUuid"}, Unique: true},
+}
+
+// audit action recorded when a domain is shredded
+const AuditDomainShred = "domain.shred"
+
+// DomainKey is the key a domain's token values are encrypted with.
+// It is stored wrapped, i.e. encrypted with the master EncryptionKey.
+// Shredding the domain blanks the wrapped key and keeps the record as a
+// tombstone, so the domain can't quietly be given a new key.
+type DomainKey struct {
+	DomainUuid string `bson:"domainUuid" json:"domainUuid"`
+	KeyId      string `bson:"keyId" json:"keyId"`
+	WrappedKey string `bson:"wrappedKey" json:"-"`
+	Created    int64  `bson:"created" json:"created"`
+	Shredded   bool   `bson:"shredded" json:"shredded"`
+	ShreddedAt int64  `bson:"shreddedAt" json:"shreddedAt"`
+}
+
+// the fields changed when a domain key is shredded
+type domainKeyShred struct {
+	WrappedKey string `bson:"wrappedKey"`
+	Shredded   bool   `bson:"shredded"`
+	ShreddedAt int64  `bson:"shreddedAt"`
+}
+
+// ShredCertificate records the destruction of a domain's key.
+// The signature covers every field but AuditUuid, which is
+// assigned when the certificate is written to the audit log.
+type ShredCertificate struct {
+	DomainUuid    string `bson:"domainUuid" json:"domainUuid"`
+	KeyId         string `bson:"keyId" json:"keyId"`
+	Actor         string `bson:"actor" json:"actor"`
+	ShreddedAt    int64  `bson:"shreddedAt" json:"shreddedAt"`
+	TokensDeleted int64  `bson:"tokensDeleted" json:"tokensDeleted"`
+	// earlier versions of tokens stored outside the domain key
+	VersionsDeleted int64  `bson:"versionsDeleted" json:"versionsDeleted"`
+	AuditUuid       string `bson:"auditUuid" json:"auditUuid"`
+	Signature       string `bson:"signature" json:"signature"`
+}
+
+// an unwrapped domain key as held in memory; an empty keyId means
+// the domain has no key yet
+type domainKeyMaterial struct {
+	keyId    string
+	key      string
+	shredded bool
+	loaded   time.Time
+}
+
+var domainKeyCache = make(map[string]domainKeyMaterial)
+var domainKeyLock sync.RWMutex
+
+var (
+	ErrDomainShredded     = errors.New("data: domain has been shredded, its tokens can no longer be read")
+	ErrShredNotConfirmed  = errors.New("data: shredding a domain must be confirmed with the domain id")
+	ErrDomainKeyMissing   = errors.New("data: the key this token was encrypted with could not be found")
+	ErrInvalidDomainKey   = errors.New("data: domain key could not be unwrapped with the master key")
+	ErrMasterKeyNotLoaded = errors.New("data: the master encryption key is not configured")
+)
+
+// ShredDomain destroys the domain's key, which makes every value encrypted
+// under it unreadable, wherever copies of the ciphertext are kept.
+// Tokens and earlier versions in the domain that were not encrypted with the
+// domain key are hard deleted, as destroying the key would not protect them,
+// and so are the responses kept for idempotent replay and the files of the
+// domain's jobs. The blind indexes of what is left are removed, so they can't
+// confirm a guessed value either.
+// The confirmation must repeat the domain id. A signed certificate of the
+// destruction is written to the audit log and returned.
+func ShredDomain(domainUuid string, confirmation string, actor string) (ShredCertificate, error) {
+	var cert ShredCertificate
+	err := errors.New("data: need domain id")
+	if len(strings.TrimSpace(domainUuid)) == 0 {
+		return cert, err
+	}
+	if confirmation != domainUuid {
+		return cert, ErrShredNotConfirmed
+	}
+
+	now := time.Now().Unix()
+	cert = ShredCertificate{DomainUuid: domainUuid, Actor: actor, ShreddedAt: now}
+	if UnitTest {
+		material, _ := cachedDomainKey(domainUuid)
+		if material.shredded {
+			return ShredCertificate{}, ErrDomainShredded
+		}
+		cert.KeyId = material.keyId
+		cacheDomainKey(domainUuid, domainKeyMaterial{shredded: true})
+		cert.Signature = signShredCertificate(cert)
+		return cert, removeDomainJobFiles(domainUuid)
+	}
+
+	record, tombstoned, keyerr := claimDomainKeyRecord(domainUuid, now)
+	if keyerr != nil {
+		return ShredCertificate{}, keyerr
+	}
+	if record.Shredded && !tombstoned {
+		return ShredCertificate{}, ErrDomainShredded
+	}
+	cert.KeyId = record.KeyId
+
+	if !tombstoned {
+		shred := domainKeyShred{WrappedKey: "", Shredded: true, ShreddedAt: now}
+		_, updateerr := datastore.UpdateRecordIn(domainKeyCollectionName, domainKeyRecordType,
+			makeDomainKeyQuery(domainUuid), "and", shred)
+		if updateerr != nil {
+			return ShredCertificate{}, updateerr
+		}
+	}
+	cacheDomainKey(domainUuid, domainKeyMaterial{shredded: true})
+
+	deleted, deleteerr := datastore.DeleteRecordsIn(CollectionName, makeUnkeyedTokenQuery(domainUuid, record.KeyId), "and")
+	cert.TokensDeleted = deleted
+	if deleteerr == nil {
+		cert.VersionsDeleted, deleteerr = datastore.DeleteRecordsIn(historyCollectionName,
+			makeUnkeyedTokenQuery(domainUuid, record.KeyId), "and")
+	}
+	if deleteerr == nil {
+		// responses kept for idempotent replay can hold values stored before the domain key
+		_, deleteerr = datastore.DeleteRecordsIn(idempotencyCollectionName, makeDomainKeyQuery(domainUuid), "and")
+	}
+	if deleteerr == nil {
+		// the blind index would still confirm a guessed value after the key is gone
+		_, deleteerr = datastore.UnsetFieldsIn(CollectionName, makeDomainKeyQuery(domainUuid), "and", []string{"blindIndex"})
+	}
+	if deleteerr == nil {
+		_, deleteerr = datastore.UnsetFieldsIn(historyCollectionName, makeDomainKeyQuery(domainUuid), "and", []string{"blindIndex"})
+	}
+	if deleteerr == nil {
+		// job inputs hold values in the clear until the job completes
+		deleteerr = removeDomainJobFiles(domainUuid)
+	}
+	cert.Signature = signShredCertificate(cert)
+
+	details := map[string]string{
+		"keyId":           cert.KeyId,
+		"shreddedAt":      strconv.FormatInt(cert.ShreddedAt, 10),
+		"tokensDeleted":   strconv.FormatInt(cert.TokensDeleted, 10),
+		"versionsDeleted": strconv.FormatInt(cert.VersionsDeleted, 10),
+		"signature":       cert.Signature,
+	}
+	if deleteerr != nil {
+		details["error"] = fmt.Sprint(deleteerr)
+	}
+	entry, auditerr := datalog.Write(datalog.Entry{
+		Action:     AuditDomainShred,
+		DomainUuid: domainUuid,
+		Actor:      actor,
+		Details:    details,
+	})
+	cert.AuditUuid = entry.Uuid
+	if deleteerr != nil {
+		return cert, deleteerr
+	}
+	return cert, auditerr
+}
+
+// VerifyShredCertificate reports whether the certificate was signed by this service
+func VerifyShredCertificate(cert ShredCertificate) bool {
+	if len(cert.Signature) == 0 {
+		return false
+	}
+	return hmac.Equal([]byte(signShredCertificate(cert)), []byte(cert.Signature))
+}
+
+func signShredCertificate(cert ShredCertificate) string {
+	getEncryptionKey()
+	shredKey := tokencrypto.GetHMACForString("tokentarpon shred", encryptionKey)
+	payload := strings.Join([]string{
+		cert.DomainUuid,
+		cert.KeyId,
+		cert.Actor,
+		strconv.FormatInt(cert.ShreddedAt, 10),
+		strconv.FormatInt(cert.TokensDeleted, 10),
+		strconv.FormatInt(cert.VersionsDeleted, 10),
+	}, "\n")
+	return tokencrypto.GetHMACForString(payload, shredKey)
+}
+
+// claimDomainKeyRecord gets the domain's key record for shredding. A domain
+// that never had a key gets a shredded tombstone instead, reported by tombstoned.
+func claimDomainKeyRecord(domainUuid string, now int64) (DomainKey, bool, error) {
+	var record DomainKey
+	filter := makeDomainKeyQuery(domainUuid)
+	geterr := datastore.GetRecordIn(domainKeyCollectionName, filter, &record)
+	if geterr == nil {
+		return record, false, nil
+	} else if geterr != datastore.ErrNotFound {
+		return record, false, geterr
+	}
+
+	record = DomainKey{DomainUuid: domainUuid, Created: now, Shredded: true, ShreddedAt: now}
+	inserterr := datastore.InsertRecordIn(domainKeyCollectionName, domainKeyRecordType, record)
+	if inserterr == nil {
+		return record, true, nil
+	} else if inserterr != datastore.ErrConflict {
+		return record, false, inserterr
+	}
+
+	// a key was created while we looked, shred that one
+	record = DomainKey{}
+	geterr = datastore.GetRecordIn(domainKeyCollectionName, filter, &record)
+	return record, false, geterr
+}
+
+// checkDomainOpen returns ErrDomainShredded for a shredded domain
+func checkDomainOpen(domainUuid string) error {
+	_, err := loadDomainKey(domainUuid, false)
+	return err
+}
+
+// loadDomainKey returns the domain's unwrapped key, creating one on first
+// use when create is set. Keys are cached for DomainKeyCacheSeconds, so a
+// shred on another replica takes up to that long to be seen here.
+func loadDomainKey(domainUuid string, create bool) (domainKeyMaterial, error) {
+	if material, ok := cachedDomainKey(domainUuid); ok {
+		if material.shredded {
+			return material, ErrDomainShredded
+		}
+		if len(material.keyId) > 0 || !create {
+			return material, nil
+		}
+	}
+
+	if UnitTest {
+		if !create {
+			return domainKeyMaterial{}, nil
+		}
+		material, _, err := newDomainKey(domainUuid)
+		if err == nil {
+			cacheDomainKey(domainUuid, material)
+		}
+		return material, err
+	}
+
+	var record DomainKey
+	filter := makeDomainKeyQuery(domainUuid)
+	geterr := datastore.GetRecordIn(domainKeyCollectionName, filter, &record)
+	if geterr == datastore.ErrNotFound {
+		if !create {
+			cacheDomainKey(domainUuid, domainKeyMaterial{})
+			return domainKeyMaterial{}, nil
+		}
+		material, newRecord, err := newDomainKey(domainUuid)
+		if err != nil {
+			return material, err
+		}
+		inserterr := datastore.InsertRecordIn(domainKeyCollectionName, domainKeyRecordType, newRecord)
+		if inserterr == nil {
+			cacheDomainKey(domainUuid, material)
+			return material, nil
+		} else if inserterr != datastore.ErrConflict {
+			return domainKeyMaterial{}, inserterr
+		}
+		// another request created the key first, use theirs
+		geterr = datastore.GetRecordIn(domainKeyCollectionName, filter, &record)
+	}
+	if geterr != nil {
+		return domainKeyMaterial{}, geterr
+	}
+
+	material, err := unwrapDomainKey(record)
+	if err == nil || err == ErrDomainShredded {
+		cacheDomainKey(domainUuid, material)
+	}
+	return material, err
+}
+
+// domainKeyFor returns the key a token was encrypted with, reloading
+// the domain's key once in case the cached one is stale
+func domainKeyFor(domainUuid string, keyId string) (domainKeyMaterial, error) {
+	material, err := loadDomainKey(domainUuid, false)
+	if err != nil || material.keyId == keyId {
+		return material, err
+	}
+	forgetDomainKey(domainUuid)
+	material, err = loadDomainKey(domainUuid, false)
+	if err != nil {
+		return material, err
+	}
+	if material.keyId != keyId {
+		return domainKeyMaterial{}, ErrDomainKeyMissing
+	}
+	return material, nil
+}
+
+// newDomainKey generates a random key for the domain, along with its record wrapped by the master key
+func newDomainKey(domainUuid string) (domainKeyMaterial, DomainKey, error) {
+	var record DomainKey
+	raw := make([]byte, domainKeyBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return domainKeyMaterial{}, record, err
+	}
+	material := domainKeyMaterial{keyId: uuid.New().String(), key: string(raw)}
+
+	record = DomainKey{DomainUuid: domainUuid, KeyId: material.keyId, Created: time.Now().Unix()}
+	if UnitTest {
+		return material, record, nil
+	}
+	getEncryptionKey()
+	if len(encryptionKey) == 0 {
+		return domainKeyMaterial{}, record, ErrMasterKeyNotLoaded
+	}
+	wrapped, err := encryptWithKey(material.key, encryptionKey)
+	if err != nil {
+		return domainKeyMaterial{}, record, err
+	}
+	record.WrappedKey = wrapped
+	return material, record, nil
+}
+
+func unwrapDomainKey(record DomainKey) (domainKeyMaterial, error) {
+	if record.Shredded {
+		return domainKeyMaterial{shredded: true}, ErrDomainShredded
+	}
+	getEncryptionKey()
+	key, err := decryptWithKey(record.WrappedKey, encryptionKey)
+	if err != nil || len(key) != domainKeyBytes {
+		return domainKeyMaterial{}, ErrInvalidDomainKey
+	}
+	return domainKeyMaterial{keyId: record.KeyId, key: key}, nil
+}
+
+// cachedDomainKey returns the cached key for the domain, if it is still fresh.
+// A shredded domain stays shredded, so that is cached for good.
+func cachedDomainKey(domainUuid string) (domainKeyMaterial, bool) {
+	domainKeyLock.RLock()
+	material, ok := domainKeyCache[domainUuid]
+	domainKeyLock.RUnlock()
+	if !ok || material.shredded {
+		return material, ok
+	}
+	maxAge := time.Duration(getDomainKeyCacheSeconds()) * time.Second
+	if time.Since(material.loaded) > maxAge {
+		return domainKeyMaterial{}, false
+	}
+	return material, true
+}
+
+func cacheDomainKey(domainUuid string, material domainKeyMaterial) {
+	material.loaded = time.Now()
+	domainKeyLock.Lock()
+	domainKeyCache[domainUuid] = material
+	domainKeyLock.Unlock()
+}
+
+func forgetDomainKey(domainUuid string) {
+	domainKeyLock.Lock()
+	delete(domainKeyCache, domainUuid)
+	domainKeyLock.Unlock()
+}
+
+// encryptWithKey encrypts the plaintext, returning base64 so the ciphertext can be stored as a string
+func encryptWithKey(plaintext string, key string) (string, error) {
+	encrypted, err := tokencrypto.EncryptAES(plaintext, key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString([]byte(encrypted)), nil
+}
+
+func decryptWithKey(encryptedValue string, key string) (string, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(encryptedValue)
+	if err != nil {
+		return "", err
+	}
+	return tokencrypto.DecryptAES(string(ciphertext), key)
+}
+
+func makeDomainKeyQuery(domainUuid string) []datastore.DataQueryGroup {
+	var filters = make([]datastore.DataQueryGroup, 1)
+	var nvq datastore.DataQueryGroup
+
+	nvq.Operator = "and"
+	nvq.DataQueries = []datastore.DataQuery{
+		{FieldName: "domainUuid", FieldValue: domainUuid, CaseSensitive: true},
+	}
+	filters[0] = nvq
+	return filters
+}
+
+// makeUnkeyedTokenQuery finds the domain's tokens that were not encrypted with the
+// domain key: stored in plaintext, or under the master key before domain keys existed
+func makeUnkeyedTokenQuery(domainUuid string, keyId string) []datastore.DataQueryGroup {
+	filters := makeDomainKeyQuery(domainUuid)
+	if len(keyId) > 0 {
+		filters[0].DataQueries = append(filters[0].DataQueries,
+			datastore.DataQuery{FieldName: "keyId", FieldValue: keyId, CaseSensitive: true, Negate: true})
+	}
+	return filters
+}
+
+func getDomainKeyCacheSeconds() int64 {
+	configuration, configerr := systemconfig.Load()
+	if configerr != nil || configuration.DomainKeyCacheSeconds <= 0 {
+		return defaultDomainKeyCacheSeconds
+	}
+	return configuration.DomainKeyCacheSeconds
+}
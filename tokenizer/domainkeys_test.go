@@ -0,0 +1,106 @@
+package tokenizer
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"tokentarpon/tokenizer/datastore"
+)
+
+func TestShredDomain(t *testing.T) {
+	UnitTest = true
+	encryptionKey = ";kldfpo87-28374isu;dfjhZXJCVG786"
+	defer func() { encryptionKey = "" }()
+	defer forgetDomainKey("shreddomain")
+
+	sealed, sealerrs := encryptTokens([]Token{{DomainUuid: "shreddomain", Value: "secret"}}, 1)
+	if sealerrs[0] != nil {
+		t.Fatal(sealerrs[0])
+	}
+	t.Setenv("TMPDIR", t.TempDir())
+	job, err := CreateTokenizeJob("shreddomain", JobSpec{Format: "csv", Fields: []FieldSelector{{Path: "email"}}},
+		strings.NewReader("email\na@example.com\n"), "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ShredDomain("shreddomain", "shred", "admin"); err != ErrShredNotConfirmed {
+		t.Fatalf("expect error %#v but got %#v", ErrShredNotConfirmed, err)
+	}
+
+	cert, err := ShredDomain("shreddomain", "shreddomain", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := sealed[0].KeyId, cert.KeyId; want != got {
+		t.Errorf("expect certificate for key %#v but got %#v", want, got)
+	}
+	if !VerifyShredCertificate(cert) {
+		t.Error("expect the certificate to verify")
+	}
+	if _, staterr := os.Stat(jobInputPath(job.Uuid)); !os.IsNotExist(staterr) {
+		t.Errorf("expect the job input removed but got %#v", staterr)
+	}
+	cert.TokensDeleted++
+	if VerifyShredCertificate(cert) {
+		t.Error("expect an altered certificate not to verify")
+	}
+
+	// once shredded, nothing in the domain can be read, written, or shredded again
+	if _, err := GetToken("shreddomain", "abc"); err != ErrDomainShredded {
+		t.Errorf("expect error %#v but got %#v", ErrDomainShredded, err)
+	}
+	if err := revealValue(&sealed[0]); err != ErrDomainShredded {
+		t.Errorf("expect error %#v but got %#v", ErrDomainShredded, err)
+	}
+	if _, sealerrs := encryptTokens([]Token{{DomainUuid: "shreddomain", Value: "more"}}, 1); sealerrs[0] != ErrDomainShredded {
+		t.Errorf("expect error %#v but got %#v", ErrDomainShredded, sealerrs[0])
+	}
+	if _, err := ShredDomain("shreddomain", "shreddomain", "admin"); err != ErrDomainShredded {
+		t.Errorf("expect error %#v but got %#v", ErrDomainShredded, err)
+	}
+}
+
+func TestWrapDomainKey(t *testing.T) {
+	encryptionKey = ";kldfpo87-28374isu;dfjhZXJCVG786"
+	defer func() { encryptionKey = "" }()
+
+	UnitTest = false
+	material, record, err := newDomainKey("mydomain")
+	UnitTest = true
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record.WrappedKey) == 0 || record.WrappedKey == material.key {
+		t.Fatalf("expect the stored key to be wrapped but got %#v", record.WrappedKey)
+	}
+
+	unwrapped, err := unwrapDomainKey(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unwrapped.key != material.key || unwrapped.keyId != material.keyId {
+		t.Error("expect the unwrapped key to match the generated key")
+	}
+
+	record.WrappedKey = ""
+	record.Shredded = true
+	if _, err := unwrapDomainKey(record); err != ErrDomainShredded {
+		t.Errorf("expect error %#v but got %#v", ErrDomainShredded, err)
+	}
+}
+
+func TestMakeUnkeyedTokenQuery(t *testing.T) {
+	filter := datastore.CreateMongoFilter(makeUnkeyedTokenQuery("mydomain", "key1"), "and")
+	want := "map[$and:[map[domainUuid:mydomain] map[keyId:map[$ne:key1]]]]"
+	if got := fmt.Sprint(filter); want != got {
+		t.Errorf("expect filter %s but got %s", want, got)
+	}
+
+	filter = datastore.CreateMongoFilter(makeUnkeyedTokenQuery("mydomain", ""), "and")
+	want = "map[domainUuid:mydomain]"
+	if got := fmt.Sprint(filter); want != got {
+		t.Errorf("expect filter %s but got %s", want, got)
+	}
+}
@@ -0,0 +1,303 @@
+package tokenizer
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"tokentarpon/tokencrypto"
+	"tokentarpon/tokenizer/datalog"
+	"tokentarpon/tokenizer/datastore"
+	"tokentarpon/tokenizer/systemconfig"
+)
+
+// audit action recorded for each erase by value
+const AuditEraseByValue = "value.erase"
+
+// ErasureReport lists the tokens hard deleted by an erase, per domain searched,
+// so callers can remove their own references to them
+type ErasureReport struct {
+	Domains   []DomainErasure `bson:"domains" json:"domains"`
+	Erased    int64           `bson:"erased" json:"erased"`
+	AuditUuid string          `bson:"auditUuid" json:"auditUuid"`
+}
+
+// DomainErasure lists the tokens erased from a single domain. HistoryTokenUuids
+// are tokens that were kept because their current value differs, but whose
+// earlier versions held the value; those versions were erased.
+// UnindexedTokens counts the domain's tokens without a blind index, created
+// before blind indexes or left by a shred, which can't be found by value,
+// so the erase can't say whether they hold it.
+type DomainErasure struct {
+	DomainUuid        string   `bson:"domainUuid" json:"domainUuid"`
+	TokenUuids        []string `bson:"tokenUuids" json:"tokenUuids"`
+	HistoryTokenUuids []string `bson:"historyTokenUuids" json:"historyTokenUuids"`
+	UnindexedTokens   int64    `bson:"unindexedTokens" json:"unindexedTokens"`
+}
+
+// only the uuid is read when finding tokens to erase
+type erasureCandidate struct {
+	Uuid string `bson:"uuid"`
+}
+
+var (
+	ErrUnknownAccount = errors.New("data: account is not configured")
+	ErrNoEraseValue   = errors.New("data: need a value to erase")
+)
+
+// blindIndexFor returns the keyed hash a token's value is found by without decrypting it.
+// The domain and value type are part of the hash, so the same value can't be linked
+// across domains, nor matched as another type. Only padding is trimmed from the value;
+// anything more, such as an email's case, is left to its value type's normalizer,
+// so values that differ in their own right never share an index.
+func blindIndexFor(domainUuid string, valueType string, value string) (string, error) {
+	getEncryptionKey()
+	if len(encryptionKey) == 0 {
+		return "", ErrMasterKeyNotLoaded
+	}
+	indexKey := tokencrypto.GetHMACForString("tokentarpon blind index", encryptionKey)
+	return tokencrypto.GetHMACForString(domainUuid+"\x00"+valueType+"\x00"+normalizeIndexValue(value), indexKey), nil
+}
+
+func normalizeIndexValue(value string) string {
+	return strings.TrimSpace(value)
+}
+
+// EraseByValueInAccount erases the value from every domain in the account
+func EraseByValueInAccount(accountId string, valueType string, value string, actor string) (ErasureReport, error) {
+	domainUuids, ok := getAccountDomains(accountId)
+	if !ok {
+		return ErasureReport{Domains: []DomainErasure{}}, ErrUnknownAccount
+	}
+	return EraseByValue(domainUuids, valueType, value, actor)
+}
+
+// EraseByValue hard deletes every token in the domains that holds the value,
+// deleted or not, with its history, and every earlier version of a token
+// that held the value. Tokens are found through their blind index, so the value is
+// never decrypted or compared in plaintext. The erase is recorded in the audit
+// log with the affected token ids, but never the value.
+// The value is normalized by the value type, when given, as it was when tokenized,
+// so e.g. a phone number is found whatever its formatting. The type is part of the
+// blind index, so only tokens created with the same value type are found.
+func EraseByValue(domainUuids []string, valueType string, value string, actor string) (ErasureReport, error) {
+	report := ErasureReport{Domains: []DomainErasure{}}
+	if len(strings.TrimSpace(value)) == 0 {
+		return report, ErrNoEraseValue
+	}
+	valueType = strings.ToLower(strings.TrimSpace(valueType))
+	value, typeerr := NormalizeValue(valueType, value)
+	if typeerr != nil {
+		return report, typeerr
+	}
+	for _, domainUuid := range domainUuids {
+		if len(strings.TrimSpace(domainUuid)) == 0 {
+			return report, errors.New("data: need domain id")
+		}
+	}
+
+	if UnitTest {
+		for _, domainUuid := range domainUuids {
+			report.Domains = append(report.Domains, DomainErasure{DomainUuid: domainUuid, TokenUuids: []string{}, HistoryTokenUuids: []string{}})
+		}
+		return report, nil
+	}
+
+	details := make(map[string]string)
+	var runerr error
+	for _, domainUuid := range domainUuids {
+		blindIndex, indexerr := blindIndexFor(domainUuid, valueType, value)
+		if indexerr != nil {
+			return report, indexerr
+		}
+		erasure, erased, err := eraseFromDomain(domainUuid, blindIndex)
+		report.Domains = append(report.Domains, erasure)
+		report.Erased += erased
+		details[domainUuid+".tokens"] = strings.Join(erasure.TokenUuids, ",")
+		details[domainUuid+".historyTokens"] = strings.Join(erasure.HistoryTokenUuids, ",")
+		details[domainUuid+".unindexedTokens"] = strconv.FormatInt(erasure.UnindexedTokens, 10)
+		if err != nil {
+			details[domainUuid+".error"] = err.Error()
+			runerr = err
+			break
+		}
+	}
+
+	details["domains"] = strconv.Itoa(len(report.Domains))
+	details["erased"] = strconv.FormatInt(report.Erased, 10)
+	entry := datalog.Entry{Action: AuditEraseByValue, Actor: actor, Details: details}
+	if len(domainUuids) == 1 {
+		entry.DomainUuid = domainUuids[0]
+	}
+	entry, auditerr := datalog.Write(entry)
+	report.AuditUuid = entry.Uuid
+	if runerr != nil {
+		return report, runerr
+	}
+	return report, auditerr
+}
+
+// eraseFromDomain finds the domain's tokens with the blind index, then deletes
+// exactly those and their history, so the report matches what was deleted.
+// Earlier versions with the blind index are erased after. Responses kept for
+// idempotent replay that hold any of the tokens are deleted too.
+func eraseFromDomain(domainUuid string, blindIndex string) (DomainErasure, int64, error) {
+	erasure := DomainErasure{DomainUuid: domainUuid, TokenUuids: []string{}, HistoryTokenUuids: []string{}}
+
+	pageRecordCount := getPageRecordCount()
+	if pageRecordCount <= 0 {
+		pageRecordCount = defaultPageRecordCount
+	}
+	byUuid := []datastore.DataSort{{FieldName: "uuid"}}
+	after := ""
+	for {
+		filter := makeBlindIndexQuery(domainUuid, blindIndex, after)
+		results, geterr := datastore.GetSortedRecordsIn(CollectionName, filter, "and", byUuid, 0, pageRecordCount, erasureCandidate{})
+		if geterr != nil {
+			return erasure, 0, geterr
+		}
+		for _, result := range results {
+			after = result.(erasureCandidate).Uuid
+			erasure.TokenUuids = append(erasure.TokenUuids, after)
+		}
+		if int64(len(results)) < pageRecordCount {
+			break
+		}
+	}
+
+	unindexed, counterr := datastore.CountRecordsIn(CollectionName, makeUnindexedQuery(domainUuid), "and")
+	if counterr != nil {
+		return erasure, 0, counterr
+	}
+	erasure.UnindexedTokens = unindexed
+
+	var erased int64
+	for _, chunk := range chunkUuids(erasure.TokenUuids, int(pageRecordCount)) {
+		deleted, deleteerr := datastore.DeleteRecordsIn(CollectionName, makeTokenUuidsQuery(domainUuid, chunk), "and")
+		erased += deleted
+		if deleteerr != nil {
+			return erasure, erased, deleteerr
+		}
+		if _, historyerr := datastore.DeleteRecordsIn(historyCollectionName, makeTokenUuidsQuery(domainUuid, chunk), "and"); historyerr != nil {
+			return erasure, erased, historyerr
+		}
+		if idempotencyerr := deleteIdempotencyRecords(domainUuid, chunk); idempotencyerr != nil {
+			return erasure, erased, idempotencyerr
+		}
+	}
+
+	historyTokenUuids, historyerr := eraseHistory(domainUuid, blindIndex, pageRecordCount)
+	erasure.HistoryTokenUuids = historyTokenUuids
+	if historyerr != nil {
+		return erasure, erased, historyerr
+	}
+	// a response kept for idempotent replay may hold an earlier value
+	for _, chunk := range chunkUuids(historyTokenUuids, int(pageRecordCount)) {
+		if idempotencyerr := deleteIdempotencyRecords(domainUuid, chunk); idempotencyerr != nil {
+			return erasure, erased, idempotencyerr
+		}
+	}
+	return erasure, erased, nil
+}
+
+// eraseHistory deletes the domain's earlier versions with the blind index a page
+// at a time, returning the ids of the tokens they belonged to
+func eraseHistory(domainUuid string, blindIndex string, pageRecordCount int64) ([]string, error) {
+	tokenUuids := []string{}
+	seen := make(map[string]bool)
+	for {
+		filter := makeBlindIndexQuery(domainUuid, blindIndex, "")
+		results, geterr := datastore.GetRecordsIn(historyCollectionName, filter, "and", 0, pageRecordCount, erasureCandidate{})
+		if geterr != nil || len(results) == 0 {
+			return tokenUuids, geterr
+		}
+
+		var page []string
+		for _, result := range results {
+			tokenUuid := result.(erasureCandidate).Uuid
+			if !seen[tokenUuid] {
+				seen[tokenUuid] = true
+				tokenUuids = append(tokenUuids, tokenUuid)
+				page = append(page, tokenUuid)
+			}
+		}
+		if len(page) == 0 {
+			// versions already read and deleted are still matching, stop rather than spin
+			return tokenUuids, nil
+		}
+		filter[0].DataQueryGroups = makeTokenUuidsQuery(domainUuid, page)[0].DataQueryGroups
+		if _, deleteerr := datastore.DeleteRecordsIn(historyCollectionName, filter, "and"); deleteerr != nil {
+			return tokenUuids, deleteerr
+		}
+	}
+}
+
+// makeBlindIndexQuery finds a domain's tokens by blind index, deleted or not,
+// continuing after the given uuid when it is set
+func makeBlindIndexQuery(domainUuid string, blindIndex string, afterUuid string) []datastore.DataQueryGroup {
+	var filters = make([]datastore.DataQueryGroup, 1)
+	var nvq datastore.DataQueryGroup
+
+	nvq.Operator = "and"
+	nvq.DataQueries = []datastore.DataQuery{
+		{FieldName: "domainUuid", FieldValue: domainUuid, CaseSensitive: true},
+		{FieldName: "blindIndex", FieldValue: blindIndex, CaseSensitive: true},
+	}
+	if len(afterUuid) > 0 {
+		nvq.DataQueries = append(nvq.DataQueries,
+			datastore.DataQuery{FieldName: "uuid", FieldValue: afterUuid, Comparison: "gt"})
+	}
+	filters[0] = nvq
+	return filters
+}
+
+// makeUnindexedQuery finds a domain's tokens without a blind index, deleted or not
+func makeUnindexedQuery(domainUuid string) []datastore.DataQueryGroup {
+	var filters = make([]datastore.DataQueryGroup, 1)
+	var nvq datastore.DataQueryGroup
+
+	nvq.Operator = "and"
+	nvq.DataQueries = []datastore.DataQuery{
+		{FieldName: "domainUuid", FieldValue: domainUuid, CaseSensitive: true},
+		{FieldName: "blindIndex", Comparison: "missing"},
+	}
+	filters[0] = nvq
+	return filters
+}
+
+// makeTokenUuidsQuery finds the listed tokens in a domain, deleted or not
+func makeTokenUuidsQuery(domainUuid string, tokenUuids []string) []datastore.DataQueryGroup {
+	var filters = make([]datastore.DataQueryGroup, 1)
+	var nvq datastore.DataQueryGroup
+	var uuids datastore.DataQueryGroup
+
+	uuids.Operator = "or"
+	for _, tokenUuid := range tokenUuids {
+		uuids.DataQueries = append(uuids.DataQueries,
+			datastore.DataQuery{FieldName: "uuid", FieldValue: tokenUuid, CaseSensitive: true})
+	}
+
+	nvq.Operator = "and"
+	nvq.DataQueries = []datastore.DataQuery{
+		{FieldName: "domainUuid", FieldValue: domainUuid, CaseSensitive: true},
+	}
+	nvq.DataQueryGroups = []datastore.DataQueryGroup{uuids}
+	filters[0] = nvq
+	return filters
+}
+
+// getAccountDomains returns the account's domains in a stable order
+func getAccountDomains(accountId string) ([]string, bool) {
+	configuration, configerr := systemconfig.Load()
+	if configerr != nil {
+		return nil, false
+	}
+	domainUuids, ok := configuration.Accounts[accountId]
+	if !ok || len(domainUuids) == 0 {
+		return nil, false
+	}
+	sorted := make([]string, len(domainUuids))
+	copy(sorted, domainUuids)
+	sort.Strings(sorted)
+	return sorted, true
+}
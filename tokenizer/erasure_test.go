@@ -0,0 +1,115 @@
+package tokenizer
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+	"tokentarpon/tokenizer/datastore"
+)
+
+func TestBlindIndexFor(t *testing.T) {
+	if _, err := blindIndexFor("mydomain", "email", "jane@example.com"); err != ErrMasterKeyNotLoaded {
+		t.Errorf("expect error %#v but got %#v", ErrMasterKeyNotLoaded, err)
+	}
+
+	encryptionKey = ";kldfpo87-28374isu;dfjhZXJCVG786"
+	defer func() { encryptionKey = "" }()
+
+	index, _ := blindIndexFor("mydomain", "email", "jane@example.com")
+	testScenarios := []struct {
+		givenDomain, givenType, givenValue string
+		expectMatch                        bool
+	}{
+		{"mydomain", "email", "jane@example.com", true},
+		{"mydomain", "email", "  jane@example.com ", true},
+		// case is left to the value type's normalizer
+		{"mydomain", "email", "Jane@Example.COM", false},
+		{"mydomain", "email", "john@example.com", false},
+		// the same value as another type, or in another domain, has its own index
+		{"mydomain", "", "jane@example.com", false},
+		{"otherdomain", "email", "jane@example.com", false},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			got, err := blindIndexFor(scenario.givenDomain, scenario.givenType, scenario.givenValue)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := scenario.expectMatch; want != (got == index) {
+				t.Errorf("expect match %t but got %t", want, got == index)
+			}
+		})
+	}
+
+	// changing the key changes every index
+	encryptionKey = "0123456789abcdef0123456789abcdef"
+	if changed, _ := blindIndexFor("mydomain", "email", "jane@example.com"); changed == index {
+		t.Error("expect the blind index to depend on the key")
+	}
+}
+
+func TestSealTokensSetsBlindIndex(t *testing.T) {
+	UnitTest = true
+	_, sealerrs := sealTokens([]Token{{DomainUuid: "mydomain", Value: "jane@example.com"}}, 1)
+	if want, got := ErrMasterKeyNotLoaded, sealerrs[0]; want != got {
+		t.Errorf("expect error %#v but got %#v", want, got)
+	}
+
+	encryptionKey = ";kldfpo87-28374isu;dfjhZXJCVG786"
+	defer func() { encryptionKey = "" }()
+	sealed, sealerrs := sealTokens([]Token{{DomainUuid: "mydomain", ValueType: "email", Value: "jane@example.com"}}, 1)
+	if sealerrs[0] != nil {
+		t.Fatal(sealerrs[0])
+	}
+	if want, _ := blindIndexFor("mydomain", "email", "jane@example.com"); want != sealed[0].BlindIndex {
+		t.Errorf("expect blind index %#v but got %#v", want, sealed[0].BlindIndex)
+	}
+}
+
+func TestEraseByValue(t *testing.T) {
+	UnitTest = true
+	if _, err := EraseByValue([]string{"mydomain"}, "", " ", "admin"); err != ErrNoEraseValue {
+		t.Errorf("expect error %#v but got %#v", ErrNoEraseValue, err)
+	}
+	if _, err := EraseByValue([]string{"mydomain", ""}, "", "jane@example.com", "admin"); err == nil {
+		t.Error("expect a blank domain to be rejected")
+	}
+	if _, err := EraseByValueInAccount("noaccount", "", "jane@example.com", "admin"); err != ErrUnknownAccount {
+		t.Errorf("expect error %#v but got %#v", ErrUnknownAccount, err)
+	}
+	// a value is checked against its type, as it was when tokenized
+	var fielderr *FieldError
+	if _, err := EraseByValue([]string{"mydomain"}, ValueTypePhone, "not a phone", "admin"); !errors.As(err, &fielderr) {
+		t.Errorf("expect a field error but got %#v", err)
+	}
+
+	report, err := EraseByValue([]string{"mydomain", "otherdomain"}, "", "jane@example.com", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(report.Domains); want != got {
+		t.Errorf("expect %d domains in the report but got %d", want, got)
+	}
+}
+
+func TestMakeErasureQueries(t *testing.T) {
+	filter := datastore.CreateMongoFilter(makeBlindIndexQuery("mydomain", "idx", "abc"), "and")
+	want := "map[$and:[map[domainUuid:mydomain] map[blindIndex:idx] map[uuid:map[$gt:abc]]]]"
+	if got := fmt.Sprint(filter); want != got {
+		t.Errorf("expect filter %s but got %s", want, got)
+	}
+
+	filter = datastore.CreateMongoFilter(makeUnindexedQuery("mydomain"), "and")
+	want = "map[$and:[map[domainUuid:mydomain] map[blindIndex:map[$exists:false]]]]"
+	if got := fmt.Sprint(filter); want != got {
+		t.Errorf("expect filter %s but got %s", want, got)
+	}
+
+	filter = datastore.CreateMongoFilter(makeTokenUuidsQuery("mydomain", []string{"a", "b"}), "and")
+	want = "map[$and:[map[domainUuid:mydomain] map[$or:[map[uuid:a] map[uuid:b]]]]]"
+	if got := fmt.Sprint(filter); want != got {
+		t.Errorf("expect filter %s but got %s", want, got)
+	}
+}
@@ -0,0 +1,160 @@
+package tokenizer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"tokentarpon/tokenizer/datastore"
+	"tokentarpon/tokenizer/systemconfig"
+)
+
+var defaultExpirySweepSeconds int64 = 60
+
+var ErrInvalidLifetime = errors.New("data: expiry must be in the future, ttl and max reads must not be negative")
+
+// checkLifetime makes sure a token's requested expiry and read limit make sense
+func checkLifetime(tok Token, now int64) error {
+	if tok.TTLSeconds < 0 || tok.MaxReads < 0 || tok.ExpiresAt < 0 {
+		return ErrInvalidLifetime
+	}
+	if tok.TTLSeconds == 0 && tok.ExpiresAt > 0 && tok.ExpiresAt <= now {
+		return ErrInvalidLifetime
+	}
+	return nil
+}
+
+// applyLifetime turns a requested ttl into an expiry time
+// and starts the read count for read limited tokens
+func applyLifetime(tok *Token, now int64) error {
+	if err := checkLifetime(*tok, now); err != nil {
+		return err
+	}
+	if tok.TTLSeconds > 0 {
+		tok.ExpiresAt = now + tok.TTLSeconds
+		tok.TTLSeconds = 0
+	}
+	tok.ReadsRemaining = tok.MaxReads
+	return nil
+}
+
+// isLive reports whether the token has neither expired nor run out of reads
+func isLive(tok Token, now int64) bool {
+	if tok.ExpiresAt > 0 && tok.ExpiresAt <= now {
+		return false
+	}
+	if tok.MaxReads > 0 && tok.ReadsRemaining <= 0 {
+		return false
+	}
+	return true
+}
+
+// consumeRead takes one read from a read limited token. The decrement only
+// applies while reads remain, so when two callers race for the last read
+// exactly one of them gets it.
+func consumeRead(tok Token) (bool, error) {
+	if UnitTest {
+		return tok.ReadsRemaining > 0, nil
+	}
+
+	filter := datastore.MakeDomainQuery(tok.DomainUuid, "uuid", tok.Uuid, true)
+	filter[0].DataQueries = append(filter[0].DataQueries, datastore.DataQuery{
+		FieldName: "readsRemaining", IsInt: true, IntValue: 0, Comparison: "gt",
+	})
+	changed, err := datastore.IncrementRecordIn(CollectionName, filter, "and", "readsRemaining", -1)
+	return changed == 1, err
+}
+
+// GetTokenValue returns the value of a token, counting the read
+// against the token's read limit if it has one
+func GetTokenValue(domainUuid string, tokenUuid string) (string, error) {
+	return GetTokenValueAs(domainUuid, tokenUuid, ValueView{Mode: ViewFull})
+}
+
+// GetTokenValueAs returns the value of a token presented in the view,
+// counting the read against the token's read limit whatever the view
+func GetTokenValueAs(domainUuid string, tokenUuid string, view ValueView) (string, error) {
+	err := errors.New("data: need domain id, token id")
+	if len(strings.TrimSpace(domainUuid)) == 0 {
+		return "", err
+	}
+	if len(strings.TrimSpace(tokenUuid)) == 0 {
+		return "", err
+	}
+	if shrederr := checkDomainOpen(domainUuid); shrederr != nil {
+		return "", shrederr
+	}
+
+	if UnitTest {
+		return "", nil
+	}
+
+	var tok Token
+	filter := datastore.MakeDomainQuery(domainUuid, "uuid", tokenUuid, true)
+	geterr := datastore.GetRecordIn(CollectionName, filter, &tok)
+	if geterr == datastore.ErrNotFound {
+		return "", ErrNoMatchingToken
+	} else if geterr != nil {
+		return "", geterr
+	}
+	if !isLive(tok, time.Now().Unix()) {
+		return "", ErrNoMatchingToken
+	}
+
+	if tok.MaxReads > 0 {
+		consumed, consumeerr := consumeRead(tok)
+		if consumeerr != nil {
+			return "", consumeerr
+		} else if !consumed {
+			return "", ErrNoMatchingToken
+		}
+	}
+
+	if revealerr := revealValue(&tok); revealerr != nil {
+		return "", revealerr
+	}
+	return PresentValue(tok, view)
+}
+
+// PurgeExpiredTokens removes tokens that have expired or used up their reads,
+// along with their history, returning the number of tokens removed
+func PurgeExpiredTokens() (int64, error) {
+	if UnitTest {
+		return 0, nil
+	}
+
+	now := time.Now().Unix()
+	var expired datastore.DataQueryGroup
+	expired.Operator = "and"
+	expired.DataQueries = []datastore.DataQuery{
+		{FieldName: "expiresAt", IsInt: true, IntValue: 0, Comparison: "gt"},
+		{FieldName: "expiresAt", IsInt: true, IntValue: now, Comparison: "lte"},
+	}
+	var exhausted datastore.DataQueryGroup
+	exhausted.Operator = "and"
+	exhausted.DataQueries = []datastore.DataQuery{
+		{FieldName: "maxReads", IsInt: true, IntValue: 0, Comparison: "gt"},
+		{FieldName: "readsRemaining", IsInt: true, IntValue: 0, Comparison: "lte"},
+	}
+
+	filter := []datastore.DataQueryGroup{expired, exhausted}
+	return purgeTokens(filter, "or")
+}
+
+// SweepExpiredTokens purges expired tokens on an interval, for the life of the service
+func SweepExpiredTokens() {
+	interval := time.Duration(getExpirySweepSeconds()) * time.Second
+	for range time.Tick(interval) {
+		if _, err := PurgeExpiredTokens(); err != nil {
+			fmt.Printf("expired token sweep failed: %s\n", fmt.Sprint(err))
+		}
+	}
+}
+
+func getExpirySweepSeconds() int64 {
+	configuration, configerr := systemconfig.Load()
+	if configerr != nil || configuration.ExpirySweepSeconds <= 0 {
+		return defaultExpirySweepSeconds
+	}
+	return configuration.ExpirySweepSeconds
+}
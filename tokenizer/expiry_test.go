@@ -0,0 +1,78 @@
+package tokenizer
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestCreateTokenFrom(t *testing.T) {
+	testScenarios := []struct {
+		givenToken          Token
+		expectedError       error
+		expectExpiry        bool
+		expectedReadsRemain int64
+	}{
+		{
+			givenToken: Token{Value: "forever"},
+		},
+		{
+			givenToken:   Token{Value: "short lived", TTLSeconds: 300},
+			expectExpiry: true,
+		},
+		{
+			givenToken:          Token{Value: "read once", MaxReads: 1},
+			expectedReadsRemain: 1,
+		},
+		{
+			givenToken:    Token{Value: "already gone", ExpiresAt: 1},
+			expectedError: ErrInvalidLifetime,
+		},
+		{
+			givenToken:    Token{Value: "negative reads", MaxReads: -1},
+			expectedError: ErrInvalidLifetime,
+		},
+	}
+
+	UnitTest = true
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			tok, err := CreateTokenFrom("mydomain", scenario.givenToken)
+			if want, got := scenario.expectedError, err; want != got {
+				t.Errorf("expect error %#v but got %#v", want, got)
+				return
+			}
+			if want, got := scenario.expectExpiry, tok.ExpiresAt > tok.Created; want != got {
+				t.Errorf("expect token to expire: %v, but got %#v", want, tok)
+			}
+			if tok.TTLSeconds != 0 {
+				t.Errorf("expect ttl to be turned into an expiry but got %#v", tok)
+			}
+			if want, got := scenario.expectedReadsRemain, tok.ReadsRemaining; want != got {
+				t.Errorf("expect %d reads remaining but got %d", want, got)
+			}
+		})
+	}
+}
+
+func TestIsLive(t *testing.T) {
+	var now int64 = 1700000000
+	testScenarios := []struct {
+		givenToken Token
+		expectLive bool
+	}{
+		{givenToken: Token{}, expectLive: true},
+		{givenToken: Token{ExpiresAt: now + 1}, expectLive: true},
+		{givenToken: Token{ExpiresAt: now}, expectLive: false},
+		{givenToken: Token{MaxReads: 2, ReadsRemaining: 1}, expectLive: true},
+		{givenToken: Token{MaxReads: 2, ReadsRemaining: 0}, expectLive: false},
+		{givenToken: Token{ExpiresAt: now - 1, MaxReads: 2, ReadsRemaining: 2}, expectLive: false},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if want, got := scenario.expectLive, isLive(scenario.givenToken, now); want != got {
+				t.Errorf("expect live %v but got %v for %#v", want, got, scenario.givenToken)
+			}
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package tokenizer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+	"tokentarpon/tokencrypto"
+	"tokentarpon/tokenizer/datastore"
+
+	"github.com/google/uuid"
+)
+
+// the longest token id an export list may hold
+const maxExportTokenIdBytes = 64
+
+// ExportSpec picks the tokens an export job detokenizes, either the listed
+// ones or every token in the domain, and the X25519 public key, base64
+// encoded, its output is encrypted to.
+type ExportSpec struct {
+	Tokens       []string `json:"tokens"`
+	All          bool     `json:"all"`
+	RecipientKey string   `json:"recipientKey"`
+}
+
+var (
+	ErrJobApprover = errors.New("data: an export must be approved by someone other than who asked for it")
+	ErrNoJobActor  = errors.New("data: an export needs the name of who asked for it")
+)
+
+// CreateExportJob stores the export's token list, if it has one, and leaves
+// the job awaiting approval. Nothing is detokenized until someone other than
+// the actor approves it.
+func CreateExportJob(domainUuid string, spec ExportSpec, actor string) (Job, error) {
+	var job Job
+	if len(strings.TrimSpace(domainUuid)) == 0 {
+		return job, errors.New("data: need domain id")
+	}
+	if len(strings.TrimSpace(actor)) == 0 {
+		return job, ErrNoJobActor
+	}
+	spec.RecipientKey = strings.TrimSpace(spec.RecipientKey)
+	var tokens []string
+	for _, token := range spec.Tokens {
+		if token = strings.TrimSpace(token); len(token) > 0 {
+			tokens = append(tokens, token)
+		}
+	}
+	spec.Tokens = tokens
+	if err := checkExportSpec(spec); err != nil {
+		return job, err
+	}
+	if err := checkDomainOpen(domainUuid); err != nil {
+		return job, err
+	}
+
+	now := time.Now().Unix()
+	job = Job{
+		Uuid:         uuid.New().String(),
+		DomainUuid:   domainUuid,
+		Kind:         JobKindExport,
+		Format:       JobFormatNDJSON,
+		Status:       JobAwaitingApproval,
+		RowErrors:    []JobRowError{},
+		CreatedBy:    actor,
+		Created:      now,
+		Updated:      now,
+		RecipientKey: spec.RecipientKey,
+		AllTokens:    spec.All,
+	}
+	var err error
+	if !spec.All {
+		job.InputBytes, err = writeJobInput(job.Uuid, strings.NewReader(strings.Join(spec.Tokens, "\n")+"\n"))
+	}
+	if err == nil {
+		err = insertJob(job)
+	}
+	if err != nil {
+		removeJobFiles(job.Uuid)
+		return job, err
+	}
+	return job, auditJob(AuditJobCreate, job, actor)
+}
+
+// checkExportSpec makes sure the export can be run, returning a FieldError when it can't
+func checkExportSpec(spec ExportSpec) error {
+	if spec.All == (len(spec.Tokens) > 0) {
+		return &FieldError{Field: "tokens", Message: "must list token ids, or all must be set, but not both"}
+	}
+	for _, token := range spec.Tokens {
+		if len(token) > maxExportTokenIdBytes || strings.ContainsAny(token, "\r\n") {
+			return &FieldError{Field: "tokens", Message: "has an invalid token id"}
+		}
+	}
+	// a key that can't be encrypted to is caught now, rather than when the job runs
+	if _, _, err := tokencrypto.NewRecipientFile(spec.RecipientKey); err != nil {
+		return &FieldError{Field: "recipientKey", Message: "must be a base64 encoded 32 byte X25519 public key"}
+	}
+	return nil
+}
+
+// ApproveJob queues an export awaiting approval. The approver can't be who asked for it.
+func ApproveJob(domainUuid string, jobUuid string, actor string) (Job, error) {
+	job, err := GetJob(domainUuid, jobUuid)
+	if err != nil {
+		return job, err
+	}
+	if len(strings.TrimSpace(actor)) == 0 || actor == job.CreatedBy {
+		return job, ErrJobApprover
+	}
+	return changeJobStatus(domainUuid, jobUuid, []string{JobAwaitingApproval}, AuditJobApprove, actor, func(job *Job) {
+		job.Status = JobQueued
+		job.ApprovedBy = actor
+		job.Approved = time.Now().Unix()
+	})
+}
+
+// processExportJob detokenizes the export's tokens from its last checkpoint,
+// a batch at a time, writing each batch out as a chunk of a recipient file
+// encrypted to the job's recipient key. Values are only held in memory for
+// the batch they are in. The file key is kept wrapped with the master key
+// while the job runs, and dropped once the final chunk is written, so after
+// that only the recipient can read the output.
+// A chunk sealed after the last checkpoint may have been written out, so
+// when there is one the export starts again, under a new file key.
+func processExportJob(job *Job) error {
+	if job.SealedChunks > job.Chunks {
+		restartExport(job)
+	}
+	output, err := openJobOutput(*job)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	var header []byte
+	var fileKey []byte
+	var sealedFileKey string
+	if job.OutputBytes == 0 {
+		fileKey, header, err = tokencrypto.NewRecipientFile(job.RecipientKey)
+		if err == nil {
+			sealedFileKey, err = sealExportFileKey(fileKey)
+		}
+	} else {
+		fileKey, err = openExportFileKey(job.SealedFileKey)
+	}
+	if err != nil {
+		return err
+	}
+
+	var lines *bufio.Scanner
+	counter := &countingReader{}
+	if !job.AllTokens {
+		input, openerr := os.Open(jobInputPath(job.Uuid))
+		if openerr != nil {
+			return openerr
+		}
+		defer input.Close()
+		counter.reader = input
+		lines = bufio.NewScanner(counter)
+		for skipped := int64(0); skipped < job.RowsDone; skipped++ {
+			if !lines.Scan() {
+				break
+			}
+		}
+	}
+
+	for {
+		if err = reserveExportChunk(job); err != nil {
+			return err
+		}
+		next := *job
+		var buffer bytes.Buffer
+		if next.OutputBytes == 0 {
+			buffer.Write(header)
+			next.SealedFileKey = sealedFileKey
+		}
+		done, batcherr := exportJobBatch(&next, lines, fileKey, &buffer)
+		if batcherr != nil {
+			return batcherr
+		}
+		next.BytesRead = counter.count
+		if done {
+			next.SealedFileKey = ""
+		}
+		if err = checkpointJob(job, next, output, buffer.Bytes()); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// exportJobBatch detokenizes up to a batch of the export's tokens and seals
+// them as the next chunk, a line of {"uuid", "value"} or {"uuid", "error"}
+// for each. The chunk is sealed as the final one once the tokens run out,
+// and it returns true.
+func exportJobBatch(job *Job, lines *bufio.Scanner, fileKey []byte, buffer *bytes.Buffer) (bool, error) {
+	var uuids []string
+	var err error
+	done := false
+	if job.AllTokens {
+		uuids, err = findExportTokens(job.DomainUuid, job.Cursor, int64(jobBatchRows))
+		if err != nil {
+			return false, err
+		}
+		done = len(uuids) < jobBatchRows
+	} else {
+		for len(uuids) < jobBatchRows && lines.Scan() {
+			uuids = append(uuids, lines.Text())
+		}
+		if err = lines.Err(); err != nil {
+			return false, err
+		}
+		done = len(uuids) < jobBatchRows
+	}
+
+	var plaintext bytes.Buffer
+	if len(uuids) > 0 {
+		values, geterr := getExportValues(job.DomainUuid, uuids)
+		if geterr != nil {
+			return false, geterr
+		}
+		encoder := json.NewEncoder(&plaintext)
+		encoder.SetEscapeHTML(false)
+		for _, result := range values.Results {
+			if err = encoder.Encode(result); err != nil {
+				return false, err
+			}
+			if len(result.Error) > 0 {
+				job.RowsFailed++
+			}
+		}
+		job.RowsDone += int64(len(uuids))
+		job.Cursor = uuids[len(uuids)-1]
+	}
+
+	chunk, err := tokencrypto.SealRecipientChunk(fileKey, uint64(job.Chunks), plaintext.Bytes(), done)
+	if err != nil {
+		return false, err
+	}
+	job.Chunks++
+	buffer.Write(chunk)
+	return done, nil
+}
+
+// getExportValues reads the tokens' full values without using up any reads, so
+// an export that is started again writes the same values. Tokens with a read
+// limit are never exported, and get ErrCodeReadLimited instead, as an export
+// can't count as a read when it may be written more than once.
+func getExportValues(domainUuid string, uuids []string) (TokenValues, error) {
+	if shrederr := checkDomainOpen(domainUuid); shrederr != nil {
+		return TokenValues{}, shrederr
+	}
+	found := make(map[string]Token)
+	if !UnitTest {
+		var geterr error
+		found, geterr = fetchLiveTokens(domainUuid, uuids)
+		if geterr != nil {
+			return TokenValues{}, geterr
+		}
+	}
+	return buildExportValues(uuids, found), nil
+}
+
+// buildExportValues is buildTokenValues in the full view, with read limited
+// tokens left unrevealed
+func buildExportValues(uuids []string, found map[string]Token) TokenValues {
+	readLimited := make(map[string]bool)
+	for tokenUuid, t := range found {
+		if t.MaxReads > 0 {
+			readLimited[tokenUuid] = true
+			delete(found, tokenUuid)
+		}
+	}
+	values := buildTokenValues(uuids, found, ValueView{Mode: ViewFull})
+	for idx, result := range values.Results {
+		if readLimited[strings.TrimSpace(result.Uuid)] {
+			values.Results[idx].Error = ErrCodeReadLimited
+		}
+	}
+	return values
+}
+
+// reserveExportChunk saves the job's next chunk counter as used, before the
+// chunk is sealed, as long as this worker still holds the job
+func reserveExportChunk(job *Job) error {
+	next := *job
+	next.SealedChunks = job.Chunks + 1
+	next.Updated = time.Now().Unix()
+	saved, err := saveJob(next, jobCondition{statuses: []string{JobRunning}, worker: jobWorkerId})
+	if err != nil {
+		return err
+	}
+	if !saved {
+		return errJobReleased
+	}
+	*job = next
+	return nil
+}
+
+// restartExport drops the export's progress, so its output is written again
+// from the start, with a new file key
+func restartExport(job *Job) {
+	job.BytesRead = 0
+	job.RowsDone = 0
+	job.RowsFailed = 0
+	job.OutputBytes = 0
+	job.SealedFileKey = ""
+	job.Chunks = 0
+	job.SealedChunks = 0
+	job.Cursor = ""
+}
+
+// findExportTokens returns the ids of up to limit of the domain's tokens that
+// aren't deleted, in order, from after the one given
+func findExportTokens(domainUuid string, afterUuid string, limit int64) ([]string, error) {
+	var uuids []string
+	if UnitTest {
+		return uuids, nil
+	}
+
+	filter := []datastore.DataQueryGroup{{
+		Operator: "and",
+		DataQueries: []datastore.DataQuery{
+			{FieldName: "domainUuid", FieldValue: domainUuid, CaseSensitive: true},
+			{FieldName: "isDeleted", IsBool: true, BoolValue: false},
+		},
+	}}
+	if len(afterUuid) > 0 {
+		filter[0].DataQueries = append(filter[0].DataQueries,
+			datastore.DataQuery{FieldName: "uuid", FieldValue: afterUuid, Comparison: "gt"})
+	}
+	byUuid := []datastore.DataSort{{FieldName: "uuid"}}
+	results, err := datastore.GetSortedRecordsIn(CollectionName, filter, "and", byUuid, 0, limit, erasureCandidate{})
+	if err != nil {
+		return uuids, err
+	}
+	for _, result := range results {
+		uuids = append(uuids, result.(erasureCandidate).Uuid)
+	}
+	return uuids, nil
+}
+
+func sealExportFileKey(fileKey []byte) (string, error) {
+	getEncryptionKey()
+	if len(encryptionKey) == 0 {
+		return "", ErrMasterKeyNotLoaded
+	}
+	return encryptWithKey(string(fileKey), encryptionKey)
+}
+
+func openExportFileKey(sealedFileKey string) ([]byte, error) {
+	getEncryptionKey()
+	if len(encryptionKey) == 0 {
+		return nil, ErrMasterKeyNotLoaded
+	}
+	fileKey, err := decryptWithKey(sealedFileKey, encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fileKey), nil
+}
@@ -0,0 +1,222 @@
+package tokenizer
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"tokentarpon/tokencrypto"
+)
+
+func TestCheckExportSpec(t *testing.T) {
+	publicKey, _, err := tokencrypto.GenerateRecipientKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testScenarios := []struct {
+		givenSpec   ExportSpec
+		expectField string
+	}{
+		{ExportSpec{Tokens: []string{"a1", "b2"}, RecipientKey: publicKey}, ""},
+		{ExportSpec{All: true, RecipientKey: publicKey}, ""},
+		{ExportSpec{RecipientKey: publicKey}, "tokens"},
+		{ExportSpec{Tokens: []string{"a1"}, All: true, RecipientKey: publicKey}, "tokens"},
+		{ExportSpec{Tokens: []string{strings.Repeat("a", 65)}, RecipientKey: publicKey}, "tokens"},
+		{ExportSpec{Tokens: []string{"a1"}}, "recipientKey"},
+		{ExportSpec{Tokens: []string{"a1"}, RecipientKey: "c2hvcnQ="}, "recipientKey"},
+		{ExportSpec{Tokens: []string{"a1"}, RecipientKey: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}, "recipientKey"},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			err := checkExportSpec(scenario.givenSpec)
+			if len(scenario.expectField) == 0 {
+				if err != nil {
+					t.Fatalf("expect no error but got %#v", err)
+				}
+				return
+			}
+			var fielderr *FieldError
+			if !errors.As(err, &fielderr) {
+				t.Fatalf("expect a field error but got %#v", err)
+			}
+			if want, got := scenario.expectField, fielderr.Field; want != got {
+				t.Errorf("expect field %s but got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestExportJobApproval(t *testing.T) {
+	UnitTest = true
+	t.Setenv("TMPDIR", t.TempDir())
+	publicKey, _, _ := tokencrypto.GenerateRecipientKeys()
+
+	if _, err := CreateExportJob("mydomain", ExportSpec{All: true, RecipientKey: publicKey}, ""); err != ErrNoJobActor {
+		t.Fatalf("expect an export without an actor refused but got %#v", err)
+	}
+	job, err := CreateExportJob("mydomain", ExportSpec{All: true, RecipientKey: publicKey}, "alice")
+	if err != nil {
+		t.Fatalf("expect no error but got %#v", err)
+	}
+
+	testScenarios := []struct {
+		givenStep    func() error
+		expectErr    error
+		expectStatus string
+	}{
+		{runQueuedJobs, nil, JobAwaitingApproval},
+		{func() error { _, err := ApproveJob("mydomain", job.Uuid, "alice"); return err }, ErrJobApprover, JobAwaitingApproval},
+		{func() error { _, err := ApproveJob("mydomain", job.Uuid, ""); return err }, ErrJobApprover, JobAwaitingApproval},
+		{func() error { _, err := ApproveJob("otherdomain", job.Uuid, "bob"); return err }, ErrNoSuchJob, JobAwaitingApproval},
+		{func() error { _, err := ApproveJob("mydomain", job.Uuid, "bob"); return err }, nil, JobQueued},
+		{func() error { _, err := ApproveJob("mydomain", job.Uuid, "carol"); return err }, ErrJobState, JobQueued},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if want, got := scenario.expectErr, scenario.givenStep(); want != got {
+				t.Fatalf("expect error %#v but got %#v", want, got)
+			}
+			stored, _ := GetJob("mydomain", job.Uuid)
+			if want, got := scenario.expectStatus, stored.Status; want != got {
+				t.Errorf("expect status %s but got %s", want, got)
+			}
+		})
+	}
+
+	job, _ = GetJob("mydomain", job.Uuid)
+	if want, got := "bob", job.ApprovedBy; want != got {
+		t.Errorf("expect approved by %s but got %s", want, got)
+	}
+	if err = DeleteJob("mydomain", job.Uuid, "alice"); err != nil {
+		t.Errorf("expect an export awaiting approval deleted but got %#v", err)
+	}
+}
+
+func TestExportJob(t *testing.T) {
+	UnitTest = true
+	encryptionKey = ";kldfpo87-28374isu;dfjhZXJCVG786"
+	defer func() { encryptionKey = "" }()
+	jobBatchRows = 2
+	defer func() { jobBatchRows = 500 }()
+
+	testScenarios := []struct {
+		// whether the next chunk's counter was saved as used before the worker stopped
+		givenReserved bool
+		expectNewKey  bool
+	}{
+		{false, false},
+		{true, true},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Setenv("TMPDIR", t.TempDir())
+			publicKey, privateKey, _ := tokencrypto.GenerateRecipientKeys()
+			spec := ExportSpec{Tokens: []string{"a1", " ", "b2", "c3"}, RecipientKey: publicKey}
+			job, err := CreateExportJob("mydomain", spec, "alice")
+			if err != nil {
+				t.Fatalf("expect no error but got %#v", err)
+			}
+			if _, err = ApproveJob("mydomain", job.Uuid, "bob"); err != nil {
+				t.Fatalf("expect no error but got %#v", err)
+			}
+
+			// stop after the first checkpoint, part way through writing the next chunk
+			claimed, err := claimJob()
+			if err != nil {
+				t.Fatal(err)
+			}
+			output, _ := openJobOutput(claimed)
+			next := claimed
+			var buffer bytes.Buffer
+			fileKey, header, _ := tokencrypto.NewRecipientFile(publicKey)
+			buffer.Write(header)
+			next.SealedFileKey, _ = sealExportFileKey(fileKey)
+			next.SealedChunks = 1
+			lines, _ := os.Open(jobInputPath(job.Uuid))
+			defer lines.Close()
+			if _, err = exportJobBatch(&next, bufio.NewScanner(lines), fileKey, &buffer); err != nil {
+				t.Fatal(err)
+			}
+			if err = checkpointJob(&claimed, next, output, buffer.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			output.Write([]byte("half a chunk"))
+			output.Close()
+			claimed.LeaseUntil = 0
+			if scenario.givenReserved {
+				claimed.SealedChunks = claimed.Chunks + 1
+			}
+			if _, err = saveJob(claimed, jobCondition{statuses: []string{JobRunning}}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = runQueuedJobs(); err != nil {
+				t.Fatalf("expect jobs to run but got %#v", err)
+			}
+			job, _ = GetJob("mydomain", job.Uuid)
+			if want, got := JobCompleted, job.Status; want != got {
+				t.Fatalf("expect status %s but got %s: %s", want, got, job.Error)
+			}
+			if want, got := int64(3), job.RowsDone; want != got {
+				t.Errorf("expect %d tokens exported but got %d", want, got)
+			}
+			if len(job.SealedFileKey) > 0 {
+				t.Errorf("expect the file key dropped once the export completed")
+			}
+
+			path, _ := JobOutputPath(job)
+			written, _ := os.ReadFile(path)
+			if want, got := scenario.expectNewKey, !bytes.HasPrefix(written, header); want != got {
+				t.Errorf("expect the export started again under a new key %t but got %t", want, got)
+			}
+			var plaintext bytes.Buffer
+			if err = tokencrypto.OpenRecipientFile(bytes.NewReader(written), privateKey, &plaintext); err != nil {
+				t.Fatalf("expect the output to open but got %#v", err)
+			}
+			// unit tests have no stored tokens, so every token is exported as not found
+			expect := "{\"uuid\":\"a1\",\"error\":\"not_found\"}\n{\"uuid\":\"b2\",\"error\":\"not_found\"}\n{\"uuid\":\"c3\",\"error\":\"not_found\"}\n"
+			if want, got := expect, plaintext.String(); want != got {
+				t.Errorf("expect output %q but got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestBuildExportValues(t *testing.T) {
+	found := map[string]Token{
+		"a1": {Uuid: "a1", Value: "jane@example.com"},
+		"b2": {Uuid: "b2", Value: "4242424242424242", MaxReads: 3, ReadsRemaining: 3},
+	}
+	values := buildExportValues([]string{"a1", "b2", "c3"}, found)
+
+	testScenarios := []struct {
+		expectValue string
+		expectError string
+	}{
+		{"jane@example.com", ""},
+		// read limited tokens are never exported
+		{"", ErrCodeReadLimited},
+		{"", ErrCodeNotFound},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if want, got := scenario.expectValue, values.Results[i].Value; want != got {
+				t.Errorf("expect value %s but got %s", want, got)
+			}
+			if want, got := scenario.expectError, values.Results[i].Error; want != got {
+				t.Errorf("expect error %s but got %s", want, got)
+			}
+		})
+	}
+	if want, got := 2, values.Failed; want != got {
+		t.Errorf("expect %d failed but got %d", want, got)
+	}
+}
@@ -2,7 +2,13 @@ module tokentarpon/tokenizer
 
 go 1.18
 
-require github.com/google/uuid v1.3.0
+require (
+	github.com/google/uuid v1.3.0
+	tokentarpon/tokencrypto v0.0.0-00010101000000-000000000000
+	tokentarpon/tokenizer/datalog v0.0.0-00010101000000-000000000000
+	tokentarpon/tokenizer/datastore v0.0.0-00010101000000-000000000000
+	tokentarpon/tokenizer/systemconfig v0.0.0-00010101000000-000000000000
+)
 
 require (
 	github.com/golang/snappy v0.0.1 // indirect
@@ -17,8 +23,6 @@ require (
 	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
 	golang.org/x/text v0.3.7 // indirect
-	tokentarpon/tokencrypto v0.0.0-00010101000000-000000000000 // indirect
-	tokentarpon/tokenizer/datastore v0.0.0-00010101000000-000000000000 // indirect
 	tokentarpon/tokenizer/datastore/datastoremongo v0.0.0 // indirect
 )
 
@@ -29,3 +33,5 @@ replace tokentarpon/tokenizer/datastore => ./datastore
 replace tokentarpon/tokenizer/datastore/datastoremongo => ./datastore/datastoremongo
 
 replace tokentarpon/tokenizer/systemconfig => ./systemconfig
+
+replace tokentarpon/tokenizer/datalog => ./datalog
@@ -0,0 +1,227 @@
+package tokenizer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+	"tokentarpon/tokenizer/datastore"
+	"tokentarpon/tokenizer/systemconfig"
+)
+
+var idempotencyCollectionName = "idempotency"
+var idempotencyRecordType = "idempotency"
+var defaultIdempotencyWindowSeconds int64 = 86400
+
+// IdempotencyRecord remembers the first request made with an idempotency key
+// and the response that was sent for it, so retries can be answered the same way.
+// ExpiresAt is a date rather than a unix time so mongodb can expire it with a TTL index.
+// A response holds token values, so it is stored encrypted with the domain key
+// like the tokens themselves, and TokenUuids lists the tokens in it, so the
+// record is deleted along with them when they are erased or purged.
+type IdempotencyRecord struct {
+	Key         string    `bson:"key" json:"key"`
+	DomainUuid  string    `bson:"domainUuid" json:"domainUuid"`
+	Fingerprint string    `bson:"fingerprint" json:"fingerprint"`
+	Completed   bool      `bson:"completed" json:"completed"`
+	Status      int       `bson:"status" json:"status"`
+	Response    string    `bson:"response" json:"response"`
+	KeyId       string    `bson:"keyId" json:"keyId"`
+	TokenUuids  []string  `bson:"tokenUuids" json:"tokenUuids"`
+	Created     int64     `bson:"created" json:"created"`
+	ExpiresAt   time.Time `bson:"expiresAt" json:"expiresAt"`
+}
+
+// the fields set once the original request has been answered
+type idempotencyResponse struct {
+	Completed  bool     `bson:"completed"`
+	Status     int      `bson:"status"`
+	Response   string   `bson:"response"`
+	KeyId      string   `bson:"keyId"`
+	TokenUuids []string `bson:"tokenUuids"`
+}
+
+var idempotencyIndexes = []datastore.DataIndex{
+	{Fields: []string{"domainUuid", "key"}, Unique: true},
+	{Fields: []string{"expiresAt"}, Expires: true, ExpireAfterSeconds: 0},
+	{Fields: []string{"domainUuid", "tokenUuids"}},
+}
+
+var (
+	ErrIdempotencyKeyReused  = errors.New("idempotency key was already used for a different request")
+	ErrIdempotencyInProgress = errors.New("a request with this idempotency key is still in progress")
+)
+
+// RequestFingerprint hashes the parts of a request that must match
+// for a retry to be treated as the same request
+func RequestFingerprint(parts ...string) string {
+	hasher := sha256.New()
+	for _, part := range parts {
+		hasher.Write([]byte(part))
+		hasher.Write([]byte{0})
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// BeginIdempotentRequest claims an idempotency key for a request.
+// If the key was already used for the same request and that request has
+// finished, the stored record is returned with replay set so its response
+// can be sent again. A key reused for a different request returns
+// ErrIdempotencyKeyReused, and a key whose first request is still running
+// returns ErrIdempotencyInProgress.
+func BeginIdempotentRequest(domainUuid string, key string, fingerprint string) (IdempotencyRecord, bool, error) {
+	var record IdempotencyRecord
+	err := errors.New("data: need domain id, idempotency key")
+	if len(strings.TrimSpace(domainUuid)) == 0 {
+		return record, false, err
+	}
+	if len(strings.TrimSpace(key)) == 0 {
+		return record, false, err
+	}
+
+	now := time.Now()
+	record = IdempotencyRecord{
+		Key:         key,
+		DomainUuid:  domainUuid,
+		Fingerprint: fingerprint,
+		Created:     now.Unix(),
+		ExpiresAt:   now.Add(time.Duration(getIdempotencyWindowSeconds()) * time.Second),
+	}
+	if UnitTest {
+		return record, false, nil
+	}
+
+	filter := makeIdempotencyQuery(domainUuid, key)
+	// a second attempt covers a stored record that expired
+	// but has not yet been removed by the TTL index
+	for attempt := 0; attempt < 2; attempt++ {
+		inserterr := datastore.InsertRecordIn(idempotencyCollectionName, idempotencyRecordType, record)
+		if inserterr == nil {
+			return record, false, nil
+		} else if inserterr != datastore.ErrConflict {
+			return record, false, inserterr
+		}
+
+		var existing IdempotencyRecord
+		geterr := datastore.GetRecordIn(idempotencyCollectionName, filter, &existing)
+		if geterr == datastore.ErrNotFound {
+			continue
+		} else if geterr != nil {
+			return record, false, geterr
+		}
+
+		if existing.ExpiresAt.Before(now) {
+			if _, deleteerr := datastore.DeleteRecordsIn(idempotencyCollectionName, filter, "and"); deleteerr != nil {
+				return record, false, deleteerr
+			}
+			continue
+		}
+		if existing.Fingerprint != fingerprint {
+			return existing, false, ErrIdempotencyKeyReused
+		}
+		if !existing.Completed {
+			return existing, false, ErrIdempotencyInProgress
+		}
+		response, openerr := openIdempotentResponse(existing)
+		if openerr != nil {
+			return existing, false, openerr
+		}
+		existing.Response = response
+		return existing, true, nil
+	}
+	return record, false, ErrIdempotencyInProgress
+}
+
+// CompleteIdempotentRequest stores the response sent for the request
+// that claimed the key, so it can be replayed for retries, along with the
+// ids of the tokens it holds. The response is encrypted with the domain key
+// when the service is configured to encrypt stored values.
+func CompleteIdempotentRequest(domainUuid string, key string, status int, response string, tokenUuids []string) error {
+	if UnitTest {
+		return nil
+	}
+	result := idempotencyResponse{Completed: true, Status: status, Response: response, TokenUuids: tokenUuids}
+	if getEncryptValues() {
+		var sealerr error
+		result.Response, result.KeyId, sealerr = sealIdempotentResponse(domainUuid, response)
+		if sealerr != nil {
+			return sealerr
+		}
+	}
+	filter := makeIdempotencyQuery(domainUuid, key)
+	_, err := datastore.UpdateRecordIn(idempotencyCollectionName, idempotencyRecordType, filter, "and", result)
+	return err
+}
+
+// sealIdempotentResponse encrypts a response with the domain key, returning the key's id
+func sealIdempotentResponse(domainUuid string, response string) (string, string, error) {
+	material, err := loadDomainKey(domainUuid, true)
+	if err != nil {
+		return "", "", err
+	}
+	sealed, err := encryptWithKey(response, material.key)
+	return sealed, material.keyId, err
+}
+
+// openIdempotentResponse returns the record's response, decrypted if it was
+// stored encrypted. A shredded domain's responses can't be replayed.
+func openIdempotentResponse(record IdempotencyRecord) (string, error) {
+	if len(record.KeyId) == 0 {
+		return record.Response, nil
+	}
+	material, err := domainKeyFor(record.DomainUuid, record.KeyId)
+	if err != nil {
+		return "", err
+	}
+	return decryptWithKey(record.Response, material.key)
+}
+
+// deleteIdempotencyRecords deletes the domain's records whose response holds any of the tokens
+func deleteIdempotencyRecords(domainUuid string, tokenUuids []string) error {
+	if len(tokenUuids) == 0 {
+		return nil
+	}
+	filter := makeTokenUuidsQuery(domainUuid, tokenUuids)
+	for idx := range filter[0].DataQueryGroups[0].DataQueries {
+		filter[0].DataQueryGroups[0].DataQueries[idx].FieldName = "tokenUuids"
+	}
+	_, err := datastore.DeleteRecordsIn(idempotencyCollectionName, filter, "and")
+	return err
+}
+
+// AbandonIdempotentRequest releases the key when the request failed
+// in a way that should not be replayed, so the caller can retry it
+func AbandonIdempotentRequest(domainUuid string, key string) error {
+	if UnitTest {
+		return nil
+	}
+	filter := makeIdempotencyQuery(domainUuid, key)
+	_, err := datastore.DeleteRecordsIn(idempotencyCollectionName, filter, "and")
+	return err
+}
+
+func makeIdempotencyQuery(domainUuid string, key string) []datastore.DataQueryGroup {
+	var filters = make([]datastore.DataQueryGroup, 1)
+	var nvq datastore.DataQueryGroup
+
+	nvq.Operator = "and"
+	nvq.DataQueries = make([]datastore.DataQuery, 2)
+	nvq.DataQueries[0].FieldName = "domainUuid"
+	nvq.DataQueries[0].FieldValue = domainUuid
+	nvq.DataQueries[0].CaseSensitive = true
+	nvq.DataQueries[1].FieldName = "key"
+	nvq.DataQueries[1].FieldValue = key
+	nvq.DataQueries[1].CaseSensitive = true
+
+	filters[0] = nvq
+	return filters
+}
+
+func getIdempotencyWindowSeconds() int64 {
+	configuration, configerr := systemconfig.Load()
+	if configerr != nil || configuration.IdempotencyWindowSeconds <= 0 {
+		return defaultIdempotencyWindowSeconds
+	}
+	return configuration.IdempotencyWindowSeconds
+}
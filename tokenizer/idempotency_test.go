@@ -0,0 +1,101 @@
+package tokenizer
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRequestFingerprint(t *testing.T) {
+	testScenarios := []struct {
+		givenFirst, givenSecond []string
+		expectedMatch           bool
+	}{
+		{
+			givenFirst:    []string{"PUT", "/tokens/mydomain", `[{"value":"abc"}]`},
+			givenSecond:   []string{"PUT", "/tokens/mydomain", `[{"value":"abc"}]`},
+			expectedMatch: true,
+		},
+		{
+			givenFirst:  []string{"PUT", "/tokens/mydomain", `[{"value":"abc"}]`},
+			givenSecond: []string{"PUT", "/tokens/mydomain", `[{"value":"abd"}]`},
+		},
+		{
+			// parts are delimited, so shifting bytes between them changes the fingerprint
+			givenFirst:  []string{"PUT", "/tokens/mydomain", "ab"},
+			givenSecond: []string{"PUT", "/tokens/mydomaina", "b"},
+		},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			first := RequestFingerprint(scenario.givenFirst...)
+			second := RequestFingerprint(scenario.givenSecond...)
+			if want, got := scenario.expectedMatch, first == second; want != got {
+				t.Errorf("expect fingerprints to match: %v, but got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestBeginIdempotentRequest(t *testing.T) {
+	UnitTest = true
+
+	_, _, err := BeginIdempotentRequest("mydomain", " ", "fingerprint")
+	if err == nil {
+		t.Error("expect an error for a blank idempotency key")
+	}
+
+	record, replay, err := BeginIdempotentRequest("mydomain", "retry-1", "fingerprint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replay {
+		t.Error("expect a new key not to be replayed")
+	}
+	if record.Created == 0 || record.ExpiresAt.Unix() <= record.Created {
+		t.Errorf("expect the record to expire after it was created but got %#v", record)
+	}
+}
+
+func TestIdempotentResponseSealing(t *testing.T) {
+	UnitTest = true
+	encryptionKey = ";kldfpo87-28374isu;dfjhZXJCVG786"
+	defer func() { encryptionKey = "" }()
+	response := `[{"uuid":"a1","value":"jane@example.com"}]`
+
+	sealed, keyId, err := sealIdempotentResponse("replaydomain", response)
+	if err != nil {
+		t.Fatalf("expect no error but got %#v", err)
+	}
+	if len(keyId) == 0 || strings.Contains(sealed, "jane@example.com") {
+		t.Fatalf("expect the response stored encrypted but got %s", sealed)
+	}
+
+	testScenarios := []struct {
+		givenRecord    IdempotencyRecord
+		expectResponse string
+	}{
+		{IdempotencyRecord{DomainUuid: "replaydomain", Response: sealed, KeyId: keyId}, response},
+		{IdempotencyRecord{DomainUuid: "replaydomain", Response: response}, response},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			opened, err := openIdempotentResponse(scenario.givenRecord)
+			if err != nil {
+				t.Fatalf("expect no error but got %#v", err)
+			}
+			if want, got := scenario.expectResponse, opened; want != got {
+				t.Errorf("expect response %s but got %s", want, got)
+			}
+		})
+	}
+
+	if _, err = ShredDomain("replaydomain", "replaydomain", "ops"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = openIdempotentResponse(testScenarios[0].givenRecord); err != ErrDomainShredded {
+		t.Errorf("expect a shredded domain's response not replayed but got %#v", err)
+	}
+}
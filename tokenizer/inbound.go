@@ -0,0 +1,366 @@
+package tokenizer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"tokentarpon/tokenizer/datalog"
+	"tokentarpon/tokenizer/datastore"
+)
+
+var inboundRouteCollectionName = "inboundroutes"
+var inboundRouteRecordType = "inboundroute"
+
+var inboundRouteIndexes = []datastore.DataIndex{
+	{Fields: []string{"name"}, Unique: true},
+}
+
+// audit actions recorded when inbound routes are changed, and for each request one rewrites
+const (
+	AuditInboundRouteSave   = "inbound.route.save"
+	AuditInboundRouteDelete = "inbound.route.delete"
+	AuditInboundRewrite     = "inbound.rewrite"
+)
+
+var inboundRouteNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_\-]{0,63}$`)
+
+// InboundField names a form field or header to tokenize, with the value type
+// its values are tokenized as
+type InboundField struct {
+	Name      string `bson:"name" json:"name"`
+	ValueType string `bson:"valueType" json:"valueType"`
+}
+
+// UnmarshalJSON takes a field given as just its name, as well as the full object
+func (f *InboundField) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		f.Name = name
+		return nil
+	}
+	type field InboundField
+	return json.Unmarshal(data, (*field)(f))
+}
+
+// InboundRoute receives requests from a third party, such as a partner's
+// webhooks, at /inbound/<Name>, tokenizes the fields it lists into its domain,
+// and forwards the request to Target, an internal service.
+type InboundRoute struct {
+	Name       string          `bson:"name" json:"name"`
+	DomainUuid string          `bson:"domainUuid" json:"domainUuid"`
+	Target     string          `bson:"target" json:"target"`
+	Paths      []FieldSelector `bson:"paths" json:"paths"`
+	FormFields []InboundField  `bson:"formFields" json:"formFields"`
+	Headers    []InboundField  `bson:"headers" json:"headers"`
+	Created    int64           `bson:"created" json:"created"`
+	Updated    int64           `bson:"updated" json:"updated"`
+	UpdatedBy  string          `bson:"updatedBy" json:"updatedBy"`
+}
+
+// InboundMessage is the parts of a request an inbound route can tokenize.
+// Form is only set for form bodies, and Document only for JSON bodies.
+type InboundMessage struct {
+	Header   map[string][]string
+	Form     map[string][]string
+	Document json.RawMessage
+}
+
+var ErrNoInboundRoute = errors.New("data: no inbound route with this name")
+
+// routes are kept in memory when unit testing
+var unitTestInboundRoutes = make(map[string]InboundRoute)
+var unitTestInboundRoutesMutex sync.Mutex
+
+// SaveInboundRoute creates the route, or replaces the route with the same name.
+// The change is recorded in the audit log under the actor.
+func SaveInboundRoute(route InboundRoute, actor string) (InboundRoute, error) {
+	route = normalizeInboundRoute(route)
+	if err := CheckInboundRoute(route); err != nil {
+		return route, err
+	}
+
+	now := time.Now().Unix()
+	route.Created = now
+	route.Updated = now
+	route.UpdatedBy = actor
+	if UnitTest {
+		unitTestInboundRoutesMutex.Lock()
+		defer unitTestInboundRoutesMutex.Unlock()
+		if existing, ok := unitTestInboundRoutes[route.Name]; ok {
+			route.Created = existing.Created
+		}
+		unitTestInboundRoutes[route.Name] = route
+		return route, nil
+	}
+
+	existing, geterr := GetInboundRoute(route.Name)
+	if geterr == nil {
+		route.Created = existing.Created
+		if _, updateerr := datastore.UpdateRecordIn(inboundRouteCollectionName, inboundRouteRecordType,
+			makeInboundRouteQuery(route.Name), "and", route); updateerr != nil {
+			return route, updateerr
+		}
+	} else if geterr != ErrNoInboundRoute {
+		return route, geterr
+	} else if inserterr := datastore.InsertRecordIn(inboundRouteCollectionName, inboundRouteRecordType, route); inserterr != nil {
+		return route, inserterr
+	}
+
+	_, auditerr := datalog.Write(datalog.Entry{
+		Action:     AuditInboundRouteSave,
+		DomainUuid: route.DomainUuid,
+		Actor:      actor,
+		Details:    inboundRouteDetails(route),
+	})
+	return route, auditerr
+}
+
+// GetInboundRoute returns the route with the name, or ErrNoInboundRoute
+func GetInboundRoute(name string) (InboundRoute, error) {
+	var route InboundRoute
+	name = strings.ToLower(strings.TrimSpace(name))
+	if UnitTest {
+		unitTestInboundRoutesMutex.Lock()
+		defer unitTestInboundRoutesMutex.Unlock()
+		route, ok := unitTestInboundRoutes[name]
+		if !ok {
+			return route, ErrNoInboundRoute
+		}
+		return route, nil
+	}
+
+	geterr := datastore.GetRecordIn(inboundRouteCollectionName, makeInboundRouteQuery(name), &route)
+	if geterr == datastore.ErrNotFound {
+		return route, ErrNoInboundRoute
+	}
+	return route, geterr
+}
+
+// ListInboundRoutes returns a page of the routes, ordered by name
+func ListInboundRoutes(start int64, limit int64) ([]InboundRoute, error) {
+	routes := []InboundRoute{}
+	if UnitTest {
+		return routes, nil
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	sort := []datastore.DataSort{{FieldName: "name"}}
+	// every route has a name, so this matches them all
+	filter := []datastore.DataQueryGroup{{Operator: "and", DataQueries: []datastore.DataQuery{
+		{FieldName: "name", FieldValue: "", Comparison: "gt"},
+	}}}
+	results, geterr := datastore.GetSortedRecordsIn(inboundRouteCollectionName, filter, "and", sort, start, limit, InboundRoute{})
+	if geterr != nil {
+		return routes, geterr
+	}
+	for _, result := range results {
+		routes = append(routes, result.(InboundRoute))
+	}
+	return routes, nil
+}
+
+// DeleteInboundRoute removes the route, recording it in the audit log under the actor
+func DeleteInboundRoute(name string, actor string) error {
+	route, geterr := GetInboundRoute(name)
+	if geterr != nil {
+		return geterr
+	}
+	if UnitTest {
+		unitTestInboundRoutesMutex.Lock()
+		defer unitTestInboundRoutesMutex.Unlock()
+		delete(unitTestInboundRoutes, route.Name)
+		return nil
+	}
+
+	deleted, deleteerr := datastore.DeleteRecordsIn(inboundRouteCollectionName, makeInboundRouteQuery(route.Name), "and")
+	if deleteerr != nil {
+		return deleteerr
+	} else if deleted == 0 {
+		return ErrNoInboundRoute
+	}
+	_, auditerr := datalog.Write(datalog.Entry{
+		Action:     AuditInboundRouteDelete,
+		DomainUuid: route.DomainUuid,
+		Actor:      actor,
+		Details:    inboundRouteDetails(route),
+	})
+	return auditerr
+}
+
+// CheckInboundRoute makes sure the route can be saved, returning a FieldError when it can't
+func CheckInboundRoute(route InboundRoute) error {
+	if !inboundRouteNamePattern.MatchString(route.Name) {
+		return &FieldError{Field: "name", Message: "must be 1 to 64 lowercase letters, digits, - or _"}
+	}
+	if len(strings.TrimSpace(route.DomainUuid)) == 0 {
+		return &FieldError{Field: "domainUuid", Message: "must not be blank"}
+	}
+	target, err := url.Parse(route.Target)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || len(target.Host) == 0 {
+		return &FieldError{Field: "target", Message: "must be an absolute http or https url"}
+	}
+	if len(route.Paths)+len(route.FormFields)+len(route.Headers) == 0 {
+		return &FieldError{Field: "paths", Message: "must list the paths, form fields or headers to tokenize"}
+	}
+
+	var fieldTypes []string
+	for _, selector := range route.Paths {
+		if _, parseerr := parseSelector(selector.Path); parseerr != nil {
+			return &FieldError{Field: "paths", Message: "has an invalid path: " + selector.Path}
+		}
+		fieldTypes = append(fieldTypes, selector.ValueType)
+	}
+	for _, field := range route.FormFields {
+		if len(field.Name) == 0 {
+			return &FieldError{Field: "formFields", Message: "must not have a blank name"}
+		}
+		fieldTypes = append(fieldTypes, field.ValueType)
+	}
+	for _, field := range route.Headers {
+		if len(field.Name) == 0 {
+			return &FieldError{Field: "headers", Message: "must not have a blank name"}
+		}
+		fieldTypes = append(fieldTypes, field.ValueType)
+	}
+	for _, valueType := range fieldTypes {
+		if len(valueType) == 0 {
+			continue
+		}
+		if !knownValueType(valueType) {
+			return &FieldError{Field: "valueType", Message: "is not a known value type: " + valueType}
+		}
+	}
+	return nil
+}
+
+// TokenizeInbound tokenizes the route's fields in the message into the
+// route's domain, in a single batch, replacing each value with its token id.
+// Fields missing from the message are skipped. A value that can't be
+// tokenized fails the whole message with a FieldError naming the field,
+// so nothing is forwarded with its raw value. Each rewrite is recorded in
+// the audit log, naming the fields that were tokenized but never their values.
+func TokenizeInbound(route InboundRoute, message InboundMessage) (InboundMessage, error) {
+	var fields []documentField
+	for _, header := range route.Headers {
+		values := message.Header[header.Name]
+		for idx := range values {
+			idx := idx
+			setValue := func(value interface{}) { values[idx] = value.(string) }
+			fields = append(fields, documentField{path: "header " + header.Name, value: values[idx], valueType: header.ValueType, set: setValue})
+		}
+	}
+	for _, formField := range route.FormFields {
+		values := message.Form[formField.Name]
+		for idx := range values {
+			idx := idx
+			setValue := func(value interface{}) { values[idx] = value.(string) }
+			fields = append(fields, documentField{path: "form " + formField.Name, value: values[idx], valueType: formField.ValueType, set: setValue})
+		}
+	}
+	var document interface{}
+	if len(message.Document) > 0 && len(route.Paths) > 0 {
+		var documentFields []documentField
+		var selecterr error
+		document, documentFields, selecterr = selectDocumentFields(DocumentRequest{Document: message.Document, Selectors: route.Paths})
+		if selecterr != nil {
+			return message, selecterr
+		}
+		fields = append(fields, documentFields...)
+	}
+
+	if _, err := tokenizeFields(route.DomainUuid, fields); err != nil {
+		return message, err
+	}
+	if document != nil {
+		// the rest of the document is passed on as it was sent, so <, > and &
+		// in its strings aren't escaped the way json.Marshal would
+		var rewritten bytes.Buffer
+		encoder := json.NewEncoder(&rewritten)
+		encoder.SetEscapeHTML(false)
+		if encodeerr := encoder.Encode(document); encodeerr != nil {
+			return message, encodeerr
+		}
+		message.Document = bytes.TrimRight(rewritten.Bytes(), "\n")
+	}
+
+	if UnitTest {
+		return message, nil
+	}
+	paths := make([]string, len(fields))
+	for idx, field := range fields {
+		paths[idx] = field.path
+	}
+	_, auditerr := datalog.Write(datalog.Entry{
+		Action:     AuditInboundRewrite,
+		DomainUuid: route.DomainUuid,
+		Actor:      "inbound:" + route.Name,
+		Details: map[string]string{
+			"route":  route.Name,
+			"target": route.Target,
+			"fields": strconv.Itoa(len(fields)),
+			"paths":  strings.Join(paths, ","),
+		},
+	})
+	return message, auditerr
+}
+
+// normalizeInboundRoute puts names and value types in the form they are matched in
+func normalizeInboundRoute(route InboundRoute) InboundRoute {
+	route.Name = strings.ToLower(strings.TrimSpace(route.Name))
+	route.DomainUuid = strings.TrimSpace(route.DomainUuid)
+	route.Target = strings.TrimSpace(route.Target)
+	for idx := range route.Paths {
+		route.Paths[idx].ValueType = strings.ToLower(strings.TrimSpace(route.Paths[idx].ValueType))
+	}
+	for idx := range route.FormFields {
+		route.FormFields[idx].ValueType = strings.ToLower(strings.TrimSpace(route.FormFields[idx].ValueType))
+	}
+	for idx := range route.Headers {
+		route.Headers[idx].Name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(route.Headers[idx].Name))
+		route.Headers[idx].ValueType = strings.ToLower(strings.TrimSpace(route.Headers[idx].ValueType))
+	}
+	return route
+}
+
+func inboundRouteDetails(route InboundRoute) map[string]string {
+	paths := make([]string, len(route.Paths))
+	for idx, selector := range route.Paths {
+		paths[idx] = selector.Path
+	}
+	formFields := make([]string, len(route.FormFields))
+	for idx, field := range route.FormFields {
+		formFields[idx] = field.Name
+	}
+	headers := make([]string, len(route.Headers))
+	for idx, field := range route.Headers {
+		headers[idx] = field.Name
+	}
+	return map[string]string{
+		"route":      route.Name,
+		"target":     route.Target,
+		"paths":      strings.Join(paths, ","),
+		"formFields": strings.Join(formFields, ","),
+		"headers":    strings.Join(headers, ","),
+	}
+}
+
+func makeInboundRouteQuery(name string) []datastore.DataQueryGroup {
+	var filters = make([]datastore.DataQueryGroup, 1)
+	var nvq datastore.DataQueryGroup
+
+	nvq.Operator = "and"
+	nvq.DataQueries = []datastore.DataQuery{
+		{FieldName: "name", FieldValue: name, CaseSensitive: true},
+	}
+	filters[0] = nvq
+	return filters
+}
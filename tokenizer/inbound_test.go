@@ -0,0 +1,121 @@
+package tokenizer
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCheckInboundRoute(t *testing.T) {
+	valid := InboundRoute{Name: "stripe", DomainUuid: "mydomain", Target: "http://billing.internal:8080/hooks", Paths: []FieldSelector{{Path: "$.data.email", ValueType: "email"}}}
+
+	testScenarios := []struct {
+		givenChange func(route *InboundRoute)
+		expectField string
+	}{
+		{func(route *InboundRoute) {}, ""},
+		{func(route *InboundRoute) { route.Name = "Stripe Hooks" }, "name"},
+		{func(route *InboundRoute) { route.DomainUuid = " " }, "domainUuid"},
+		{func(route *InboundRoute) { route.Target = "billing.internal/hooks" }, "target"},
+		{func(route *InboundRoute) { route.Paths = nil }, "paths"},
+		{func(route *InboundRoute) { route.Paths = []FieldSelector{{Path: "data.email"}} }, "paths"},
+		{func(route *InboundRoute) {
+			route.Paths = nil
+			route.Headers = []InboundField{{Name: "X-Card", ValueType: "pan"}}
+		}, ""},
+		{func(route *InboundRoute) { route.FormFields = []InboundField{{Name: ""}} }, "formFields"},
+		{func(route *InboundRoute) { route.FormFields = []InboundField{{Name: "ssn", ValueType: "shoesize"}} }, "valueType"},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			route := valid
+			scenario.givenChange(&route)
+			err := CheckInboundRoute(route)
+			var fielderr *FieldError
+			if len(scenario.expectField) == 0 {
+				if err != nil {
+					t.Fatalf("expect no error but got %#v", err)
+				}
+				return
+			}
+			if !errors.As(err, &fielderr) {
+				t.Fatalf("expect a field error but got %#v", err)
+			}
+			if want, got := scenario.expectField, fielderr.Field; want != got {
+				t.Errorf("expect field %s but got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestTokenizeInbound(t *testing.T) {
+	UnitTest = true
+	route := normalizeInboundRoute(InboundRoute{
+		Name:       "partner",
+		DomainUuid: "mydomain",
+		Target:     "http://localhost:9000",
+		Paths:      []FieldSelector{{Path: "$.customer.email", ValueType: "email"}},
+		FormFields: []InboundField{{Name: "ssn", ValueType: "ssn"}},
+		Headers:    []InboundField{{Name: "x-card-number", ValueType: "pan"}},
+	})
+
+	testScenarios := []struct {
+		givenMessage InboundMessage
+		expectRaw    []string
+		expectErr    string
+	}{
+		{InboundMessage{
+			Header:   map[string][]string{"X-Card-Number": {"4242 4242 4242 4242"}, "X-Event": {"paid"}},
+			Document: json.RawMessage(`{"customer": {"email": "Jane@Example.com", "name": "Jane"}}`),
+		}, []string{"4242", "Jane@Example.com"}, ""},
+		{InboundMessage{Form: map[string][]string{"ssn": {"123-45-6789"}, "plan": {"gold"}}}, []string{"123-45-6789"}, ""},
+		{InboundMessage{Header: map[string][]string{"X-Event": {"ping"}}}, nil, ""},
+		{InboundMessage{Header: map[string][]string{"X-Card-Number": {"4242 4242 4242 4241"}}}, nil, "header X-Card-Number"},
+		{InboundMessage{Document: json.RawMessage(`{"customer": `)}, nil, "document"},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			message, err := TokenizeInbound(route, scenario.givenMessage)
+			if len(scenario.expectErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), scenario.expectErr) {
+					t.Fatalf("expect an error about %s but got %#v", scenario.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			rewritten, _ := json.Marshal(message)
+			for _, raw := range scenario.expectRaw {
+				if strings.Contains(string(rewritten), raw) {
+					t.Errorf("expect %s to be tokenized but got %s", raw, rewritten)
+				}
+			}
+			if !strings.Contains(string(rewritten), "X-Event") && !strings.Contains(string(rewritten), "gold") {
+				t.Errorf("expect fields not on the route to be left alone but got %s", rewritten)
+			}
+		})
+	}
+}
+
+func TestTokenizeInboundLeavesDocumentUnescaped(t *testing.T) {
+	UnitTest = true
+	route := normalizeInboundRoute(InboundRoute{
+		Name:       "partner",
+		DomainUuid: "mydomain",
+		Target:     "http://localhost:9000",
+		Paths:      []FieldSelector{{Path: "$.email", ValueType: "email"}},
+	})
+
+	message, err := TokenizeInbound(route, InboundMessage{Document: json.RawMessage(`{"email": "jane@example.com", "note": "<b>Tom & Jerry</b>"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := `"note":"<b>Tom & Jerry</b>"`, string(message.Document); !strings.Contains(got, want) {
+		t.Errorf("expect %s passed on as sent but got %s", want, got)
+	}
+}
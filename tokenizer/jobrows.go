@@ -0,0 +1,191 @@
+package tokenizer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// the longest line an ndjson job will read
+const maxJobLineBytes = 1024 * 1024
+
+// jobRow is a row of a job's input: the fields to tokenize in it, and how to
+// write it out once they are replaced by their token ids. err is set for a
+// row that can't be read, which is left out of the output.
+type jobRow struct {
+	fields []documentField
+	err    error
+	write  func(*bytes.Buffer) error
+}
+
+// jobRows reads a job's input a row at a time
+type jobRows interface {
+	// header is written out once, ahead of the first row
+	header() []byte
+	// next returns the next row, or io.EOF after the last
+	next() (jobRow, error)
+	// skip passes over the next row, for a job carrying on from a checkpoint
+	skip() error
+}
+
+func newJobRows(job Job, input io.Reader) (jobRows, error) {
+	if job.Format == JobFormatCSV {
+		return newCSVJobRows(job.Fields, input)
+	}
+	return newNDJSONJobRows(job.Fields, input), nil
+}
+
+// csvJobRows reads csv with a header row, tokenizing the named columns
+type csvJobRows struct {
+	reader    *csv.Reader
+	headerRow []byte
+	fields    []FieldSelector
+	columns   []int
+}
+
+func newCSVJobRows(fields []FieldSelector, input io.Reader) (*csvJobRows, error) {
+	reader := csv.NewReader(input)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, &FieldError{Field: "file", Message: "must start with a header row"}
+	} else if err != nil {
+		return nil, csvJobError(err)
+	}
+	// spreadsheets often start the file with a byte order mark
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+
+	rows := &csvJobRows{reader: reader, fields: fields}
+	for _, field := range fields {
+		column := -1
+		for idx, name := range header {
+			if strings.TrimSpace(name) == strings.TrimSpace(field.Path) {
+				column = idx
+				break
+			}
+		}
+		if column < 0 {
+			return nil, &FieldError{Field: "fields", Message: "names a column the file doesn't have: " + field.Path}
+		}
+		rows.columns = append(rows.columns, column)
+	}
+
+	var buffer bytes.Buffer
+	if err = writeCSVRecord(&buffer, header); err != nil {
+		return nil, err
+	}
+	rows.headerRow = buffer.Bytes()
+	return rows, nil
+}
+
+func (rows *csvJobRows) header() []byte {
+	return rows.headerRow
+}
+
+func (rows *csvJobRows) next() (jobRow, error) {
+	record, err := rows.reader.Read()
+	if err != nil {
+		return jobRow{}, csvJobError(err)
+	}
+	row := jobRow{write: func(buffer *bytes.Buffer) error {
+		return writeCSVRecord(buffer, record)
+	}}
+	for idx, column := range rows.columns {
+		field := rows.fields[idx]
+		if column >= len(record) {
+			row.err = &FieldError{Field: field.Path, Message: "is missing from the row"}
+			return row, nil
+		}
+		column := column
+		setValue := func(value interface{}) { record[column] = value.(string) }
+		row.fields = append(row.fields, documentField{path: field.Path, value: record[column], valueType: field.ValueType, set: setValue})
+	}
+	return row, nil
+}
+
+func (rows *csvJobRows) skip() error {
+	_, err := rows.reader.Read()
+	return csvJobError(err)
+}
+
+func writeCSVRecord(buffer *bytes.Buffer, record []string) error {
+	writer := csv.NewWriter(buffer)
+	if err := writer.Write(record); err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// csvJobError reports malformed csv as a FieldError, which fails the job rather than being tried again
+func csvJobError(err error) error {
+	var parseerr *csv.ParseError
+	if errors.As(err, &parseerr) {
+		return &FieldError{Field: "file", Message: fmt.Sprintf("is not valid csv at line %d: %s", parseerr.Line, parseerr.Err)}
+	}
+	return err
+}
+
+// ndjsonJobRows reads a JSON document on each line, tokenizing the fields the selectors pick out
+type ndjsonJobRows struct {
+	scanner   *bufio.Scanner
+	selectors []FieldSelector
+}
+
+func newNDJSONJobRows(selectors []FieldSelector, input io.Reader) *ndjsonJobRows {
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxJobLineBytes)
+	return &ndjsonJobRows{scanner: scanner, selectors: selectors}
+}
+
+func (rows *ndjsonJobRows) header() []byte {
+	return nil
+}
+
+func (rows *ndjsonJobRows) next() (jobRow, error) {
+	line, err := rows.scan()
+	if err != nil {
+		return jobRow{}, err
+	}
+	if len(bytes.TrimSpace(line)) == 0 {
+		return jobRow{write: func(buffer *bytes.Buffer) error {
+			return buffer.WriteByte('\n')
+		}}, nil
+	}
+
+	document, fields, err := selectDocumentFields(DocumentRequest{Document: line, Selectors: rows.selectors})
+	if err == ErrInvalidDocument {
+		return jobRow{err: &FieldError{Field: "$", Message: "must be a JSON document"}}, nil
+	} else if err != nil {
+		return jobRow{}, err
+	}
+	return jobRow{fields: fields, write: func(buffer *bytes.Buffer) error {
+		encoder := json.NewEncoder(buffer)
+		encoder.SetEscapeHTML(false)
+		return encoder.Encode(document)
+	}}, nil
+}
+
+func (rows *ndjsonJobRows) skip() error {
+	_, err := rows.scan()
+	return err
+}
+
+// scan returns the next line, which is only good until the next scan
+func (rows *ndjsonJobRows) scan() ([]byte, error) {
+	if rows.scanner.Scan() {
+		return rows.scanner.Bytes(), nil
+	}
+	err := rows.scanner.Err()
+	if err == bufio.ErrTooLong {
+		return nil, &FieldError{Field: "file", Message: "has a line longer than 1MB"}
+	} else if err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
@@ -0,0 +1,897 @@
+package tokenizer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"tokentarpon/tokenizer/datalog"
+	"tokentarpon/tokenizer/datastore"
+	"tokentarpon/tokenizer/systemconfig"
+
+	"github.com/google/uuid"
+)
+
+var jobCollectionName = "jobs"
+var jobRecordType = "job"
+
+var jobIndexes = []datastore.DataIndex{
+	{Fields: []string{"uuid"}, Unique: true},
+	{Fields: []string{"status", "leaseUntil", "created"}},
+	{Fields: []string{"domainUuid", "-created"}},
+}
+
+// kinds of job
+const (
+	JobKindTokenize = "tokenize"
+	JobKindExport   = "export"
+)
+
+// job statuses. Queued and running jobs are picked up by a worker once their
+// lease is up, so a job whose worker stopped, e.g. for a restart, carries on
+// from its last checkpoint. Exports wait for approval before they are queued.
+const (
+	JobAwaitingApproval = "awaiting_approval"
+	JobQueued           = "queued"
+	JobRunning          = "running"
+	JobPaused           = "paused"
+	JobCompleted        = "completed"
+	JobFailed           = "failed"
+)
+
+// file formats a tokenize job reads and writes
+const (
+	JobFormatCSV    = "csv"
+	JobFormatNDJSON = "ndjson"
+)
+
+// audit actions recorded through a job's life
+const (
+	AuditJobCreate   = "job.create"
+	AuditJobApprove  = "job.approve"
+	AuditJobPause    = "job.pause"
+	AuditJobResume   = "job.resume"
+	AuditJobRetry    = "job.retry"
+	AuditJobDelete   = "job.delete"
+	AuditJobComplete = "job.complete"
+	AuditJobFail     = "job.fail"
+)
+
+var defaultJobPollSeconds int64 = 5
+var defaultJobMaxInputBytes int64 = 1024 * 1024 * 1024
+
+// rows are tokenized, written out and checkpointed in batches of this many
+var jobBatchRows = 500
+
+const (
+	jobLeaseSeconds = 120
+	jobRetrySeconds = 30 // wait before another attempt, for each attempt made
+	jobMaxAttempts  = 3
+	maxJobRowErrors = 100
+	maxJobFields    = 100
+)
+
+// each worker has an id of its own, so it only checkpoints the jobs it holds the lease on
+var jobWorkerId = uuid.New().String()
+
+// the actor job completions and failures are audited under
+const jobWorkerActor = "jobs"
+
+// JobSpec describes the file a tokenize job reads and the fields it tokenizes.
+// For csv files each field's Path is a column name from the header row; for
+// ndjson files it is a selector path applied to each line, e.g. $.email.
+type JobSpec struct {
+	Format string          `bson:"format" json:"format"`
+	Fields []FieldSelector `bson:"fields" json:"fields"`
+}
+
+// JobRowError reports a row of the input that was left out of the output,
+// numbered from 1 after any header row, and why. Values are never included.
+type JobRowError struct {
+	Row     int64  `bson:"row" json:"row"`
+	Field   string `bson:"field" json:"field"`
+	Message string `bson:"message" json:"message"`
+}
+
+// Job is a file worked through in the background. RowsDone, OutputBytes and
+// the counts are only moved on at a checkpoint, once the output up to that
+// point is on disk. BytesRead against InputBytes is the job's progress.
+// For an export, RowsDone counts the tokens exported and RowsFailed the ones
+// exported as an error, and the fields from RecipientKey on are its own.
+// SealedChunks is saved before each chunk is sealed, unlike Chunks, so a
+// chunk counter is never used twice under the same file key.
+type Job struct {
+	Uuid          string          `bson:"uuid" json:"uuid"`
+	DomainUuid    string          `bson:"domainUuid" json:"domainUuid"`
+	Kind          string          `bson:"kind" json:"kind"`
+	Format        string          `bson:"format" json:"format"`
+	Fields        []FieldSelector `bson:"fields" json:"fields"`
+	Status        string          `bson:"status" json:"status"`
+	InputBytes    int64           `bson:"inputBytes" json:"inputBytes"`
+	BytesRead     int64           `bson:"bytesRead" json:"bytesRead"`
+	RowsDone      int64           `bson:"rowsDone" json:"rowsDone"`
+	RowsFailed    int64           `bson:"rowsFailed" json:"rowsFailed"`
+	TokensCreated int64           `bson:"tokensCreated" json:"tokensCreated"`
+	OutputBytes   int64           `bson:"outputBytes" json:"outputBytes"`
+	RowErrors     []JobRowError   `bson:"rowErrors" json:"rowErrors"`
+	Error         string          `bson:"error" json:"error,omitempty"`
+	Attempts      int64           `bson:"attempts" json:"attempts"`
+	Worker        string          `bson:"worker" json:"-"`
+	LeaseUntil    int64           `bson:"leaseUntil" json:"-"`
+	CreatedBy     string          `bson:"createdBy" json:"createdBy"`
+	Created       int64           `bson:"created" json:"created"`
+	Updated       int64           `bson:"updated" json:"updated"`
+	Started       int64           `bson:"started" json:"started"`
+	Finished      int64           `bson:"finished" json:"finished"`
+	RecipientKey  string          `bson:"recipientKey,omitempty" json:"recipientKey,omitempty"`
+	AllTokens     bool            `bson:"allTokens,omitempty" json:"allTokens,omitempty"`
+	ApprovedBy    string          `bson:"approvedBy,omitempty" json:"approvedBy,omitempty"`
+	Approved      int64           `bson:"approved,omitempty" json:"approved,omitempty"`
+	SealedFileKey string          `bson:"sealedFileKey,omitempty" json:"-"`
+	Chunks        int64           `bson:"chunks,omitempty" json:"-"`
+	SealedChunks  int64           `bson:"sealedChunks,omitempty" json:"-"`
+	Cursor        string          `bson:"cursor,omitempty" json:"-"`
+}
+
+var (
+	ErrNoSuchJob        = errors.New("data: job not found")
+	ErrJobState         = errors.New("data: the job's status doesn't allow this")
+	ErrJobInputTooLarge = errors.New("data: job file is larger than the limit")
+	errJobReleased      = errors.New("data: job is no longer held by this worker")
+)
+
+// jobCondition is what a job's stored record must match for a change to it to go ahead
+type jobCondition struct {
+	statuses   []string
+	worker     string // when set, the worker must hold the job's lease
+	leaseUntil int64  // when set, the job's lease must be up by then
+}
+
+// jobs are kept in memory when unit testing
+var unitTestJobs = make(map[string]Job)
+var unitTestJobsMutex sync.Mutex
+
+// CreateTokenizeJob stores the input file and queues a job to tokenize the
+// spec's fields in every row of it. A csv file's header row is checked for
+// the columns up front; anything else wrong with a row is found as the job
+// runs, and the row is left out of the output.
+func CreateTokenizeJob(domainUuid string, spec JobSpec, input io.Reader, actor string) (Job, error) {
+	var job Job
+	if len(strings.TrimSpace(domainUuid)) == 0 {
+		return job, errors.New("data: need domain id")
+	}
+	spec.Format = strings.ToLower(strings.TrimSpace(spec.Format))
+	for idx := range spec.Fields {
+		spec.Fields[idx].ValueType = strings.ToLower(strings.TrimSpace(spec.Fields[idx].ValueType))
+	}
+	if err := checkJobSpec(spec); err != nil {
+		return job, err
+	}
+	if err := checkDomainOpen(domainUuid); err != nil {
+		return job, err
+	}
+
+	now := time.Now().Unix()
+	job = Job{
+		Uuid:       uuid.New().String(),
+		DomainUuid: domainUuid,
+		Kind:       JobKindTokenize,
+		Format:     spec.Format,
+		Fields:     spec.Fields,
+		Status:     JobQueued,
+		RowErrors:  []JobRowError{},
+		CreatedBy:  actor,
+		Created:    now,
+		Updated:    now,
+	}
+	size, err := writeJobInput(job.Uuid, input)
+	job.InputBytes = size
+	if err == nil && job.Format == JobFormatCSV {
+		err = checkJobColumns(job)
+	}
+	if err == nil {
+		err = insertJob(job)
+	}
+	if err != nil {
+		removeJobFiles(job.Uuid)
+		return job, err
+	}
+	return job, auditJob(AuditJobCreate, job, actor)
+}
+
+// checkJobSpec makes sure the job can be run, returning a FieldError when it can't
+func checkJobSpec(spec JobSpec) error {
+	if spec.Format != JobFormatCSV && spec.Format != JobFormatNDJSON {
+		return &FieldError{Field: "format", Message: "must be csv or ndjson"}
+	}
+	if len(spec.Fields) == 0 || len(spec.Fields) > maxJobFields {
+		return &FieldError{Field: "fields", Message: "must list 1 to 100 columns or paths to tokenize"}
+	}
+	seen := make(map[string]bool)
+	for _, field := range spec.Fields {
+		if spec.Format == JobFormatCSV && len(strings.TrimSpace(field.Path)) == 0 {
+			return &FieldError{Field: "fields", Message: "must not have a blank column name"}
+		}
+		if spec.Format == JobFormatNDJSON {
+			if _, parseerr := parseSelector(field.Path); parseerr != nil {
+				return &FieldError{Field: "fields", Message: "has an invalid path: " + field.Path}
+			}
+		}
+		if seen[field.Path] {
+			return &FieldError{Field: "fields", Message: "names a column or path twice: " + field.Path}
+		}
+		seen[field.Path] = true
+		if len(field.ValueType) > 0 && !knownValueType(field.ValueType) {
+			return &FieldError{Field: "valueType", Message: "is not a known value type: " + field.ValueType}
+		}
+	}
+	return nil
+}
+
+// GetJob returns the domain's job with the id, or ErrNoSuchJob
+func GetJob(domainUuid string, jobUuid string) (Job, error) {
+	job, err := findJob(jobUuid)
+	if err == nil && job.DomainUuid != domainUuid {
+		return Job{}, ErrNoSuchJob
+	}
+	return job, err
+}
+
+// ListJobs returns a page of the domain's jobs, newest first
+func ListJobs(domainUuid string, start int64, limit int64) ([]Job, error) {
+	jobs := []Job{}
+	if UnitTest {
+		unitTestJobsMutex.Lock()
+		for _, job := range unitTestJobs {
+			if job.DomainUuid == domainUuid {
+				jobs = append(jobs, job)
+			}
+		}
+		unitTestJobsMutex.Unlock()
+		sort.Slice(jobs, func(i, j int) bool { return jobs[i].Created > jobs[j].Created })
+		if start >= int64(len(jobs)) {
+			return []Job{}, nil
+		}
+		jobs = jobs[start:]
+		if limit > 0 && limit < int64(len(jobs)) {
+			jobs = jobs[:limit]
+		}
+		return jobs, nil
+	}
+
+	filter := []datastore.DataQueryGroup{{
+		Operator:    "and",
+		DataQueries: []datastore.DataQuery{{FieldName: "domainUuid", FieldValue: domainUuid, CaseSensitive: true}},
+	}}
+	sortBy := []datastore.DataSort{{FieldName: "created", Descending: true}}
+	results, err := datastore.GetSortedRecordsIn(jobCollectionName, filter, "and", sortBy, start, limit, Job{})
+	if err != nil {
+		return jobs, err
+	}
+	for _, result := range results {
+		jobs = append(jobs, result.(Job))
+	}
+	return jobs, nil
+}
+
+// PauseJob stops a queued or running job at its next checkpoint, until it is resumed
+func PauseJob(domainUuid string, jobUuid string, actor string) (Job, error) {
+	return changeJobStatus(domainUuid, jobUuid, []string{JobQueued, JobRunning}, AuditJobPause, actor, func(job *Job) {
+		job.Status = JobPaused
+	})
+}
+
+// ResumeJob queues a paused job again, to carry on from its last checkpoint
+func ResumeJob(domainUuid string, jobUuid string, actor string) (Job, error) {
+	return changeJobStatus(domainUuid, jobUuid, []string{JobPaused}, AuditJobResume, actor, func(job *Job) {
+		job.Status = JobQueued
+		job.Worker = ""
+		job.LeaseUntil = 0
+	})
+}
+
+// RetryJob queues a failed job again, with its attempts reset, to carry on
+// from its last checkpoint
+func RetryJob(domainUuid string, jobUuid string, actor string) (Job, error) {
+	return changeJobStatus(domainUuid, jobUuid, []string{JobFailed}, AuditJobRetry, actor, func(job *Job) {
+		job.Status = JobQueued
+		job.Attempts = 0
+		job.Error = ""
+		job.Worker = ""
+		job.LeaseUntil = 0
+		job.Finished = 0
+	})
+}
+
+// DeleteJob removes a job that isn't running, along with its files
+func DeleteJob(domainUuid string, jobUuid string, actor string) error {
+	job, err := GetJob(domainUuid, jobUuid)
+	if err != nil {
+		return err
+	}
+	deleted, err := removeJob(job.Uuid, jobCondition{statuses: []string{JobAwaitingApproval, JobQueued, JobPaused, JobCompleted, JobFailed}})
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrJobState
+	}
+	removeJobFiles(job.Uuid)
+	return auditJob(AuditJobDelete, job, actor)
+}
+
+// JobOutputPath returns where a completed job's output file is
+func JobOutputPath(job Job) (string, error) {
+	if job.Status != JobCompleted {
+		return "", ErrJobState
+	}
+	return jobOutputPath(job.Uuid), nil
+}
+
+// changeJobStatus applies the change to the job when it is in one of the from statuses
+func changeJobStatus(domainUuid string, jobUuid string, from []string, action string, actor string, change func(*Job)) (Job, error) {
+	job, err := GetJob(domainUuid, jobUuid)
+	if err != nil {
+		return job, err
+	}
+	condition := jobCondition{statuses: from}
+	if !condition.matches(job) {
+		return job, ErrJobState
+	}
+	change(&job)
+	job.Updated = time.Now().Unix()
+	saved, err := saveJob(job, condition)
+	if err != nil {
+		return job, err
+	}
+	if !saved {
+		// the job moved on while it was being changed
+		return job, ErrJobState
+	}
+	return job, auditJob(action, job, actor)
+}
+
+// RunJobs works through the queued jobs on an interval, for the life of the service.
+// Every instance of the service runs jobs; a job is only worked on by the worker holding its lease.
+func RunJobs() {
+	interval := time.Duration(getJobPollSeconds()) * time.Second
+	for range time.Tick(interval) {
+		if err := runQueuedJobs(); err != nil {
+			fmt.Printf("job run failed: %s\n", fmt.Sprint(err))
+		}
+	}
+}
+
+// runQueuedJobs claims and runs jobs one at a time until there are none to claim
+func runQueuedJobs() error {
+	for {
+		job, err := claimJob()
+		if err == ErrNoSuchJob {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		runJob(job)
+	}
+}
+
+// claimJob takes the lease on the oldest job that is queued, or running with its lease up
+func claimJob() (Job, error) {
+	now := time.Now().Unix()
+	candidates, err := findClaimableJobs(now)
+	if err != nil {
+		return Job{}, err
+	}
+	for _, job := range candidates {
+		condition := jobCondition{statuses: []string{job.Status}, leaseUntil: now}
+		job.Status = JobRunning
+		job.Worker = jobWorkerId
+		job.LeaseUntil = now + jobLeaseSeconds
+		job.Updated = now
+		if job.Started == 0 {
+			job.Started = now
+		}
+		claimed, claimerr := saveJob(job, condition)
+		if claimerr != nil {
+			return job, claimerr
+		}
+		if claimed {
+			return job, nil
+		}
+	}
+	return Job{}, ErrNoSuchJob
+}
+
+// runJob runs a claimed job until it completes, fails, or is taken from this worker.
+// A failed attempt is tried again later from the last checkpoint, up to
+// jobMaxAttempts; a file that can't be read fails the job straight away.
+func runJob(job Job) {
+	var err error
+	if job.Kind == JobKindExport {
+		err = processExportJob(&job)
+	} else {
+		err = processTokenizeJob(&job)
+	}
+	if err == errJobReleased {
+		return
+	}
+
+	now := time.Now().Unix()
+	action := AuditJobComplete
+	if err == nil {
+		job.Status = JobCompleted
+		job.BytesRead = job.InputBytes
+		job.Finished = now
+	} else {
+		var fielderr *FieldError
+		job.Attempts++
+		job.Error = fmt.Sprint(err)
+		if errors.As(err, &fielderr) || err == ErrDomainShredded || job.Attempts >= jobMaxAttempts {
+			job.Status = JobFailed
+			job.Finished = now
+			action = AuditJobFail
+		} else {
+			job.Status = JobQueued
+			job.LeaseUntil = now + job.Attempts*jobRetrySeconds
+			action = ""
+		}
+	}
+	job.Updated = now
+	saved, saveerr := saveJob(job, jobCondition{statuses: []string{JobRunning}, worker: jobWorkerId})
+	if saveerr != nil {
+		fmt.Printf("job %s could not be saved: %s\n", job.Uuid, fmt.Sprint(saveerr))
+		return
+	}
+	if !saved {
+		return
+	}
+	if job.Status == JobCompleted {
+		// the input holds the values, so it goes as soon as it isn't needed
+		if removeerr := os.Remove(jobInputPath(job.Uuid)); removeerr != nil && !os.IsNotExist(removeerr) {
+			fmt.Printf("job %s input could not be removed: %s\n", job.Uuid, fmt.Sprint(removeerr))
+		}
+	}
+	if len(action) > 0 {
+		if auditerr := auditJob(action, job, jobWorkerActor); auditerr != nil {
+			fmt.Printf("job %s could not be audited: %s\n", job.Uuid, fmt.Sprint(auditerr))
+		}
+	}
+}
+
+// processTokenizeJob works through the job's input from its last checkpoint,
+// a batch of rows at a time. Each batch's output is written and synced before
+// the checkpoint is saved, and output written after the last checkpoint is
+// dropped and written again, so the output always lines up with the rows done.
+// Each batch's tokens are created all or none, so a batch that fails leaves no
+// tokens behind. Only a crash between creating a batch's tokens and saving its
+// checkpoint leaves tokens nothing refers to, as the batch is created again.
+func processTokenizeJob(job *Job) error {
+	input, err := os.Open(jobInputPath(job.Uuid))
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	output, err := openJobOutput(*job)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	counter := &countingReader{reader: input}
+	rows, err := newJobRows(*job, counter)
+	if err != nil {
+		return err
+	}
+	for skipped := int64(0); skipped < job.RowsDone; skipped++ {
+		if err = rows.skip(); err != nil {
+			return err
+		}
+	}
+
+	for {
+		next := *job
+		var buffer bytes.Buffer
+		if next.OutputBytes == 0 {
+			buffer.Write(rows.header())
+		}
+		done, batcherr := tokenizeJobBatch(&next, rows, &buffer)
+		if batcherr != nil {
+			return batcherr
+		}
+		next.BytesRead = counter.count
+		if err = checkpointJob(job, next, output, buffer.Bytes()); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// openJobOutput opens the job's output file, dropping anything written after its last checkpoint
+func openJobOutput(job Job) (*os.File, error) {
+	output, err := os.OpenFile(jobOutputPath(job.Uuid), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = output.Truncate(job.OutputBytes); err == nil {
+		_, err = output.Seek(job.OutputBytes, io.SeekStart)
+	}
+	if err != nil {
+		output.Close()
+		return nil, err
+	}
+	return output, nil
+}
+
+// checkpointJob writes and syncs a batch's output, then saves next as the
+// job's checkpoint, as long as this worker still holds the job
+func checkpointJob(job *Job, next Job, output *os.File, written []byte) error {
+	if _, err := output.Write(written); err != nil {
+		return err
+	}
+	if err := output.Sync(); err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	next.OutputBytes += int64(len(written))
+	next.LeaseUntil = now + jobLeaseSeconds
+	next.Updated = now
+	saved, err := saveJob(next, jobCondition{statuses: []string{JobRunning}, worker: jobWorkerId})
+	if err != nil {
+		return err
+	}
+	if !saved {
+		// paused, or the lease ran out and another worker has it
+		return errJobReleased
+	}
+	*job = next
+	return nil
+}
+
+// tokenizeJobBatch reads up to a batch of rows, tokenizes their fields in a
+// single batch and writes the rows out. Rows with a field that can't be
+// tokenized are left out and counted as failed. It returns true once the
+// input has run out.
+func tokenizeJobBatch(job *Job, rows jobRows, buffer *bytes.Buffer) (bool, error) {
+	var batch []jobRow
+	var fields []documentField
+	done := false
+	maxValueBytes := GetRequestLimits(job.DomainUuid).MaxValueBytes
+	for len(batch) < jobBatchRows {
+		row, err := rows.next()
+		if err == io.EOF {
+			done = true
+			break
+		} else if err != nil {
+			return false, err
+		}
+		job.RowsDone++
+		if row.err == nil {
+			row.fields, row.err = checkJobRowFields(row.fields, maxValueBytes)
+		}
+		if row.err != nil {
+			job.RowsFailed++
+			if len(job.RowErrors) < maxJobRowErrors {
+				job.RowErrors = append(job.RowErrors, makeJobRowError(job.RowsDone, row.err))
+			}
+			continue
+		}
+		fields = append(fields, row.fields...)
+		batch = append(batch, row)
+	}
+
+	if _, err := tokenizeFields(job.DomainUuid, fields); err != nil {
+		return false, err
+	}
+	job.TokensCreated += int64(len(fields))
+	for _, row := range batch {
+		if err := row.write(buffer); err != nil {
+			return false, err
+		}
+	}
+	return done, nil
+}
+
+// checkJobRowFields checks each of a row's fields can be tokenized. Blank
+// values are left as they are, a blank cell holds nothing to tokenize.
+func checkJobRowFields(fields []documentField, maxValueBytes int64) ([]documentField, error) {
+	var kept []documentField
+	for _, field := range fields {
+		if value, ok := field.value.(string); ok && len(strings.TrimSpace(value)) == 0 {
+			continue
+		}
+		if _, err := checkDocumentField(field, maxValueBytes); err != nil {
+			return nil, err
+		}
+		kept = append(kept, field)
+	}
+	return kept, nil
+}
+
+func makeJobRowError(row int64, err error) JobRowError {
+	var fielderr *FieldError
+	if errors.As(err, &fielderr) {
+		return JobRowError{Row: row, Field: fielderr.Field, Message: fielderr.Message}
+	}
+	return JobRowError{Row: row, Message: fmt.Sprint(err)}
+}
+
+// writeJobInput streams the input to the job's input file, returning its size
+func writeJobInput(jobUuid string, input io.Reader) (int64, error) {
+	if err := os.MkdirAll(getJobDirectory(), 0700); err != nil {
+		return 0, err
+	}
+	file, err := os.OpenFile(jobInputPath(jobUuid), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	maxBytes := getJobMaxInputBytes()
+	size, copyerr := io.Copy(file, io.LimitReader(input, maxBytes+1))
+	closeerr := file.Close()
+	if copyerr != nil {
+		return size, copyerr
+	}
+	if closeerr != nil {
+		return size, closeerr
+	}
+	if size > maxBytes {
+		return size, ErrJobInputTooLarge
+	}
+	if size == 0 {
+		return size, &FieldError{Field: "file", Message: "must not be empty"}
+	}
+	return size, nil
+}
+
+// checkJobColumns reads the header row of the job's input, to check it has the job's columns
+func checkJobColumns(job Job) error {
+	input, err := os.Open(jobInputPath(job.Uuid))
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	_, err = newJobRows(job, input)
+	return err
+}
+
+func jobInputPath(jobUuid string) string {
+	return filepath.Join(getJobDirectory(), jobUuid+".input")
+}
+
+func jobOutputPath(jobUuid string) string {
+	return filepath.Join(getJobDirectory(), jobUuid+".output")
+}
+
+func removeJobFiles(jobUuid string) {
+	for _, path := range []string{jobInputPath(jobUuid), jobOutputPath(jobUuid)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("job file %s could not be removed: %s\n", path, fmt.Sprint(err))
+		}
+	}
+}
+
+// removeDomainJobFiles removes the files of every one of the domain's jobs,
+// whatever their status, once the domain is shredded
+func removeDomainJobFiles(domainUuid string) error {
+	pageRecordCount := getPageRecordCount()
+	if pageRecordCount <= 0 {
+		pageRecordCount = defaultPageRecordCount
+	}
+	for start := int64(0); ; start += pageRecordCount {
+		jobs, err := ListJobs(domainUuid, start, pageRecordCount)
+		if err != nil {
+			return err
+		}
+		for _, job := range jobs {
+			removeJobFiles(job.Uuid)
+		}
+		if int64(len(jobs)) < pageRecordCount {
+			return nil
+		}
+	}
+}
+
+func auditJob(action string, job Job, actor string) error {
+	if UnitTest {
+		return nil
+	}
+	_, err := datalog.Write(datalog.Entry{
+		Action:     action,
+		DomainUuid: job.DomainUuid,
+		Actor:      actor,
+		Details: map[string]string{
+			"job":        job.Uuid,
+			"kind":       job.Kind,
+			"format":     job.Format,
+			"status":     job.Status,
+			"rowsDone":   strconv.FormatInt(job.RowsDone, 10),
+			"rowsFailed": strconv.FormatInt(job.RowsFailed, 10),
+		},
+	})
+	return err
+}
+
+// matches reports whether the job meets the condition
+func (condition jobCondition) matches(job Job) bool {
+	if len(condition.worker) > 0 && job.Worker != condition.worker {
+		return false
+	}
+	if condition.leaseUntil > 0 && job.LeaseUntil > condition.leaseUntil {
+		return false
+	}
+	for _, status := range condition.statuses {
+		if job.Status == status {
+			return true
+		}
+	}
+	return false
+}
+
+// query finds the job with the id when it meets the condition
+func (condition jobCondition) query(jobUuid string) []datastore.DataQueryGroup {
+	match := datastore.DataQueryGroup{
+		Operator:    "and",
+		DataQueries: []datastore.DataQuery{{FieldName: "uuid", FieldValue: jobUuid, CaseSensitive: true}},
+	}
+	if len(condition.worker) > 0 {
+		match.DataQueries = append(match.DataQueries, datastore.DataQuery{FieldName: "worker", FieldValue: condition.worker, CaseSensitive: true})
+	}
+	if condition.leaseUntil > 0 {
+		match.DataQueries = append(match.DataQueries, datastore.DataQuery{FieldName: "leaseUntil", IsInt: true, IntValue: condition.leaseUntil, Comparison: "lte"})
+	}
+	match.DataQueryGroups = []datastore.DataQueryGroup{makeJobStatusQuery(condition.statuses)}
+	return []datastore.DataQueryGroup{match}
+}
+
+func makeJobStatusQuery(statuses []string) datastore.DataQueryGroup {
+	group := datastore.DataQueryGroup{Operator: "or"}
+	for _, status := range statuses {
+		group.DataQueries = append(group.DataQueries, datastore.DataQuery{FieldName: "status", FieldValue: status, CaseSensitive: true})
+	}
+	return group
+}
+
+func insertJob(job Job) error {
+	if UnitTest {
+		unitTestJobsMutex.Lock()
+		defer unitTestJobsMutex.Unlock()
+		unitTestJobs[job.Uuid] = job
+		return nil
+	}
+	return datastore.InsertRecordIn(jobCollectionName, jobRecordType, job)
+}
+
+func findJob(jobUuid string) (Job, error) {
+	var job Job
+	if UnitTest {
+		unitTestJobsMutex.Lock()
+		defer unitTestJobsMutex.Unlock()
+		job, ok := unitTestJobs[jobUuid]
+		if !ok {
+			return job, ErrNoSuchJob
+		}
+		return job, nil
+	}
+
+	filter := []datastore.DataQueryGroup{{
+		Operator:    "and",
+		DataQueries: []datastore.DataQuery{{FieldName: "uuid", FieldValue: jobUuid, CaseSensitive: true}},
+	}}
+	err := datastore.GetRecordIn(jobCollectionName, filter, &job)
+	if err == datastore.ErrNotFound {
+		return job, ErrNoSuchJob
+	}
+	return job, err
+}
+
+// saveJob replaces the stored job when it meets the condition, returning whether it did
+func saveJob(job Job, condition jobCondition) (bool, error) {
+	if UnitTest {
+		unitTestJobsMutex.Lock()
+		defer unitTestJobsMutex.Unlock()
+		stored, ok := unitTestJobs[job.Uuid]
+		if !ok || !condition.matches(stored) {
+			return false, nil
+		}
+		unitTestJobs[job.Uuid] = job
+		return true, nil
+	}
+
+	matched, err := datastore.UpdateRecordIfMatchedIn(jobCollectionName, jobRecordType, condition.query(job.Uuid), "and", job)
+	return matched > 0, err
+}
+
+// removeJob deletes the stored job when it meets the condition, returning whether it did
+func removeJob(jobUuid string, condition jobCondition) (bool, error) {
+	if UnitTest {
+		unitTestJobsMutex.Lock()
+		defer unitTestJobsMutex.Unlock()
+		stored, ok := unitTestJobs[jobUuid]
+		if !ok || !condition.matches(stored) {
+			return false, nil
+		}
+		delete(unitTestJobs, jobUuid)
+		return true, nil
+	}
+
+	deleted, err := datastore.DeleteRecordsIn(jobCollectionName, condition.query(jobUuid), "and")
+	return deleted > 0, err
+}
+
+// findClaimableJobs returns the oldest jobs that are queued, or running with their lease up
+func findClaimableJobs(now int64) ([]Job, error) {
+	var jobs []Job
+	statuses := []string{JobQueued, JobRunning}
+	if UnitTest {
+		unitTestJobsMutex.Lock()
+		condition := jobCondition{statuses: statuses, leaseUntil: now}
+		for _, job := range unitTestJobs {
+			if condition.matches(job) {
+				jobs = append(jobs, job)
+			}
+		}
+		unitTestJobsMutex.Unlock()
+		sort.Slice(jobs, func(i, j int) bool { return jobs[i].Created < jobs[j].Created })
+		return jobs, nil
+	}
+
+	filter := []datastore.DataQueryGroup{{
+		Operator:        "and",
+		DataQueries:     []datastore.DataQuery{{FieldName: "leaseUntil", IsInt: true, IntValue: now, Comparison: "lte"}},
+		DataQueryGroups: []datastore.DataQueryGroup{makeJobStatusQuery(statuses)},
+	}}
+	sortBy := []datastore.DataSort{{FieldName: "created"}}
+	results, err := datastore.GetSortedRecordsIn(jobCollectionName, filter, "and", sortBy, 0, 10, Job{})
+	if err != nil {
+		return jobs, err
+	}
+	for _, result := range results {
+		jobs = append(jobs, result.(Job))
+	}
+	return jobs, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+func getJobDirectory() string {
+	configuration, configerr := systemconfig.Load()
+	if configerr != nil || len(configuration.JobDirectory) == 0 {
+		return filepath.Join(os.TempDir(), "tokentarpon-jobs")
+	}
+	return configuration.JobDirectory
+}
+
+func getJobMaxInputBytes() int64 {
+	configuration, configerr := systemconfig.Load()
+	if configerr != nil || configuration.JobMaxInputBytes <= 0 {
+		return defaultJobMaxInputBytes
+	}
+	return configuration.JobMaxInputBytes
+}
+
+func getJobPollSeconds() int64 {
+	configuration, configerr := systemconfig.Load()
+	if configerr != nil || configuration.JobPollSeconds <= 0 {
+		return defaultJobPollSeconds
+	}
+	return configuration.JobPollSeconds
+}
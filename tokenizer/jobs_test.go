@@ -0,0 +1,318 @@
+package tokenizer
+
+import (
+	"errors"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var jobTokenPattern = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+
+func TestCheckJobSpec(t *testing.T) {
+	testScenarios := []struct {
+		givenSpec   JobSpec
+		expectField string
+	}{
+		{JobSpec{Format: "csv", Fields: []FieldSelector{{Path: "email", ValueType: "email"}}}, ""},
+		{JobSpec{Format: "ndjson", Fields: []FieldSelector{{Path: "$.cards[*].number", ValueType: "pan"}}}, ""},
+		{JobSpec{Format: "xlsx", Fields: []FieldSelector{{Path: "email"}}}, "format"},
+		{JobSpec{Format: "csv"}, "fields"},
+		{JobSpec{Format: "csv", Fields: []FieldSelector{{Path: " "}}}, "fields"},
+		{JobSpec{Format: "ndjson", Fields: []FieldSelector{{Path: "email"}}}, "fields"},
+		{JobSpec{Format: "csv", Fields: []FieldSelector{{Path: "email"}, {Path: "email"}}}, "fields"},
+		{JobSpec{Format: "csv", Fields: []FieldSelector{{Path: "email", ValueType: "shoesize"}}}, "valueType"},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			err := checkJobSpec(scenario.givenSpec)
+			if len(scenario.expectField) == 0 {
+				if err != nil {
+					t.Fatalf("expect no error but got %#v", err)
+				}
+				return
+			}
+			var fielderr *FieldError
+			if !errors.As(err, &fielderr) {
+				t.Fatalf("expect a field error but got %#v", err)
+			}
+			if want, got := scenario.expectField, fielderr.Field; want != got {
+				t.Errorf("expect field %s but got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestTokenizeJob(t *testing.T) {
+	UnitTest = true
+	t.Setenv("TMPDIR", t.TempDir())
+	jobBatchRows = 2
+	defer func() { jobBatchRows = 500 }()
+
+	testScenarios := []struct {
+		givenFormat     string
+		givenFields     []FieldSelector
+		givenInput      string
+		expectCreateErr string
+		expectStatus    string
+		expectOutput    string
+		expectFailed    int64
+		expectTokens    int64
+		expectRowErrors []JobRowError
+	}{
+		{
+			"csv",
+			[]FieldSelector{{Path: "email", ValueType: "email"}, {Path: "card", ValueType: "pan"}},
+			"name,email,card\nAnn,ann@example.com,4242424242424242\nBob,not-an-email,4242424242424242\nCy,,4000056655665556\n",
+			"", JobCompleted, "name,email,card\nAnn,T,T\nCy,,T\n", 1, 3,
+			[]JobRowError{{Row: 2, Field: "email", Message: "must be an email address"}},
+		},
+		{
+			"csv",
+			[]FieldSelector{{Path: "email"}},
+			"\ufeffemail,note\r\n\"a@example.com\",\"says \"\"hi\"\", twice\"\r\nb@example.com\r\n",
+			"", JobCompleted, "email,note\nT,\"says \"\"hi\"\", twice\"\nT\n", 0, 2, nil,
+		},
+		{
+			"csv",
+			[]FieldSelector{{Path: "ssn"}},
+			"name,email\nAnn,ann@example.com\n",
+			"fields", "", "", 0, 0, nil,
+		},
+		{
+			"csv",
+			[]FieldSelector{{Path: "email"}},
+			"",
+			"file", "", "", 0, 0, nil,
+		},
+		{
+			"csv",
+			[]FieldSelector{{Path: "email"}},
+			"name,email\nAnn,ann@example.com\nBob,b\"ob@example.com\n",
+			"", JobFailed, "", 0, 0, nil,
+		},
+		{
+			"ndjson",
+			[]FieldSelector{{Path: "$.email", ValueType: "email"}},
+			"{\"email\": \"a@example.com\", \"n\": 1, \"note\": \"<b>\"}\n\n{\"email\": \"x\"}\nnot json\n{\"n\": 2}",
+			"", JobCompleted, "{\"email\":\"T\",\"n\":1,\"note\":\"<b>\"}\n\n{\"n\":2}\n", 2, 1,
+			[]JobRowError{{Row: 3, Field: "$.email", Message: "must be an email address"}, {Row: 4, Field: "$", Message: "must be a JSON document"}},
+		},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			spec := JobSpec{Format: scenario.givenFormat, Fields: scenario.givenFields}
+			job, err := CreateTokenizeJob("mydomain", spec, strings.NewReader(scenario.givenInput), "tester")
+			if len(scenario.expectCreateErr) > 0 {
+				var fielderr *FieldError
+				if !errors.As(err, &fielderr) {
+					t.Fatalf("expect a field error but got %#v", err)
+				}
+				if want, got := scenario.expectCreateErr, fielderr.Field; want != got {
+					t.Errorf("expect field %s but got %s", want, got)
+				}
+				if _, staterr := os.Stat(jobInputPath(job.Uuid)); !os.IsNotExist(staterr) {
+					t.Errorf("expect the input of a rejected job removed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expect no error but got %#v", err)
+			}
+
+			if err = runQueuedJobs(); err != nil {
+				t.Fatalf("expect jobs to run but got %#v", err)
+			}
+			job, err = GetJob("mydomain", job.Uuid)
+			if err != nil {
+				t.Fatalf("expect the job but got %#v", err)
+			}
+			if want, got := scenario.expectStatus, job.Status; want != got {
+				t.Fatalf("expect status %s but got %s: %s", want, got, job.Error)
+			}
+			if job.Status != JobCompleted {
+				return
+			}
+
+			output, _ := os.ReadFile(jobOutputPath(job.Uuid))
+			if want, got := scenario.expectOutput, jobTokenPattern.ReplaceAllString(string(output), "T"); want != got {
+				t.Errorf("expect output %q but got %q", want, got)
+			}
+			if want, got := scenario.expectFailed, job.RowsFailed; want != got {
+				t.Errorf("expect %d rows failed but got %d", want, got)
+			}
+			if want, got := scenario.expectTokens, job.TokensCreated; want != got {
+				t.Errorf("expect %d tokens but got %d", want, got)
+			}
+			if want, got := len(scenario.expectRowErrors), len(job.RowErrors); want != got {
+				t.Fatalf("expect %d row errors but got %#v", want, job.RowErrors)
+			}
+			for idx, rowErr := range scenario.expectRowErrors {
+				if want, got := rowErr, job.RowErrors[idx]; want != got {
+					t.Errorf("expect row error %#v but got %#v", want, got)
+				}
+			}
+			if want, got := job.InputBytes, job.BytesRead; want != got {
+				t.Errorf("expect %d bytes read but got %d", want, got)
+			}
+			if _, staterr := os.Stat(jobInputPath(job.Uuid)); !os.IsNotExist(staterr) {
+				t.Errorf("expect the input removed once the job completed")
+			}
+		})
+	}
+}
+
+func TestJobLifecycle(t *testing.T) {
+	UnitTest = true
+	t.Setenv("TMPDIR", t.TempDir())
+
+	spec := JobSpec{Format: "csv", Fields: []FieldSelector{{Path: "email"}}}
+	job, err := CreateTokenizeJob("mydomain", spec, strings.NewReader("email\na@example.com\n"), "tester")
+	if err != nil {
+		t.Fatalf("expect no error but got %#v", err)
+	}
+	if _, err = GetJob("otherdomain", job.Uuid); err != ErrNoSuchJob {
+		t.Errorf("expect another domain's job not found but got %#v", err)
+	}
+
+	testScenarios := []struct {
+		givenStep    func() error
+		expectErr    error
+		expectStatus string
+	}{
+		{func() error { _, err := PauseJob("mydomain", job.Uuid, "tester"); return err }, nil, JobPaused},
+		{runQueuedJobs, nil, JobPaused},
+		{func() error { _, err := RetryJob("mydomain", job.Uuid, "tester"); return err }, ErrJobState, JobPaused},
+		{func() error { _, err := ResumeJob("mydomain", job.Uuid, "tester"); return err }, nil, JobQueued},
+		{runQueuedJobs, nil, JobCompleted},
+		{func() error { _, err := PauseJob("mydomain", job.Uuid, "tester"); return err }, ErrJobState, JobCompleted},
+		{func() error { return DeleteJob("mydomain", job.Uuid, "tester") }, nil, ""},
+		{func() error { return DeleteJob("mydomain", job.Uuid, "tester") }, ErrNoSuchJob, ""},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if want, got := scenario.expectErr, scenario.givenStep(); want != got {
+				t.Fatalf("expect error %#v but got %#v", want, got)
+			}
+			stored, geterr := GetJob("mydomain", job.Uuid)
+			if len(scenario.expectStatus) == 0 {
+				if geterr != ErrNoSuchJob {
+					t.Errorf("expect the job deleted but got %#v", geterr)
+				}
+				if _, staterr := os.Stat(jobOutputPath(job.Uuid)); !os.IsNotExist(staterr) {
+					t.Errorf("expect the output removed with the job")
+				}
+				return
+			}
+			if want, got := scenario.expectStatus, stored.Status; want != got {
+				t.Errorf("expect status %s but got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestJobResumesFromCheckpoint(t *testing.T) {
+	UnitTest = true
+	t.Setenv("TMPDIR", t.TempDir())
+	jobBatchRows = 2
+	defer func() { jobBatchRows = 500 }()
+
+	input := "email\na@example.com\nb@example.com\nc@example.com\nd@example.com\n"
+	spec := JobSpec{Format: "csv", Fields: []FieldSelector{{Path: "email", ValueType: "email"}}}
+	job, err := CreateTokenizeJob("mydomain", spec, strings.NewReader(input), "tester")
+	if err != nil {
+		t.Fatalf("expect no error but got %#v", err)
+	}
+	if err = runQueuedJobs(); err != nil {
+		t.Fatalf("expect jobs to run but got %#v", err)
+	}
+	first, _ := os.ReadFile(jobOutputPath(job.Uuid))
+	lines := strings.SplitAfter(string(first), "\n")
+	checkpoint := strings.Join(lines[:3], "")
+
+	// a worker that stopped after its first checkpoint, part way through writing the next batch
+	job.Status = JobRunning
+	job.Worker = "stopped-worker"
+	job.RowsDone = 2
+	job.TokensCreated = 2
+	job.OutputBytes = int64(len(checkpoint))
+	if err = os.WriteFile(jobInputPath(job.Uuid), []byte(input), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(jobOutputPath(job.Uuid), []byte(checkpoint+"half a ro"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = insertJob(job); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = runQueuedJobs(); err != nil {
+		t.Fatalf("expect jobs to run but got %#v", err)
+	}
+	job, _ = GetJob("mydomain", job.Uuid)
+	if want, got := JobCompleted, job.Status; want != got {
+		t.Fatalf("expect status %s but got %s: %s", want, got, job.Error)
+	}
+	resumed, _ := os.ReadFile(jobOutputPath(job.Uuid))
+	if !strings.HasPrefix(string(resumed), checkpoint) {
+		t.Errorf("expect the output up to the checkpoint kept but got %q", resumed)
+	}
+	if want, got := "email\nT\nT\nT\nT\n", jobTokenPattern.ReplaceAllString(string(resumed), "T"); want != got {
+		t.Errorf("expect output %q but got %q", want, got)
+	}
+	if want, got := int64(4), job.TokensCreated; want != got {
+		t.Errorf("expect %d tokens but got %d", want, got)
+	}
+}
+
+func TestJobRetriesLater(t *testing.T) {
+	UnitTest = true
+	t.Setenv("TMPDIR", t.TempDir())
+
+	spec := JobSpec{Format: "csv", Fields: []FieldSelector{{Path: "email"}}}
+	job, err := CreateTokenizeJob("mydomain", spec, strings.NewReader("email\na@example.com\n"), "tester")
+	if err != nil {
+		t.Fatalf("expect no error but got %#v", err)
+	}
+	os.Remove(jobInputPath(job.Uuid))
+
+	testScenarios := []struct {
+		givenAttempts  int64
+		expectStatus   string
+		expectAttempts int64
+	}{
+		{0, JobQueued, 1},
+		{jobMaxAttempts - 1, JobFailed, jobMaxAttempts},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			job.Status = JobQueued
+			job.Attempts = scenario.givenAttempts
+			job.LeaseUntil = 0
+			insertJob(job)
+			if err := runQueuedJobs(); err != nil {
+				t.Fatalf("expect jobs to run but got %#v", err)
+			}
+			stored, _ := GetJob("mydomain", job.Uuid)
+			if want, got := scenario.expectStatus, stored.Status; want != got {
+				t.Errorf("expect status %s but got %s", want, got)
+			}
+			if want, got := scenario.expectAttempts, stored.Attempts; want != got {
+				t.Errorf("expect %d attempts but got %d", want, got)
+			}
+			if len(stored.Error) == 0 {
+				t.Errorf("expect the error recorded")
+			}
+			// a job waiting to be tried again isn't picked up straight away
+			if claimed, _ := claimJob(); claimed.Uuid == job.Uuid {
+				t.Errorf("expect the job left until its backoff is up")
+			}
+		})
+	}
+}
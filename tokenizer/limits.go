@@ -0,0 +1,78 @@
+package tokenizer
+
+import (
+	"strconv"
+	"strings"
+	"tokentarpon/tokenizer/systemconfig"
+)
+
+var defaultMaxValueBytes int64 = 256
+var defaultMaxBatchItems int64 = 1000
+var defaultMaxRequestBytes int64 = 4 * 1024 * 1024
+
+// no value is stored above this, whatever the limits say, so a token and its
+// encryption stay well inside the datastore's 16MB document limit
+const maxStorableValueBytes = 8 * 1024 * 1024
+
+// error codes for requests turned away by a limit
+const (
+	ErrCodeEmptyValue      = "empty_value"
+	ErrCodeValueTooBig     = "value_too_big"
+	ErrCodeBatchTooLarge   = "batch_too_large"
+	ErrCodeRequestTooLarge = "request_too_large"
+)
+
+// RequestLimits are the largest value, batch and request body a domain takes
+type RequestLimits struct {
+	MaxValueBytes   int64 `json:"maxValueBytes"`
+	MaxBatchItems   int64 `json:"maxBatchItems"`
+	MaxRequestBytes int64 `json:"maxRequestBytes"`
+}
+
+// GetRequestLimits returns the domain's limits. Each is the domain's own
+// setting when it has one, otherwise the global setting, otherwise the default.
+func GetRequestLimits(domainUuid string) RequestLimits {
+	limits := RequestLimits{
+		MaxValueBytes:   defaultMaxValueBytes,
+		MaxBatchItems:   defaultMaxBatchItems,
+		MaxRequestBytes: defaultMaxRequestBytes,
+	}
+	configuration, configerr := systemconfig.Load()
+	if configerr != nil {
+		return limits
+	}
+	domain := configuration.Domains[domainUuid]
+	limits.MaxValueBytes = firstLimit(domain.MaxValueBytes, configuration.MaxValueBytes, limits.MaxValueBytes)
+	limits.MaxBatchItems = firstLimit(domain.MaxBatchItems, configuration.MaxBatchItems, limits.MaxBatchItems)
+	limits.MaxRequestBytes = firstLimit(domain.MaxRequestBytes, configuration.MaxRequestBytes, limits.MaxRequestBytes)
+	if limits.MaxValueBytes > maxStorableValueBytes {
+		limits.MaxValueBytes = maxStorableValueBytes
+	}
+	return limits
+}
+
+// checkValueSize returns ErrEmptyValue for a blank value, and ErrValueTooBig
+// for one over the limit, counted in bytes as it was given
+func checkValueSize(value string, maxValueBytes int64) error {
+	if len(strings.TrimSpace(value)) == 0 {
+		return ErrEmptyValue
+	}
+	if int64(len(value)) > maxValueBytes {
+		return ErrValueTooBig
+	}
+	return nil
+}
+
+// valueTooBigMessage says what the limit is, for a field or batch item over it
+func valueTooBigMessage(maxValueBytes int64) string {
+	return "must be at most " + strconv.FormatInt(maxValueBytes, 10) + " bytes"
+}
+
+func firstLimit(limits ...int64) int64 {
+	for _, limit := range limits {
+		if limit > 0 {
+			return limit
+		}
+	}
+	return 0
+}
@@ -0,0 +1,78 @@
+package tokenizer
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFirstLimit(t *testing.T) {
+	testScenarios := []struct {
+		givenDomain, givenGlobal, givenDefault int64
+		expectLimit                            int64
+	}{
+		{0, 0, 256, 256},
+		{0, 512, 256, 512},
+		{100, 512, 256, 100},
+		{-1, 0, 256, 256},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if want, got := scenario.expectLimit, firstLimit(scenario.givenDomain, scenario.givenGlobal, scenario.givenDefault); want != got {
+				t.Errorf("expect limit %d but got %d", want, got)
+			}
+		})
+	}
+}
+
+func TestValueLimits(t *testing.T) {
+	UnitTest = true
+	// unit tests have no configuration, so the default limits apply
+	limits := GetRequestLimits("mydomain")
+	if want, got := defaultMaxValueBytes, limits.MaxValueBytes; want != got {
+		t.Fatalf("expect max value bytes %d but got %d", want, got)
+	}
+	atLimit := strings.Repeat("v", int(limits.MaxValueBytes))
+	overLimit := atLimit + "v"
+
+	testScenarios := []struct {
+		givenValue string
+		expectErr  error
+		expectMsg  string
+	}{
+		{atLimit, nil, ""},
+		{" ", ErrEmptyValue, "Missing Token Value"},
+		{overLimit, ErrValueTooBig, "Token Value Too Large"},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if _, err := CreateToken("mydomain", scenario.givenValue); err != scenario.expectErr {
+				t.Errorf("expect create error %#v but got %#v", scenario.expectErr, err)
+			}
+			if _, err := UpdateTokenValue("mydomain", "a1", scenario.givenValue, 0); err != scenario.expectErr {
+				t.Errorf("expect update error %#v but got %#v", scenario.expectErr, err)
+			}
+
+			results := CreateTokenResults("mydomain", []Token{{DomainUuid: "mydomain", Value: scenario.givenValue}})
+			got := ""
+			if results[0].Error != nil {
+				got = results[0].Error.Error
+			}
+			if want := scenario.expectMsg; want != got {
+				t.Errorf("expect batch error %q but got %q", want, got)
+			}
+
+			_, err := checkDocumentField(documentField{path: "$.notes", value: scenario.givenValue}, limits.MaxValueBytes)
+			var fielderr *FieldError
+			if want, got := scenario.expectErr != nil, errors.As(err, &fielderr); want != got {
+				t.Fatalf("expect a field error %t but got %#v", want, err)
+			}
+			if fielderr != nil && fielderr.Field != "$.notes" {
+				t.Errorf("expect field $.notes but got %s", fielderr.Field)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package tokenizer
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"tokentarpon/tokenizer/datastore"
+)
+
+// metadata is stored in plaintext next to the encrypted value,
+// so it is kept short and must never hold the value itself
+const (
+	maxMetadataLength = 128
+	maxLabels         = 32
+)
+
+var ErrInvalidMetadata = errors.New("data: metadata fields must be at most 128 characters, with at most 32 labels, none blank")
+
+// checkMetadata makes sure a token's metadata fits what is stored and indexed
+func checkMetadata(tok Token) error {
+	for _, field := range []string{tok.DataClass, tok.SourceSystem, tok.ExternalRef} {
+		if len(strings.TrimSpace(field)) > maxMetadataLength {
+			return ErrInvalidMetadata
+		}
+	}
+	if len(tok.Labels) > maxLabels {
+		return ErrInvalidMetadata
+	}
+	for _, label := range tok.Labels {
+		label = strings.TrimSpace(label)
+		if len(label) == 0 || len(label) > maxMetadataLength {
+			return ErrInvalidMetadata
+		}
+	}
+	return nil
+}
+
+// applyMetadata trims the token's metadata and drops repeated labels.
+// Data classes are lowercased so "Email" and "email" filter the same.
+func applyMetadata(tok *Token) error {
+	if err := checkMetadata(*tok); err != nil {
+		return err
+	}
+	tok.DataClass = strings.ToLower(strings.TrimSpace(tok.DataClass))
+	tok.SourceSystem = strings.TrimSpace(tok.SourceSystem)
+	tok.ExternalRef = strings.TrimSpace(tok.ExternalRef)
+
+	var labels []string
+	seen := make(map[string]bool)
+	for _, label := range tok.Labels {
+		label = strings.TrimSpace(label)
+		if !seen[label] {
+			seen[label] = true
+			labels = append(labels, label)
+		}
+	}
+	tok.Labels = labels
+	return nil
+}
+
+// makeMetadataQueries matches tokens with every metadata field set in the query,
+// and every one of its labels
+func makeMetadataQueries(query TokenListQuery) []datastore.DataQuery {
+	var queries []datastore.DataQuery
+	if dataClass := strings.ToLower(strings.TrimSpace(query.DataClass)); len(dataClass) > 0 {
+		queries = append(queries, datastore.DataQuery{FieldName: "dataClass", FieldValue: dataClass, CaseSensitive: true})
+	}
+	if sourceSystem := strings.TrimSpace(query.SourceSystem); len(sourceSystem) > 0 {
+		queries = append(queries, datastore.DataQuery{FieldName: "sourceSystem", FieldValue: sourceSystem, CaseSensitive: true})
+	}
+	if externalRef := strings.TrimSpace(query.ExternalRef); len(externalRef) > 0 {
+		queries = append(queries, datastore.DataQuery{FieldName: "externalRef", FieldValue: externalRef, CaseSensitive: true})
+	}
+	for _, label := range query.Labels {
+		if label = strings.TrimSpace(label); len(label) > 0 {
+			queries = append(queries, datastore.DataQuery{FieldName: "labels", FieldValue: label, CaseSensitive: true})
+		}
+	}
+	return queries
+}
+
+// GetTokenMetadata returns a token, or one of its earlier versions when revision
+// is set, with its metadata and without its value. Nothing is decrypted, and
+// reading it doesn't count against the token's read limit.
+func GetTokenMetadata(domainUuid string, tokenUuid string, revision int64) (Token, error) {
+	var tok Token
+	err := errors.New("data: need domain id, token id")
+	if len(strings.TrimSpace(domainUuid)) == 0 {
+		return tok, err
+	}
+	if len(strings.TrimSpace(tokenUuid)) == 0 {
+		return tok, err
+	}
+	if shrederr := checkDomainOpen(domainUuid); shrederr != nil {
+		return tok, shrederr
+	}
+
+	if UnitTest {
+		tok.DomainUuid = domainUuid
+		tok.Uuid = tokenUuid
+		tok.Revision = currentRevision(Token{Revision: revision})
+		return tok, nil
+	}
+
+	current, geterr := getLiveToken(domainUuid, tokenUuid)
+	if geterr != nil {
+		return Token{}, geterr
+	}
+	tok = current
+	if revision > 0 && revision != current.Revision {
+		version, versionerr := getStoredVersion(domainUuid, tokenUuid, revision)
+		if versionerr != nil {
+			return Token{}, versionerr
+		}
+		tok = version.Token
+	}
+	tok.Value = ""
+	tok.EncryptedValue = ""
+	return tok, nil
+}
+
+// getLiveToken reads a token as it is stored, still encrypted,
+// treating expired and used up tokens as not found
+func getLiveToken(domainUuid string, tokenUuid string) (Token, error) {
+	var tok Token
+	filter := datastore.MakeDomainQuery(domainUuid, "uuid", tokenUuid, true)
+	geterr := datastore.GetRecordIn(CollectionName, filter, &tok)
+	if geterr == datastore.ErrNotFound {
+		return Token{}, ErrNoMatchingToken
+	} else if geterr != nil {
+		return Token{}, geterr
+	}
+	if !isLive(tok, time.Now().Unix()) {
+		return Token{}, ErrNoMatchingToken
+	}
+	tok.Revision = currentRevision(tok)
+	return tok, nil
+}
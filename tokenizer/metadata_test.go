@@ -0,0 +1,73 @@
+package tokenizer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"tokentarpon/tokenizer/datastore"
+)
+
+func TestApplyMetadata(t *testing.T) {
+	tooManyLabels := make([]string, maxLabels+1)
+	for idx := range tooManyLabels {
+		tooManyLabels[idx] = strconv.Itoa(idx)
+	}
+
+	testScenarios := []struct {
+		givenToken  Token
+		expectToken Token
+		expectErr   error
+	}{
+		{
+			givenToken:  Token{DataClass: " Email ", SourceSystem: " crm ", Labels: []string{"pii", " gdpr", "pii"}, ExternalRef: " cust-42 "},
+			expectToken: Token{DataClass: "email", SourceSystem: "crm", Labels: []string{"pii", "gdpr"}, ExternalRef: "cust-42"},
+		},
+		{givenToken: Token{}, expectToken: Token{}},
+		{givenToken: Token{Labels: []string{"pii", " "}}, expectErr: ErrInvalidMetadata},
+		{givenToken: Token{Labels: tooManyLabels}, expectErr: ErrInvalidMetadata},
+		{givenToken: Token{ExternalRef: strings.Repeat("x", maxMetadataLength+1)}, expectErr: ErrInvalidMetadata},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			tok := scenario.givenToken
+			err := applyMetadata(&tok)
+			if want, got := scenario.expectErr, err; want != got {
+				t.Fatalf("expect error %#v but got %#v", want, got)
+			}
+			if err == nil && fmt.Sprint(scenario.expectToken) != fmt.Sprint(tok) {
+				t.Errorf("expect token %#v but got %#v", scenario.expectToken, tok)
+			}
+		})
+	}
+}
+
+func TestMakeMetadataQueries(t *testing.T) {
+	query := TokenListQuery{DomainUuid: "mydomain", DataClass: "Email", Labels: []string{"pii", " ", "gdpr"}}
+	filter := datastore.MakeSimpleQuery("domainUuid", query.DomainUuid, true)
+	filter[0].DataQueries = append(filter[0].DataQueries, makeMetadataQueries(query)...)
+
+	want := "map[$and:[map[domainUuid:mydomain] map[isDeleted:map[$eq:false]] map[dataClass:email] map[labels:pii] map[labels:gdpr]]]"
+	if got := fmt.Sprint(datastore.CreateMongoFilter(filter, "and")); want != got {
+		t.Errorf("expect filter %s but got %s", want, got)
+	}
+}
+
+func TestCreateTokensRejectsInvalidMetadata(t *testing.T) {
+	UnitTest = true
+	tokens := []Token{
+		{DomainUuid: "mydomain", Value: "a value", DataClass: "Email"},
+		{DomainUuid: "mydomain", Value: "a value", Labels: []string{""}},
+	}
+	created, errorTokens := CreateTokens("mydomain", tokens)
+	if len(created) != 1 || len(errorTokens) != 1 {
+		t.Fatalf("expect 1 created and 1 failed but got %d and %d", len(created), len(errorTokens))
+	}
+	if want, got := "email", created[0].DataClass; want != got {
+		t.Errorf("expect data class %s but got %s", want, got)
+	}
+	if want, got := "Invalid Metadata", errorTokens[0].Error; want != got {
+		t.Errorf("expect error %s but got %s", want, got)
+	}
+}
@@ -0,0 +1,255 @@
+package tokenizer
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+	"tokentarpon/tokencrypto"
+	"tokentarpon/tokenizer/datastore"
+)
+
+// sort orders for listing tokens, a leading "-" lists newest first
+const (
+	SortCreated           = "created"
+	SortCreatedDescending = "-created"
+	SortUpdated           = "updated"
+	SortUpdatedDescending = "-updated"
+)
+
+// TokenListQuery describes a page of tokens to list for a domain.
+// Cursor continues from a previous page; Start is only used for the first page.
+// The metadata fields, when set, only list tokens that match all of them.
+type TokenListQuery struct {
+	DomainUuid   string   `bson:"domainUuid" json:"domainUuid"`
+	Cursor       string   `bson:"cursor" json:"cursor"`
+	Start        int64    `bson:"start" json:"start"`
+	Limit        int64    `bson:"limit" json:"limit"`
+	Sort         string   `bson:"sort" json:"sort"`
+	IncludeTotal bool     `bson:"includeTotal" json:"includeTotal"`
+	DataClass    string   `bson:"dataClass" json:"dataClass"`
+	SourceSystem string   `bson:"sourceSystem" json:"sourceSystem"`
+	Labels       []string `bson:"labels" json:"labels"`
+	ExternalRef  string   `bson:"externalRef" json:"externalRef"`
+}
+
+// TokenPage is one page of a token listing. NextCursor is empty on the last page,
+// and Total is only set when it was asked for.
+type TokenPage struct {
+	Tokens     []Token `bson:"tokens" json:"tokens"`
+	NextCursor string  `bson:"nextCursor" json:"nextCursor,omitempty"`
+	Sort       string  `bson:"sort" json:"sort"`
+	Total      *int64  `bson:"total" json:"total,omitempty"`
+}
+
+// the position a cursor continues from: the sort key and uuid of the last token returned
+type pageCursor struct {
+	DomainUuid string `json:"d"`
+	Sort       string `json:"s"`
+	Value      int64  `json:"v"`
+	Uuid       string `json:"u"`
+}
+
+var (
+	ErrInvalidCursor = errors.New("data: cursor is invalid or was issued for another listing")
+	ErrInvalidSort   = errors.New("data: sort must be one of created, -created, updated, -updated")
+)
+
+// ListTokens returns a page of tokens for a domain ordered by the sort key,
+// with the token uuid breaking ties so the order is stable.
+// Pages are read from the position in the cursor rather than by offset,
+// so deep pages stay fast and inserts or deletes don't shift later pages.
+func ListTokens(query TokenListQuery) (TokenPage, error) {
+	var page TokenPage
+	err := errors.New("data: need domain id")
+	if len(strings.TrimSpace(query.DomainUuid)) == 0 {
+		return page, err
+	}
+	if shrederr := checkDomainOpen(query.DomainUuid); shrederr != nil {
+		return page, shrederr
+	}
+
+	if len(query.Sort) == 0 {
+		query.Sort = SortCreated
+	}
+	sortField, descending, sorterr := parseTokenSort(query.Sort)
+	if sorterr != nil {
+		return page, sorterr
+	}
+	page.Sort = query.Sort
+	page.Tokens = []Token{}
+
+	var after *pageCursor
+	if len(query.Cursor) > 0 {
+		cursor, cursorerr := decodeCursor(query.Cursor)
+		if cursorerr == ErrMasterKeyNotLoaded {
+			return page, cursorerr
+		} else if cursorerr != nil || cursor.DomainUuid != query.DomainUuid || cursor.Sort != query.Sort {
+			return page, ErrInvalidCursor
+		}
+		after = &cursor
+	}
+
+	pageRecordCount := getPageRecordCount()
+	limit := query.Limit
+	if limit <= 0 || limit > pageRecordCount {
+		limit = pageRecordCount
+	}
+
+	if UnitTest {
+		return page, nil
+	}
+
+	datastore.CollectionName = CollectionName
+	datastore.PageRecordCount = pageRecordCount
+	filter := datastore.MakeSimpleQuery("domainUuid", query.DomainUuid, true)
+	filter[0].DataQueries = append(filter[0].DataQueries, makeMetadataQueries(query)...)
+	if query.IncludeTotal {
+		total, counterr := datastore.CountRecords(filter, "and")
+		if counterr != nil {
+			return page, counterr
+		}
+		page.Total = &total
+	}
+
+	sort := []datastore.DataSort{
+		{FieldName: sortField, Descending: descending},
+		{FieldName: "uuid", Descending: descending},
+	}
+
+	// read one token past the page to find out if another page follows
+	var token Token
+	start := query.Start
+	if after != nil {
+		filter = append(filter, makeKeysetQuery(sortField, descending, *after))
+		start = 0
+	}
+	records, geterr := datastore.GetSortedRecords(filter, "and", sort, start, limit+1, token)
+	if geterr != nil {
+		return page, geterr
+	}
+
+	// the cursor continues from the last token read, even if it was skipped
+	var last Token
+	now := time.Now().Unix()
+	for idx, x := range records {
+		if int64(idx) == limit {
+			nextCursor, cursorerr := encodeCursor(pageCursor{
+				DomainUuid: query.DomainUuid,
+				Sort:       query.Sort,
+				Value:      tokenSortValue(last, sortField),
+				Uuid:       last.Uuid,
+			})
+			if cursorerr != nil {
+				return TokenPage{}, cursorerr
+			}
+			page.NextCursor = nextCursor
+			break
+		}
+		tok := x.(Token)
+		last = tok
+		if !isLive(tok, now) {
+			continue
+		}
+		if tok.MaxReads > 0 {
+			tok.Value = ""
+			tok.EncryptedValue = ""
+		} else if revealerr := revealValue(&tok); revealerr != nil {
+			return page, revealerr
+		}
+		tok.Revision = currentRevision(tok)
+		page.Tokens = append(page.Tokens, tok)
+	}
+	return page, nil
+}
+
+func parseTokenSort(sort string) (string, bool, error) {
+	switch sort {
+	case SortCreated, SortUpdated:
+		return sort, false, nil
+	case SortCreatedDescending, SortUpdatedDescending:
+		return strings.TrimPrefix(sort, "-"), true, nil
+	}
+	return "", false, ErrInvalidSort
+}
+
+func tokenSortValue(tok Token, sortField string) int64 {
+	if sortField == SortUpdated {
+		return tok.Updated
+	}
+	return tok.Created
+}
+
+// makeKeysetQuery matches the tokens that sort after the cursor position:
+// a later sort value, or the same sort value and a later uuid
+func makeKeysetQuery(sortField string, descending bool, after pageCursor) datastore.DataQueryGroup {
+	comparison := "gt"
+	if descending {
+		comparison = "lt"
+	}
+
+	var nvq datastore.DataQueryGroup
+	nvq.Operator = "or"
+	nvq.DataQueries = []datastore.DataQuery{
+		{FieldName: sortField, IsInt: true, IntValue: after.Value, Comparison: comparison},
+	}
+	nvq.DataQueryGroups = []datastore.DataQueryGroup{
+		{
+			Operator: "and",
+			DataQueries: []datastore.DataQuery{
+				{FieldName: sortField, IsInt: true, IntValue: after.Value},
+				{FieldName: "uuid", FieldValue: after.Uuid, CaseSensitive: true, Comparison: comparison},
+			},
+		},
+	}
+	return nvq
+}
+
+// encodeCursor serializes the cursor and signs it, so callers can pass it
+// back but can't alter it to read from somewhere else
+func encodeCursor(cursor pageCursor) (string, error) {
+	payload, _ := json.Marshal(cursor)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	signature, err := signCursor(encoded)
+	if err != nil {
+		return "", err
+	}
+	return encoded + "." + signature, nil
+}
+
+func decodeCursor(cursor string) (pageCursor, error) {
+	var decoded pageCursor
+	parts := strings.Split(cursor, ".")
+	if len(parts) != 2 {
+		return decoded, ErrInvalidCursor
+	}
+	signature, err := signCursor(parts[0])
+	if err != nil {
+		return decoded, err
+	}
+	if !hmac.Equal([]byte(signature), []byte(parts[1])) {
+		return decoded, ErrInvalidCursor
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return decoded, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(payload, &decoded); err != nil {
+		return decoded, ErrInvalidCursor
+	}
+	return decoded, nil
+}
+
+// cursors are signed with a key derived from the encryption key,
+// so a cursor from one deployment is useless against another.
+// Without the key cursors could be forged, so none are signed.
+func signCursor(encoded string) (string, error) {
+	getEncryptionKey()
+	if len(encryptionKey) == 0 {
+		return "", ErrMasterKeyNotLoaded
+	}
+	cursorKey := tokencrypto.GetHMACForString("tokentarpon cursor", encryptionKey)
+	return tokencrypto.GetHMACForString(encoded, cursorKey), nil
+}
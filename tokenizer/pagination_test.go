@@ -0,0 +1,96 @@
+package tokenizer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"tokentarpon/tokenizer/datastore"
+)
+
+func TestDecodeCursor(t *testing.T) {
+	encryptionKey = ";kldfpo87-28374isu;dfjhZXJCVG786"
+	defer func() { encryptionKey = "" }()
+
+	cursor := pageCursor{DomainUuid: "mydomain", Sort: SortCreated, Value: 1700000000, Uuid: "abc123"}
+	encoded, _ := encodeCursor(cursor)
+	payload := strings.Split(encoded, ".")[0]
+
+	testScenarios := []struct {
+		givenCursor   string
+		expectedError error
+	}{
+		{givenCursor: encoded},
+		{givenCursor: encoded + "0", expectedError: ErrInvalidCursor},
+		{givenCursor: "X" + encoded[1:], expectedError: ErrInvalidCursor},
+		{givenCursor: payload, expectedError: ErrInvalidCursor},
+		{givenCursor: "not a cursor", expectedError: ErrInvalidCursor},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			decoded, err := decodeCursor(scenario.givenCursor)
+			if want, got := scenario.expectedError, err; want != got {
+				t.Errorf("expect error %#v but got %#v", want, got)
+				return
+			}
+			if err == nil && decoded != cursor {
+				t.Errorf("expect cursor %#v but got %#v", cursor, decoded)
+			}
+		})
+	}
+
+	// without the key a cursor can't be signed or checked, rather than being signed with an empty key
+	encryptionKey = ""
+	if _, err := encodeCursor(cursor); err != ErrMasterKeyNotLoaded {
+		t.Errorf("expect error %#v but got %#v", ErrMasterKeyNotLoaded, err)
+	}
+	if _, err := decodeCursor(encoded); err != ErrMasterKeyNotLoaded {
+		t.Errorf("expect error %#v but got %#v", ErrMasterKeyNotLoaded, err)
+	}
+}
+
+func TestListTokens(t *testing.T) {
+	encryptionKey = ";kldfpo87-28374isu;dfjhZXJCVG786"
+	defer func() { encryptionKey = "" }()
+	UnitTest = true
+
+	otherDomainCursor, _ := encodeCursor(pageCursor{DomainUuid: "thisisnotmybeautifuldomain", Sort: SortCreated})
+	otherSortCursor, _ := encodeCursor(pageCursor{DomainUuid: "mydomain", Sort: SortUpdated})
+
+	testScenarios := []struct {
+		givenQuery    TokenListQuery
+		expectedError error
+	}{
+		{givenQuery: TokenListQuery{DomainUuid: "mydomain"}},
+		{givenQuery: TokenListQuery{DomainUuid: "mydomain", Sort: SortUpdatedDescending}},
+		{givenQuery: TokenListQuery{DomainUuid: "mydomain", Sort: "value"}, expectedError: ErrInvalidSort},
+		{givenQuery: TokenListQuery{DomainUuid: "mydomain", Cursor: otherDomainCursor}, expectedError: ErrInvalidCursor},
+		{givenQuery: TokenListQuery{DomainUuid: "mydomain", Cursor: otherSortCursor}, expectedError: ErrInvalidCursor},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			_, err := ListTokens(scenario.givenQuery)
+			if want, got := scenario.expectedError, err; want != got {
+				t.Errorf("expect error %#v but got %#v", want, got)
+			}
+		})
+	}
+}
+
+func TestMakeKeysetQuery(t *testing.T) {
+	after := pageCursor{Value: 1700000000, Uuid: "abc123"}
+
+	filter := datastore.CreateMongoFilter([]datastore.DataQueryGroup{makeKeysetQuery("created", false, after)}, "and")
+	want := "map[$or:[map[created:map[$gt:1700000000]] map[$and:[map[created:map[$eq:1700000000]] map[uuid:map[$gt:abc123]]]]]]"
+	if got := fmt.Sprint(filter); want != got {
+		t.Errorf("expect filter %s but got %s", want, got)
+	}
+
+	filter = datastore.CreateMongoFilter([]datastore.DataQueryGroup{makeKeysetQuery("updated", true, after)}, "and")
+	want = "map[$or:[map[updated:map[$lt:1700000000]] map[$and:[map[updated:map[$eq:1700000000]] map[uuid:map[$lt:abc123]]]]]]"
+	if got := fmt.Sprint(filter); want != got {
+		t.Errorf("expect filter %s but got %s", want, got)
+	}
+}
@@ -0,0 +1,138 @@
+package tokenizer
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"tokentarpon/tokencrypto"
+	"tokentarpon/tokenizer/systemconfig"
+)
+
+var defaultPseudonymEpochDays int64 = 90
+
+// PseudonymRequest asks for pseudonyms of plaintext values, of the values of
+// existing tokens, or both. Values are normalized by ValueType first, as they
+// would be when tokenized. Epoch defaults to the current analytics epoch.
+type PseudonymRequest struct {
+	Values    []string `bson:"values" json:"values"`
+	Uuids     []string `bson:"uuids" json:"uuids"`
+	ValueType string   `bson:"valueType" json:"valueType"`
+	Epoch     *int64   `bson:"epoch" json:"epoch"`
+}
+
+// Pseudonym is the result for a single value or token, in request order,
+// carrying either the pseudonym or an error code
+type Pseudonym struct {
+	Uuid      string `bson:"uuid" json:"uuid,omitempty"`
+	Pseudonym string `bson:"pseudonym" json:"pseudonym,omitempty"`
+	Error     string `bson:"error" json:"error,omitempty"`
+}
+
+// Pseudonyms holds one Pseudonym per requested value and per requested token,
+// each lined up with the request, and the epoch they were made for
+type Pseudonyms struct {
+	Epoch  int64       `bson:"epoch" json:"epoch"`
+	Values []Pseudonym `bson:"values" json:"values"`
+	Tokens []Pseudonym `bson:"tokens" json:"tokens"`
+}
+
+var (
+	ErrNoPseudonymInput = errors.New("data: need values or uuids to pseudonymize")
+	ErrEpochNotLinkable = errors.New("data: pseudonyms can't be made for this epoch")
+)
+
+// Pseudonymize returns a keyed hash for each value and token, the same for
+// the same value within a domain and analytics epoch, so datasets can be
+// joined and counted on it without detokenizing. Pseudonyms from different
+// domains or epochs can't be linked. Earlier epochs can only be asked for
+// while the domain's LinkablePseudonymEpochs allows it.
+// Tokens are read without counting against their read limits, since their values
+// are never returned.
+func Pseudonymize(domainUuid string, request PseudonymRequest) (Pseudonyms, error) {
+	pseudonyms := Pseudonyms{Values: []Pseudonym{}, Tokens: []Pseudonym{}}
+	if len(strings.TrimSpace(domainUuid)) == 0 {
+		return pseudonyms, errors.New("data: need domain id")
+	}
+	if len(request.Values) == 0 && len(request.Uuids) == 0 {
+		return pseudonyms, ErrNoPseudonymInput
+	}
+	if shrederr := checkDomainOpen(domainUuid); shrederr != nil {
+		return pseudonyms, shrederr
+	}
+
+	currentEpoch := pseudonymEpochAt(time.Now().Unix(), getPseudonymEpochDays())
+	epoch := currentEpoch
+	if request.Epoch != nil {
+		epoch = *request.Epoch
+	}
+	if epoch > currentEpoch || epoch < currentEpoch-getDomainConfig(domainUuid).LinkablePseudonymEpochs {
+		return pseudonyms, ErrEpochNotLinkable
+	}
+	pseudonyms.Epoch = epoch
+
+	getEncryptionKey()
+	if len(encryptionKey) == 0 {
+		return pseudonyms, ErrMasterKeyNotLoaded
+	}
+	epochKey := pseudonymKeyFor(domainUuid, epoch)
+
+	for _, value := range request.Values {
+		normalized, typeerr := NormalizeValue(request.ValueType, value)
+		if typeerr != nil {
+			var fielderr *FieldError
+			if errors.As(typeerr, &fielderr) && fielderr.Field == "valueType" {
+				return pseudonyms, typeerr
+			}
+			pseudonyms.Values = append(pseudonyms.Values, Pseudonym{Error: ErrCodeInvalidValue})
+			continue
+		}
+		pseudonyms.Values = append(pseudonyms.Values, Pseudonym{Pseudonym: tokencrypto.GetHMACForString(normalized, epochKey)})
+	}
+
+	if len(request.Uuids) == 0 {
+		return pseudonyms, nil
+	}
+	found := make(map[string]Token)
+	if !UnitTest {
+		var geterr error
+		found, geterr = fetchLiveTokens(domainUuid, request.Uuids)
+		if geterr != nil {
+			return pseudonyms, geterr
+		}
+	}
+	for _, tokenUuid := range request.Uuids {
+		result := Pseudonym{Uuid: tokenUuid}
+		if len(strings.TrimSpace(tokenUuid)) == 0 {
+			result.Error = ErrCodeInvalidId
+		} else if t, ok := found[strings.TrimSpace(tokenUuid)]; !ok {
+			result.Error = ErrCodeNotFound
+		} else if revealerr := revealValue(&t); revealerr != nil {
+			result.Error = ErrCodeDecryptFailed
+		} else {
+			result.Pseudonym = tokencrypto.GetHMACForString(t.Value, epochKey)
+		}
+		pseudonyms.Tokens = append(pseudonyms.Tokens, result)
+	}
+	return pseudonyms, nil
+}
+
+// pseudonymEpochAt numbers the analytics epochs from the unix epoch
+func pseudonymEpochAt(now int64, epochDays int64) int64 {
+	return now / (epochDays * 86400)
+}
+
+// pseudonymKeyFor derives the key for a domain's epoch from the encryption key,
+// so no pseudonym keys need to be stored, and each epoch's key is unrelated to the next
+func pseudonymKeyFor(domainUuid string, epoch int64) string {
+	label := "tokentarpon pseudonym\x00" + domainUuid + "\x00" + strconv.FormatInt(epoch, 10)
+	return tokencrypto.GetHMACForString(label, encryptionKey)
+}
+
+func getPseudonymEpochDays() int64 {
+	configuration, configerr := systemconfig.Load()
+	if configerr != nil || configuration.PseudonymEpochDays <= 0 {
+		return defaultPseudonymEpochDays
+	}
+	return configuration.PseudonymEpochDays
+}
@@ -0,0 +1,81 @@
+package tokenizer
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPseudonymize(t *testing.T) {
+	UnitTest = true
+	encryptionKey = ";kldfpo87-28374isu;dfjhZXJCVG786"
+	defer func() { encryptionKey = "" }()
+
+	request := PseudonymRequest{
+		Values:    []string{"Jane@Example.com", " jane@example.com", "not an email"},
+		Uuids:     []string{"abc", ""},
+		ValueType: ValueTypeEmail,
+	}
+	pseudonyms, err := Pseudonymize("mydomain", request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := pseudonymEpochAt(time.Now().Unix(), defaultPseudonymEpochDays), pseudonyms.Epoch; want != got {
+		t.Errorf("expect epoch %d but got %d", want, got)
+	}
+	if len(pseudonyms.Values) != 3 || len(pseudonyms.Tokens) != 2 {
+		t.Fatalf("expect results lined up with the request but got %#v", pseudonyms)
+	}
+	if pseudonyms.Values[0].Pseudonym != pseudonyms.Values[1].Pseudonym || len(pseudonyms.Values[0].Pseudonym) == 0 {
+		t.Error("expect the same normalized value to get the same pseudonym")
+	}
+	if want, got := ErrCodeInvalidValue, pseudonyms.Values[2].Error; want != got {
+		t.Errorf("expect error %s but got %s", want, got)
+	}
+	if want, got := ErrCodeNotFound, pseudonyms.Tokens[0].Error; want != got {
+		t.Errorf("expect error %s but got %s", want, got)
+	}
+	if want, got := ErrCodeInvalidId, pseudonyms.Tokens[1].Error; want != got {
+		t.Errorf("expect error %s but got %s", want, got)
+	}
+
+	other, _ := Pseudonymize("otherdomain", request)
+	if other.Values[0].Pseudonym == pseudonyms.Values[0].Pseudonym {
+		t.Error("expect pseudonyms to differ between domains")
+	}
+}
+
+func TestPseudonymizeEpochs(t *testing.T) {
+	UnitTest = true
+	encryptionKey = ";kldfpo87-28374isu;dfjhZXJCVG786"
+	defer func() { encryptionKey = "" }()
+
+	current := pseudonymEpochAt(time.Now().Unix(), defaultPseudonymEpochDays)
+	earlier := current - 1
+	later := current + 1
+	for _, epoch := range []*int64{&earlier, &later} {
+		_, err := Pseudonymize("mydomain", PseudonymRequest{Values: []string{"a value"}, Epoch: epoch})
+		if want, got := ErrEpochNotLinkable, err; want != got {
+			t.Errorf("expect error %#v for epoch %d but got %#v", want, *epoch, got)
+		}
+	}
+
+	if pseudonymKeyFor("mydomain", current) == pseudonymKeyFor("mydomain", earlier) {
+		t.Error("expect the key to change between epochs")
+	}
+}
+
+func TestPseudonymizeRejectsRequests(t *testing.T) {
+	UnitTest = true
+	encryptionKey = ";kldfpo87-28374isu;dfjhZXJCVG786"
+	defer func() { encryptionKey = "" }()
+
+	if _, err := Pseudonymize("mydomain", PseudonymRequest{}); err != ErrNoPseudonymInput {
+		t.Errorf("expect error %#v but got %#v", ErrNoPseudonymInput, err)
+	}
+	_, err := Pseudonymize("mydomain", PseudonymRequest{Values: []string{"42"}, ValueType: "shoesize"})
+	var fielderr *FieldError
+	if !errors.As(err, &fielderr) || fielderr.Field != "valueType" {
+		t.Errorf("expect an error for the value type but got %#v", err)
+	}
+}
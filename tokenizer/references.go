@@ -0,0 +1,80 @@
+package tokenizer
+
+import (
+	"regexp"
+)
+
+// a token reference as written by TokenPlaceholder
+var tokenReferencePattern = regexp.MustCompile(`\{\{token:([0-9A-Za-z\-]+)\}\}`)
+
+// TokenPlaceholder is how a token is written in place of its value in text,
+// such as redacted text or a request sent through the proxy
+func TokenPlaceholder(tokenUuid string) string {
+	return "{{token:" + tokenUuid + "}}"
+}
+
+// FindTokenReferences returns the uuids of the token references in the text, in order
+func FindTokenReferences(text string) []string {
+	var uuids []string
+	for _, match := range tokenReferencePattern.FindAllStringSubmatch(text, -1) {
+		uuids = append(uuids, match[1])
+	}
+	return uuids
+}
+
+// ReplaceTokenReferences replaces each token reference in the text with its
+// value. References without a value are left as they are.
+func ReplaceTokenReferences(text string, values map[string]string) string {
+	return tokenReferencePattern.ReplaceAllStringFunc(text, func(reference string) string {
+		if value, ok := values[tokenReferencePattern.FindStringSubmatch(reference)[1]]; ok {
+			return value
+		}
+		return reference
+	})
+}
+
+// ResolveTokenReferences looks up the full value of each token, returning
+// the values by uuid along with the results of the tokens that could not be
+// read. Reading a value counts against the token's read limit.
+func ResolveTokenReferences(domainUuid string, uuids []string) (map[string]string, []TokenValue, error) {
+	values := make(map[string]string)
+	var unresolved []TokenValue
+	if len(uuids) == 0 {
+		return values, unresolved, nil
+	}
+	tokenValues, err := GetTokenValues(TokenQuery{DomainUuid: domainUuid, Uuids: uuids, View: ValueView{Mode: ViewFull}})
+	if err != nil {
+		return values, unresolved, err
+	}
+	for _, result := range tokenValues.Results {
+		if len(result.Error) > 0 {
+			unresolved = append(unresolved, result)
+		} else {
+			values[result.Uuid] = result.Value
+		}
+	}
+	return values, unresolved, nil
+}
+
+// NewReferenceReplacer returns a function that gives back the token reference
+// for a text equal to one of the values, the reverse of ReplaceTokenReferences,
+// and any other text as it is. Only whole values are replaced, so a value that
+// turns up inside other text, such as a short one inside an id, is left alone.
+// Where tokens share a value, the one with the lowest uuid is used.
+func NewReferenceReplacer(values map[string]string) func(string) string {
+	references := make(map[string]string)
+	for tokenUuid, value := range values {
+		if len(value) == 0 {
+			continue
+		}
+		if existing, ok := references[value]; !ok || tokenUuid < existing {
+			references[value] = tokenUuid
+		}
+	}
+	return func(text string) string {
+		if tokenUuid, ok := references[text]; ok {
+			return TokenPlaceholder(tokenUuid)
+		}
+		return text
+	}
+}
@@ -0,0 +1,57 @@
+package tokenizer
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestReplaceTokenReferences(t *testing.T) {
+	values := map[string]string{"a1": "4242424242424242", "b2": "jane@example.com"}
+
+	testScenarios := []struct {
+		givenText    string
+		expectUuids  int
+		expectResult string
+	}{
+		{"card {{token:a1}}", 1, "card 4242424242424242"},
+		{"{{token:b2}},{{token:a1}},{{token:b2}}", 3, "jane@example.com,4242424242424242,jane@example.com"},
+		{"unknown {{token:c3}}", 1, "unknown {{token:c3}}"},
+		{"not a reference {{token:}} {token:a1}", 0, "not a reference {{token:}} {token:a1}"},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if want, got := scenario.expectUuids, len(FindTokenReferences(scenario.givenText)); want != got {
+				t.Errorf("expect %d references but got %d", want, got)
+			}
+			replaced := ReplaceTokenReferences(scenario.givenText, values)
+			if want, got := scenario.expectResult, replaced; want != got {
+				t.Errorf("expect %s but got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestNewReferenceReplacer(t *testing.T) {
+	replace := NewReferenceReplacer(map[string]string{"short": "555", "long": "+14155550123", "also": "555"})
+
+	testScenarios := []struct {
+		givenText    string
+		expectResult string
+	}{
+		{"+14155550123", "{{token:long}}"},
+		{"555", "{{token:also}}"},
+		// values inside other text are left alone
+		{"call +14155550123 ext 555", "call +14155550123 ext 555"},
+		{"ord_5551234", "ord_5551234"},
+		{"", ""},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if want, got := scenario.expectResult, replace(scenario.givenText); want != got {
+				t.Errorf("expect %s but got %s", want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package tokenizer
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"tokentarpon/tokenizer/datalog"
+	"tokentarpon/tokenizer/datastore"
+	"tokentarpon/tokenizer/systemconfig"
+)
+
+// audit actions recorded for the admin routes over deleted tokens
+const (
+	AuditListDeleted = "token.listDeleted"
+	AuditUndelete    = "token.undelete"
+)
+
+var ErrRetentionExpired = errors.New("data: token is past its retention window and can no longer be restored")
+
+// the fields changed when a deleted token is restored; deleted is written
+// as zero rather than left out, so the token no longer looks deleted to a purge
+type tokenRestore struct {
+	IsDeleted bool  `bson:"isDeleted"`
+	Deleted   int64 `bson:"deleted"`
+	Updated   int64 `bson:"updated"`
+}
+
+// ListDeletedTokens returns a page of the domain's soft deleted tokens,
+// most recently deleted first. Values are left out, the listing is only
+// for finding tokens to restore. Each listing is recorded in the audit log.
+func ListDeletedTokens(domainUuid string, start int64, limit int64, actor string) ([]Token, error) {
+	tokens := []Token{}
+	err := errors.New("data: need domain id")
+	if len(strings.TrimSpace(domainUuid)) == 0 {
+		return tokens, err
+	}
+	if limit <= 0 {
+		limit = getPageRecordCount()
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	if UnitTest {
+		return tokens, nil
+	}
+
+	sort := []datastore.DataSort{{FieldName: "deleted", Descending: true}, {FieldName: "uuid"}}
+	results, geterr := datastore.GetSortedRecordsIn(CollectionName, makeDeletedTokenQuery(domainUuid, ""),
+		"and", sort, start, limit, Token{})
+	if geterr != nil {
+		return tokens, geterr
+	}
+	for _, result := range results {
+		tok := result.(Token)
+		tok.Value = ""
+		tok.EncryptedValue = ""
+		tokens = append(tokens, tok)
+	}
+
+	_, auditerr := datalog.Write(datalog.Entry{
+		Action:     AuditListDeleted,
+		DomainUuid: domainUuid,
+		Actor:      actor,
+		Details: map[string]string{
+			"start":    strconv.FormatInt(start, 10),
+			"limit":    strconv.FormatInt(limit, 10),
+			"returned": strconv.Itoa(len(tokens)),
+		},
+	})
+	return tokens, auditerr
+}
+
+// UndeleteToken restores a soft deleted token, as long as the domain's
+// retention rules would not already have purged it. A token that is not
+// deleted, or that has been purged, returns ErrNoMatchingToken.
+func UndeleteToken(domainUuid string, tokenUuid string, actor string) (Token, error) {
+	var tok Token
+	err := errors.New("data: need domain id, token id")
+	if len(strings.TrimSpace(domainUuid)) == 0 {
+		return tok, err
+	}
+	if len(strings.TrimSpace(tokenUuid)) == 0 {
+		return tok, err
+	}
+
+	if UnitTest {
+		tok.DomainUuid = domainUuid
+		tok.Uuid = tokenUuid
+		return tok, nil
+	}
+
+	filter := makeDeletedTokenQuery(domainUuid, tokenUuid)
+	geterr := datastore.GetRecordIn(CollectionName, filter, &tok)
+	if geterr == datastore.ErrNotFound {
+		return Token{}, ErrNoMatchingToken
+	} else if geterr != nil {
+		return Token{}, geterr
+	}
+
+	now := time.Now().Unix()
+	if err := checkRestorable(tok, getDomainConfig(domainUuid), now); err != nil {
+		return Token{}, err
+	}
+
+	restore := tokenRestore{IsDeleted: false, Deleted: 0, Updated: now}
+	if _, updateerr := datastore.UpdateRecordIn(CollectionName, tokenRecordType, filter, "and", restore); updateerr != nil {
+		return Token{}, updateerr
+	}
+	deleted := tok.Deleted
+	tok.IsDeleted = restore.IsDeleted
+	tok.Deleted = restore.Deleted
+	tok.Updated = restore.Updated
+
+	_, auditerr := datalog.Write(datalog.Entry{
+		Action:     AuditUndelete,
+		DomainUuid: domainUuid,
+		Actor:      actor,
+		Details: map[string]string{
+			"tokenUuid": tokenUuid,
+			"deleted":   strconv.FormatInt(deleted, 10),
+		},
+	})
+	if auditerr != nil {
+		return Token{}, auditerr
+	}
+
+	if tok.MaxReads > 0 {
+		tok.Value = ""
+		tok.EncryptedValue = ""
+		return tok, nil
+	}
+	return tok, revealValue(&tok)
+}
+
+// checkRestorable refuses a token the retention rules have already passed,
+// even if the purge has not run yet, so a restore never races the purge
+func checkRestorable(tok Token, policy systemconfig.DomainConfig, now int64) error {
+	if policy.DeletedRetentionDays > 0 && tok.Deleted > 0 &&
+		tok.Deleted <= now-policy.DeletedRetentionDays*secondsPerDay {
+		return ErrRetentionExpired
+	}
+	if policy.RetentionDays > 0 && tok.Created <= now-policy.RetentionDays*secondsPerDay {
+		return ErrRetentionExpired
+	}
+	return nil
+}
+
+// makeDeletedTokenQuery finds a domain's deleted tokens, or a single one when tokenUuid is set
+func makeDeletedTokenQuery(domainUuid string, tokenUuid string) []datastore.DataQueryGroup {
+	var filters = make([]datastore.DataQueryGroup, 1)
+	var nvq datastore.DataQueryGroup
+
+	nvq.Operator = "and"
+	nvq.DataQueries = []datastore.DataQuery{
+		{FieldName: "domainUuid", FieldValue: domainUuid, CaseSensitive: true},
+		{FieldName: "isDeleted", IsBool: true, BoolValue: true},
+	}
+	if len(tokenUuid) > 0 {
+		nvq.DataQueries = append(nvq.DataQueries,
+			datastore.DataQuery{FieldName: "uuid", FieldValue: tokenUuid, CaseSensitive: true})
+	}
+	filters[0] = nvq
+	return filters
+}
@@ -0,0 +1,80 @@
+package tokenizer
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"tokentarpon/tokenizer/datastore"
+	"tokentarpon/tokenizer/systemconfig"
+)
+
+func TestCheckRestorable(t *testing.T) {
+	var now int64 = 1700000000
+	day := secondsPerDay
+	policy := systemconfig.DomainConfig{DeletedRetentionDays: 30, RetentionDays: 365}
+
+	testScenarios := []struct {
+		givenToken  Token
+		givenPolicy systemconfig.DomainConfig
+		expectErr   error
+	}{
+		{Token{Created: now - 10*day, Deleted: now - day}, policy, nil},
+		{Token{Created: now - 40*day, Deleted: now - 31*day}, policy, ErrRetentionExpired},
+		{Token{Created: now - 400*day, Deleted: now - day}, policy, ErrRetentionExpired},
+		// deleted before deletion times were recorded, only the age rule applies
+		{Token{Created: now - 10*day}, policy, nil},
+		// no rules, always restorable
+		{Token{Created: now - 400*day, Deleted: now - 300*day}, systemconfig.DomainConfig{}, nil},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if want, got := scenario.expectErr, checkRestorable(scenario.givenToken, scenario.givenPolicy, now); want != got {
+				t.Errorf("expect error %#v but got %#v", want, got)
+			}
+		})
+	}
+}
+
+func TestMakeDeletedTokenQuery(t *testing.T) {
+	filter := datastore.CreateMongoFilter(makeDeletedTokenQuery("mydomain", ""), "and")
+	want := "map[$and:[map[domainUuid:mydomain] map[isDeleted:map[$eq:true]]]]"
+	if got := fmt.Sprint(filter); want != got {
+		t.Errorf("expect filter %s but got %s", want, got)
+	}
+
+	filter = datastore.CreateMongoFilter(makeDeletedTokenQuery("mydomain", "abc"), "and")
+	want = "map[$and:[map[domainUuid:mydomain] map[isDeleted:map[$eq:true]] map[uuid:abc]]]"
+	if got := fmt.Sprint(filter); want != got {
+		t.Errorf("expect filter %s but got %s", want, got)
+	}
+}
+
+func TestUndeleteToken(t *testing.T) {
+	UnitTest = true
+	testScenarios := []struct {
+		domainUuid string
+		tokenUuid  string
+		expectErr  bool
+	}{
+		{"mydomain", "abc", false},
+		{"", "abc", true},
+		{"mydomain", " ", true},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			tok, err := UndeleteToken(scenario.domainUuid, scenario.tokenUuid, "admin")
+			if want, got := scenario.expectErr, err != nil; want != got {
+				t.Fatalf("expect error %t but got %#v", want, err)
+			}
+			if err == nil && tok.IsDeleted {
+				t.Error("expect restored token not to be deleted")
+			}
+		})
+	}
+
+	if _, err := ListDeletedTokens("", 0, 10, "admin"); err == nil {
+		t.Error("expect listing without a domain to fail")
+	}
+}
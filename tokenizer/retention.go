@@ -0,0 +1,256 @@
+package tokenizer
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+	"tokentarpon/tokenizer/datalog"
+	"tokentarpon/tokenizer/datastore"
+	"tokentarpon/tokenizer/systemconfig"
+)
+
+var defaultPurgeIntervalSeconds int64 = 3600
+var secondsPerDay int64 = 86400
+
+// audit action recorded for each retention purge run
+const AuditRetentionPurge = "retention.purge"
+
+// PurgeSummary counts the tokens hard deleted from a domain by a purge run
+type PurgeSummary struct {
+	DomainUuid    string `bson:"domainUuid" json:"domainUuid"`
+	DeletedPurged int64  `bson:"deletedPurged" json:"deletedPurged"`
+	AgedPurged    int64  `bson:"agedPurged" json:"agedPurged"`
+}
+
+// PurgeDomain hard deletes the domain's tokens that are past its retention rules,
+// along with their history:
+// tokens deleted more than DeletedRetentionDays ago, and tokens created more than
+// RetentionDays ago whether deleted or not. A rule of zero days is not applied.
+func PurgeDomain(domainUuid string, policy systemconfig.DomainConfig, now int64) (PurgeSummary, error) {
+	summary := PurgeSummary{DomainUuid: domainUuid}
+	if UnitTest {
+		return summary, nil
+	}
+
+	if cutoff, applies := retentionCutoff(policy.DeletedRetentionDays, now); applies {
+		purged, err := purgeTokens(makeDeletedBeforeQuery(domainUuid, cutoff), "and")
+		if err != nil {
+			return summary, err
+		}
+		summary.DeletedPurged = purged
+	}
+
+	if cutoff, applies := retentionCutoff(policy.RetentionDays, now); applies {
+		purged, err := purgeTokens(makeCreatedBeforeQuery(domainUuid, cutoff), "and")
+		if err != nil {
+			return summary, err
+		}
+		summary.AgedPurged = purged
+	}
+	return summary, nil
+}
+
+// PurgeByRetention runs the retention rules for every configured domain,
+// and records a summary of the run in the audit log whether it succeeded or not
+func PurgeByRetention() ([]PurgeSummary, error) {
+	var summaries []PurgeSummary
+	configuration, configerr := systemconfig.Load()
+	if configerr != nil {
+		return summaries, configerr
+	}
+
+	domainUuids := make([]string, 0, len(configuration.Domains))
+	for domainUuid := range configuration.Domains {
+		domainUuids = append(domainUuids, domainUuid)
+	}
+	sort.Strings(domainUuids)
+
+	started := time.Now().Unix()
+	details := make(map[string]string)
+	var total int64
+	var runerr error
+	for _, domainUuid := range domainUuids {
+		policy := configuration.Domains[domainUuid]
+		if policy.DeletedRetentionDays <= 0 && policy.RetentionDays <= 0 {
+			continue
+		}
+		summary, err := PurgeDomain(domainUuid, policy, started)
+		details[domainUuid+".deletedPurged"] = strconv.FormatInt(summary.DeletedPurged, 10)
+		details[domainUuid+".agedPurged"] = strconv.FormatInt(summary.AgedPurged, 10)
+		total += summary.DeletedPurged + summary.AgedPurged
+		summaries = append(summaries, summary)
+		if err != nil {
+			details[domainUuid+".error"] = fmt.Sprint(err)
+			runerr = err
+		}
+	}
+
+	details["started"] = strconv.FormatInt(started, 10)
+	details["finished"] = strconv.FormatInt(time.Now().Unix(), 10)
+	details["domains"] = strconv.Itoa(len(summaries))
+	details["totalPurged"] = strconv.FormatInt(total, 10)
+	_, auditerr := datalog.Write(datalog.Entry{
+		Action:  AuditRetentionPurge,
+		Actor:   datalog.ActorSystem,
+		Details: details,
+	})
+	if runerr != nil {
+		return summaries, runerr
+	}
+	return summaries, auditerr
+}
+
+// PurgeOnSchedule applies the retention rules on an interval, for the life of the service
+func PurgeOnSchedule() {
+	interval := time.Duration(getPurgeIntervalSeconds()) * time.Second
+	for range time.Tick(interval) {
+		if _, err := PurgeByRetention(); err != nil {
+			fmt.Printf("retention purge failed: %s\n", fmt.Sprint(err))
+		}
+	}
+}
+
+// a token to purge, with just enough to find its history
+type purgeCandidate struct {
+	DomainUuid string `bson:"domainUuid"`
+	Uuid       string `bson:"uuid"`
+}
+
+// purgeTokens hard deletes the tokens matching the filter along with their
+// history, a page of token ids at a time, so no version outlives its token.
+// Each page is deleted with the filter still applied, so a token restored
+// after the page was read is left alone, and so is its history.
+func purgeTokens(filter []datastore.DataQueryGroup, operator string) (int64, error) {
+	pageRecordCount := getPageRecordCount()
+	if pageRecordCount <= 0 {
+		pageRecordCount = defaultPageRecordCount
+	}
+
+	var purged int64
+	for {
+		results, geterr := datastore.GetRecordsIn(CollectionName, filter, operator, 0, pageRecordCount, purgeCandidate{})
+		if geterr != nil {
+			return purged, geterr
+		}
+		if len(results) == 0 {
+			return purged, nil
+		}
+
+		var domainUuids []string
+		byDomain := make(map[string][]string)
+		for _, result := range results {
+			candidate := result.(purgeCandidate)
+			if _, seen := byDomain[candidate.DomainUuid]; !seen {
+				domainUuids = append(domainUuids, candidate.DomainUuid)
+			}
+			byDomain[candidate.DomainUuid] = append(byDomain[candidate.DomainUuid], candidate.Uuid)
+		}
+
+		var deleted int64
+		for _, domainUuid := range domainUuids {
+			count, err := purgeTokenPage(domainUuid, byDomain[domainUuid], filter, operator)
+			deleted += count
+			if err != nil {
+				return purged + deleted, err
+			}
+		}
+		purged += deleted
+		// the page no longer matched, stop rather than read it again
+		if deleted == 0 {
+			return purged, nil
+		}
+	}
+}
+
+// purgeTokenPage deletes a page of a domain's tokens that still match the
+// filter, then the history of those that are gone and any response kept
+// for idempotent replay that holds them
+func purgeTokenPage(domainUuid string, tokenUuids []string, filter []datastore.DataQueryGroup, operator string) (int64, error) {
+	pageFilter := []datastore.DataQueryGroup{
+		{Operator: operator, DataQueryGroups: filter},
+		makeTokenUuidsQuery(domainUuid, tokenUuids)[0],
+	}
+	deleted, deleteerr := datastore.DeleteRecordsIn(CollectionName, pageFilter, "and")
+	if deleteerr != nil || deleted == 0 {
+		return deleted, deleteerr
+	}
+
+	gone := tokenUuids
+	if deleted < int64(len(tokenUuids)) {
+		remaining, geterr := datastore.GetRecordsIn(CollectionName, makeTokenUuidsQuery(domainUuid, tokenUuids),
+			"and", 0, int64(len(tokenUuids)), purgeCandidate{})
+		if geterr != nil {
+			return deleted, geterr
+		}
+		kept := make(map[string]bool)
+		for _, result := range remaining {
+			kept[result.(purgeCandidate).Uuid] = true
+		}
+		gone = nil
+		for _, tokenUuid := range tokenUuids {
+			if !kept[tokenUuid] {
+				gone = append(gone, tokenUuid)
+			}
+		}
+	}
+	if len(gone) == 0 {
+		return deleted, nil
+	}
+	if _, historyerr := datastore.DeleteRecordsIn(historyCollectionName, makeTokenUuidsQuery(domainUuid, gone), "and"); historyerr != nil {
+		return deleted, historyerr
+	}
+	return deleted, deleteIdempotencyRecords(domainUuid, gone)
+}
+
+// retentionCutoff is the time at or before which a rule of the given days
+// purges, and whether the rule applies at all
+func retentionCutoff(days int64, now int64) (int64, bool) {
+	if days <= 0 {
+		return 0, false
+	}
+	return now - days*secondsPerDay, true
+}
+
+func makeDeletedBeforeQuery(domainUuid string, cutoff int64) []datastore.DataQueryGroup {
+	var filters = make([]datastore.DataQueryGroup, 1)
+	var nvq datastore.DataQueryGroup
+
+	nvq.Operator = "and"
+	nvq.DataQueries = []datastore.DataQuery{
+		{FieldName: "domainUuid", FieldValue: domainUuid, CaseSensitive: true},
+		{FieldName: "isDeleted", IsBool: true, BoolValue: true},
+		{FieldName: "deleted", IsInt: true, IntValue: cutoff, Comparison: "lte"},
+	}
+	filters[0] = nvq
+	return filters
+}
+
+func makeCreatedBeforeQuery(domainUuid string, cutoff int64) []datastore.DataQueryGroup {
+	var filters = make([]datastore.DataQueryGroup, 1)
+	var nvq datastore.DataQueryGroup
+
+	nvq.Operator = "and"
+	nvq.DataQueries = []datastore.DataQuery{
+		{FieldName: "domainUuid", FieldValue: domainUuid, CaseSensitive: true},
+		{FieldName: "created", IsInt: true, IntValue: cutoff, Comparison: "lte"},
+	}
+	filters[0] = nvq
+	return filters
+}
+
+func getPurgeIntervalSeconds() int64 {
+	configuration, configerr := systemconfig.Load()
+	if configerr != nil || configuration.PurgeIntervalSeconds <= 0 {
+		return defaultPurgeIntervalSeconds
+	}
+	return configuration.PurgeIntervalSeconds
+}
+
+func getDomainConfig(domainUuid string) systemconfig.DomainConfig {
+	configuration, configerr := systemconfig.Load()
+	if configerr != nil {
+		return systemconfig.DomainConfig{}
+	}
+	return configuration.Domains[domainUuid]
+}
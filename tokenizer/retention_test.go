@@ -0,0 +1,50 @@
+package tokenizer
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"tokentarpon/tokenizer/datastore"
+)
+
+func TestRetentionCutoff(t *testing.T) {
+	var now int64 = 1700000000
+	testScenarios := []struct {
+		givenDays     int64
+		expectCutoff  int64
+		expectApplies bool
+	}{
+		{30, now - 30*86400, true},
+		{365, now - 365*86400, true},
+		{1, now - 86400, true},
+		// 0 means never purge
+		{0, 0, false},
+		{-1, 0, false},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			cutoff, applies := retentionCutoff(scenario.givenDays, now)
+			if want, got := scenario.expectApplies, applies; want != got {
+				t.Errorf("expect applies %t but got %t", want, got)
+			}
+			if want, got := scenario.expectCutoff, cutoff; want != got {
+				t.Errorf("expect cutoff %d but got %d", want, got)
+			}
+		})
+	}
+}
+
+func TestMakeDeletedBeforeQuery(t *testing.T) {
+	filter := datastore.CreateMongoFilter(makeDeletedBeforeQuery("mydomain", 1700000000), "and")
+	want := "map[$and:[map[domainUuid:mydomain] map[isDeleted:map[$eq:true]] map[deleted:map[$lte:1700000000]]]]"
+	if got := fmt.Sprint(filter); want != got {
+		t.Errorf("expect filter %s but got %s", want, got)
+	}
+
+	filter = datastore.CreateMongoFilter(makeCreatedBeforeQuery("mydomain", 1700000000), "and")
+	want = "map[$and:[map[domainUuid:mydomain] map[created:map[$lte:1700000000]]]]"
+	if got := fmt.Sprint(filter); want != got {
+		t.Errorf("expect filter %s but got %s", want, got)
+	}
+}
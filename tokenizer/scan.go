@@ -0,0 +1,234 @@
+package tokenizer
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Detector finds one kind of PII in free text. Each match of Pattern is
+// checked against ValueType, when it has one, so e.g. a run of digits is
+// only taken as a card number if it passes the Luhn check, and is
+// tokenized normalized like any other token of the type.
+type Detector struct {
+	Pattern   *regexp.Regexp
+	ValueType string
+}
+
+// ScanRequest is free text to find PII in. Detectors narrows the scan to
+// some of the detectors enabled for the domain; by default all are run.
+type ScanRequest struct {
+	Text      string   `bson:"text" json:"text"`
+	Detectors []string `bson:"detectors" json:"detectors"`
+}
+
+// ScanMatch is a piece of PII found in the text and the token it was
+// replaced by. Start and End are character offsets into the text that was
+// scanned, RedactedStart and RedactedEnd those of its placeholder in the
+// redacted text.
+type ScanMatch struct {
+	Detector      string `bson:"detector" json:"detector"`
+	ValueType     string `bson:"valueType" json:"valueType,omitempty"`
+	Uuid          string `bson:"uuid" json:"uuid"`
+	Start         int    `bson:"start" json:"start"`
+	End           int    `bson:"end" json:"end"`
+	RedactedStart int    `bson:"redactedStart" json:"redactedStart"`
+	RedactedEnd   int    `bson:"redactedEnd" json:"redactedEnd"`
+}
+
+// ScanResult is the text with every match replaced by its token placeholder,
+// and the matches in the order they appear
+type ScanResult struct {
+	Text    string      `bson:"text" json:"text"`
+	Matches []ScanMatch `bson:"matches" json:"matches"`
+}
+
+// a detector's match before it is tokenized, offsets in bytes
+type scanCandidate struct {
+	detector  string
+	valueType string
+	value     string
+	start     int
+	end       int
+}
+
+var ErrNoScanText = errors.New("data: need text to scan")
+
+var detectors = map[string]Detector{
+	ValueTypeEmail: {Pattern: regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`), ValueType: ValueTypeEmail},
+	ValueTypePhone: {Pattern: regexp.MustCompile(`(?:\+|\b00)[1-9][0-9 .\-()]{6,20}[0-9]`), ValueType: ValueTypePhone},
+	ValueTypePAN:   {Pattern: regexp.MustCompile(`\b[0-9](?:[ \-]?[0-9]){11,18}\b`), ValueType: ValueTypePAN},
+	ValueTypeSSN:   {Pattern: regexp.MustCompile(`\b[0-9]{3}-[0-9]{2}-[0-9]{4}\b`), ValueType: ValueTypeSSN},
+	ValueTypeIBAN:  {Pattern: regexp.MustCompile(`\b[A-Z]{2}[0-9]{2}(?: ?[A-Z0-9]{4}){2,7}(?: ?[A-Z0-9]{1,3})?\b`), ValueType: ValueTypeIBAN},
+}
+var detectorsMutex sync.RWMutex
+
+// RegisterDetector adds a detector every domain can scan with, or replaces
+// an existing one. Domains that list their ScanDetectors only run the ones listed.
+func RegisterDetector(name string, detector Detector) {
+	detectorsMutex.Lock()
+	defer detectorsMutex.Unlock()
+	detectors[strings.ToLower(strings.TrimSpace(name))] = detector
+}
+
+// ScanText finds PII in the text with the domain's detectors, tokenizes each
+// match into the domain and returns the text with the matches replaced by
+// their token placeholders. The same value found more than once is
+// tokenized once. Where matches overlap the earliest, then longest, is kept.
+// The text may be as long as the domain's request limit, and each match as
+// long as its value limit; a longer one fails the scan with a FieldError,
+// rather than being left in the text. The matches are tokenized all or none.
+func ScanText(domainUuid string, request ScanRequest) (ScanResult, error) {
+	result := ScanResult{Matches: []ScanMatch{}}
+	if len(strings.TrimSpace(domainUuid)) == 0 {
+		return result, errors.New("data: need domain id")
+	}
+	if len(strings.TrimSpace(request.Text)) == 0 {
+		return result, ErrNoScanText
+	}
+	limits := GetRequestLimits(domainUuid)
+	if int64(len(request.Text)) > limits.MaxRequestBytes {
+		return result, &FieldError{Field: "text", Message: "must be at most " + strconv.FormatInt(limits.MaxRequestBytes, 10) + " bytes"}
+	}
+	scanDetectors, err := detectorsFor(domainUuid, request.Detectors)
+	if err != nil {
+		return result, err
+	}
+	if shrederr := checkDomainOpen(domainUuid); shrederr != nil {
+		return result, shrederr
+	}
+
+	candidates := findCandidates(request.Text, scanDetectors)
+
+	// one token per distinct value, in the order the values first appear
+	var tokens []Token
+	tokenIndex := make(map[string]int)
+	for _, candidate := range candidates {
+		if int64(len(candidate.value)) > limits.MaxValueBytes {
+			return result, &FieldError{Field: "text", Message: "holds a match found by the " + candidate.detector + " detector that " + valueTooBigMessage(limits.MaxValueBytes)}
+		}
+		key := candidate.valueType + "\x00" + candidate.value
+		if _, ok := tokenIndex[key]; !ok {
+			tokenIndex[key] = len(tokens)
+			tokens = append(tokens, Token{DomainUuid: domainUuid, Value: candidate.value, ValueType: candidate.valueType})
+		}
+	}
+	var createdTokens []Token
+	if len(tokens) > 0 {
+		createdTokens, _, err = CreateTokensAtomic(domainUuid, tokens)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	// offsets are counted as the text is rebuilt, in characters rather than bytes
+	var redacted strings.Builder
+	last, offset, redactedOffset := 0, 0, 0
+	for _, candidate := range candidates {
+		tokenUuid := createdTokens[tokenIndex[candidate.valueType+"\x00"+candidate.value]].Uuid
+		placeholder := TokenPlaceholder(tokenUuid)
+		between := utf8.RuneCountInString(request.Text[last:candidate.start])
+		match := ScanMatch{
+			Detector:      candidate.detector,
+			ValueType:     candidate.valueType,
+			Uuid:          tokenUuid,
+			Start:         offset + between,
+			End:           offset + between + utf8.RuneCountInString(request.Text[candidate.start:candidate.end]),
+			RedactedStart: redactedOffset + between,
+			RedactedEnd:   redactedOffset + between + utf8.RuneCountInString(placeholder),
+		}
+		result.Matches = append(result.Matches, match)
+		redacted.WriteString(request.Text[last:candidate.start])
+		redacted.WriteString(placeholder)
+		last, offset, redactedOffset = candidate.end, match.End, match.RedactedEnd
+	}
+	redacted.WriteString(request.Text[last:])
+	result.Text = redacted.String()
+	return result, nil
+}
+
+// findCandidates runs every detector over the text, keeps the matches valid
+// for their value type, and drops the ones overlapping an earlier match
+func findCandidates(text string, scanDetectors map[string]Detector) []scanCandidate {
+	var found []scanCandidate
+	for name, detector := range scanDetectors {
+		for _, loc := range detector.Pattern.FindAllStringIndex(text, -1) {
+			if loc[0] == loc[1] {
+				continue
+			}
+			value, err := NormalizeValue(detector.ValueType, text[loc[0]:loc[1]])
+			if err != nil {
+				continue
+			}
+			found = append(found, scanCandidate{detector: name, valueType: detector.ValueType, value: value, start: loc[0], end: loc[1]})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].start != found[j].start {
+			return found[i].start < found[j].start
+		}
+		if found[i].end != found[j].end {
+			return found[i].end > found[j].end
+		}
+		return found[i].detector < found[j].detector
+	})
+
+	var candidates []scanCandidate
+	end := 0
+	for _, candidate := range found {
+		if candidate.start >= end {
+			candidates = append(candidates, candidate)
+			end = candidate.end
+		}
+	}
+	return candidates
+}
+
+// detectorsFor returns the detectors enabled for the domain: the ones its
+// ScanDetectors names, or every registered one along with its ScanPatterns.
+// When names are asked for, only those are returned.
+func detectorsFor(domainUuid string, names []string) (map[string]Detector, error) {
+	policy := getDomainConfig(domainUuid)
+	available := make(map[string]Detector)
+	detectorsMutex.RLock()
+	for name, detector := range detectors {
+		available[name] = detector
+	}
+	detectorsMutex.RUnlock()
+	for name, pattern := range policy.ScanPatterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.New("data: scan pattern " + name + " for the domain is not a valid regular expression")
+		}
+		available[strings.ToLower(strings.TrimSpace(name))] = Detector{Pattern: compiled}
+	}
+
+	enabled := available
+	if len(policy.ScanDetectors) > 0 {
+		enabled = make(map[string]Detector)
+		for _, name := range policy.ScanDetectors {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if detector, ok := available[name]; ok {
+				enabled[name] = detector
+			}
+		}
+	}
+	if len(names) == 0 {
+		return enabled, nil
+	}
+
+	chosen := make(map[string]Detector)
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		detector, ok := enabled[name]
+		if !ok {
+			return nil, &FieldError{Field: "detectors", Message: "has a detector not enabled for the domain: " + name}
+		}
+		chosen[name] = detector
+	}
+	return chosen, nil
+}
@@ -0,0 +1,132 @@
+package tokenizer
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFindCandidates(t *testing.T) {
+	testScenarios := []struct {
+		givenText       string
+		expectDetectors []string
+		expectValues    []string
+	}{
+		{"mail Jane@Example.com today", []string{"email"}, []string{"jane@example.com"}},
+		{"call +1 (415) 555-0123 after 5", []string{"phone"}, []string{"+14155550123"}},
+		{"card 4242 4242 4242 4242 exp 12/30", []string{"pan"}, []string{"4242424242424242"}},
+		{"card 4242 4242 4242 4241 is a typo", nil, nil},
+		{"ssn 123-45-6789, not 000-12-3456", []string{"ssn"}, []string{"123-45-6789"}},
+		{"pay GB82 WEST 1234 5698 7654 32 AND thanks", []string{"iban"}, []string{"GB82WEST12345698765432"}},
+		{"order 12345 shipped on 2024-01-02", nil, nil},
+		{"a@b.io and 378282246310005", []string{"email", "pan"}, []string{"a@b.io", "378282246310005"}},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			candidates := findCandidates(scenario.givenText, detectors)
+			if want, got := len(scenario.expectValues), len(candidates); want != got {
+				t.Fatalf("expect %d matches but got %d: %#v", want, got, candidates)
+			}
+			for idx, candidate := range candidates {
+				if want, got := scenario.expectDetectors[idx], candidate.detector; want != got {
+					t.Errorf("expect detector %s but got %s", want, got)
+				}
+				if want, got := scenario.expectValues[idx], candidate.value; want != got {
+					t.Errorf("expect value %s but got %s", want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestScanText(t *testing.T) {
+	UnitTest = true
+	text := "Hi, I'm José, jose@example.com. Card 4242424242424242; again jose@example.com"
+
+	result, err := ScanText("mydomain", ScanRequest{Text: text})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 3, len(result.Matches); want != got {
+		t.Fatalf("expect %d matches but got %d", want, got)
+	}
+	if strings.Contains(result.Text, "jose@example.com") || strings.Contains(result.Text, "4242") {
+		t.Errorf("expect the PII to be redacted but got %s", result.Text)
+	}
+	if want, got := result.Matches[0].Uuid, result.Matches[2].Uuid; want != got {
+		t.Errorf("expect the same value to get the same token but got %s and %s", want, got)
+	}
+
+	runes, redactedRunes := []rune(text), []rune(result.Text)
+	for _, match := range result.Matches {
+		if want, got := TokenPlaceholder(match.Uuid), string(redactedRunes[match.RedactedStart:match.RedactedEnd]); want != got {
+			t.Errorf("expect placeholder %s at the redacted offsets but got %s", want, got)
+		}
+		if _, err := NormalizeValue(match.ValueType, string(runes[match.Start:match.End])); err != nil {
+			t.Errorf("expect a %s at the offsets but got %s", match.ValueType, string(runes[match.Start:match.End]))
+		}
+	}
+}
+
+func TestScanTextDetectors(t *testing.T) {
+	UnitTest = true
+	RegisterDetector("employeeid", Detector{Pattern: regexp.MustCompile(`\bEMP-[0-9]{6}\b`)})
+	defer func() {
+		detectorsMutex.Lock()
+		delete(detectors, "employeeid")
+		detectorsMutex.Unlock()
+	}()
+	text := "EMP-004211 emailed a@b.io"
+
+	testScenarios := []struct {
+		givenDetectors []string
+		expectMatches  int
+		expectErr      bool
+	}{
+		{nil, 2, false},
+		{[]string{"employeeid"}, 1, false},
+		{[]string{"EMAIL"}, 1, false},
+		{[]string{"ssn"}, 0, false},
+		{[]string{"passport"}, 0, true},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			result, err := ScanText("mydomain", ScanRequest{Text: text, Detectors: scenario.givenDetectors})
+			if want, got := scenario.expectErr, err != nil; want != got {
+				t.Fatalf("expect error %t but got %#v", want, err)
+			}
+			if want, got := scenario.expectMatches, len(result.Matches); want != got {
+				t.Errorf("expect %d matches but got %d", want, got)
+			}
+		})
+	}
+}
+
+func TestScanTextLimits(t *testing.T) {
+	UnitTest = true
+	limits := GetRequestLimits("mydomain")
+
+	testScenarios := []struct {
+		givenText   string
+		expectField bool
+	}{
+		{"mail jose@example.com", false},
+		// a match over the value limit fails the scan rather than being left in the text
+		{"mail " + strings.Repeat("j", int(limits.MaxValueBytes)) + "@example.com", true},
+		{strings.Repeat("x", int(limits.MaxRequestBytes)+1), true},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			_, err := ScanText("mydomain", ScanRequest{Text: scenario.givenText})
+			var fielderr *FieldError
+			if want, got := scenario.expectField, errors.As(err, &fielderr); want != got {
+				t.Errorf("expect field error %t but got %#v", want, err)
+			}
+		})
+	}
+}
@@ -9,13 +9,62 @@ import (
 var servicePathName = "tokenizerService"
 
 type Configuration struct {
-	TokenizerServiceUrl     string // tokenizerService
-	TokenizerServiceApiMode string // tokenizerService
-	CORSAllowOrigin         string // tokenizerService
-	MongoUri                string // datastore
-	MongoDatabase           string // datastore
-	PageRecordCount         int64  // tokenizer
-	EncryptionKey           string // tokenizer
+	TokenizerServiceUrl      string                   // tokenizerService
+	TokenizerServiceApiMode  string                   // tokenizerService
+	CORSAllowOrigin          string                   // tokenizerService
+	MongoUri                 string                   // datastore
+	MongoDatabase            string                   // datastore
+	PageRecordCount          int64                    // tokenizer
+	EncryptionKey            string                   // tokenizer
+	EncryptValues            bool                     // tokenizer
+	EncryptionWorkers        int                      // tokenizer
+	IdempotencyWindowSeconds int64                    // tokenizer
+	ExpirySweepSeconds       int64                    // tokenizer
+	PurgeIntervalSeconds     int64                    // tokenizer
+	Domains                  map[string]DomainConfig  // tokenizer, settings for each domain by domain id
+	ApiKeys                  []ApiKey                 // tokenizerService, callers allowed to use scoped routes
+	DomainKeyCacheSeconds    int64                    // tokenizer
+	Accounts                 map[string][]string      // tokenizer, domain ids for each account id
+	RequireDetokenizeScope   bool                     // tokenizerService, value routes need an api key with a detokenize scope
+	VerifyMaxAttempts        int64                    // tokenizer, verify attempts allowed per token in each window
+	VerifyWindowSeconds      int64                    // tokenizer
+	PseudonymEpochDays       int64                    // tokenizer, pseudonym keys rotate every this many days
+	ProxyUpstreams           map[string]ProxyUpstream // tokenizerService, upstreams the outbound proxy may forward to by name
+	ProxyTimeoutSeconds      int64                    // tokenizerService
+	TemplateSinks            map[string]string        // tokenizerService, urls rendered templates may be posted to by name
+	JobDirectory             string                   // tokenizer, where bulk job files are kept while they run
+	JobMaxInputBytes         int64                    // tokenizer
+	JobPollSeconds           int64                    // tokenizer
+	MaxValueBytes            int64                    // tokenizer, largest token value, before a domain's own limit
+	MaxBatchItems            int64                    // tokenizerService, most tokens in a batch request
+	MaxRequestBytes          int64                    // tokenizerService, largest request body, but for uploads and streams
+}
+
+// ApiKey lets a caller presenting Key in the x-auth-token header
+// use the routes its scopes allow; Name identifies the caller in the audit log
+type ApiKey struct {
+	Name   string
+	Key    string
+	Scopes []string
+}
+
+// ProxyUpstream is an upstream the outbound proxy forwards requests to,
+// with the path the caller asks for appended to Url
+type ProxyUpstream struct {
+	Url              string
+	TokenizeResponse bool // put the token references back in place of the values sent, in the response
+}
+
+// DomainConfig holds the settings for a single domain
+type DomainConfig struct {
+	DeletedRetentionDays    int64             // purge deleted tokens this many days after deletion
+	RetentionDays           int64             // purge every token this many days after creation
+	LinkablePseudonymEpochs int64             // earlier epochs pseudonyms can still be made for
+	ScanDetectors           []string          // detectors text is scanned with, every registered one when empty
+	ScanPatterns            map[string]string // extra detectors for the domain, regular expressions by name
+	MaxValueBytes           int64             // limits for the domain, in place of the global ones
+	MaxBatchItems           int64
+	MaxRequestBytes         int64
 }
 
 func Load() (Configuration, error) {
@@ -0,0 +1,249 @@
+package tokenizer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	htmltemplate "html/template"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// formats a template can be rendered in; html escapes the values for the page they are put in
+const (
+	TemplateFormatText = "text"
+	TemplateFormatHTML = "html"
+)
+
+// the largest template, and the largest output, a render will take on
+const (
+	maxTemplateBytes       = 64 * 1024
+	maxTemplateOutputBytes = 1024 * 1024
+)
+
+// token names are used as template fields, e.g. {{.name}}
+var templateTokenNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,63}$`)
+
+// TemplateToken is a token whose value is put in a template, and the view it
+// is presented in, e.g. only the last 4 digits of a card number
+type TemplateToken struct {
+	Uuid  string `bson:"uuid" json:"uuid"`
+	View  string `bson:"view" json:"view"`
+	Count int    `bson:"n" json:"n"`
+}
+
+// UnmarshalJSON takes a token given as just its uuid, as well as the full object
+func (t *TemplateToken) UnmarshalJSON(data []byte) error {
+	var tokenUuid string
+	if err := json.Unmarshal(data, &tokenUuid); err == nil {
+		t.Uuid = tokenUuid
+		return nil
+	}
+	type token TemplateToken
+	return json.Unmarshal(data, (*token)(t))
+}
+
+// ValueView is the view the token's value is presented in
+func (t TemplateToken) ValueView() ValueView {
+	return ValueView{Mode: t.View, Count: t.Count}
+}
+
+// TemplateRequest is a Go template and the tokens whose values fill it in,
+// by the names the template uses for them. Sink, when given, names where the
+// rendered output is sent rather than returned.
+type TemplateRequest struct {
+	Template string                   `bson:"template" json:"template"`
+	Format   string                   `bson:"format" json:"format"`
+	Tokens   map[string]TemplateToken `bson:"tokens" json:"tokens"`
+	Sink     string                   `bson:"sink" json:"sink"`
+}
+
+var ErrTemplateTooLarge = errors.New("data: templates and their output must be at most 64KB and 1MB")
+
+// RenderTemplate fills the template in with the values of its tokens, each in
+// its own view, and returns the output. Templates can only use the tokens'
+// values and the built in functions; range and template actions are not
+// allowed, so a template can't run away with the service.
+// Reading a value counts against the token's read limit.
+func RenderTemplate(domainUuid string, request TemplateRequest) ([]byte, error) {
+	if len(strings.TrimSpace(domainUuid)) == 0 {
+		return nil, errors.New("data: need domain id")
+	}
+	if len(request.Template) > maxTemplateBytes {
+		return nil, ErrTemplateTooLarge
+	}
+	execute, err := parseTemplate(request.Format, request.Template)
+	if err != nil {
+		return nil, err
+	}
+	if len(request.Tokens) == 0 {
+		return nil, &FieldError{Field: "tokens", Message: "must name the tokens the template uses"}
+	}
+
+	// tokens are read once for each view they are presented in
+	names := make([]string, 0, len(request.Tokens))
+	for name := range request.Tokens {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	namesByView := make(map[ValueView][]string)
+	var views []ValueView
+	for _, name := range names {
+		if !templateTokenNamePattern.MatchString(name) {
+			return nil, &FieldError{Field: "tokens", Message: "has a name that can't be used in a template: " + name}
+		}
+		view, viewerr := CheckValueView(request.Tokens[name].ValueView())
+		if viewerr != nil {
+			return nil, &FieldError{Field: "tokens." + name, Message: "has an invalid view"}
+		}
+		if _, ok := namesByView[view]; !ok {
+			views = append(views, view)
+		}
+		namesByView[view] = append(namesByView[view], name)
+	}
+
+	data := make(map[string]string)
+	for _, view := range views {
+		viewNames := namesByView[view]
+		uuids := make([]string, len(viewNames))
+		for idx, name := range viewNames {
+			uuids[idx] = request.Tokens[name].Uuid
+		}
+		tokenValues, valueserr := GetTokenValues(TokenQuery{DomainUuid: domainUuid, Uuids: uuids, View: view})
+		if valueserr != nil {
+			return nil, valueserr
+		}
+		for idx, result := range tokenValues.Results {
+			if len(result.Error) > 0 {
+				return nil, &FieldError{Field: "tokens." + viewNames[idx], Message: "could not be read: " + result.Error}
+			}
+			data[viewNames[idx]] = result.Value
+		}
+	}
+
+	output := &limitedBuffer{limit: maxTemplateOutputBytes}
+	if err := execute(output, data); err != nil {
+		if output.full {
+			return nil, ErrTemplateTooLarge
+		}
+		// execution errors can quote the data, so they are not passed on
+		return nil, &FieldError{Field: "template", Message: "could not be rendered, check it only uses the token names given"}
+	}
+	return output.Bytes(), nil
+}
+
+// parseTemplate parses the template in its format, returning how to execute it.
+// A field missing from the data is an error rather than being left blank.
+func parseTemplate(format string, text string) (func(*limitedBuffer, map[string]string) error, error) {
+	switch format {
+	case "", TemplateFormatText:
+		parsed, err := template.New("render").Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, &FieldError{Field: "template", Message: "could not be parsed: " + err.Error()}
+		}
+		if err := checkTemplateTree(parsed.Templates()); err != nil {
+			return nil, err
+		}
+		return func(output *limitedBuffer, data map[string]string) error {
+			return parsed.Execute(output, data)
+		}, nil
+	case TemplateFormatHTML:
+		parsed, err := htmltemplate.New("render").Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, &FieldError{Field: "template", Message: "could not be parsed: " + err.Error()}
+		}
+		var trees []*template.Template
+		for _, tmpl := range parsed.Templates() {
+			trees = append(trees, &template.Template{Tree: tmpl.Tree})
+		}
+		if err := checkTemplateTree(trees); err != nil {
+			return nil, err
+		}
+		return func(output *limitedBuffer, data map[string]string) error {
+			return parsed.Execute(output, data)
+		}, nil
+	}
+	return nil, &FieldError{Field: "format", Message: "must be text or html"}
+}
+
+// checkTemplateTree only lets through text, token names, and if and with on
+// token names. Everything else is rejected, from range and calls to other
+// templates to variables and functions such as printf, index or slice, so a
+// template can't build more output than its values and text.
+func checkTemplateTree(templates []*template.Template) error {
+	if len(templates) > 1 {
+		return &FieldError{Field: "template", Message: "must not define templates"}
+	}
+	var walkerr error
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		if node == nil || walkerr != nil {
+			return
+		}
+		switch typed := node.(type) {
+		case *parse.ListNode:
+			if typed == nil {
+				return
+			}
+			for _, child := range typed.Nodes {
+				walk(child)
+			}
+		case *parse.TextNode:
+		case *parse.ActionNode:
+			walkerr = checkTemplatePipe(typed.Pipe)
+		case *parse.IfNode:
+			if walkerr = checkTemplatePipe(typed.Pipe); walkerr == nil {
+				walk(typed.List)
+				walk(typed.ElseList)
+			}
+		case *parse.WithNode:
+			if walkerr = checkTemplatePipe(typed.Pipe); walkerr == nil {
+				walk(typed.List)
+				walk(typed.ElseList)
+			}
+		case *parse.RangeNode:
+			walkerr = &FieldError{Field: "template", Message: "must not use range"}
+		case *parse.TemplateNode:
+			walkerr = &FieldError{Field: "template", Message: "must not call templates"}
+		default:
+			walkerr = &FieldError{Field: "template", Message: "must only use token names, if and with"}
+		}
+	}
+	for _, tmpl := range templates {
+		if tmpl.Tree != nil {
+			walk(tmpl.Tree.Root)
+		}
+	}
+	return walkerr
+}
+
+// checkTemplatePipe only lets through a pipeline that is a single token name,
+// or the dot inside a with
+func checkTemplatePipe(pipe *parse.PipeNode) error {
+	if pipe == nil || len(pipe.Decl) > 0 || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return &FieldError{Field: "template", Message: "must only use token names, without variables or functions"}
+	}
+	switch pipe.Cmds[0].Args[0].(type) {
+	case *parse.FieldNode, *parse.DotNode:
+		return nil
+	}
+	return &FieldError{Field: "template", Message: "must only use token names, without variables or functions"}
+}
+
+// limitedBuffer stops taking output past its limit, which ends the template's execution
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+	full  bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.limit {
+		b.full = true
+		return 0, ErrTemplateTooLarge
+	}
+	return b.Buffer.Write(p)
+}
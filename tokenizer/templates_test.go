@@ -0,0 +1,94 @@
+package tokenizer
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseTemplate(t *testing.T) {
+	data := map[string]string{"name": "Jane <Doe>", "card": "••••4242"}
+
+	testScenarios := []struct {
+		givenFormat   string
+		givenTemplate string
+		expectOutput  string
+		expectField   string
+	}{
+		{"", "Dear {{.name}}, card {{.card}}", "Dear Jane <Doe>, card ••••4242", ""},
+		{"html", "<p>Dear {{.name}}</p>", "<p>Dear Jane &lt;Doe&gt;</p>", ""},
+		{"text", "{{if .card}}Card {{.card}}{{else}}No card{{end}}", "Card ••••4242", ""},
+		{"text", "{{with .name}}Dear {{.}}{{end}}", "Dear Jane <Doe>", ""},
+		{"text", "{{with .name}}{{printf \"%.4s\" .}}{{end}}", "", "template"},
+		{"text", "{{$x := .name}}{{$x}}", "", "template"},
+		{"text", "{{.name | len}}", "", "template"},
+		{"text", "{{if index . \"name\"}}x{{end}}", "", "template"},
+		{"html", "{{slice .name 1}}", "", "template"},
+		{"text", "Dear {{.nmae}}", "", "template"},
+		{"text", "Dear {{.name}", "", "template"},
+		{"text", "{{range 1000000000}}x{{end}}", "", "template"},
+		{"text", "{{define \"x\"}}{{.name}}{{end}}{{template \"x\" .}}", "", "template"},
+		{"html", "{{block \"x\" .}}{{.name}}{{end}}", "", "template"},
+		{"pdf", "Dear {{.name}}", "", "format"},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			execute, err := parseTemplate(scenario.givenFormat, scenario.givenTemplate)
+			if err == nil {
+				output := &limitedBuffer{limit: maxTemplateOutputBytes}
+				if err = execute(output, data); err == nil {
+					if want, got := scenario.expectOutput, output.String(); want != got {
+						t.Errorf("expect output %s but got %s", want, got)
+					}
+				} else {
+					err = &FieldError{Field: "template"}
+				}
+			}
+			var fielderr *FieldError
+			if want, got := len(scenario.expectField) > 0, errors.As(err, &fielderr); want != got {
+				t.Fatalf("expect error %t but got %#v", want, err)
+			}
+			if fielderr != nil && fielderr.Field != scenario.expectField {
+				t.Errorf("expect field %s but got %s", scenario.expectField, fielderr.Field)
+			}
+		})
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	UnitTest = true
+
+	testScenarios := []struct {
+		givenRequest TemplateRequest
+		expectErr    string
+	}{
+		{TemplateRequest{Template: "Dear {{.name}}", Tokens: map[string]TemplateToken{"name": {Uuid: "missing"}}}, "tokens.name"},
+		{TemplateRequest{Template: "Dear {{.name}}"}, "tokens"},
+		{TemplateRequest{Template: "Dear {{.name}}", Tokens: map[string]TemplateToken{"first name": {Uuid: "a"}}}, "tokens"},
+		{TemplateRequest{Template: "Dear {{.name}}", Tokens: map[string]TemplateToken{"name": {Uuid: "a", View: "initials"}}}, "tokens.name"},
+		{TemplateRequest{Template: strings.Repeat("x", maxTemplateBytes+1)}, "64KB"},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			_, err := RenderTemplate("mydomain", scenario.givenRequest)
+			if err == nil || !strings.Contains(err.Error(), scenario.expectErr) {
+				t.Errorf("expect an error about %s but got %#v", scenario.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	execute, err := parseTemplate("text", "{{.name}}{{.name}}{{.name}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := &limitedBuffer{limit: 10}
+	err = execute(output, map[string]string{"name": "Jane"})
+	if err == nil || !output.full {
+		t.Errorf("expect output past the limit to stop the render but got %#v", err)
+	}
+}
@@ -1,11 +1,15 @@
 package tokenizer
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"runtime"
 	"strings"
+	"sync"
 	"time"
 	"tokentarpon/tokencrypto"
+	"tokentarpon/tokenizer/datalog"
 	"tokentarpon/tokenizer/datastore"
 	"tokentarpon/tokenizer/systemconfig"
 
@@ -17,18 +21,33 @@ var UnitTest = false
 var defaultPageRecordCount int64 = 100
 var tokenRecordType = "token"
 var encryptionKey = ""
+var defaultEncryptionWorkers = runtime.NumCPU()
 
 type Token struct {
 	Uuid           string `bson:"uuid" json:"uuid"`
 	DomainUuid     string `bson:"domainUuid" json:"domainUuid"`
 	Value          string `bson:"value" json:"value"`
 	EncryptedValue string `bson:"encryptedValue" json:"encryptedValue"`
+	ValueType      string `bson:"valueType,omitempty" json:"valueType,omitempty"`
+	KeyId          string `bson:"keyId,omitempty" json:"keyId,omitempty"`
+	BlindIndex     string `bson:"blindIndex,omitempty" json:"-"`
 	IsDeleted      bool   `json:"isDeleted" bson:"isDeleted"`
 	DocumentType   string `bson:"documentType" json:"documentType"`
 	Version        string `bson:"version" json:"version"`
+	Revision       int64  `json:"revision" bson:"revision"`
 	Created        int64  `json:"created" bson:"created"`
 	Updated        int64  `json:"updated" bson:"updated"`
 	Check          string `bson:"check" json:"check"`
+	ExpiresAt      int64  `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+	TTLSeconds     int64  `json:"ttlSeconds,omitempty" bson:"-"`
+	MaxReads       int64  `json:"maxReads,omitempty" bson:"maxReads,omitempty"`
+	ReadsRemaining int64  `json:"readsRemaining,omitempty" bson:"readsRemaining,omitempty"`
+	Deleted        int64  `json:"deleted,omitempty" bson:"deleted,omitempty"`
+	// metadata, stored unencrypted so tokens can be filtered on it
+	DataClass    string   `json:"dataClass,omitempty" bson:"dataClass,omitempty"`
+	SourceSystem string   `json:"sourceSystem,omitempty" bson:"sourceSystem,omitempty"`
+	Labels       []string `json:"labels,omitempty" bson:"labels,omitempty"`
+	ExternalRef  string   `json:"externalRef,omitempty" bson:"externalRef,omitempty"`
 }
 
 type Token_v001 struct {
@@ -44,84 +63,315 @@ type Token_v001 struct {
 	Check          string `bson:"check" json:"check"`
 }
 
+// TokenQuery asks for the values of several tokens in a domain,
+// presented in View, which is set by the caller rather than the request body
 type TokenQuery struct {
-	DomainUuid string   `bson:"domainUuid" json:"domainUuid"`
-	Uuids      []string `bson:"uuids" json:"uuids"`
+	DomainUuid string    `bson:"domainUuid" json:"domainUuid"`
+	Uuids      []string  `bson:"uuids" json:"uuids"`
+	View       ValueView `bson:"-" json:"-"`
 }
 
+// TokenError reports why a token in a batch was not created,
+// with the field at fault when a single field was rejected
 type TokenError struct {
 	Token Token  `bson:"token" json:"token"`
 	Error string `bson:"error" json:"error"`
+	Field string `bson:"field" json:"field,omitempty"`
+	Code  string `bson:"code" json:"code,omitempty"`
 }
 
+// TokenBatch holds the outcome of a batch create, with the tokens that
+// were created alongside the ones that failed
+type TokenBatch struct {
+	Created []Token      `bson:"created" json:"created"`
+	Errors  []TokenError `bson:"errors" json:"errors"`
+}
+
+// TokenValue is the result for a single uuid in a batch value request,
+// carrying either the token value or an error code
+type TokenValue struct {
+	Uuid  string `bson:"uuid" json:"uuid"`
+	Value string `bson:"value" json:"value,omitempty"`
+	Error string `bson:"error" json:"error,omitempty"`
+}
+
+// TokenValues holds one TokenValue per requested uuid, in request order,
+// along with counts so callers can tell a partial result from a full one
+type TokenValues struct {
+	Results []TokenValue `bson:"results" json:"results"`
+	Found   int          `bson:"found" json:"found"`
+	Failed  int          `bson:"failed" json:"failed"`
+	Partial bool         `bson:"partial" json:"partial"`
+}
+
+// TokenResult is the outcome for one token of a batch, either the created
+// token or the error it failed with
+type TokenResult struct {
+	Token Token       `bson:"token" json:"token"`
+	Error *TokenError `bson:"error" json:"error,omitempty"`
+}
+
+// error codes reported per item in TokenValues
+const (
+	ErrCodeNotFound      = "not_found"
+	ErrCodeInvalidId     = "invalid_id"
+	ErrCodeDecryptFailed = "decrypt_failed"
+	ErrCodeInvalidValue  = "invalid_value"
+	ErrCodeReadLimited   = "read_limited"
+)
+
 var (
 	ErrEmptyValue      = errors.New("cannot store empty value")
 	ErrValueTooBig     = errors.New("value too large for storage")
 	ErrNoMatchingToken = errors.New("no token found for provided domain and token id")
+	ErrBatchInvalid    = errors.New("data: batch contains invalid tokens, none were created")
+)
+
+// batch modes for creating several tokens
+const (
+	BatchModeBestEffort = "besteffort"
+	BatchModeAtomic     = "atomic"
 )
 
 var CollectionName string = "community"
 
+// indexes for finding tokens by uuid, listing them in sort order,
+// finding the ones to purge, finding them by value to erase,
+// and filtering them by metadata
+var tokenIndexes = []datastore.DataIndex{
+	{Fields: []string{"domainUuid", "uuid"}},
+	{Fields: []string{"domainUuid", "isDeleted", "created", "uuid"}},
+	{Fields: []string{"domainUuid", "isDeleted", "updated", "uuid"}},
+	{Fields: []string{"expiresAt"}},
+	{Fields: []string{"domainUuid", "isDeleted", "deleted"}},
+	{Fields: []string{"domainUuid", "blindIndex", "uuid"}},
+	{Fields: []string{"domainUuid", "dataClass"}},
+	{Fields: []string{"domainUuid", "sourceSystem"}},
+	{Fields: []string{"domainUuid", "labels"}},
+	{Fields: []string{"domainUuid", "externalRef"}},
+}
+
 func CreateToken(domainUuid string, value string) (Token, error) {
+	return CreateTokenFrom(domainUuid, Token{Value: value})
+}
+
+// CreateTokenFrom creates a token for the value in tokenObj,
+// along with its optional expiry, read limit and metadata.
+// Values with a value type are validated and normalized before they are stored,
+// and rejected with a FieldError when malformed.
+// A blank value is rejected with ErrEmptyValue, and one over the domain's
+// limit with ErrValueTooBig.
+func CreateTokenFrom(domainUuid string, tokenObj Token) (Token, error) {
 	var tok Token
 
 	err := errors.New("data: token incomplete, need domain id, value")
 	if len(strings.TrimSpace(domainUuid)) == 0 {
 		return tok, err
 	}
-	if len(strings.TrimSpace(value)) == 0 {
-		return tok, err
+	if sizeerr := checkValueSize(tokenObj.Value, GetRequestLimits(domainUuid).MaxValueBytes); sizeerr != nil {
+		return tok, sizeerr
 	}
 	aUuid := uuid.New()
 	tok.DomainUuid = domainUuid
-	tok.Value = value
+	tok.Value = tokenObj.Value
 	tok.Uuid = aUuid.String()
+	tok.Revision = 1
 	tok.Created = time.Now().Unix()
+	tok.Updated = tok.Created
+	tok.ExpiresAt = tokenObj.ExpiresAt
+	tok.TTLSeconds = tokenObj.TTLSeconds
+	tok.MaxReads = tokenObj.MaxReads
+	if lifetimeerr := applyLifetime(&tok, tok.Created); lifetimeerr != nil {
+		return Token{}, lifetimeerr
+	}
+	tok.DataClass = tokenObj.DataClass
+	tok.SourceSystem = tokenObj.SourceSystem
+	tok.Labels = tokenObj.Labels
+	tok.ExternalRef = tokenObj.ExternalRef
+	if metadataerr := applyMetadata(&tok); metadataerr != nil {
+		return Token{}, metadataerr
+	}
+	tok.ValueType = tokenObj.ValueType
+	if typeerr := applyValueType(&tok); typeerr != nil {
+		return Token{}, typeerr
+	}
 
 	if UnitTest {
 		return tok, nil
 	}
 
+	stored, sealerrs := sealTokens([]Token{tok}, 1)
+	if sealerrs[0] != nil {
+		return tok, sealerrs[0]
+	}
+
 	datastore.CollectionName = CollectionName
-	errInsert := datastore.InsertRecord(tokenRecordType, tok)
+	errInsert := datastore.InsertRecord(tokenRecordType, stored[0])
 	return tok, errInsert
 }
 
+// CreateTokens creates each token independently, returning the tokens
+// that were created along with the ones that failed.
+// Valid tokens are encrypted on a bounded worker pool and written
+// in a single unordered bulk insert.
 func CreateTokens(domainUuid string, tokens []Token) ([]Token, []TokenError) {
 	var createdTokens []Token
 	var errorTokens []TokenError
-	datastore.CollectionName = CollectionName
+	for _, result := range CreateTokenResults(domainUuid, tokens) {
+		if result.Error != nil {
+			errorTokens = append(errorTokens, *result.Error)
+		} else {
+			createdTokens = append(createdTokens, result.Token)
+		}
+	}
+	return createdTokens, errorTokens
+}
 
-	for _, tokenObj := range tokens {
-		if len(strings.TrimSpace(tokenObj.DomainUuid)) == 0 {
-			e := TokenError{Token: tokenObj, Error: "Missing Domain ID"}
-			errorTokens = append(errorTokens, e)
-		} else if tokenObj.DomainUuid != domainUuid {
-			e := TokenError{Token: tokenObj, Error: "Invalid Domain ID"}
-			errorTokens = append(errorTokens, e)
-		} else if len(strings.TrimSpace(tokenObj.Value)) == 0 {
-			e := TokenError{Token: tokenObj, Error: "Missing Token Value"}
-			errorTokens = append(errorTokens, e)
+// CreateTokenResults creates each token independently as CreateTokens does,
+// returning one result per token in the order given, so a caller can tell
+// which of its tokens failed
+func CreateTokenResults(domainUuid string, tokens []Token) []TokenResult {
+	results := make([]TokenResult, len(tokens))
+	var pendingTokens []Token
+	var pendingIdx []int
+
+	now := time.Now().Unix()
+	maxValueBytes := GetRequestLimits(domainUuid).MaxValueBytes
+	for idx, tokenObj := range tokens {
+		if errmsg, code := validateBatchToken(domainUuid, tokenObj, maxValueBytes); len(errmsg) > 0 {
+			results[idx].Error = &TokenError{Token: tokenObj, Error: errmsg, Code: code}
+		} else if typeerr := applyValueType(&tokenObj); typeerr != nil {
+			e := makeFieldTokenError(tokenObj, typeerr)
+			results[idx].Error = &e
 		} else {
 			aUuid := uuid.New()
 			tokenObj.Uuid = aUuid.String()
-			tokenObj.Created = time.Now().Unix()
+			tokenObj.Revision = 1
+			tokenObj.Created = now
+			tokenObj.Updated = now
+			applyLifetime(&tokenObj, now)
+			applyMetadata(&tokenObj)
+			pendingTokens = append(pendingTokens, tokenObj)
+			pendingIdx = append(pendingIdx, idx)
+		}
+	}
 
-			if UnitTest {
-				createdTokens = append(createdTokens, tokenObj)
-			} else {
-				errInsert := datastore.InsertRecord(tokenRecordType, &tokenObj)
-				if errInsert != nil {
-					errmsg := fmt.Sprint(errInsert)
-					e := TokenError{Token: tokenObj, Error: errmsg}
-					errorTokens = append(errorTokens, e)
-				} else {
-					createdTokens = append(createdTokens, tokenObj)
-				}
-			}
+	if UnitTest {
+		for pending, idx := range pendingIdx {
+			results[idx].Token = pendingTokens[pending]
 		}
+		return results
 	}
-	return createdTokens, errorTokens
+
+	stored, sealerrs := sealTokens(pendingTokens, getEncryptionWorkers())
+	var documents []interface{}
+	var documentIdx []int
+	for pending, tokenObj := range pendingTokens {
+		if sealerrs[pending] != nil {
+			results[pendingIdx[pending]].Error = &TokenError{Token: tokenObj, Error: fmt.Sprint(sealerrs[pending])}
+		} else {
+			documents = append(documents, stored[pending])
+			documentIdx = append(documentIdx, pending)
+		}
+	}
+
+	datastore.CollectionName = CollectionName
+	failed, errInsert := datastore.InsertRecords(tokenRecordType, documents, false)
+	for document, pending := range documentIdx {
+		tokenObj := pendingTokens[pending]
+		result := &results[pendingIdx[pending]]
+		if errInsert != nil {
+			result.Error = &TokenError{Token: tokenObj, Error: fmt.Sprint(errInsert)}
+		} else if inserterr, ok := failed[document]; ok {
+			result.Error = &TokenError{Token: tokenObj, Error: fmt.Sprint(inserterr)}
+		} else {
+			result.Token = tokenObj
+		}
+	}
+	return results
+}
+
+// CreateTokensAtomic creates every token or none of them.
+// If any token is invalid, ErrBatchInvalid is returned with the failing tokens;
+// if the datastore fails, the transaction is rolled back and its error is returned.
+func CreateTokensAtomic(domainUuid string, tokens []Token) ([]Token, []TokenError, error) {
+	var errorTokens []TokenError
+	normalizedTokens := make([]Token, len(tokens))
+	maxValueBytes := GetRequestLimits(domainUuid).MaxValueBytes
+	for idx, tokenObj := range tokens {
+		if errmsg, code := validateBatchToken(domainUuid, tokenObj, maxValueBytes); len(errmsg) > 0 {
+			e := TokenError{Token: tokenObj, Error: errmsg, Code: code}
+			errorTokens = append(errorTokens, e)
+		} else if typeerr := applyValueType(&tokenObj); typeerr != nil {
+			errorTokens = append(errorTokens, makeFieldTokenError(tokenObj, typeerr))
+		}
+		normalizedTokens[idx] = tokenObj
+	}
+	if len(errorTokens) > 0 {
+		return nil, errorTokens, ErrBatchInvalid
+	}
+
+	createdTokens := make([]Token, len(tokens))
+	documents := make([]interface{}, len(tokens))
+	now := time.Now().Unix()
+	for idx, tokenObj := range normalizedTokens {
+		tokenObj.Uuid = uuid.New().String()
+		tokenObj.Revision = 1
+		tokenObj.Created = now
+		tokenObj.Updated = now
+		applyLifetime(&tokenObj, now)
+		applyMetadata(&tokenObj)
+		createdTokens[idx] = tokenObj
+	}
+
+	if UnitTest {
+		return createdTokens, nil, nil
+	}
+
+	stored, sealerrs := sealTokens(createdTokens, getEncryptionWorkers())
+	for idx, sealerr := range sealerrs {
+		if sealerr != nil {
+			return nil, nil, sealerr
+		}
+		documents[idx] = stored[idx]
+	}
+
+	datastore.CollectionName = CollectionName
+	if errInsert := datastore.InsertRecordsAtomic(tokenRecordType, documents); errInsert != nil {
+		return nil, nil, errInsert
+	}
+	return createdTokens, nil, nil
+}
+
+// validateBatchToken returns a message describing why the token
+// cannot be created in the domain, or an empty string if it can,
+// along with the error code of a value turned away by the limits
+func validateBatchToken(domainUuid string, tokenObj Token, maxValueBytes int64) (string, string) {
+	if len(strings.TrimSpace(tokenObj.DomainUuid)) == 0 {
+		return "Missing Domain ID", ""
+	} else if tokenObj.DomainUuid != domainUuid {
+		return "Invalid Domain ID", ""
+	} else if len(strings.TrimSpace(tokenObj.Value)) == 0 {
+		return "Missing Token Value", ErrCodeEmptyValue
+	} else if int64(len(tokenObj.Value)) > maxValueBytes {
+		return "Token Value Too Large", ErrCodeValueTooBig
+	} else if checkLifetime(tokenObj, time.Now().Unix()) != nil {
+		return "Invalid Expiry Or Max Reads", ""
+	} else if checkMetadata(tokenObj) != nil {
+		return "Invalid Metadata", ""
+	}
+	return "", ""
+}
+
+// makeFieldTokenError reports a rejected token, naming the field at fault when there is one
+func makeFieldTokenError(tokenObj Token, err error) TokenError {
+	e := TokenError{Token: tokenObj, Error: fmt.Sprint(err)}
+	var fielderr *FieldError
+	if errors.As(err, &fielderr) {
+		e.Error = fielderr.Message
+		e.Field = fielderr.Field
+	}
+	return e
 }
 
 func GetToken(domainUuid string, tokenUuid string) (Token, error) {
@@ -133,6 +383,9 @@ func GetToken(domainUuid string, tokenUuid string) (Token, error) {
 	if len(strings.TrimSpace(tokenUuid)) == 0 {
 		return tok, err
 	}
+	if shrederr := checkDomainOpen(domainUuid); shrederr != nil {
+		return tok, shrederr
+	}
 
 	if UnitTest {
 		tok.DomainUuid = domainUuid
@@ -140,10 +393,19 @@ func GetToken(domainUuid string, tokenUuid string) (Token, error) {
 		return tok, nil
 	}
 
-	filter := datastore.MakeDomainQuery(domainUuid, "uuid", tokenUuid, true)
-	datastore.CollectionName = CollectionName
-	geterr := datastore.GetRecord(filter, &tok)
-	return tok, geterr
+	tok, geterr := getLiveToken(domainUuid, tokenUuid)
+	if geterr != nil {
+		return tok, geterr
+	}
+
+	// read limited tokens only give up their value through GetTokenValue(s),
+	// which counts the read
+	if tok.MaxReads > 0 {
+		tok.Value = ""
+		tok.EncryptedValue = ""
+		return tok, nil
+	}
+	return tok, revealValue(&tok)
 }
 
 func DeleteToken(domainUuid string, tokenUuid string) (Token, error) {
@@ -173,14 +435,18 @@ func DeleteToken(domainUuid string, tokenUuid string) (Token, error) {
 	}
 
 	tokenObj.IsDeleted = true
-	updateResult, err := datastore.UpdateRecord(tokenRecordType, filter, "and", tokenObj)
-	updatedToken := updateResult.(Token)
-	return updatedToken, err
+	tokenObj.Deleted = time.Now().Unix()
+	tokenObj.Updated = tokenObj.Deleted
+	_, err = datastore.UpdateRecord(tokenRecordType, filter, "and", tokenObj)
+	if err != nil {
+		return empty, err
+	}
+	return tokenObj, nil
 }
 
 func CreateMultiTokenQuery(tokenQuery TokenQuery) []datastore.DataQueryGroup {
 
-	var filters = make([]datastore.DataQueryGroup, 2)
+	var filters = make([]datastore.DataQueryGroup, 3)
 	var nvq datastore.DataQueryGroup
 
 	nvq.Operator = "and"
@@ -191,6 +457,13 @@ func CreateMultiTokenQuery(tokenQuery TokenQuery) []datastore.DataQueryGroup {
 	nvq.DataQueries[0].CaseSensitive = true
 	filters[0] = nvq
 
+	nvq.Operator = "and"
+	nvq.DataQueries = make([]datastore.DataQuery, 1)
+	nvq.DataQueries[0].FieldName = "isDeleted"
+	nvq.DataQueries[0].BoolValue = false
+	nvq.DataQueries[0].IsBool = true
+	filters[1] = nvq
+
 	nvq.Operator = "or"
 	nvq.DataQueries = make([]datastore.DataQuery, len(tokenQuery.Uuids))
 	for idx, uuid := range tokenQuery.Uuids {
@@ -199,7 +472,7 @@ func CreateMultiTokenQuery(tokenQuery TokenQuery) []datastore.DataQueryGroup {
 		nvq.DataQueries[idx].Wildcard = false
 		nvq.DataQueries[idx].CaseSensitive = true
 	}
-	filters[1] = nvq
+	filters[2] = nvq
 	return filters
 }
 
@@ -226,16 +499,32 @@ func GetTokens(domainUuid string, start int64, limit int64) ([]Token, error) {
 		return nil, geterr
 	}
 
+	// like ListTokens, leave out spent tokens, and don't reveal read limited
+	// values, as listing them doesn't count as a read
+	now := time.Now().Unix()
 	for _, x := range records {
-		tokens = append(tokens, x.(Token))
+		tok := x.(Token)
+		if !isLive(tok, now) {
+			continue
+		}
+		if tok.MaxReads > 0 {
+			tok.Value = ""
+			tok.EncryptedValue = ""
+		} else if revealerr := revealValue(&tok); revealerr != nil {
+			return nil, revealerr
+		}
+		tokens = append(tokens, tok)
 	}
 
 	return tokens, nil
 }
 
-func GetTokenValues(tokenQuery TokenQuery) ([]string, error) {
-	var empty []string
-	//var token Token
+// GetTokenValues returns one result per requested uuid, in request order.
+// Uuids that are missing, deleted or belong to another domain get an error code
+// rather than being dropped, so the results always line up with the request.
+// Large requests are fetched from the datastore in page-sized chunks.
+func GetTokenValues(tokenQuery TokenQuery) (TokenValues, error) {
+	var empty TokenValues
 	err := errors.New("data: need domain id")
 	if len(strings.TrimSpace(tokenQuery.DomainUuid)) == 0 {
 		return empty, err
@@ -244,42 +533,246 @@ func GetTokenValues(tokenQuery TokenQuery) ([]string, error) {
 	if len(tokenQuery.Uuids) == 0 {
 		return empty, err
 	}
+	if shrederr := checkDomainOpen(tokenQuery.DomainUuid); shrederr != nil {
+		return empty, shrederr
+	}
 
 	if UnitTest {
-		return empty, err
+		return buildTokenValues(tokenQuery.Uuids, make(map[string]Token), tokenQuery.View), nil
+	}
+
+	found, geterr := fetchLiveTokens(tokenQuery.DomainUuid, tokenQuery.Uuids)
+	if geterr != nil {
+		return empty, geterr
+	}
+
+	// read limited tokens whose reads run out are not found
+	for tokenUuid, t := range found {
+		if t.MaxReads > 0 {
+			consumed, consumeerr := consumeRead(t)
+			if consumeerr != nil {
+				return empty, consumeerr
+			} else if !consumed {
+				delete(found, tokenUuid)
+			}
+		}
 	}
 
-	filter := CreateMultiTokenQuery(tokenQuery)
+	return buildTokenValues(tokenQuery.Uuids, found, tokenQuery.View), nil
+}
+
+// fetchLiveTokens reads the domain's tokens with the uuids as they are stored,
+// still encrypted, in page-sized chunks, keyed by uuid.
+// Deleted and expired tokens, and ones out of reads, are left out.
+func fetchLiveTokens(domainUuid string, uuids []string) (map[string]Token, error) {
+	found := make(map[string]Token)
 	datastore.CollectionName = CollectionName
 	pageRecordCount := getPageRecordCount()
 	datastore.PageRecordCount = pageRecordCount
 	var token Token
-	records, geterr := datastore.GetRecords(filter, "and", 0, pageRecordCount, token)
-	if geterr != nil {
-		return nil, geterr
-	}
-
-	tokenValues := make([]string, 0)
-	// return the token values at the same indices as their uuids were presented
-	for _, uuid := range tokenQuery.Uuids {
+	now := time.Now().Unix()
+	for _, chunk := range chunkUuids(uuids, int(pageRecordCount)) {
+		chunkQuery := TokenQuery{DomainUuid: domainUuid, Uuids: chunk}
+		filter := CreateMultiTokenQuery(chunkQuery)
+		records, geterr := datastore.GetRecords(filter, "and", 0, int64(len(chunk)), token)
+		if geterr != nil {
+			return found, geterr
+		}
 		for _, tv := range records {
 			t := tv.(Token)
-			if uuid == t.Uuid {
-				tokenValues = append(tokenValues, t.Value)
+			if isLive(t, now) {
+				found[t.Uuid] = t
+			}
+		}
+	}
+	return found, nil
+}
+
+// chunkUuids splits the requested uuids into chunks of at most size entries,
+// skipping blanks and duplicates so each uuid is only fetched once
+func chunkUuids(uuids []string, size int) [][]string {
+	if size <= 0 {
+		size = int(defaultPageRecordCount)
+	}
+	var chunks [][]string
+	var chunk []string
+	seen := make(map[string]bool)
+	for _, uuid := range uuids {
+		uuid = strings.TrimSpace(uuid)
+		if len(uuid) == 0 || seen[uuid] {
+			continue
+		}
+		seen[uuid] = true
+		chunk = append(chunk, uuid)
+		if len(chunk) == size {
+			chunks = append(chunks, chunk)
+			chunk = nil
+		}
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// buildTokenValues lays out the found tokens at the same indices
+// as their uuids were presented, with each value in the view
+func buildTokenValues(uuids []string, found map[string]Token, view ValueView) TokenValues {
+	tokenValues := TokenValues{Results: make([]TokenValue, len(uuids))}
+	for idx, uuid := range uuids {
+		result := TokenValue{Uuid: uuid}
+		if len(strings.TrimSpace(uuid)) == 0 {
+			result.Error = ErrCodeInvalidId
+		} else if t, ok := found[strings.TrimSpace(uuid)]; ok {
+			if revealerr := revealValue(&t); revealerr != nil {
+				result.Error = ErrCodeDecryptFailed
+			} else if value, presenterr := PresentValue(t, view); presenterr != nil {
+				result.Error = ErrCodeDecryptFailed
+			} else {
+				result.Value = value
 			}
+		} else {
+			result.Error = ErrCodeNotFound
+		}
+
+		if len(result.Error) > 0 {
+			tokenValues.Failed++
+		} else {
+			tokenValues.Found++
 		}
+		tokenValues.Results[idx] = result
 	}
-	return tokenValues, nil
+	tokenValues.Partial = tokenValues.Failed > 0
+	return tokenValues
 }
 
+// EncryptValue encrypts the plaintext with the configured master key,
+// returning base64 so the ciphertext can be stored as a string.
+// Token values are encrypted with their domain's key instead.
 func EncryptValue(plaintext string) (string, error) {
 	getEncryptionKey()
-	return tokencrypto.EncryptAES(plaintext, encryptionKey)
+	return encryptWithKey(plaintext, encryptionKey)
 }
 
+// DecryptValue decrypts a value from EncryptValue. Values encrypted before
+// it returned base64 were the raw ciphertext, which is never valid base64,
+// so they are still decrypted as they are.
 func DecryptValue(encryptedValue string) (string, error) {
 	getEncryptionKey()
-	return tokencrypto.DecryptAES(encryptedValue, encryptionKey)
+	if _, err := base64.StdEncoding.DecodeString(encryptedValue); err != nil {
+		return tokencrypto.DecryptAES(encryptedValue, encryptionKey)
+	}
+	return decryptWithKey(encryptedValue, encryptionKey)
+}
+
+// sealTokens returns copies of the tokens ready for storage, with the
+// blind index of each value set, encrypted when the service is
+// configured to encrypt stored values
+func sealTokens(tokens []Token, workers int) ([]Token, []error) {
+	indexed := make([]Token, len(tokens))
+	copy(indexed, tokens)
+	for idx := range indexed {
+		blindIndex, indexerr := blindIndexFor(indexed[idx].DomainUuid, indexed[idx].ValueType, indexed[idx].Value)
+		if indexerr != nil {
+			sealerrs := make([]error, len(indexed))
+			for errIdx := range sealerrs {
+				sealerrs[errIdx] = indexerr
+			}
+			return indexed, sealerrs
+		}
+		indexed[idx].BlindIndex = blindIndex
+	}
+
+	if !getEncryptValues() {
+		sealerrs := make([]error, len(indexed))
+		for idx := range indexed {
+			sealerrs[idx] = checkDomainOpen(indexed[idx].DomainUuid)
+		}
+		return indexed, sealerrs
+	}
+	return encryptTokens(indexed, workers)
+}
+
+// encryptTokens returns copies of the tokens with each value moved into
+// EncryptedValue, encrypted with the token's domain key, using a pool
+// of at most workers goroutines. Errors line up with the tokens by index.
+func encryptTokens(tokens []Token, workers int) ([]Token, []error) {
+	sealed := make([]Token, len(tokens))
+	sealerrs := make([]error, len(tokens))
+	copy(sealed, tokens)
+
+	// load each domain's key up front, so the workers only read the maps
+	keys := make(map[string]domainKeyMaterial)
+	keyerrs := make(map[string]error)
+	for _, tok := range tokens {
+		if _, loaded := keys[tok.DomainUuid]; !loaded {
+			keys[tok.DomainUuid], keyerrs[tok.DomainUuid] = loadDomainKey(tok.DomainUuid, true)
+		}
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(tokens) {
+		workers = len(tokens)
+	}
+
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indices {
+				domainUuid := sealed[idx].DomainUuid
+				if keyerrs[domainUuid] != nil {
+					sealerrs[idx] = keyerrs[domainUuid]
+					continue
+				}
+				encrypted, err := encryptWithKey(sealed[idx].Value, keys[domainUuid].key)
+				if err != nil {
+					sealerrs[idx] = err
+					continue
+				}
+				sealed[idx].EncryptedValue = encrypted
+				sealed[idx].KeyId = keys[domainUuid].keyId
+				sealed[idx].Value = ""
+			}
+		}()
+	}
+	for idx := range sealed {
+		indices <- idx
+	}
+	close(indices)
+	wg.Wait()
+	return sealed, sealerrs
+}
+
+// revealValue decrypts a stored token's value in place,
+// leaving tokens stored without encryption untouched
+func revealValue(tok *Token) error {
+	if len(tok.EncryptedValue) == 0 {
+		return nil
+	}
+
+	var plaintext string
+	var err error
+	if len(tok.KeyId) == 0 {
+		// stored before domain keys, under the master key
+		plaintext, err = DecryptValue(tok.EncryptedValue)
+	} else {
+		material, keyerr := domainKeyFor(tok.DomainUuid, tok.KeyId)
+		if keyerr != nil {
+			return keyerr
+		}
+		plaintext, err = decryptWithKey(tok.EncryptedValue, material.key)
+	}
+	if err != nil {
+		return err
+	}
+	tok.Value = plaintext
+	tok.EncryptedValue = ""
+	return nil
 }
 
 func EncryptValues(plaintext []string) []string {
@@ -304,6 +797,35 @@ func DecryptValues(encryptedValues []string) []string {
 	return plaintext
 }
 
+// EnsureIndexes creates the datastore indexes the tokenizer relies on
+func EnsureIndexes() error {
+	if UnitTest {
+		return nil
+	}
+	if err := datastore.EnsureIndexes(CollectionName, tokenIndexes); err != nil {
+		return err
+	}
+	if err := datastore.EnsureIndexes(historyCollectionName, historyIndexes); err != nil {
+		return err
+	}
+	if err := datastore.EnsureIndexes(domainKeyCollectionName, domainKeyIndexes); err != nil {
+		return err
+	}
+	if err := datastore.EnsureIndexes(verifyAttemptCollectionName, verifyAttemptIndexes); err != nil {
+		return err
+	}
+	if err := datastore.EnsureIndexes(inboundRouteCollectionName, inboundRouteIndexes); err != nil {
+		return err
+	}
+	if err := datastore.EnsureIndexes(jobCollectionName, jobIndexes); err != nil {
+		return err
+	}
+	if err := datastore.EnsureIndexes(datalog.CollectionName, datalog.Indexes); err != nil {
+		return err
+	}
+	return datastore.EnsureIndexes(idempotencyCollectionName, idempotencyIndexes)
+}
+
 func getPageRecordCount() int64 {
 	configuration, configerr := systemconfig.Load()
 	if configerr != nil {
@@ -312,6 +834,51 @@ func getPageRecordCount() int64 {
 	return configuration.PageRecordCount
 }
 
+func getEncryptValues() bool {
+	configuration, configerr := systemconfig.Load()
+	if configerr != nil {
+		return false
+	}
+	return configuration.EncryptValues
+}
+
+func getEncryptionWorkers() int {
+	configuration, configerr := systemconfig.Load()
+	if configerr != nil || configuration.EncryptionWorkers < 1 {
+		return defaultEncryptionWorkers
+	}
+	return configuration.EncryptionWorkers
+}
+
+var ErrInvalidMasterKey = errors.New("data: EncryptionKey must be 16, 24 or 32 bytes to select AES-128, AES-192 or AES-256")
+
+// CheckEncryptionKey makes sure values can be encrypted with the configured
+// master key, so a service with a bad key refuses to start rather than
+// failing every token it is asked to create. Without EncryptValues the key
+// is still needed for blind indexes, so it must be set but can be any size.
+func CheckEncryptionKey() error {
+	if err := getEncryptionKey(); err != nil {
+		return err
+	}
+	if !getEncryptValues() {
+		if len(encryptionKey) == 0 {
+			return ErrMasterKeyNotLoaded
+		}
+		return nil
+	}
+	return checkMasterKey(encryptionKey)
+}
+
+func checkMasterKey(key string) error {
+	switch len(key) {
+	case 0:
+		return ErrMasterKeyNotLoaded
+	case 16, 24, 32:
+		return nil
+	}
+	return ErrInvalidMasterKey
+}
+
 func getEncryptionKey() error {
 	// don't keep getting the key if we already got it
 	if len(encryptionKey) > 0 {
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strconv"
 	"testing"
+	"tokentarpon/tokencrypto"
 )
 
 func TestCreateToken(t *testing.T) {
@@ -58,13 +59,13 @@ func TestCreateToken(t *testing.T) {
 			}
 
 			// 3.3 try delete
-			deleteerr := DeleteToken(tok.DomainUuid, tok.Uuid)
+			_, deleteerr := DeleteToken(tok.DomainUuid, tok.Uuid)
 			if nil != deleteerr {
 				t.Error(deleteerr.Error())
 			}
 
 			// 3.4 try delete token that doesn't exist
-			deleteerr2 := DeleteToken("thisisnotmybeautifuldomain", tok.Uuid)
+			_, deleteerr2 := DeleteToken("thisisnotmybeautifuldomain", tok.Uuid)
 			if want, got := ErrNoMatchingToken, deleteerr2; want != got {
 				t.Error(fmt.Printf("expect error %#v but got %#v", want, got))
 			}
@@ -83,6 +84,214 @@ func TestGetToken(t *testing.T) {
 	t.Fatal("argggh")
 }
 
+func TestCreateTokensAtomic(t *testing.T) {
+	testScenarios := []struct {
+		givenTokens        []Token
+		expectedCreated    int
+		expectedErrorCount int
+		expectedError      error
+	}{
+		{
+			givenTokens: []Token{
+				{DomainUuid: "mydomain", Value: "first value"},
+				{DomainUuid: "mydomain", Value: "second value"},
+			},
+			expectedCreated: 2,
+		},
+		{
+			givenTokens: []Token{
+				{DomainUuid: "mydomain", Value: "first value"},
+				{DomainUuid: "mydomain", Value: ""},
+				{DomainUuid: "thisisnotmybeautifuldomain", Value: "third value"},
+			},
+			expectedErrorCount: 2,
+			expectedError:      ErrBatchInvalid,
+		},
+	}
+
+	UnitTest = true
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			created, errorTokens, err := CreateTokensAtomic("mydomain", scenario.givenTokens)
+			if want, got := scenario.expectedError, err; want != got {
+				t.Errorf("expect error %#v but got %#v", want, got)
+			}
+			if want, got := scenario.expectedCreated, len(created); want != got {
+				t.Errorf("expect %d created tokens but got %d", want, got)
+			}
+			if want, got := scenario.expectedErrorCount, len(errorTokens); want != got {
+				t.Errorf("expect %d token errors but got %d", want, got)
+			}
+			for _, tok := range created {
+				if len(tok.Uuid) == 0 {
+					t.Error("expect created token to have a uuid")
+				}
+			}
+		})
+	}
+}
+
+func TestEncryptTokens(t *testing.T) {
+	UnitTest = true
+	encryptionKey = ";kldfpo87-28374isu;dfjhZXJCVG786"
+	defer func() { encryptionKey = "" }()
+
+	var tokens []Token
+	for i := 0; i < 50; i++ {
+		tokens = append(tokens, Token{DomainUuid: "mydomain", Value: "value " + strconv.Itoa(i)})
+	}
+
+	sealed, sealerrs := encryptTokens(tokens, 4)
+	for idx, tok := range sealed {
+		if sealerrs[idx] != nil {
+			t.Fatal(sealerrs[idx])
+		}
+		if len(tok.Value) > 0 || len(tok.EncryptedValue) == 0 {
+			t.Fatalf("expect token %d to be stored encrypted but got %#v", idx, tok)
+		}
+
+		// decrypting must give back the value at the same index
+		if revealerr := revealValue(&tok); revealerr != nil {
+			t.Fatal(revealerr)
+		}
+		if want, got := tokens[idx].Value, tok.Value; want != got {
+			t.Errorf("expect token value %#v but got %#v", want, got)
+		}
+	}
+
+	// the tokens passed in are left alone
+	if want, got := "value 0", tokens[0].Value; want != got {
+		t.Errorf("expect original token value %#v but got %#v", want, got)
+	}
+}
+
+func TestDecryptValue(t *testing.T) {
+	encryptionKey = ";kldfpo87-28374isu;dfjhZXJCVG786"
+	defer func() { encryptionKey = "" }()
+
+	encrypted, _ := EncryptValue("a value")
+	// values encrypted before EncryptValue returned base64 are the raw ciphertext
+	raw, _ := tokencrypto.EncryptAES("an older value", encryptionKey)
+
+	testScenarios := []struct {
+		givenValue  string
+		expectValue string
+	}{
+		{encrypted, "a value"},
+		{raw, "an older value"},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			value, err := DecryptValue(scenario.givenValue)
+			if err != nil {
+				t.Fatalf("expect no error but got %#v", err)
+			}
+			if want, got := scenario.expectValue, value; want != got {
+				t.Errorf("expect value %#v but got %#v", want, got)
+			}
+		})
+	}
+}
+
+func TestCheckMasterKey(t *testing.T) {
+	testScenarios := []struct {
+		givenKey  string
+		expectErr error
+	}{
+		{"0123456789abcdef", nil},
+		{"0123456789abcdef01234567", nil},
+		{";kldfpo87-28374isu;dfjhZXJCVG786", nil},
+		{"", ErrMasterKeyNotLoaded},
+		{"must be either 16, 24, or 32 bytes to select AES-128, AES-192, or AES-256", ErrInvalidMasterKey},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if want, got := scenario.expectErr, checkMasterKey(scenario.givenKey); want != got {
+				t.Errorf("expect error %#v but got %#v", want, got)
+			}
+		})
+	}
+}
+
+func TestChunkUuids(t *testing.T) {
+	testScenarios := []struct {
+		givenUuids     []string
+		givenSize      int
+		expectedChunks []int
+	}{
+		{
+			givenUuids:     []string{"a", "b", "c", "d", "e"},
+			givenSize:      2,
+			expectedChunks: []int{2, 2, 1},
+		},
+		{
+			givenUuids:     []string{"a", "b", "a", " ", "c", "b"},
+			givenSize:      2,
+			expectedChunks: []int{2, 1},
+		},
+		{
+			givenUuids:     []string{},
+			givenSize:      100,
+			expectedChunks: []int{},
+		},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			chunks := chunkUuids(scenario.givenUuids, scenario.givenSize)
+			if want, got := len(scenario.expectedChunks), len(chunks); want != got {
+				t.Errorf("expect %d chunks but got %d", want, got)
+				return
+			}
+			for idx, chunk := range chunks {
+				if want, got := scenario.expectedChunks[idx], len(chunk); want != got {
+					t.Errorf("expect chunk %d to have %d uuids but got %d", idx, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestGetTokenValues(t *testing.T) {
+	found := map[string]Token{
+		"first": {Uuid: "first", Value: "one"},
+		"third": {Uuid: "third", Value: "three"},
+	}
+
+	tokenValues := buildTokenValues([]string{"first", "second", "", "third"}, found, ValueView{Mode: ViewFull})
+
+	// results line up with the requested uuids, gaps included
+	expected := []TokenValue{
+		{Uuid: "first", Value: "one"},
+		{Uuid: "second", Error: ErrCodeNotFound},
+		{Uuid: "", Error: ErrCodeInvalidId},
+		{Uuid: "third", Value: "three"},
+	}
+	if want, got := len(expected), len(tokenValues.Results); want != got {
+		t.Fatalf("expect %d results but got %d", want, got)
+	}
+	for idx, want := range expected {
+		if got := tokenValues.Results[idx]; want != got {
+			t.Errorf("expect result %d to be %#v but got %#v", idx, want, got)
+		}
+	}
+	if tokenValues.Found != 2 || tokenValues.Failed != 2 || !tokenValues.Partial {
+		t.Errorf("expect 2 found, 2 failed and a partial result but got %#v", tokenValues)
+	}
+
+	// unit test mode reports every uuid as not found rather than failing
+	UnitTest = true
+	tokenValues, err := GetTokenValues(TokenQuery{DomainUuid: "mydomain", Uuids: []string{"first"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := ErrCodeNotFound, tokenValues.Results[0].Error; want != got {
+		t.Errorf("expect error %#v but got %#v", want, got)
+	}
+}
+
 /*
 // test fixtures
 func TestAdd(t *testing.T) {
@@ -280,3 +489,40 @@ func TestEncryptValues(t *testing.T) {
 func TestDecryptValues(t *testing.T) {
 }
 */
+
+func TestCreateTokenResults(t *testing.T) {
+	UnitTest = true
+	tokens := []Token{
+		{DomainUuid: "mydomain", Value: "not a card", ValueType: ValueTypePAN},
+		{DomainUuid: "mydomain", Value: "Jane@Example.com", ValueType: ValueTypeEmail},
+		{DomainUuid: "otherdomain", Value: "a value"},
+		{DomainUuid: "mydomain", Value: "another value"},
+	}
+
+	expectErrors := []string{"value", "", "Invalid Domain ID", ""}
+	results := CreateTokenResults("mydomain", tokens)
+	if want, got := len(tokens), len(results); want != got {
+		t.Fatalf("expect %d results but got %d", want, got)
+	}
+	for i, result := range results {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if len(expectErrors[i]) == 0 {
+				if result.Error != nil || len(result.Token.Uuid) == 0 {
+					t.Fatalf("expect the token created but got %#v", result.Error)
+				}
+				return
+			}
+			if result.Error == nil {
+				t.Fatalf("expect an error but got %#v", result.Token)
+			}
+			if want, got := expectErrors[i], result.Error.Field; len(got) > 0 && want != got {
+				t.Errorf("expect field %q but got %q", want, got)
+			} else if want, got := expectErrors[i], result.Error.Error; len(result.Error.Field) == 0 && want != got {
+				t.Errorf("expect error %q but got %q", want, got)
+			}
+		})
+	}
+	if want, got := "jane@example.com", results[1].Token.Value; want != got {
+		t.Errorf("expect value %#v but got %#v", want, got)
+	}
+}
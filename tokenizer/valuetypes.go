@@ -0,0 +1,241 @@
+package tokenizer
+
+import (
+	"errors"
+	"math/big"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+)
+
+// built in value types, a token without a value type is stored as given
+const (
+	ValueTypeText  = "text"
+	ValueTypeEmail = "email"
+	ValueTypePhone = "phone"
+	ValueTypePAN   = "pan"
+	ValueTypeSSN   = "ssn"
+	ValueTypeIBAN  = "iban"
+	ValueTypeDOB   = "dob"
+)
+
+// ValueNormalizer checks a value is well formed for its type and returns it
+// in the one form it is stored, indexed and compared in.
+// The error message is returned to the caller, so it must not include the value.
+type ValueNormalizer func(value string) (string, error)
+
+// FieldError reports which field of a token was rejected and why
+type FieldError struct {
+	Field   string `bson:"field" json:"field"`
+	Message string `bson:"message" json:"message"`
+}
+
+func (e *FieldError) Error() string {
+	return "data: " + e.Field + " " + e.Message
+}
+
+var valueTypes = map[string]ValueNormalizer{
+	ValueTypeText:  normalizeText,
+	ValueTypeEmail: normalizeEmail,
+	ValueTypePhone: normalizePhone,
+	ValueTypePAN:   normalizePAN,
+	ValueTypeSSN:   normalizeSSN,
+	ValueTypeIBAN:  normalizeIBAN,
+	ValueTypeDOB:   normalizeDOB,
+}
+var valueTypesMutex sync.RWMutex
+
+// RegisterValueType adds a value type, or replaces the normalizer of an existing one.
+// Tokens can use it as soon as it is registered.
+func RegisterValueType(name string, normalizer ValueNormalizer) {
+	valueTypesMutex.Lock()
+	defer valueTypesMutex.Unlock()
+	valueTypes[strings.ToLower(strings.TrimSpace(name))] = normalizer
+}
+
+// NormalizeValue validates the value against the value type and returns it normalized.
+// Values without a value type are returned unchanged.
+func NormalizeValue(valueType string, value string) (string, error) {
+	if len(valueType) == 0 {
+		return value, nil
+	}
+	valueTypesMutex.RLock()
+	normalizer, ok := valueTypes[valueType]
+	valueTypesMutex.RUnlock()
+	if !ok {
+		return "", &FieldError{Field: "valueType", Message: "is not a known value type"}
+	}
+
+	normalized, err := normalizer(value)
+	if err != nil {
+		return "", &FieldError{Field: "value", Message: err.Error()}
+	}
+	return normalized, nil
+}
+
+// knownValueType reports whether a normalizer is registered for the value type
+func knownValueType(valueType string) bool {
+	valueTypesMutex.RLock()
+	defer valueTypesMutex.RUnlock()
+	_, ok := valueTypes[valueType]
+	return ok
+}
+
+// applyValueType normalizes the token's value by its value type in place
+func applyValueType(tok *Token) error {
+	tok.ValueType = strings.ToLower(strings.TrimSpace(tok.ValueType))
+	normalized, err := NormalizeValue(tok.ValueType, tok.Value)
+	if err != nil {
+		return err
+	}
+	tok.Value = normalized
+	return nil
+}
+
+func normalizeText(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return "", errors.New("must not be blank")
+	}
+	return value, nil
+}
+
+func normalizeEmail(value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	address, err := mail.ParseAddress(value)
+	if err != nil || address.Address != value || len(address.Name) > 0 {
+		return "", errors.New("must be an email address")
+	}
+	at := strings.LastIndex(value, "@")
+	if !strings.Contains(value[at+1:], ".") {
+		return "", errors.New("must be an email address")
+	}
+	return value, nil
+}
+
+// normalizePhone returns the number in E.164 form, +<country code><number>.
+// Spaces, dots, dashes and brackets are dropped, and a leading 00 is read as +.
+func normalizePhone(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "00") {
+		value = "+" + value[2:]
+	}
+	if !strings.HasPrefix(value, "+") {
+		return "", errors.New("must be a phone number with its country code, e.g. +14155550123")
+	}
+	digits := stripSeparators(value[1:], " .-()")
+	if len(digits) < 8 || len(digits) > 15 || !isDigits(digits) || digits[0] == '0' {
+		return "", errors.New("must be a phone number with its country code, e.g. +14155550123")
+	}
+	return "+" + digits, nil
+}
+
+// normalizePAN returns the card number as digits only,
+// rejecting numbers that fail the Luhn check
+func normalizePAN(value string) (string, error) {
+	digits := stripSeparators(strings.TrimSpace(value), " -")
+	if len(digits) < 12 || len(digits) > 19 || !isDigits(digits) {
+		return "", errors.New("must be a card number of 12 to 19 digits")
+	}
+	if !luhnValid(digits) {
+		return "", errors.New("is not a valid card number")
+	}
+	return digits, nil
+}
+
+// normalizeSSN returns a US social security number as AAA-GG-SSSS,
+// rejecting numbers that are never issued
+func normalizeSSN(value string) (string, error) {
+	digits := stripSeparators(strings.TrimSpace(value), " -")
+	if len(digits) != 9 || !isDigits(digits) {
+		return "", errors.New("must be a social security number, e.g. 123-45-6789")
+	}
+	area, group, serial := digits[0:3], digits[3:5], digits[5:9]
+	if area == "000" || area == "666" || area[0] == '9' || group == "00" || serial == "0000" {
+		return "", errors.New("is not a valid social security number")
+	}
+	return area + "-" + group + "-" + serial, nil
+}
+
+// normalizeIBAN returns the IBAN uppercased without spaces,
+// rejecting ones that fail the mod 97 check
+func normalizeIBAN(value string) (string, error) {
+	iban := strings.ToUpper(stripSeparators(strings.TrimSpace(value), " "))
+	if len(iban) < 15 || len(iban) > 34 || !isLetters(iban[0:2]) || !isDigits(iban[2:4]) {
+		return "", errors.New("must be an IBAN, e.g. GB82WEST12345698765432")
+	}
+
+	// move the country and check digits to the end, then letters become 10 to 35
+	var numeric strings.Builder
+	for _, r := range iban[4:] + iban[0:4] {
+		if r >= '0' && r <= '9' {
+			numeric.WriteRune(r)
+		} else if r >= 'A' && r <= 'Z' {
+			numeric.WriteString(big.NewInt(int64(r - 'A' + 10)).String())
+		} else {
+			return "", errors.New("must be an IBAN, e.g. GB82WEST12345698765432")
+		}
+	}
+	checked, _ := new(big.Int).SetString(numeric.String(), 10)
+	if new(big.Int).Mod(checked, big.NewInt(97)).Int64() != 1 {
+		return "", errors.New("is not a valid IBAN")
+	}
+	return iban, nil
+}
+
+// normalizeDOB returns a date of birth as YYYY-MM-DD, which can't be in the future
+func normalizeDOB(value string) (string, error) {
+	dob, err := time.Parse("2006-01-02", strings.TrimSpace(value))
+	if err != nil {
+		return "", errors.New("must be a date, e.g. 1990-12-31")
+	}
+	if dob.Year() < 1900 || dob.After(time.Now()) {
+		return "", errors.New("is not a valid date of birth")
+	}
+	return dob.Format("2006-01-02"), nil
+}
+
+func luhnValid(digits string) bool {
+	sum := 0
+	double := false
+	for idx := len(digits) - 1; idx >= 0; idx-- {
+		digit := int(digits[idx] - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+func stripSeparators(value string, separators string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(separators, r) {
+			return -1
+		}
+		return r
+	}, value)
+}
+
+func isDigits(value string) bool {
+	for _, r := range value {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return len(value) > 0
+}
+
+func isLetters(value string) bool {
+	for _, r := range value {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return len(value) > 0
+}
@@ -0,0 +1,107 @@
+package tokenizer
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeValue(t *testing.T) {
+	testScenarios := []struct {
+		valueType, value string
+		expectValue      string
+		expectField      string
+	}{
+		{"", "  As Given ", "  As Given ", ""},
+		{ValueTypeText, "  free text ", "free text", ""},
+		{ValueTypeText, "   ", "", "value"},
+		{ValueTypeEmail, " Jane@Example.COM ", "jane@example.com", ""},
+		{ValueTypeEmail, "jane@localhost", "", "value"},
+		{ValueTypeEmail, "Jane <jane@example.com>", "", "value"},
+		{ValueTypePhone, "+1 (415) 555-0123", "+14155550123", ""},
+		{ValueTypePhone, "0044 20 7946 0018", "+442079460018", ""},
+		{ValueTypePhone, "415 555 0123", "", "value"},
+		{ValueTypePAN, "4242 4242 4242 4242", "4242424242424242", ""},
+		{ValueTypePAN, "4242 4242 4242 4241", "", "value"},
+		{ValueTypeSSN, "123456789", "123-45-6789", ""},
+		{ValueTypeSSN, "666-45-6789", "", "value"},
+		{ValueTypeIBAN, "gb82 west 1234 5698 7654 32", "GB82WEST12345698765432", ""},
+		{ValueTypeIBAN, "GB83WEST12345698765432", "", "value"},
+		{ValueTypeDOB, " 1990-12-31 ", "1990-12-31", ""},
+		{ValueTypeDOB, "31/12/1990", "", "value"},
+		{ValueTypeDOB, "2999-01-01", "", "value"},
+		{"shoesize", "42", "", "valueType"},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			value, err := NormalizeValue(scenario.valueType, scenario.value)
+			var fielderr *FieldError
+			if len(scenario.expectField) == 0 && err != nil {
+				t.Fatalf("expect no error but got %#v", err)
+			} else if len(scenario.expectField) > 0 {
+				if !errors.As(err, &fielderr) || fielderr.Field != scenario.expectField {
+					t.Fatalf("expect error for field %s but got %#v", scenario.expectField, err)
+				}
+				if given := strings.TrimSpace(scenario.value); len(given) > 0 && strings.Contains(fielderr.Message, given) {
+					t.Errorf("expect the error not to include the value but got %s", fielderr.Message)
+				}
+			}
+			if want, got := scenario.expectValue, value; want != got {
+				t.Errorf("expect value %#v but got %#v", want, got)
+			}
+		})
+	}
+}
+
+func TestRegisterValueType(t *testing.T) {
+	RegisterValueType("Postcode", func(value string) (string, error) {
+		value = strings.ToUpper(strings.TrimSpace(value))
+		if len(value) < 5 {
+			return "", errors.New("must be a postcode")
+		}
+		return value, nil
+	})
+	defer func() {
+		valueTypesMutex.Lock()
+		delete(valueTypes, "postcode")
+		valueTypesMutex.Unlock()
+	}()
+
+	UnitTest = true
+	tok, err := CreateTokenFrom("mydomain", Token{Value: " sw1a 1aa", ValueType: "postcode"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "SW1A 1AA", tok.Value; want != got {
+		t.Errorf("expect value %#v but got %#v", want, got)
+	}
+}
+
+func TestCreateTokensReportsFieldErrors(t *testing.T) {
+	UnitTest = true
+	tokens := []Token{
+		{DomainUuid: "mydomain", Value: "Jane@Example.com", ValueType: ValueTypeEmail},
+		{DomainUuid: "mydomain", Value: "not a card", ValueType: ValueTypePAN},
+	}
+
+	created, errorTokens := CreateTokens("mydomain", tokens)
+	if len(created) != 1 || len(errorTokens) != 1 {
+		t.Fatalf("expect 1 created and 1 failed but got %d and %d", len(created), len(errorTokens))
+	}
+	if want, got := "jane@example.com", created[0].Value; want != got {
+		t.Errorf("expect value %#v but got %#v", want, got)
+	}
+	if want, got := "value", errorTokens[0].Field; want != got {
+		t.Errorf("expect field %#v but got %#v", want, got)
+	}
+
+	_, errorTokens, err := CreateTokensAtomic("mydomain", tokens)
+	if err != ErrBatchInvalid || len(errorTokens) != 1 || errorTokens[0].Field != "value" {
+		t.Errorf("expect the atomic batch to be rejected for the card but got %#v %#v", err, errorTokens)
+	}
+	if tokens[0].Value != "Jane@Example.com" {
+		t.Error("expect the given tokens not to be changed")
+	}
+}
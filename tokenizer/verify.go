@@ -0,0 +1,159 @@
+package tokenizer
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"strings"
+	"time"
+	"tokentarpon/tokenizer/datastore"
+	"tokentarpon/tokenizer/systemconfig"
+)
+
+var verifyAttemptCollectionName = "verifyattempts"
+var verifyAttemptRecordType = "verifyattempt"
+var defaultVerifyMaxAttempts int64 = 5
+var defaultVerifyWindowSeconds int64 = 900
+
+// verifyAttempt counts the verify attempts made against a token in one window.
+// ExpiresAt is a date so mongodb can expire it with a TTL index.
+type verifyAttempt struct {
+	DomainUuid string    `bson:"domainUuid"`
+	Uuid       string    `bson:"uuid"`
+	Window     int64     `bson:"window"`
+	Attempts   int64     `bson:"attempts"`
+	ExpiresAt  time.Time `bson:"expiresAt"`
+}
+
+var verifyAttemptIndexes = []datastore.DataIndex{
+	{Fields: []string{"domainUuid", "uuid", "window"}, Unique: true},
+	{Fields: []string{"expiresAt"}, Expires: true, ExpireAfterSeconds: 0},
+}
+
+var (
+	ErrNoCandidateValue = errors.New("data: need a value to verify")
+	ErrTooManyAttempts  = errors.New("data: too many verify attempts for this token, try again later")
+)
+
+// VerifyTokenValue reports whether the candidate matches the token's value,
+// without revealing the value. The candidate is normalized by the token's
+// value type first, so e.g. an email matches whatever its case, and a
+// candidate that isn't valid for the type never matches.
+// Every attempt counts against the token's limit for the window; once it is
+// reached ErrTooManyAttempts is returned with the seconds until the next window.
+func VerifyTokenValue(domainUuid string, tokenUuid string, candidate string) (bool, int64, error) {
+	err := errors.New("data: need domain id, token id")
+	if len(strings.TrimSpace(domainUuid)) == 0 {
+		return false, 0, err
+	}
+	if len(strings.TrimSpace(tokenUuid)) == 0 {
+		return false, 0, err
+	}
+	if len(strings.TrimSpace(candidate)) == 0 {
+		return false, 0, ErrNoCandidateValue
+	}
+	if shrederr := checkDomainOpen(domainUuid); shrederr != nil {
+		return false, 0, shrederr
+	}
+
+	if UnitTest {
+		return false, 0, nil
+	}
+
+	// the attempt is counted before anything is read,
+	// so a caller over the limit learns nothing about the token
+	retryAfter, attempterr := claimVerifyAttempt(domainUuid, tokenUuid, time.Now().Unix())
+	if attempterr != nil {
+		return false, retryAfter, attempterr
+	}
+
+	tok, geterr := getLiveToken(domainUuid, tokenUuid)
+	if geterr != nil {
+		return false, 0, geterr
+	}
+	if revealerr := revealValue(&tok); revealerr != nil {
+		return false, 0, revealerr
+	}
+	normalized, typeerr := NormalizeValue(tok.ValueType, candidate)
+	if typeerr != nil {
+		return false, 0, nil
+	}
+	return valuesMatch(tok.Value, normalized), 0, nil
+}
+
+// valuesMatch compares digests of the values, so the comparison
+// takes the same time whatever their lengths or contents
+func valuesMatch(stored string, candidate string) bool {
+	storedDigest := sha256.Sum256([]byte(stored))
+	candidateDigest := sha256.Sum256([]byte(candidate))
+	return subtle.ConstantTimeCompare(storedDigest[:], candidateDigest[:]) == 1
+}
+
+// claimVerifyAttempt counts an attempt against the token in the current window,
+// returning ErrTooManyAttempts with the seconds left in the window once the
+// limit is reached. The count is only raised while under the limit, so
+// concurrent attempts across replicas can't go over it.
+func claimVerifyAttempt(domainUuid string, tokenUuid string, now int64) (int64, error) {
+	maxAttempts := getVerifyMaxAttempts()
+	windowSeconds := getVerifyWindowSeconds()
+	window := now - now%windowSeconds
+	retryAfter := window + windowSeconds - now
+
+	filter := makeVerifyAttemptQuery(domainUuid, tokenUuid, window, maxAttempts)
+	// a second attempt covers another replica starting the window at the same time
+	for attempt := 0; attempt < 2; attempt++ {
+		counted, incerr := datastore.IncrementRecordIn(verifyAttemptCollectionName, filter, "and", "attempts", 1)
+		if incerr != nil {
+			return 0, incerr
+		} else if counted == 1 {
+			return 0, nil
+		}
+
+		record := verifyAttempt{
+			DomainUuid: domainUuid,
+			Uuid:       tokenUuid,
+			Window:     window,
+			Attempts:   1,
+			ExpiresAt:  time.Unix(window+windowSeconds, 0),
+		}
+		inserterr := datastore.InsertRecordIn(verifyAttemptCollectionName, verifyAttemptRecordType, record)
+		if inserterr == nil {
+			return 0, nil
+		} else if inserterr != datastore.ErrConflict {
+			return 0, inserterr
+		}
+	}
+	return retryAfter, ErrTooManyAttempts
+}
+
+// makeVerifyAttemptQuery finds the token's attempt count for the window while it is under the limit
+func makeVerifyAttemptQuery(domainUuid string, tokenUuid string, window int64, maxAttempts int64) []datastore.DataQueryGroup {
+	var filters = make([]datastore.DataQueryGroup, 1)
+	var nvq datastore.DataQueryGroup
+
+	nvq.Operator = "and"
+	nvq.DataQueries = []datastore.DataQuery{
+		{FieldName: "domainUuid", FieldValue: domainUuid, CaseSensitive: true},
+		{FieldName: "uuid", FieldValue: tokenUuid, CaseSensitive: true},
+		{FieldName: "window", IsInt: true, IntValue: window},
+		{FieldName: "attempts", IsInt: true, IntValue: maxAttempts, Comparison: "lt"},
+	}
+	filters[0] = nvq
+	return filters
+}
+
+func getVerifyMaxAttempts() int64 {
+	configuration, configerr := systemconfig.Load()
+	if configerr != nil || configuration.VerifyMaxAttempts <= 0 {
+		return defaultVerifyMaxAttempts
+	}
+	return configuration.VerifyMaxAttempts
+}
+
+func getVerifyWindowSeconds() int64 {
+	configuration, configerr := systemconfig.Load()
+	if configerr != nil || configuration.VerifyWindowSeconds <= 0 {
+		return defaultVerifyWindowSeconds
+	}
+	return configuration.VerifyWindowSeconds
+}
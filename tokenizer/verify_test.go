@@ -0,0 +1,62 @@
+package tokenizer
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"tokentarpon/tokenizer/datastore"
+)
+
+func TestVerifyTokenValue(t *testing.T) {
+	UnitTest = true
+	testScenarios := []struct {
+		domainUuid, tokenUuid, candidate string
+		expectErr                        bool
+		expectNoCandidate                bool
+	}{
+		{"mydomain", "abc", "jane@example.com", false, false},
+		{"mydomain", "abc", "  ", true, true},
+		{"mydomain", "", "jane@example.com", true, false},
+		{"", "abc", "jane@example.com", true, false},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			_, _, err := VerifyTokenValue(scenario.domainUuid, scenario.tokenUuid, scenario.candidate)
+			if want, got := scenario.expectErr, err != nil; want != got {
+				t.Fatalf("expect error %t but got %#v", want, err)
+			}
+			if want, got := scenario.expectNoCandidate, err == ErrNoCandidateValue; want != got {
+				t.Errorf("expect no candidate error %t but got %#v", want, err)
+			}
+		})
+	}
+}
+
+func TestValuesMatch(t *testing.T) {
+	testScenarios := []struct {
+		stored, candidate string
+		expectMatch       bool
+	}{
+		{"jane@example.com", "jane@example.com", true},
+		{"jane@example.com", "jane@example.co", false},
+		{"jane@example.com", "Jane@example.com", false},
+		{"4242424242424242", "", false},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if want, got := scenario.expectMatch, valuesMatch(scenario.stored, scenario.candidate); want != got {
+				t.Errorf("expect match %t but got %t", want, got)
+			}
+		})
+	}
+}
+
+func TestMakeVerifyAttemptQuery(t *testing.T) {
+	filter := datastore.CreateMongoFilter(makeVerifyAttemptQuery("mydomain", "abc", 1700000000, 5), "and")
+	want := "map[$and:[map[domainUuid:mydomain] map[uuid:abc] map[window:map[$eq:1700000000]] map[attempts:map[$lt:5]]]]"
+	if got := fmt.Sprint(filter); want != got {
+		t.Errorf("expect filter %s but got %s", want, got)
+	}
+}
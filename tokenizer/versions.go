@@ -0,0 +1,249 @@
+package tokenizer
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"tokentarpon/tokenizer/datastore"
+)
+
+var historyCollectionName = "tokenhistory"
+var historyRecordType = "tokenversion"
+
+// each version of a token is kept once; the blind index
+// lets an erase find versions that held the value
+var historyIndexes = []datastore.DataIndex{
+	{Fields: []string{"domainUuid", "uuid", "revision"}, Unique: true},
+	{Fields: []string{"domainUuid", "blindIndex", "uuid"}},
+}
+
+// TokenVersion is an earlier version of a token, kept in the history
+// collection as it was stored, along with when it was replaced
+type TokenVersion struct {
+	Token      `bson:",inline"`
+	Superseded int64 `bson:"superseded" json:"superseded"`
+}
+
+// TokenVersionSummary describes a version without its value, for listing
+type TokenVersionSummary struct {
+	Revision   int64 `bson:"revision" json:"revision"`
+	Updated    int64 `bson:"updated" json:"updated"`
+	Superseded int64 `bson:"superseded" json:"superseded,omitempty"`
+	Current    bool  `bson:"current" json:"current"`
+}
+
+// the fields changed when a token's value is updated; the rest of the token,
+// e.g. its remaining reads, is left to the operations that own it
+type tokenValueUpdate struct {
+	Value          string `bson:"value"`
+	EncryptedValue string `bson:"encryptedValue"`
+	KeyId          string `bson:"keyId"`
+	BlindIndex     string `bson:"blindIndex"`
+	Revision       int64  `bson:"revision"`
+	Updated        int64  `bson:"updated"`
+}
+
+var ErrRevisionMismatch = errors.New("data: token has been changed since the given revision")
+
+// UpdateTokenValue stores a new value for an existing token, keeping its uuid,
+// and moves the value it replaces into the history collection.
+// When expectedRevision is set, the update only applies if the token is still
+// at that revision, otherwise ErrRevisionMismatch is returned. Concurrent
+// updates from the same revision can't both apply, whether a revision was given or not.
+func UpdateTokenValue(domainUuid string, tokenUuid string, value string, expectedRevision int64) (Token, error) {
+	var tok Token
+	err := errors.New("data: token incomplete, need domain id, token id, value")
+	if len(strings.TrimSpace(domainUuid)) == 0 {
+		return tok, err
+	}
+	if len(strings.TrimSpace(tokenUuid)) == 0 {
+		return tok, err
+	}
+	if sizeerr := checkValueSize(value, GetRequestLimits(domainUuid).MaxValueBytes); sizeerr != nil {
+		return tok, sizeerr
+	}
+	if shrederr := checkDomainOpen(domainUuid); shrederr != nil {
+		return tok, shrederr
+	}
+
+	if UnitTest {
+		tok.DomainUuid = domainUuid
+		tok.Uuid = tokenUuid
+		tok.Value = value
+		tok.Revision = 2
+		if expectedRevision > 0 && expectedRevision != 1 {
+			return Token{}, ErrRevisionMismatch
+		}
+		return tok, nil
+	}
+
+	var stored Token
+	filter := datastore.MakeDomainQuery(domainUuid, "uuid", tokenUuid, true)
+	geterr := datastore.GetRecordIn(CollectionName, filter, &stored)
+	if geterr == datastore.ErrNotFound {
+		return Token{}, ErrNoMatchingToken
+	} else if geterr != nil {
+		return Token{}, geterr
+	}
+	now := time.Now().Unix()
+	if !isLive(stored, now) {
+		return Token{}, ErrNoMatchingToken
+	}
+	revision := currentRevision(stored)
+	if expectedRevision > 0 && expectedRevision != revision {
+		return Token{}, ErrRevisionMismatch
+	}
+	// the new value must be of the token's type
+	normalized, typeerr := NormalizeValue(stored.ValueType, value)
+	if typeerr != nil {
+		return Token{}, typeerr
+	}
+
+	tok = stored
+	tok.Value = normalized
+	tok.EncryptedValue = ""
+	tok.KeyId = ""
+	tok.Revision = revision + 1
+	tok.Updated = now
+	sealed, sealerrs := sealTokens([]Token{tok}, 1)
+	if sealerrs[0] != nil {
+		return Token{}, sealerrs[0]
+	}
+
+	// the version being replaced is kept before the update, so a failure in
+	// between never loses it. It is keyed on its revision, so a retry or a
+	// concurrent update from the same revision finds it already kept.
+	previousVersion := stored
+	previousVersion.Revision = revision
+	previous := TokenVersion{Token: previousVersion, Superseded: now}
+	inserterr := datastore.InsertRecordIn(historyCollectionName, historyRecordType, previous)
+	if inserterr != nil && inserterr != datastore.ErrConflict {
+		return Token{}, inserterr
+	}
+
+	update := tokenValueUpdate{
+		Value:          sealed[0].Value,
+		EncryptedValue: sealed[0].EncryptedValue,
+		KeyId:          sealed[0].KeyId,
+		BlindIndex:     sealed[0].BlindIndex,
+		Revision:       tok.Revision,
+		Updated:        now,
+	}
+	matched, updateerr := datastore.UpdateRecordIfMatchedIn(CollectionName, tokenRecordType,
+		makeRevisionQuery(domainUuid, tokenUuid, stored.Revision), "and", update)
+	if updateerr != nil {
+		return Token{}, updateerr
+	} else if matched == 0 {
+		return Token{}, ErrRevisionMismatch
+	}
+
+	if tok.MaxReads > 0 {
+		tok.Value = ""
+	}
+	return tok, nil
+}
+
+// GetTokenVersion returns the token as it was at the given revision.
+// The token itself must still be readable for any of its versions to be.
+func GetTokenVersion(domainUuid string, tokenUuid string, revision int64) (Token, error) {
+	current, err := GetToken(domainUuid, tokenUuid)
+	if err != nil || revision == current.Revision || UnitTest {
+		return current, err
+	}
+
+	version, geterr := getStoredVersion(domainUuid, tokenUuid, revision)
+	if geterr != nil {
+		return Token{}, geterr
+	}
+
+	tok := version.Token
+	if current.MaxReads > 0 {
+		tok.Value = ""
+		tok.EncryptedValue = ""
+		return tok, nil
+	}
+	return tok, revealValue(&tok)
+}
+
+// GetTokenVersionValue returns the value the token held at the given revision, presented in the view.
+// Read limited tokens only give up their current value, through GetTokenValue.
+func GetTokenVersionValue(domainUuid string, tokenUuid string, revision int64, view ValueView) (string, error) {
+	tok, err := GetTokenVersion(domainUuid, tokenUuid, revision)
+	if err != nil {
+		return "", err
+	} else if tok.MaxReads > 0 {
+		return "", ErrNoMatchingToken
+	}
+	return PresentValue(tok, view)
+}
+
+// ListTokenVersions returns every version of the token, oldest first, without values
+func ListTokenVersions(domainUuid string, tokenUuid string) ([]TokenVersionSummary, error) {
+	versions := []TokenVersionSummary{}
+	current, err := GetToken(domainUuid, tokenUuid)
+	if err != nil {
+		return versions, err
+	}
+
+	if !UnitTest {
+		byRevision := []datastore.DataSort{{FieldName: "revision"}}
+		results, geterr := datastore.GetSortedRecordsIn(historyCollectionName,
+			makeTokenUuidsQuery(domainUuid, []string{tokenUuid}), "and", byRevision, 0, 0, TokenVersion{})
+		if geterr != nil {
+			return versions, geterr
+		}
+		for _, result := range results {
+			version := result.(TokenVersion)
+			// kept ahead of an update that then didn't apply
+			if version.Revision >= current.Revision {
+				continue
+			}
+			versions = append(versions, TokenVersionSummary{
+				Revision:   version.Revision,
+				Updated:    version.Updated,
+				Superseded: version.Superseded,
+			})
+		}
+	}
+
+	versions = append(versions, TokenVersionSummary{Revision: current.Revision, Updated: current.Updated, Current: true})
+	return versions, nil
+}
+
+// getStoredVersion reads an earlier version of a token as it is stored, still encrypted
+func getStoredVersion(domainUuid string, tokenUuid string, revision int64) (TokenVersion, error) {
+	var version TokenVersion
+	filter := makeTokenUuidsQuery(domainUuid, []string{tokenUuid})
+	filter[0].DataQueries = append(filter[0].DataQueries,
+		datastore.DataQuery{FieldName: "revision", IsInt: true, IntValue: revision})
+	geterr := datastore.GetRecordIn(historyCollectionName, filter, &version)
+	if geterr == datastore.ErrNotFound {
+		return TokenVersion{}, ErrNoMatchingToken
+	}
+	return version, geterr
+}
+
+// currentRevision treats tokens stored before revisions were kept as revision 1
+func currentRevision(tok Token) int64 {
+	if tok.Revision <= 0 {
+		return 1
+	}
+	return tok.Revision
+}
+
+// makeRevisionQuery finds the live token only while it is at the stored revision.
+// Tokens stored before revisions were kept may have no revision at all.
+func makeRevisionQuery(domainUuid string, tokenUuid string, storedRevision int64) []datastore.DataQueryGroup {
+	filter := datastore.MakeDomainQuery(domainUuid, "uuid", tokenUuid, true)
+	var revision datastore.DataQueryGroup
+	revision.Operator = "or"
+	revision.DataQueries = []datastore.DataQuery{
+		{FieldName: "revision", IsInt: true, IntValue: storedRevision},
+	}
+	if storedRevision <= 0 {
+		revision.DataQueries = append(revision.DataQueries,
+			datastore.DataQuery{FieldName: "revision", Comparison: "missing"})
+	}
+	filter[0].DataQueryGroups = append(filter[0].DataQueryGroups, revision)
+	return filter
+}
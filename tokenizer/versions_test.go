@@ -0,0 +1,75 @@
+package tokenizer
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"tokentarpon/tokenizer/datastore"
+)
+
+func TestUpdateTokenValue(t *testing.T) {
+	UnitTest = true
+	testScenarios := []struct {
+		domainUuid, tokenUuid, value string
+		expectedRevision             int64
+		expectErr                    bool
+		expectMismatch               bool
+	}{
+		{"mydomain", "abc", "new value", 0, false, false},
+		{"mydomain", "abc", "new value", 1, false, false},
+		{"mydomain", "abc", "new value", 3, true, true},
+		{"mydomain", "abc", " ", 0, true, false},
+		{"mydomain", "", "new value", 0, true, false},
+		{"", "abc", "new value", 0, true, false},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			tok, err := UpdateTokenValue(scenario.domainUuid, scenario.tokenUuid, scenario.value, scenario.expectedRevision)
+			if want, got := scenario.expectErr, err != nil; want != got {
+				t.Fatalf("expect error %t but got %#v", want, err)
+			}
+			if want, got := scenario.expectMismatch, err == ErrRevisionMismatch; want != got {
+				t.Errorf("expect revision mismatch %t but got %#v", want, err)
+			}
+			if err == nil && tok.Revision != 2 {
+				t.Errorf("expect revision 2 but got %d", tok.Revision)
+			}
+		})
+	}
+}
+
+func TestCreatedTokensStartAtRevisionOne(t *testing.T) {
+	UnitTest = true
+	tok, err := CreateToken("mydomain", "a value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := int64(1), tok.Revision; want != got {
+		t.Errorf("expect revision %d but got %d", want, got)
+	}
+
+	created, _ := CreateTokens("mydomain", []Token{{DomainUuid: "mydomain", Value: "a value"}})
+	if want, got := int64(1), created[0].Revision; want != got {
+		t.Errorf("expect revision %d but got %d", want, got)
+	}
+
+	if want, got := int64(1), currentRevision(Token{}); want != got {
+		t.Errorf("expect a token without a revision to be at revision %d but got %d", want, got)
+	}
+}
+
+func TestMakeRevisionQuery(t *testing.T) {
+	filter := datastore.CreateMongoFilter(makeRevisionQuery("mydomain", "abc", 3), "and")
+	want := "map[$and:[map[domainUuid:mydomain] map[uuid:abc] map[isDeleted:map[$eq:false]] map[$or:[map[revision:map[$eq:3]]]]]]"
+	if got := fmt.Sprint(filter); want != got {
+		t.Errorf("expect filter %s but got %s", want, got)
+	}
+
+	// tokens from before revisions may have none stored
+	filter = datastore.CreateMongoFilter(makeRevisionQuery("mydomain", "abc", 0), "and")
+	want = "map[$and:[map[domainUuid:mydomain] map[uuid:abc] map[isDeleted:map[$eq:false]] map[$or:[map[revision:map[$eq:0]] map[revision:map[$exists:false]]]]]]"
+	if got := fmt.Sprint(filter); want != got {
+		t.Errorf("expect filter %s but got %s", want, got)
+	}
+}
@@ -0,0 +1,174 @@
+package tokenizer
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"tokentarpon/tokencrypto"
+)
+
+// views a token value can be presented in when it is detokenized
+const (
+	ViewFull   = "full"
+	ViewMasked = "masked"
+	ViewLast   = "last"
+	ViewFirst  = "first"
+	ViewHash   = "hash"
+)
+
+// the most characters a first or last view may show,
+// never more than half of the value
+const (
+	defaultViewCount = 4
+	maxViewCount     = 8
+)
+
+// shown in place of the characters a view hides
+const maskRunes = "••••"
+
+// ValueView is how a value is presented: in full, masked by its value type,
+// only its first or last Count characters, or only a keyed hash of it
+type ValueView struct {
+	Mode  string `bson:"mode" json:"mode"`
+	Count int    `bson:"count" json:"count"`
+}
+
+// ValueMasker returns a value with all but the parts safe to show hidden
+type ValueMasker func(value string) string
+
+var ErrInvalidView = errors.New("data: view must be one of full, masked, first, last, hash, with first and last showing 1 to 8 characters")
+
+var valueMasks = map[string]ValueMasker{
+	ValueTypeEmail: maskEmail,
+	ValueTypePhone: maskLast4,
+	ValueTypePAN:   maskLast4,
+	ValueTypeSSN:   maskSSN,
+	ValueTypeIBAN:  maskIBAN,
+	ValueTypeDOB:   maskDOB,
+}
+var valueMasksMutex sync.RWMutex
+
+// RegisterValueMask sets how values of the value type are masked.
+// Values of a type without a mask are masked like free text.
+func RegisterValueMask(valueType string, masker ValueMasker) {
+	valueMasksMutex.Lock()
+	defer valueMasksMutex.Unlock()
+	valueMasks[strings.ToLower(strings.TrimSpace(valueType))] = masker
+}
+
+// CheckValueView makes sure the view is one that can be presented,
+// filling in the default count for first and last views
+func CheckValueView(view ValueView) (ValueView, error) {
+	switch view.Mode {
+	case "":
+		return ValueView{Mode: ViewFull}, nil
+	case ViewFull, ViewMasked, ViewHash:
+		return ValueView{Mode: view.Mode}, nil
+	case ViewFirst, ViewLast:
+		if view.Count == 0 {
+			view.Count = defaultViewCount
+		}
+		if view.Count < 0 || view.Count > maxViewCount {
+			return view, ErrInvalidView
+		}
+		return view, nil
+	}
+	return view, ErrInvalidView
+}
+
+// PresentValue returns the token's revealed value as the view shows it.
+// The hash view needs the master key.
+func PresentValue(tok Token, view ValueView) (string, error) {
+	if len(tok.Value) == 0 {
+		return "", nil
+	}
+	switch view.Mode {
+	case ViewMasked:
+		valueMasksMutex.RLock()
+		masker, ok := valueMasks[tok.ValueType]
+		valueMasksMutex.RUnlock()
+		if !ok {
+			masker = maskText
+		}
+		return masker(tok.Value), nil
+	case ViewFirst:
+		runes := []rune(tok.Value)
+		shown := viewCount(view.Count, len(runes))
+		return string(runes[:shown]) + maskRunes, nil
+	case ViewLast:
+		runes := []rune(tok.Value)
+		shown := viewCount(view.Count, len(runes))
+		return maskRunes + string(runes[len(runes)-shown:]), nil
+	case ViewHash:
+		return valueHashFor(tok.DomainUuid, tok.Value)
+	}
+	return tok.Value, nil
+}
+
+// viewCount keeps a first or last view to at most half of the value
+func viewCount(count int, length int) int {
+	if count > length/2 {
+		return length / 2
+	}
+	return count
+}
+
+// valueHashFor returns a keyed hash callers can compare values by without seeing them.
+// It uses its own key, so it can't be matched against the blind index.
+func valueHashFor(domainUuid string, value string) (string, error) {
+	getEncryptionKey()
+	if len(encryptionKey) == 0 {
+		return "", ErrMasterKeyNotLoaded
+	}
+	hashKey := tokencrypto.GetHMACForString("tokentarpon value hash", encryptionKey)
+	return tokencrypto.GetHMACForString(domainUuid+"\x00"+value, hashKey), nil
+}
+
+// maskText shows the last 4 characters of longer values, and nothing of short ones
+func maskText(value string) string {
+	runes := []rune(value)
+	if len(runes) < 12 {
+		return maskRunes
+	}
+	return maskRunes + string(runes[len(runes)-4:])
+}
+
+// maskEmail shows the first character of the mailbox and the whole domain, e.g. j***@example.com
+func maskEmail(value string) string {
+	at := strings.LastIndex(value, "@")
+	if at < 1 {
+		return maskText(value)
+	}
+	return string([]rune(value)[0]) + "***" + value[at:]
+}
+
+func maskLast4(value string) string {
+	runes := []rune(value)
+	if len(runes) < 8 {
+		return maskRunes
+	}
+	return maskRunes + " " + string(runes[len(runes)-4:])
+}
+
+func maskSSN(value string) string {
+	if len(value) != 11 {
+		return maskRunes
+	}
+	return "•••-••-" + value[7:]
+}
+
+// maskIBAN shows the country and the last 4 characters, e.g. GB •••• 5432
+func maskIBAN(value string) string {
+	if len(value) < 15 {
+		return maskRunes
+	}
+	return value[0:2] + " " + maskRunes + " " + value[len(value)-4:]
+}
+
+// maskDOB shows only the year of birth
+func maskDOB(value string) string {
+	if len(value) != 10 {
+		return maskRunes
+	}
+	return value[0:4] + "-••-••"
+}
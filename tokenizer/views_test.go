@@ -0,0 +1,97 @@
+package tokenizer
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestCheckValueView(t *testing.T) {
+	testScenarios := []struct {
+		givenView  ValueView
+		expectView ValueView
+		expectErr  error
+	}{
+		{ValueView{}, ValueView{Mode: ViewFull}, nil},
+		{ValueView{Mode: ViewMasked, Count: 3}, ValueView{Mode: ViewMasked}, nil},
+		{ValueView{Mode: ViewLast}, ValueView{Mode: ViewLast, Count: 4}, nil},
+		{ValueView{Mode: ViewFirst, Count: 2}, ValueView{Mode: ViewFirst, Count: 2}, nil},
+		{ValueView{Mode: ViewFirst, Count: 9}, ValueView{}, ErrInvalidView},
+		{ValueView{Mode: ViewLast, Count: -1}, ValueView{}, ErrInvalidView},
+		{ValueView{Mode: "plain"}, ValueView{}, ErrInvalidView},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			view, err := CheckValueView(scenario.givenView)
+			if want, got := scenario.expectErr, err; want != got {
+				t.Fatalf("expect error %#v but got %#v", want, got)
+			}
+			if err == nil && scenario.expectView != view {
+				t.Errorf("expect view %#v but got %#v", scenario.expectView, view)
+			}
+		})
+	}
+}
+
+func TestPresentValue(t *testing.T) {
+	testScenarios := []struct {
+		valueType, value string
+		view             ValueView
+		expectValue      string
+	}{
+		{ValueTypeEmail, "jane@example.com", ValueView{Mode: ViewFull}, "jane@example.com"},
+		{ValueTypeEmail, "jane@example.com", ValueView{Mode: ViewMasked}, "j***@example.com"},
+		{ValueTypePAN, "4242424242424242", ValueView{Mode: ViewMasked}, "•••• 4242"},
+		{ValueTypePhone, "+14155550123", ValueView{Mode: ViewMasked}, "•••• 0123"},
+		{ValueTypeSSN, "123-45-6789", ValueView{Mode: ViewMasked}, "•••-••-6789"},
+		{ValueTypeIBAN, "GB82WEST12345698765432", ValueView{Mode: ViewMasked}, "GB •••• 5432"},
+		{ValueTypeDOB, "1990-12-31", ValueView{Mode: ViewMasked}, "1990-••-••"},
+		{"", "a free text value", ValueView{Mode: ViewMasked}, "••••alue"},
+		{"", "short", ValueView{Mode: ViewMasked}, "••••"},
+		{"", "4242424242424242", ValueView{Mode: ViewLast, Count: 4}, "••••4242"},
+		{"", "4242424242424242", ValueView{Mode: ViewFirst, Count: 6}, "424242••••"},
+		{"", "123456", ValueView{Mode: ViewFirst, Count: 8}, "123••••"},
+		{"", "", ValueView{Mode: ViewMasked}, ""},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			tok := Token{DomainUuid: "mydomain", ValueType: scenario.valueType, Value: scenario.value}
+			if want, got := scenario.expectValue, presentValue(t, tok, scenario.view); want != got {
+				t.Errorf("expect value %#v but got %#v", want, got)
+			}
+		})
+	}
+}
+
+func TestPresentValueHash(t *testing.T) {
+	hashView := ValueView{Mode: ViewHash}
+	if _, err := PresentValue(Token{DomainUuid: "mydomain", Value: "jane@example.com"}, hashView); err != ErrMasterKeyNotLoaded {
+		t.Errorf("expect error %#v but got %#v", ErrMasterKeyNotLoaded, err)
+	}
+
+	encryptionKey = ";kldfpo87-28374isu;dfjhZXJCVG786"
+	defer func() { encryptionKey = "" }()
+
+	hashed := presentValue(t, Token{DomainUuid: "mydomain", Value: "jane@example.com"}, hashView)
+	if hashed == "jane@example.com" || len(hashed) == 0 {
+		t.Fatalf("expect a hash but got %#v", hashed)
+	}
+	if again := presentValue(t, Token{DomainUuid: "mydomain", Value: "jane@example.com"}, hashView); again != hashed {
+		t.Error("expect the same value to hash the same")
+	}
+	if other := presentValue(t, Token{DomainUuid: "otherdomain", Value: "jane@example.com"}, hashView); other == hashed {
+		t.Error("expect the hash to differ between domains")
+	}
+	if blindIndex, _ := blindIndexFor("mydomain", "", "jane@example.com"); hashed == blindIndex {
+		t.Error("expect the hash not to reveal the blind index")
+	}
+}
+
+func presentValue(t *testing.T, tok Token, view ValueView) string {
+	value, err := PresentValue(tok, view)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
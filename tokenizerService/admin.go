@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"tokentarpon/tokenizer"
+
+	"github.com/gin-gonic/gin"
+)
+
+func getDeletedTokens(c *gin.Context) {
+	domainUuid := c.Param("domainId")
+	start, limit := getPageParams(c)
+
+	tokens, err := tokenizer.ListDeletedTokens(domainUuid, start, limit, callerName(c))
+	if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+	} else {
+		c.JSON(http.StatusOK, tokens)
+	}
+}
+
+func undeleteToken(c *gin.Context) {
+	domainUuid := c.Param("domainId")
+	tokenId := c.Param("id")
+
+	tokenObj, err := tokenizer.UndeleteToken(domainUuid, tokenId, callerName(c))
+	if err == tokenizer.ErrNoMatchingToken {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "deleted token not found"})
+	} else if err == tokenizer.ErrRetentionExpired || err == tokenizer.ErrDomainShredded {
+		c.IndentedJSON(http.StatusGone, gin.H{"message": fmt.Sprint(err)})
+	} else if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+	} else {
+		c.IndentedJSON(http.StatusOK, tokenObj)
+	}
+}
+
+// shredRequest must repeat the domain id being shredded,
+// so a domain can't be shredded by a mistyped url
+type shredRequest struct {
+	Confirm string `json:"confirm"`
+}
+
+func shredDomain(c *gin.Context) {
+	domainUuid := c.Param("domainId")
+
+	var request shredRequest
+	if err := c.BindJSON(&request); err != nil {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Shred request malformed"})
+		return
+	}
+
+	cert, err := tokenizer.ShredDomain(domainUuid, request.Confirm, callerName(c))
+	if err == tokenizer.ErrShredNotConfirmed {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": fmt.Sprint(err)})
+	} else if err == tokenizer.ErrDomainShredded {
+		c.IndentedJSON(http.StatusGone, gin.H{"message": fmt.Sprint(err)})
+	} else if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+	} else {
+		c.IndentedJSON(http.StatusOK, cert)
+	}
+}
+
+// eraseRequest carries the plaintext value to erase, e.g. a data subject's email.
+// The value type, when given, normalizes the value the way it was when tokenized.
+type eraseRequest struct {
+	Value     string `json:"value"`
+	ValueType string `json:"valueType"`
+}
+
+func eraseDomainValue(c *gin.Context) {
+	domainUuid := c.Param("domainId")
+
+	var request eraseRequest
+	if err := c.BindJSON(&request); err != nil {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Erase request malformed"})
+		return
+	}
+
+	report, err := tokenizer.EraseByValue([]string{domainUuid}, request.ValueType, request.Value, callerName(c))
+	respondErasure(c, report, err)
+}
+
+func eraseAccountValue(c *gin.Context) {
+	accountId := c.Param("accountId")
+
+	var request eraseRequest
+	if err := c.BindJSON(&request); err != nil {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Erase request malformed"})
+		return
+	}
+
+	report, err := tokenizer.EraseByValueInAccount(accountId, request.ValueType, request.Value, callerName(c))
+	respondErasure(c, report, err)
+}
+
+func respondErasure(c *gin.Context, report tokenizer.ErasureReport, err error) {
+	var fielderr *tokenizer.FieldError
+	if err == tokenizer.ErrNoEraseValue {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprint(err)})
+	} else if errors.As(err, &fielderr) {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprint(err), "errors": []*tokenizer.FieldError{fielderr}})
+	} else if err == tokenizer.ErrUnknownAccount {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": fmt.Sprint(err)})
+	} else if err != nil {
+		// the report still lists whatever was erased before the failure
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprint(err), "report": report})
+	} else {
+		c.IndentedJSON(http.StatusOK, report)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"tokentarpon/tokenizer/systemconfig"
+
+	"github.com/gin-gonic/gin"
+)
+
+// scope granting the admin routes
+const ScopeAdmin = "admin"
+
+// scopes granting the views a caller may detokenize values in,
+// and the pseudonyms, proxy and template sink routes, when RequireDetokenizeScope is set
+const (
+	ScopeDetokenize       = "detokenize"
+	ScopeDetokenizeMasked = "detokenize:masked"
+	ScopeDetokenizeHash   = "detokenize:hash"
+	ScopePseudonymize     = "pseudonymize"
+	ScopeProxy            = "proxy"
+	ScopeRender           = "render"
+)
+
+// scope granting bulk export jobs, which always need it
+const ScopeExport = "export"
+
+// context key holding the name of the api key that made the request
+const callerKey = "caller"
+
+// api keys shorter than this are refused at startup, as easy to guess
+const minApiKeyLength = 32
+
+// keys from the sample config.json, refused at startup in case they were left in
+var placeholderApiKeys = []string{
+	"replace with a long random string",
+	"replace with another long random string",
+}
+
+// requireScope only lets a request through when its x-auth-token header is
+// a configured api key holding the scope. With no api keys configured
+// nobody holds any scope, so scoped routes are closed.
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		addHeaders(c)
+		apiKey, found := findApiKey(configuration.ApiKeys, c.GetHeader("x-auth-token"))
+		if !found {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Missing or unknown api key"})
+			return
+		}
+		if !hasScope(apiKey, scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "Api key lacks the " + scope + " scope"})
+			return
+		}
+		c.Set(callerKey, apiKey.Name)
+		c.Next()
+	}
+}
+
+// checkApiKeys refuses api keys that are too short to be safe, or that
+// were copied from the sample configuration unchanged
+func checkApiKeys(apiKeys []systemconfig.ApiKey) error {
+	for _, apiKey := range apiKeys {
+		key := strings.TrimSpace(apiKey.Key)
+		for _, placeholder := range placeholderApiKeys {
+			if key == placeholder {
+				return fmt.Errorf("api key %q is still the sample placeholder, replace it with a long random string", apiKey.Name)
+			}
+		}
+		if len(key) < minApiKeyLength {
+			return fmt.Errorf("api key %q must be at least %d bytes", apiKey.Name, minApiKeyLength)
+		}
+	}
+	return nil
+}
+
+// findApiKey looks up the key presented by a caller, comparing against
+// every configured key in constant time
+func findApiKey(apiKeys []systemconfig.ApiKey, presented string) (systemconfig.ApiKey, bool) {
+	var match systemconfig.ApiKey
+	found := false
+	presented = strings.TrimSpace(presented)
+	if len(presented) == 0 {
+		return match, false
+	}
+	for _, apiKey := range apiKeys {
+		if len(apiKey.Key) == 0 {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(apiKey.Key), []byte(presented)) == 1 && !found {
+			match = apiKey
+			found = true
+		}
+	}
+	return match, found
+}
+
+func hasScope(apiKey systemconfig.ApiKey, scope string) bool {
+	for _, held := range apiKey.Scopes {
+		if held == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// callerName is the api key name recorded as the actor in the audit log
+func callerName(c *gin.Context) string {
+	return c.GetString(callerKey)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"tokentarpon/tokenizer"
+	"tokentarpon/tokenizer/systemconfig"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequireScope(t *testing.T) {
+	tokenizer.UnitTest = true
+	gin.SetMode(gin.TestMode)
+	configuration.ApiKeys = []systemconfig.ApiKey{
+		{Name: "ops", Key: "ops-key", Scopes: []string{ScopeAdmin}},
+		{Name: "app", Key: "app-key", Scopes: []string{}},
+	}
+	defer func() { configuration.ApiKeys = nil }()
+
+	router := gin.New()
+	admin := router.Group("/admin", requireScope(ScopeAdmin))
+	admin.GET("/tokens/:domainId/deleted", getDeletedTokens)
+	admin.POST("/tokens/:domainId/:id/undelete", undeleteToken)
+
+	testScenarios := []struct {
+		method       string
+		path         string
+		authToken    string
+		expectStatus int
+	}{
+		{"GET", "/admin/tokens/mydomain/deleted", "ops-key", http.StatusOK},
+		{"POST", "/admin/tokens/mydomain/abc/undelete", "ops-key", http.StatusOK},
+		{"GET", "/admin/tokens/mydomain/deleted", "app-key", http.StatusForbidden},
+		{"GET", "/admin/tokens/mydomain/deleted", "", http.StatusUnauthorized},
+		{"POST", "/admin/tokens/mydomain/abc/undelete", "ops-key-2", http.StatusUnauthorized},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			req := httptest.NewRequest(scenario.method, scenario.path, nil)
+			req.Header.Set("x-auth-token", scenario.authToken)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if want, got := scenario.expectStatus, w.Code; want != got {
+				t.Errorf("expect status %d but got %d: %s", want, got, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestFindApiKeyWithoutKeys(t *testing.T) {
+	if _, found := findApiKey(nil, "anything"); found {
+		t.Error("expect no api key to match when none are configured")
+	}
+	if _, found := findApiKey([]systemconfig.ApiKey{{Name: "blank"}}, ""); found {
+		t.Error("expect a blank key never to match")
+	}
+}
+
+func TestCheckApiKeys(t *testing.T) {
+	testScenarios := []struct {
+		givenKeys   []systemconfig.ApiKey
+		expectError bool
+	}{
+		{nil, false},
+		{[]systemconfig.ApiKey{{Name: "ops", Key: "0123456789abcdef0123456789abcdef"}}, false},
+		{[]systemconfig.ApiKey{{Name: "ops", Key: "ops-key"}}, true},
+		{[]systemconfig.ApiKey{{Name: "blank"}}, true},
+		{[]systemconfig.ApiKey{{Name: "admin", Key: "replace with a long random string"}}, true},
+		{[]systemconfig.ApiKey{{Name: "support", Key: "replace with another long random string"}}, true},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if want, got := scenario.expectError, checkApiKeys(scenario.givenKeys) != nil; want != got {
+				t.Errorf("expect error %v but got %v", want, got)
+			}
+		})
+	}
+}
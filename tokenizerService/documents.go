@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"tokentarpon/tokenizer"
+
+	"github.com/gin-gonic/gin"
+)
+
+func tokenizeDocument(c *gin.Context) {
+	domainUuid := c.Param("domainId")
+	addHeaders(c)
+
+	var request tokenizer.DocumentRequest
+	if err := c.BindJSON(&request); err != nil {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Document request malformed"})
+		return
+	}
+
+	result, err := tokenizer.TokenizeDocument(domainUuid, request)
+	var fielderr *tokenizer.FieldError
+	if errors.As(err, &fielderr) {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprint(err), "errors": []*tokenizer.FieldError{fielderr}})
+	} else if err == tokenizer.ErrInvalidDocument || err == tokenizer.ErrNoSelectors {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprint(err)})
+	} else if err == tokenizer.ErrDomainShredded {
+		c.IndentedJSON(http.StatusGone, gin.H{"message": fmt.Sprint(err)})
+	} else if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+	} else {
+		setIdempotentTokens(c, result.Tokens)
+		c.IndentedJSON(http.StatusCreated, result)
+	}
+}
+
+func detokenizeDocument(c *gin.Context) {
+	domainUuid := c.Param("domainId")
+	addHeaders(c)
+	view, ok := authorizeView(c)
+	if !ok {
+		return
+	}
+
+	var request tokenizer.DocumentRequest
+	if err := c.BindJSON(&request); err != nil {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Document request malformed"})
+		return
+	}
+
+	result, err := tokenizer.DetokenizeDocument(domainUuid, request, view)
+	var fielderr *tokenizer.FieldError
+	if errors.As(err, &fielderr) {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprint(err), "errors": []*tokenizer.FieldError{fielderr}})
+	} else if err == tokenizer.ErrInvalidDocument || err == tokenizer.ErrNoSelectors {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprint(err)})
+	} else if err == tokenizer.ErrDomainShredded {
+		c.IndentedJSON(http.StatusGone, gin.H{"message": fmt.Sprint(err)})
+	} else if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+	} else if result.Partial {
+		c.JSON(http.StatusMultiStatus, result)
+	} else {
+		c.JSON(http.StatusOK, result)
+	}
+}
@@ -1,10 +1,16 @@
 module tokentarpon/tokenizerService
 
-go 1.18
+go 1.21
+
+require (
+	github.com/gin-gonic/gin v1.8.2
+	tokentarpon/tokencrypto v0.0.0-00010101000000-000000000000
+	tokentarpon/tokenizer v0.0.0-00010101000000-000000000000
+	tokentarpon/tokenizer/systemconfig v0.0.0-00010101000000-000000000000
+)
 
 require (
 	github.com/gin-contrib/sse v0.1.0 // indirect
-	github.com/gin-gonic/gin v1.8.2 // indirect
 	github.com/go-playground/locales v0.14.0 // indirect
 	github.com/go-playground/universal-translator v0.18.0 // indirect
 	github.com/go-playground/validator/v10 v10.11.1 // indirect
@@ -33,11 +39,9 @@ require (
 	golang.org/x/text v0.5.0 // indirect
 	google.golang.org/protobuf v1.28.1 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
-	tokentarpon/tokencrypto v0.0.0-00010101000000-000000000000 // indirect
-	tokentarpon/tokenizer v0.0.0-00010101000000-000000000000 // indirect
+	tokentarpon/tokenizer/datalog v0.0.0-00010101000000-000000000000 // indirect
 	tokentarpon/tokenizer/datastore v0.0.0-00010101000000-000000000000 // indirect
 	tokentarpon/tokenizer/datastore/datastoremongo v0.0.0 // indirect
-	tokentarpon/tokenizer/systemconfig v0.0.0-00010101000000-000000000000 // indirect
 )
 
 replace tokentarpon/tokenizer => ../tokenizer
@@ -49,3 +53,5 @@ replace tokentarpon/tokenizer/datastore => ../tokenizer/datastore
 replace tokentarpon/tokenizer/datastore/datastoremongo => ../tokenizer/datastore/datastoremongo
 
 replace tokentarpon/tokenizer/systemconfig => ../tokenizer/systemconfig
+
+replace tokentarpon/tokenizer/datalog => ../tokenizer/datalog
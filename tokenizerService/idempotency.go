@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"tokentarpon/tokenizer"
+
+	"github.com/gin-gonic/gin"
+)
+
+var maxIdempotencyKeyLength = 255
+
+// context key a handler lists the ids of the tokens in its response under,
+// so a response kept for replay is deleted with them
+const idempotentTokensKey = "idempotentTokens"
+
+// responseRecorder keeps a copy of the response body as it is written
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotent handles the Idempotency-Key header. The first request with a key
+// is recorded along with its response; retries with the same key and body get
+// the recorded response back, and reusing the key for a different body is
+// rejected with 409. Requests without the header are passed straight through.
+func idempotent(c *gin.Context) {
+	key := strings.TrimSpace(c.GetHeader("Idempotency-Key"))
+	if len(key) == 0 {
+		c.Next()
+		return
+	}
+
+	domainUuid := c.Param("domainId")
+	addHeaders(c)
+	if len(key) > maxIdempotencyKeyLength {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Idempotency-Key is too long"})
+		return
+	}
+
+	body, err := c.GetRawData()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"message": "Token request malformed"})
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	fingerprint := tokenizer.RequestFingerprint(c.Request.Method, c.Request.URL.RequestURI(), string(body))
+	record, replay, err := tokenizer.BeginIdempotentRequest(domainUuid, key, fingerprint)
+	if err == tokenizer.ErrIdempotencyKeyReused || err == tokenizer.ErrIdempotencyInProgress {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": fmt.Sprint(err)})
+		return
+	} else if err == tokenizer.ErrDomainShredded {
+		c.AbortWithStatusJSON(http.StatusGone, gin.H{"message": fmt.Sprint(err)})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprint(err)})
+		return
+	}
+
+	if replay {
+		c.Header("Idempotent-Replayed", "true")
+		c.Data(record.Status, "application/json; charset=utf-8", []byte(record.Response))
+		c.Abort()
+		return
+	}
+
+	recorder := &responseRecorder{ResponseWriter: c.Writer}
+	c.Writer = recorder
+	c.Next()
+
+	// server errors are not replayed, so the caller can retry with the same key
+	if recorder.Status() >= http.StatusInternalServerError {
+		tokenizer.AbandonIdempotentRequest(domainUuid, key)
+	} else if err := tokenizer.CompleteIdempotentRequest(domainUuid, key, recorder.Status(), recorder.body.String(), c.GetStringSlice(idempotentTokensKey)); err != nil {
+		tokenizer.AbandonIdempotentRequest(domainUuid, key)
+	}
+}
+
+// setIdempotentTokens lists the tokens in the response for the idempotent middleware
+func setIdempotentTokens(c *gin.Context, tokens []tokenizer.Token) {
+	tokenUuids := make([]string, len(tokens))
+	for idx, tok := range tokens {
+		tokenUuids[idx] = tok.Uuid
+	}
+	c.Set(idempotentTokensKey, tokenUuids)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"tokentarpon/tokenizer"
+
+	"github.com/gin-gonic/gin"
+)
+
+// proxyInbound receives a request from a third party on one of the stored
+// inbound routes, tokenizes the route's fields into its domain and forwards
+// the request to the route's internal target. A field that can't be
+// tokenized stops the request, so a raw value is never forwarded.
+func proxyInbound(c *gin.Context) {
+	addHeaders(c)
+
+	route, err := tokenizer.GetInboundRoute(c.Param("route"))
+	if err == tokenizer.ErrNoInboundRoute {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Unknown inbound route"})
+		return
+	} else if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+		return
+	}
+	target, err := proxyTarget(route.Target, c.Param("path"), c.Request.URL.RawQuery)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Inbound route target misconfigured"})
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxProxyBodyBytes))
+	if err != nil {
+		c.IndentedJSON(http.StatusRequestEntityTooLarge, gin.H{"message": "Request body too large to proxy"})
+		return
+	}
+	header := c.Request.Header.Clone()
+	for _, name := range proxyDroppedHeaders {
+		header.Del(name)
+	}
+
+	message := tokenizer.InboundMessage{Header: header}
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if len(body) > 0 && !inboundBodyCovered(route, mediaType) {
+		c.IndentedJSON(http.StatusUnsupportedMediaType, gin.H{"message": "Request body is not of a type this route tokenizes"})
+		return
+	}
+	if len(body) > 0 && isJSONMediaType(mediaType) {
+		message.Document = body
+	} else if len(body) > 0 && mediaType == "application/x-www-form-urlencoded" {
+		form, parseerr := url.ParseQuery(string(body))
+		if parseerr != nil {
+			c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Request body malformed"})
+			return
+		}
+		message.Form = form
+	}
+
+	message, err = tokenizer.TokenizeInbound(route, message)
+	var fielderr *tokenizer.FieldError
+	if errors.As(err, &fielderr) {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprint(err), "errors": []*tokenizer.FieldError{fielderr}})
+		return
+	} else if err == tokenizer.ErrInvalidDocument {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprint(err)})
+		return
+	} else if err == tokenizer.ErrDomainShredded {
+		c.IndentedJSON(http.StatusGone, gin.H{"message": fmt.Sprint(err)})
+		return
+	} else if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+		return
+	}
+
+	if message.Document != nil {
+		body = message.Document
+	} else if message.Form != nil {
+		body = []byte(url.Values(message.Form).Encode())
+	}
+	forwardUpstream(c, target, header, body, nil)
+}
+
+// inboundBodyCovered reports whether a body of the media type can have the
+// route's fields found in it. A route listing body fields fails closed on
+// any other body, rather than forwarding it with its values in the clear.
+func inboundBodyCovered(route tokenizer.InboundRoute, mediaType string) bool {
+	if isJSONMediaType(mediaType) {
+		return len(route.Paths) > 0 || len(route.FormFields) == 0
+	}
+	if mediaType == "application/x-www-form-urlencoded" {
+		return len(route.FormFields) > 0 || len(route.Paths) == 0
+	}
+	return len(route.Paths) == 0 && len(route.FormFields) == 0
+}
+
+func getInboundRoutes(c *gin.Context) {
+	start, limit := getPageParams(c)
+
+	routes, err := tokenizer.ListInboundRoutes(start, limit)
+	if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+	} else {
+		c.JSON(http.StatusOK, routes)
+	}
+}
+
+func getInboundRoute(c *gin.Context) {
+	route, err := tokenizer.GetInboundRoute(c.Param("name"))
+	if err == tokenizer.ErrNoInboundRoute {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": fmt.Sprint(err)})
+	} else if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+	} else {
+		c.IndentedJSON(http.StatusOK, route)
+	}
+}
+
+func saveInboundRoute(c *gin.Context) {
+	var route tokenizer.InboundRoute
+	if err := c.BindJSON(&route); err != nil {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Inbound route malformed"})
+		return
+	}
+	// the route is named by the url
+	route.Name = c.Param("name")
+
+	route, err := tokenizer.SaveInboundRoute(route, callerName(c))
+	var fielderr *tokenizer.FieldError
+	if errors.As(err, &fielderr) {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprint(err), "errors": []*tokenizer.FieldError{fielderr}})
+	} else if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+	} else {
+		c.IndentedJSON(http.StatusOK, route)
+	}
+}
+
+func deleteInboundRoute(c *gin.Context) {
+	err := tokenizer.DeleteInboundRoute(c.Param("name"), callerName(c))
+	if err == tokenizer.ErrNoInboundRoute {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": fmt.Sprint(err)})
+	} else if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+	} else {
+		c.IndentedJSON(http.StatusOK, gin.H{"message": "Inbound route deleted"})
+	}
+}
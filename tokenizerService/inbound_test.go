@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"tokentarpon/tokenizer"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestProxyInbound(t *testing.T) {
+	tokenizer.UnitTest = true
+	gin.SetMode(gin.TestMode)
+
+	var targetHits int
+	var targetPath, targetBody string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		targetHits++
+		targetPath = r.URL.Path
+		body, _ := io.ReadAll(r.Body)
+		targetBody = string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer target.Close()
+
+	route := tokenizer.InboundRoute{
+		Name:       "partner",
+		DomainUuid: "mydomain",
+		Target:     target.URL + "/hooks",
+		Paths:      []tokenizer.FieldSelector{{Path: "$.customer.email", ValueType: "email"}},
+		FormFields: []tokenizer.InboundField{{Name: "card", ValueType: "pan"}},
+	}
+	if _, err := tokenizer.SaveInboundRoute(route, "ops"); err != nil {
+		t.Fatal(err)
+	}
+	defer tokenizer.DeleteInboundRoute("partner", "ops")
+
+	router := gin.New()
+	router.POST("/inbound/:route/*path", proxyInbound)
+
+	testScenarios := []struct {
+		path         string
+		contentType  string
+		body         string
+		expectStatus int
+		expectRaw    string
+	}{
+		{"/inbound/partner/orders", "application/json", `{"customer": {"email": "jane@example.com"}, "total": 42}`, http.StatusNoContent, "jane@example.com"},
+		{"/inbound/partner/cards", "application/x-www-form-urlencoded", "card=4242424242424242&plan=gold", http.StatusNoContent, "4242424242424242"},
+		{"/inbound/partner/cards", "application/x-www-form-urlencoded", "card=4242424242424241", http.StatusUnprocessableEntity, ""},
+		{"/inbound/partner/orders", "application/json", `{"customer": `, http.StatusUnprocessableEntity, ""},
+		{"/inbound/other/orders", "application/json", `{}`, http.StatusNotFound, ""},
+		// a body the route's fields can't be found in is never forwarded
+		{"/inbound/partner/orders", "text/plain", `{"customer": {"email": "jane@example.com"}}`, http.StatusUnsupportedMediaType, ""},
+		{"/inbound/partner/orders", "", `{"customer": {"email": "jane@example.com"}}`, http.StatusUnsupportedMediaType, ""},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			targetHits = 0
+			req := httptest.NewRequest("POST", scenario.path, strings.NewReader(scenario.body))
+			req.Header.Set("Content-Type", scenario.contentType)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if want, got := scenario.expectStatus, w.Code; want != got {
+				t.Fatalf("expect status %d but got %d: %s", want, got, w.Body.String())
+			}
+			if want, got := scenario.expectStatus == http.StatusNoContent, targetHits == 1; want != got {
+				t.Fatalf("expect target called %t but got %d calls", want, targetHits)
+			}
+			if targetHits == 0 {
+				return
+			}
+			if want, got := "/hooks"+strings.TrimPrefix(scenario.path, "/inbound/partner"), targetPath; want != got {
+				t.Errorf("expect path %s but got %s", want, got)
+			}
+			if strings.Contains(targetBody, scenario.expectRaw) {
+				t.Errorf("expect %s tokenized before forwarding but got %s", scenario.expectRaw, targetBody)
+			}
+		})
+	}
+}
+
+func TestInboundBodyCovered(t *testing.T) {
+	paths := []tokenizer.FieldSelector{{Path: "$.email"}}
+	formFields := []tokenizer.InboundField{{Name: "card"}}
+
+	testScenarios := []struct {
+		givenRoute     tokenizer.InboundRoute
+		givenMediaType string
+		expectCovered  bool
+	}{
+		{tokenizer.InboundRoute{Paths: paths}, "application/json", true},
+		{tokenizer.InboundRoute{Paths: paths}, "application/vnd.api+json", true},
+		{tokenizer.InboundRoute{Paths: paths}, "application/x-www-form-urlencoded", false},
+		{tokenizer.InboundRoute{Paths: paths}, "text/plain", false},
+		{tokenizer.InboundRoute{FormFields: formFields}, "application/x-www-form-urlencoded", true},
+		{tokenizer.InboundRoute{FormFields: formFields}, "application/json", false},
+		{tokenizer.InboundRoute{Paths: paths, FormFields: formFields}, "application/json", true},
+		{tokenizer.InboundRoute{Paths: paths, FormFields: formFields}, "", false},
+		// a route tokenizing only headers takes any body
+		{tokenizer.InboundRoute{}, "text/plain", true},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if want, got := scenario.expectCovered, inboundBodyCovered(scenario.givenRoute, scenario.givenMediaType); want != got {
+				t.Errorf("expect covered %t but got %t", want, got)
+			}
+		})
+	}
+}
+
+func TestSaveInboundRoute(t *testing.T) {
+	tokenizer.UnitTest = true
+	gin.SetMode(gin.TestMode)
+	defer tokenizer.DeleteInboundRoute("partner", "")
+
+	router := gin.New()
+	router.PUT("/admin/inbound/:name", saveInboundRoute)
+	router.GET("/admin/inbound/:name", getInboundRoute)
+	router.DELETE("/admin/inbound/:name", deleteInboundRoute)
+
+	testScenarios := []struct {
+		method       string
+		path         string
+		body         string
+		expectStatus int
+	}{
+		{"PUT", "/admin/inbound/partner", `{"domainUuid": "mydomain", "target": "http://localhost:9000", "headers": ["x-card"]}`, http.StatusOK},
+		{"GET", "/admin/inbound/partner", "", http.StatusOK},
+		{"PUT", "/admin/inbound/partner", `{"domainUuid": "mydomain", "target": "localhost:9000", "headers": ["x-card"]}`, http.StatusUnprocessableEntity},
+		{"PUT", "/admin/inbound/partner", `{"domainUuid": "mydomain", "target": "http://localhost:9000"}`, http.StatusUnprocessableEntity},
+		{"DELETE", "/admin/inbound/partner", "", http.StatusOK},
+		{"GET", "/admin/inbound/partner", "", http.StatusNotFound},
+		{"DELETE", "/admin/inbound/partner", "", http.StatusNotFound},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			req := httptest.NewRequest(scenario.method, scenario.path, strings.NewReader(scenario.body))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if want, got := scenario.expectStatus, w.Code; want != got {
+				t.Errorf("expect status %d but got %d: %s", want, got, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"tokentarpon/tokenizer"
+
+	"github.com/gin-gonic/gin"
+)
+
+// the largest job spec part read from an upload
+const maxJobSpecBytes = 64 * 1024
+
+// createTokenizeJob takes a multipart upload of a "spec" part, the job's
+// format and fields as JSON, followed by a "file" part. The file is streamed
+// to disk rather than read into memory, which is why the spec has to come first.
+func createTokenizeJob(c *gin.Context) {
+	domainUuid := c.Param("domainId")
+	addHeaders(c)
+
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Job upload must be multipart/form-data"})
+		return
+	}
+
+	var spec tokenizer.JobSpec
+	var haveSpec bool
+	for {
+		part, parterr := reader.NextPart()
+		if parterr == io.EOF {
+			break
+		} else if parterr != nil {
+			c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Job upload malformed"})
+			return
+		}
+
+		switch part.FormName() {
+		case "spec":
+			if decodeerr := json.NewDecoder(io.LimitReader(part, maxJobSpecBytes)).Decode(&spec); decodeerr != nil {
+				c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Job spec malformed"})
+				return
+			}
+			haveSpec = true
+		case "file":
+			if !haveSpec {
+				c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Job spec must come before the file"})
+				return
+			}
+			job, joberr := tokenizer.CreateTokenizeJob(domainUuid, spec, part, callerName(c))
+			var fielderr *tokenizer.FieldError
+			if errors.As(joberr, &fielderr) {
+				c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprint(joberr), "errors": []*tokenizer.FieldError{fielderr}})
+			} else if joberr == tokenizer.ErrJobInputTooLarge {
+				c.IndentedJSON(http.StatusRequestEntityTooLarge, gin.H{"message": fmt.Sprint(joberr)})
+			} else if joberr == tokenizer.ErrDomainShredded {
+				c.IndentedJSON(http.StatusGone, gin.H{"message": fmt.Sprint(joberr)})
+			} else if joberr != nil {
+				errmsg := fmt.Sprint(joberr)
+				c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+			} else {
+				c.IndentedJSON(http.StatusAccepted, job)
+			}
+			return
+		}
+	}
+	c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Job upload needs a file"})
+}
+
+// createExportJob asks for an export of token values, encrypted to the
+// recipient's public key. It waits for approval by another api key.
+func createExportJob(c *gin.Context) {
+	domainUuid := c.Param("domainId")
+	addHeaders(c)
+
+	var spec tokenizer.ExportSpec
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Export spec malformed"})
+		return
+	}
+	job, err := tokenizer.CreateExportJob(domainUuid, spec, callerName(c))
+	var fielderr *tokenizer.FieldError
+	if errors.As(err, &fielderr) {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprint(err), "errors": []*tokenizer.FieldError{fielderr}})
+	} else if err == tokenizer.ErrJobInputTooLarge {
+		c.IndentedJSON(http.StatusRequestEntityTooLarge, gin.H{"message": fmt.Sprint(err)})
+	} else if err == tokenizer.ErrDomainShredded {
+		c.IndentedJSON(http.StatusGone, gin.H{"message": fmt.Sprint(err)})
+	} else if err == tokenizer.ErrNoJobActor {
+		c.IndentedJSON(http.StatusForbidden, gin.H{"message": fmt.Sprint(err)})
+	} else if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+	} else {
+		c.IndentedJSON(http.StatusAccepted, job)
+	}
+}
+
+// approveJob queues an export, as long as the caller isn't who asked for it
+func approveJob(c *gin.Context) {
+	addHeaders(c)
+	job, err := tokenizer.ApproveJob(c.Param("domainId"), c.Param("id"), callerName(c))
+	respondWithJob(c, job, err)
+}
+
+func getJobs(c *gin.Context) {
+	domainUuid := c.Param("domainId")
+	addHeaders(c)
+	start, limit := getPageParams(c)
+
+	jobs, err := tokenizer.ListJobs(domainUuid, start, limit)
+	if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+	} else {
+		c.JSON(http.StatusOK, jobs)
+	}
+}
+
+func getJob(c *gin.Context) {
+	addHeaders(c)
+	job, err := tokenizer.GetJob(c.Param("domainId"), c.Param("id"))
+	respondWithJob(c, job, err)
+}
+
+func pauseJob(c *gin.Context) {
+	addHeaders(c)
+	job, err := tokenizer.PauseJob(c.Param("domainId"), c.Param("id"), callerName(c))
+	respondWithJob(c, job, err)
+}
+
+func resumeJob(c *gin.Context) {
+	addHeaders(c)
+	job, err := tokenizer.ResumeJob(c.Param("domainId"), c.Param("id"), callerName(c))
+	respondWithJob(c, job, err)
+}
+
+func retryJob(c *gin.Context) {
+	addHeaders(c)
+	job, err := tokenizer.RetryJob(c.Param("domainId"), c.Param("id"), callerName(c))
+	respondWithJob(c, job, err)
+}
+
+func deleteJob(c *gin.Context) {
+	addHeaders(c)
+	err := tokenizer.DeleteJob(c.Param("domainId"), c.Param("id"), callerName(c))
+	if err == nil {
+		c.IndentedJSON(http.StatusOK, gin.H{"message": "Job deleted"})
+		return
+	}
+	respondWithJob(c, tokenizer.Job{}, err)
+}
+
+// getJobOutput sends a completed job's output file
+func getJobOutput(c *gin.Context) {
+	addHeaders(c)
+	job, err := tokenizer.GetJob(c.Param("domainId"), c.Param("id"))
+	if err != nil {
+		respondWithJob(c, job, err)
+		return
+	}
+	path, err := tokenizer.JobOutputPath(job)
+	if err != nil {
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "Job output is only ready once the job has completed"})
+		return
+	}
+	name := job.Uuid + "." + job.Format
+	if job.Kind == tokenizer.JobKindExport {
+		name += ".enc"
+	}
+	c.FileAttachment(path, name)
+}
+
+func respondWithJob(c *gin.Context, job tokenizer.Job, err error) {
+	if err == tokenizer.ErrNoSuchJob {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": fmt.Sprint(err)})
+	} else if err == tokenizer.ErrJobApprover {
+		c.IndentedJSON(http.StatusForbidden, gin.H{"message": fmt.Sprint(err)})
+	} else if err == tokenizer.ErrJobState {
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": fmt.Sprint(err), "status": job.Status})
+	} else if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+	} else {
+		c.IndentedJSON(http.StatusOK, job)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"tokentarpon/tokencrypto"
+	"tokentarpon/tokenizer"
+	"tokentarpon/tokenizer/systemconfig"
+
+	"github.com/gin-gonic/gin"
+)
+
+// makeJobUpload builds a multipart upload with the parts in the order given
+func makeJobUpload(t *testing.T, parts [][2]string) (*bytes.Buffer, string) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, part := range parts {
+		create := writer.CreateFormField
+		if part[0] == "file" {
+			create = func(name string) (io.Writer, error) { return writer.CreateFormFile(name, "customers.csv") }
+		}
+		field, err := create(part[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		field.Write([]byte(part[1]))
+	}
+	writer.Close()
+	return &body, writer.FormDataContentType()
+}
+
+func TestCreateTokenizeJob(t *testing.T) {
+	tokenizer.UnitTest = true
+	gin.SetMode(gin.TestMode)
+	t.Setenv("TMPDIR", t.TempDir())
+
+	router := gin.New()
+	router.POST("/jobs/:domainId/tokenize", createTokenizeJob)
+
+	spec := `{"format": "csv", "fields": [{"path": "email", "valueType": "email"}]}`
+	file := "name,email\nAnn,ann@example.com\n"
+	testScenarios := []struct {
+		givenParts   [][2]string
+		multipart    bool
+		expectStatus int
+	}{
+		{[][2]string{{"spec", spec}, {"file", file}}, true, http.StatusAccepted},
+		{[][2]string{{"file", file}, {"spec", spec}}, true, http.StatusUnprocessableEntity},
+		{[][2]string{{"spec", spec}}, true, http.StatusUnprocessableEntity},
+		{[][2]string{{"spec", `{"format": "csv", "fields": ["ssn"]}`}, {"file", file}}, true, http.StatusUnprocessableEntity},
+		{[][2]string{{"spec", `{"format": `}, {"file", file}}, true, http.StatusUnprocessableEntity},
+		{[][2]string{{"spec", spec}, {"file", file}}, false, http.StatusUnprocessableEntity},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			body, contentType := makeJobUpload(t, scenario.givenParts)
+			req := httptest.NewRequest("POST", "/jobs/mydomain/tokenize", body)
+			if scenario.multipart {
+				req.Header.Set("Content-Type", contentType)
+			} else {
+				req.Header.Set("Content-Type", "text/csv")
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if want, got := scenario.expectStatus, w.Code; want != got {
+				t.Fatalf("expect status %d but got %d: %s", want, got, w.Body.String())
+			}
+			if w.Code != http.StatusAccepted {
+				return
+			}
+			var job tokenizer.Job
+			json.Unmarshal(w.Body.Bytes(), &job)
+			if want, got := tokenizer.JobQueued, job.Status; want != got {
+				t.Errorf("expect status %s but got %s", want, got)
+			}
+			if want, got := int64(len(file)), job.InputBytes; want != got {
+				t.Errorf("expect %d bytes stored but got %d", want, got)
+			}
+		})
+	}
+}
+
+func TestJobRoutes(t *testing.T) {
+	tokenizer.UnitTest = true
+	gin.SetMode(gin.TestMode)
+	t.Setenv("TMPDIR", t.TempDir())
+
+	spec := tokenizer.JobSpec{Format: "ndjson", Fields: []tokenizer.FieldSelector{{Path: "$.email"}}}
+	job, err := tokenizer.CreateTokenizeJob("mydomain", spec, strings.NewReader(`{"email": "a@example.com"}`), "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.GET("/jobs/:domainId/:id", getJob)
+	router.DELETE("/jobs/:domainId/:id", deleteJob)
+	router.POST("/jobs/:domainId/:id/pause", pauseJob)
+	router.POST("/jobs/:domainId/:id/resume", resumeJob)
+	router.POST("/jobs/:domainId/:id/retry", retryJob)
+	router.GET("/jobs/:domainId/:id/output", getJobOutput)
+
+	testScenarios := []struct {
+		method       string
+		path         string
+		expectStatus int
+	}{
+		{"GET", "/jobs/mydomain/" + job.Uuid, http.StatusOK},
+		{"GET", "/jobs/otherdomain/" + job.Uuid, http.StatusNotFound},
+		{"GET", "/jobs/mydomain/" + job.Uuid + "/output", http.StatusConflict},
+		{"POST", "/jobs/mydomain/" + job.Uuid + "/pause", http.StatusOK},
+		{"POST", "/jobs/mydomain/" + job.Uuid + "/pause", http.StatusConflict},
+		{"POST", "/jobs/mydomain/" + job.Uuid + "/retry", http.StatusConflict},
+		{"POST", "/jobs/mydomain/" + job.Uuid + "/resume", http.StatusOK},
+		{"DELETE", "/jobs/mydomain/" + job.Uuid, http.StatusOK},
+		{"GET", "/jobs/mydomain/" + job.Uuid, http.StatusNotFound},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			req := httptest.NewRequest(scenario.method, scenario.path, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if want, got := scenario.expectStatus, w.Code; want != got {
+				t.Errorf("expect status %d but got %d: %s", want, got, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestExportJobRoutes(t *testing.T) {
+	tokenizer.UnitTest = true
+	gin.SetMode(gin.TestMode)
+	t.Setenv("TMPDIR", t.TempDir())
+	configuration.ApiKeys = []systemconfig.ApiKey{
+		{Name: "alice", Key: "alice-key", Scopes: []string{ScopeExport, ScopeAdmin}},
+		{Name: "bob", Key: "bob-key", Scopes: []string{ScopeAdmin}},
+		{Name: "app", Key: "app-key", Scopes: []string{ScopeDetokenize}},
+	}
+	defer func() { configuration.ApiKeys = nil }()
+	publicKey, _, _ := tokencrypto.GenerateRecipientKeys()
+
+	router := gin.New()
+	router.POST("/jobs/:domainId/tokenize", createTokenizeJob)
+	router.POST("/jobs/:domainId/export", requireScope(ScopeExport), createExportJob)
+	router.GET("/jobs/:domainId/:id", getJob)
+	router.POST("/jobs/:domainId/:id/pause", pauseJob)
+	admin := router.Group("/admin", requireScope(ScopeAdmin))
+	admin.POST("/jobs/:domainId/:id/approve", approveJob)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/jobs/mydomain/export", strings.NewReader(`{"all": true, "recipientKey": "`+publicKey+`"}`))
+	req.Header.Set("x-auth-token", "alice-key")
+	router.ServeHTTP(w, req)
+	if want, got := http.StatusAccepted, w.Code; want != got {
+		t.Fatalf("expect status %d but got %d: %s", want, got, w.Body.String())
+	}
+	var job tokenizer.Job
+	json.Unmarshal(w.Body.Bytes(), &job)
+	if want, got := tokenizer.JobAwaitingApproval, job.Status; want != got {
+		t.Errorf("expect status %s but got %s", want, got)
+	}
+
+	testScenarios := []struct {
+		method       string
+		path         string
+		givenBody    string
+		authToken    string
+		expectStatus int
+	}{
+		{"POST", "/jobs/mydomain/export", `{"tokens": ["a1"], "recipientKey": "` + publicKey + `"}`, "app-key", http.StatusForbidden},
+		{"POST", "/jobs/mydomain/export", `{"tokens": ["a1"], "recipientKey": "` + publicKey + `"}`, "", http.StatusUnauthorized},
+		{"POST", "/jobs/mydomain/export", `{"tokens": ["a1"], "recipientKey": "c2hvcnQ="}`, "alice-key", http.StatusUnprocessableEntity},
+		{"POST", "/jobs/mydomain/export", `{"tokens": `, "alice-key", http.StatusUnprocessableEntity},
+		{"POST", "/admin/jobs/mydomain/" + job.Uuid + "/approve", "", "app-key", http.StatusForbidden},
+		{"POST", "/admin/jobs/mydomain/" + job.Uuid + "/approve", "", "alice-key", http.StatusForbidden},
+		{"POST", "/admin/jobs/otherdomain/" + job.Uuid + "/approve", "", "bob-key", http.StatusNotFound},
+		{"POST", "/admin/jobs/mydomain/" + job.Uuid + "/approve", "", "bob-key", http.StatusOK},
+		{"POST", "/admin/jobs/mydomain/" + job.Uuid + "/approve", "", "bob-key", http.StatusConflict},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			req := httptest.NewRequest(scenario.method, scenario.path, strings.NewReader(scenario.givenBody))
+			req.Header.Set("x-auth-token", scenario.authToken)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if want, got := scenario.expectStatus, w.Code; want != got {
+				t.Errorf("expect status %d but got %d: %s", want, got, w.Body.String())
+			}
+		})
+	}
+}
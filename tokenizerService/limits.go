@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"tokentarpon/tokenizer"
+
+	"github.com/gin-gonic/gin"
+)
+
+// routes whose bodies are read as they arrive rather than held in memory, so
+// they are left to their own limits
+var unlimitedBodyRoutes = map[string]bool{
+	"/jobs/:domainId/tokenize":        true,
+	"/tokens/:domainId/stream":        true,
+	"/tokens/:domainId/values/stream": true,
+}
+
+// limitRequestBody turns away a request whose body is over the domain's
+// limit, with 413, before any handler reads it. The body is read up to the
+// limit and handed on from memory, so a client that understates its
+// Content-Length is caught too.
+func limitRequestBody(c *gin.Context) {
+	if c.Request.Body == nil || c.Request.ContentLength == 0 || unlimitedBodyRoutes[c.FullPath()] {
+		c.Next()
+		return
+	}
+
+	maxRequestBytes := tokenizer.GetRequestLimits(c.Param("domainId")).MaxRequestBytes
+	if c.Request.ContentLength > maxRequestBytes {
+		abortRequestTooLarge(c, maxRequestBytes)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxRequestBytes+1))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Request body could not be read"})
+		return
+	}
+	if int64(len(body)) > maxRequestBytes {
+		abortRequestTooLarge(c, maxRequestBytes)
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	c.Next()
+}
+
+func abortRequestTooLarge(c *gin.Context, maxRequestBytes int64) {
+	addHeaders(c)
+	// the rest of the body isn't wanted, so the connection isn't kept for another request
+	c.Header("Connection", "close")
+	c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{
+		"message": "Request body must be at most " + strconv.FormatInt(maxRequestBytes, 10) + " bytes",
+		"code":    tokenizer.ErrCodeRequestTooLarge,
+	})
+}
+
+// checkBatchItems answers 413 and returns false when a batch request has more
+// items than the domain allows
+func checkBatchItems(c *gin.Context, domainUuid string, items int) bool {
+	maxBatchItems := tokenizer.GetRequestLimits(domainUuid).MaxBatchItems
+	if int64(items) <= maxBatchItems {
+		return true
+	}
+	c.IndentedJSON(http.StatusRequestEntityTooLarge, gin.H{
+		"message": "Batch must have at most " + strconv.FormatInt(maxBatchItems, 10) + " items",
+		"code":    tokenizer.ErrCodeBatchTooLarge,
+	})
+	return false
+}
+
+// respondValueSize answers 422 for an empty value and 413 for one over the
+// domain's limit, returning false for any other error
+func respondValueSize(c *gin.Context, err error) bool {
+	if err == tokenizer.ErrEmptyValue {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Token value must not be blank", "code": tokenizer.ErrCodeEmptyValue})
+	} else if err == tokenizer.ErrValueTooBig {
+		maxValueBytes := tokenizer.GetRequestLimits(c.Param("domainId")).MaxValueBytes
+		c.IndentedJSON(http.StatusRequestEntityTooLarge, gin.H{
+			"message": "Token value must be at most " + strconv.FormatInt(maxValueBytes, 10) + " bytes",
+			"code":    tokenizer.ErrCodeValueTooBig,
+		})
+	} else {
+		return false
+	}
+	return true
+}
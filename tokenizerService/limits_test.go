@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"tokentarpon/tokenizer"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequestLimits(t *testing.T) {
+	tokenizer.UnitTest = true
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.Use(limitRequestBody)
+	router.PUT("/tokens/:domainId", createTokens)
+	router.POST("/tokens/:domainId", createToken)
+	router.POST("/tokens/:domainId/values", getTokenValues)
+	router.PUT("/tokens/:domainId/stream", createTokensStream)
+	router.PUT("/tokens/:domainId/:id", updateToken)
+
+	limits := tokenizer.GetRequestLimits("mydomain")
+	tokenLine := "{\"domainUuid\": \"mydomain\", \"value\": \"one\"},"
+	tooManyTokens := "[" + strings.Repeat(tokenLine, int(limits.MaxBatchItems)) + tokenLine[:len(tokenLine)-1] + "]"
+	tooManyIds := "{\"uuids\": [" + strings.Repeat("\"a1\",", int(limits.MaxBatchItems)) + "\"a1\"]}"
+	tooBigBody := "[" + strings.Repeat(" ", int(limits.MaxRequestBytes)) + tokenLine[:len(tokenLine)-1] + "]"
+	tooBigValue := "{\"domainUuid\": \"mydomain\", \"value\": \"" + strings.Repeat("v", int(limits.MaxValueBytes)+1) + "\"}"
+
+	testScenarios := []struct {
+		method        string
+		path          string
+		givenBody     string
+		unknownLength bool
+		expectStatus  int
+		expectCode    string
+	}{
+		{"PUT", "/tokens/mydomain", "[" + tokenLine[:len(tokenLine)-1] + "]", false, http.StatusCreated, ""},
+		{"PUT", "/tokens/mydomain", tooManyTokens, false, http.StatusRequestEntityTooLarge, tokenizer.ErrCodeBatchTooLarge},
+		{"POST", "/tokens/mydomain/values", tooManyIds, false, http.StatusRequestEntityTooLarge, tokenizer.ErrCodeBatchTooLarge},
+		{"PUT", "/tokens/mydomain", tooBigBody, false, http.StatusRequestEntityTooLarge, tokenizer.ErrCodeRequestTooLarge},
+		{"PUT", "/tokens/mydomain", tooBigBody, true, http.StatusRequestEntityTooLarge, tokenizer.ErrCodeRequestTooLarge},
+		{"POST", "/tokens/mydomain", tooBigValue, false, http.StatusRequestEntityTooLarge, tokenizer.ErrCodeValueTooBig},
+		{"POST", "/tokens/mydomain", "{\"domainUuid\": \"mydomain\", \"value\": \" \"}", false, http.StatusUnprocessableEntity, tokenizer.ErrCodeEmptyValue},
+		{"PUT", "/tokens/mydomain?mode=atomic", "[" + tooBigValue + "]", false, http.StatusUnprocessableEntity, tokenizer.ErrCodeValueTooBig},
+		{"PUT", "/tokens/mydomain/a1", tooBigValue, false, http.StatusRequestEntityTooLarge, tokenizer.ErrCodeValueTooBig},
+		{"PUT", "/tokens/mydomain/a1", "{\"value\": \"\"}", false, http.StatusUnprocessableEntity, tokenizer.ErrCodeEmptyValue},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			req := httptest.NewRequest(scenario.method, scenario.path, strings.NewReader(scenario.givenBody))
+			if scenario.unknownLength {
+				req.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if want, got := scenario.expectStatus, w.Code; want != got {
+				t.Fatalf("expect status %d but got %d: %.200s", want, got, w.Body.String())
+			}
+			var response struct {
+				Code   string `json:"code"`
+				Errors []struct {
+					Code string `json:"code"`
+				} `json:"errors"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &response)
+			// a batch reports the code of each token turned away
+			if len(response.Errors) > 0 {
+				response.Code = response.Errors[0].Code
+			}
+			if want, got := scenario.expectCode, response.Code; want != got {
+				t.Errorf("expect code %q but got %q", want, got)
+			}
+		})
+	}
+
+	// streams are read as they arrive, so a stream bigger than a request can be is taken
+	body := strings.Repeat("\n", int(limits.MaxRequestBytes)) + tokenLine[:len(tokenLine)-1] + "\n"
+	req := httptest.NewRequest("PUT", "/tokens/mydomain/stream", strings.NewReader(body))
+	req.Header.Set("Content-Type", ndjsonContentType)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if want, got := http.StatusOK, w.Code; want != got {
+		t.Errorf("expect a long stream taken with status %d but got %d: %.200s", want, got, w.Body.String())
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+	"tokentarpon/tokenizer"
+
+	"github.com/gin-gonic/gin"
+)
+
+var defaultProxyTimeoutSeconds int64 = 30
+
+// the most body the proxy will read from a caller or an upstream
+const maxProxyBodyBytes = 4 * 1024 * 1024
+
+// hop-by-hop headers, and ones meant for the tokenizer, are never passed on
+var proxyDroppedHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length", "Host",
+	"X-Auth-Token", "Idempotency-Key", "Accept-Encoding",
+}
+
+// proxyScopes may send token values upstream when RequireDetokenizeScope is set
+var proxyScopes = []string{ScopeDetokenize, ScopeProxy}
+
+// proxyOutbound forwards the request to the allow-listed upstream, with every
+// token reference in its headers, JSON body or form fields replaced by the
+// token's value. References that can't be resolved stop the request before
+// anything is sent upstream. The upstream's response is returned as it came,
+// or with the values sent replaced by their references again when the
+// upstream is set to TokenizeResponse.
+func proxyOutbound(c *gin.Context) {
+	domainUuid := c.Param("domainId")
+	addHeaders(c)
+
+	upstream, ok := configuration.ProxyUpstreams[c.Param("upstream")]
+	if !ok || len(upstream.Url) == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Unknown upstream"})
+		return
+	}
+	target, err := proxyTarget(upstream.Url, c.Param("path"), c.Request.URL.RawQuery)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Upstream url misconfigured"})
+		return
+	}
+	if !authorizeValueScopes(c, proxyScopes, "send token values upstream") {
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxProxyBodyBytes))
+	if err != nil {
+		c.IndentedJSON(http.StatusRequestEntityTooLarge, gin.H{"message": "Request body too large to proxy"})
+		return
+	}
+	header := c.Request.Header.Clone()
+	for _, name := range proxyDroppedHeaders {
+		header.Del(name)
+	}
+
+	// the references are gathered first, so they can all be resolved in one read
+	var uuids []string
+	collect := func(text string) string {
+		uuids = append(uuids, tokenizer.FindTokenReferences(text)...)
+		return text
+	}
+	if _, err = rewriteMessage(header, body, collect, true); err != nil {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Request body malformed"})
+		return
+	}
+
+	values, unresolved, err := tokenizer.ResolveTokenReferences(domainUuid, uuids)
+	if err == tokenizer.ErrDomainShredded {
+		c.IndentedJSON(http.StatusGone, gin.H{"message": fmt.Sprint(err)})
+		return
+	} else if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+		return
+	} else if len(unresolved) > 0 {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Token references could not be resolved", "errors": unresolved})
+		return
+	}
+
+	if len(values) > 0 {
+		body, _ = rewriteMessage(header, body, func(text string) string {
+			return tokenizer.ReplaceTokenReferences(text, values)
+		}, true)
+	}
+	var rewriteResponse func(string) string
+	if upstream.TokenizeResponse && len(values) > 0 {
+		rewriteResponse = tokenizer.NewReferenceReplacer(values)
+	}
+	forwardUpstream(c, target, header, body, rewriteResponse)
+}
+
+// forwardUpstream sends the request on to the target with the caller's method
+// and relays the response back. When rewriteResponse is given each string of
+// a JSON response body, or field of a form body, is passed through it first;
+// headers and other bodies are relayed as they are.
+func forwardUpstream(c *gin.Context, target string, header http.Header, body []byte, rewriteResponse func(string) string) {
+	outbound, err := http.NewRequestWithContext(c.Request.Context(), c.Request.Method, target, bytes.NewReader(body))
+	if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+		return
+	}
+	outbound.Header = header
+
+	response, err := proxyClient().Do(outbound)
+	var timeouterr interface{ Timeout() bool }
+	if errors.As(err, &timeouterr) && timeouterr.Timeout() {
+		c.IndentedJSON(http.StatusGatewayTimeout, gin.H{"message": "Upstream timed out"})
+		return
+	} else if err != nil {
+		c.IndentedJSON(http.StatusBadGateway, gin.H{"message": "Upstream unreachable"})
+		return
+	}
+	defer response.Body.Close()
+	responseBody, err := io.ReadAll(io.LimitReader(response.Body, maxProxyBodyBytes+1))
+	if err != nil || len(responseBody) > maxProxyBodyBytes {
+		c.IndentedJSON(http.StatusBadGateway, gin.H{"message": "Upstream response unreadable or too large"})
+		return
+	}
+
+	responseHeader := response.Header.Clone()
+	for _, name := range proxyDroppedHeaders {
+		responseHeader.Del(name)
+	}
+	if rewriteResponse != nil {
+		responseBody, err = rewriteMessage(responseHeader, responseBody, rewriteResponse, false)
+		if err != nil {
+			// an upstream claiming JSON it doesn't send must not get the values through
+			c.IndentedJSON(http.StatusBadGateway, gin.H{"message": "Upstream response malformed"})
+			return
+		}
+	}
+
+	for name, headerValues := range responseHeader {
+		// the tokenizer answers cors for itself
+		if strings.HasPrefix(name, "Access-Control-") {
+			continue
+		}
+		for _, value := range headerValues {
+			c.Writer.Header().Add(name, value)
+		}
+	}
+	c.Data(response.StatusCode, responseHeader.Get("Content-Type"), responseBody)
+}
+
+// proxyTarget appends the requested path to the upstream url. The path is
+// cleaned first, so it can't climb out of the upstream url's own path.
+func proxyTarget(upstreamUrl string, requestPath string, rawQuery string) (string, error) {
+	target, err := url.Parse(upstreamUrl)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || len(target.Host) == 0 {
+		return "", errors.New("upstream url must be an absolute http or https url")
+	}
+	target.Path = strings.TrimRight(target.Path, "/") + path.Clean("/"+requestPath)
+	if strings.HasSuffix(requestPath, "/") && !strings.HasSuffix(target.Path, "/") {
+		target.Path += "/"
+	}
+	target.RawPath = ""
+	target.RawQuery = rawQuery
+	return target.String(), nil
+}
+
+// rewriteMessage passes each string in a JSON body or each field of a form
+// body through rewrite, returning the new body, and every header value too
+// when rewriteHeaders is set. Other bodies are passed on untouched.
+func rewriteMessage(header http.Header, body []byte, rewrite func(string) string, rewriteHeaders bool) ([]byte, error) {
+	if rewriteHeaders {
+		for name, headerValues := range header {
+			for idx, value := range headerValues {
+				header[name][idx] = rewrite(value)
+			}
+		}
+	}
+	if len(body) == 0 {
+		return body, nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	switch {
+	case isJSONMediaType(mediaType):
+		var document interface{}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&document); err != nil {
+			return body, err
+		}
+		var rewritten bytes.Buffer
+		encoder := json.NewEncoder(&rewritten)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(rewriteJSONStrings(document, rewrite)); err != nil {
+			return body, err
+		}
+		return bytes.TrimRight(rewritten.Bytes(), "\n"), nil
+	case mediaType == "application/x-www-form-urlencoded":
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return body, err
+		}
+		for name, fieldValues := range form {
+			for idx, value := range fieldValues {
+				form[name][idx] = rewrite(value)
+			}
+		}
+		return []byte(form.Encode()), nil
+	}
+	return body, nil
+}
+
+func isJSONMediaType(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// rewriteJSONStrings passes each string value, not the keys, through rewrite
+func rewriteJSONStrings(node interface{}, rewrite func(string) string) interface{} {
+	switch value := node.(type) {
+	case string:
+		return rewrite(value)
+	case map[string]interface{}:
+		for key, child := range value {
+			value[key] = rewriteJSONStrings(child, rewrite)
+		}
+	case []interface{}:
+		for idx, child := range value {
+			value[idx] = rewriteJSONStrings(child, rewrite)
+		}
+	}
+	return node
+}
+
+// proxyClient doesn't follow redirects, so values are only ever sent to the allow-listed upstream
+func proxyClient() *http.Client {
+	timeoutSeconds := configuration.ProxyTimeoutSeconds
+	if timeoutSeconds <= 0 {
+		timeoutSeconds = defaultProxyTimeoutSeconds
+	}
+	return &http.Client{
+		Timeout: time.Duration(timeoutSeconds) * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"tokentarpon/tokenizer"
+	"tokentarpon/tokenizer/systemconfig"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestProxyTarget(t *testing.T) {
+	testScenarios := []struct {
+		givenUrl     string
+		givenPath    string
+		givenQuery   string
+		expectTarget string
+		expectErr    bool
+	}{
+		{"https://api.example.com/v1", "/charges", "", "https://api.example.com/v1/charges", false},
+		{"https://api.example.com/v1/", "/charges/", "expand=card", "https://api.example.com/v1/charges/?expand=card", false},
+		{"https://api.example.com/v1", "/../admin", "", "https://api.example.com/v1/admin", false},
+		{"https://api.example.com", "/a/./b/../c", "", "https://api.example.com/a/c", false},
+		{"api.example.com", "/charges", "", "", true},
+		{"ftp://api.example.com", "/charges", "", "", true},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			target, err := proxyTarget(scenario.givenUrl, scenario.givenPath, scenario.givenQuery)
+			if want, got := scenario.expectErr, err != nil; want != got {
+				t.Fatalf("expect error %t but got %#v", want, err)
+			}
+			if want, got := scenario.expectTarget, target; want != got {
+				t.Errorf("expect target %s but got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestRewriteMessage(t *testing.T) {
+	values := map[string]string{"a1": "4242424242424242", "b2": "a&b@example.com"}
+	replace := func(text string) string {
+		return tokenizer.ReplaceTokenReferences(text, values)
+	}
+
+	testScenarios := []struct {
+		givenType      string
+		givenBody      string
+		rewriteHeaders bool
+		expectBody     string
+		expectErr      bool
+	}{
+		{"application/json", `{"card": {"number": "{{token:a1}}"}, "{{token:a1}}": 42, "to": ["{{token:b2}}"]}`, true, `{"card":{"number":"4242424242424242"},"to":["a&b@example.com"],"{{token:a1}}":42}`, false},
+		{"application/json; charset=utf-8", `{"amount": 1.50}`, true, `{"amount":1.50}`, false},
+		{"application/x-www-form-urlencoded", "card%5Bnumber%5D=%7B%7Btoken%3Aa1%7D%7D&amount=150", true, "amount=150&card%5Bnumber%5D=4242424242424242", false},
+		{"text/plain", "card {{token:a1}}", true, "card {{token:a1}}", false},
+		{"text/plain", "card {{token:a1}}", false, "card {{token:a1}}", false},
+		{"application/json", `{"card": "{{token:a1}}"}`, false, `{"card":"4242424242424242"}`, false},
+		{"application/json", `{"card": `, true, `{"card": `, true},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			header := http.Header{"Content-Type": {scenario.givenType}, "Authorization": {"Bearer {{token:b2}}"}}
+			body, err := rewriteMessage(header, []byte(scenario.givenBody), replace, scenario.rewriteHeaders)
+			if want, got := scenario.expectErr, err != nil; want != got {
+				t.Fatalf("expect error %t but got %#v", want, err)
+			}
+			if want, got := scenario.expectBody, string(body); want != got {
+				t.Errorf("expect body %s but got %s", want, got)
+			}
+			expectHeader := "Bearer {{token:b2}}"
+			if scenario.rewriteHeaders {
+				expectHeader = "Bearer a&b@example.com"
+			}
+			if want, got := expectHeader, header.Get("Authorization"); want != got {
+				t.Errorf("expect header %s but got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestProxyOutbound(t *testing.T) {
+	tokenizer.UnitTest = true
+	gin.SetMode(gin.TestMode)
+
+	var upstreamHits int
+	var upstreamRequest *http.Request
+	var upstreamBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHits++
+		upstreamRequest = r
+		body, _ := io.ReadAll(r.Body)
+		upstreamBody = string(body)
+		if r.URL.Path == "/v1/redirect" {
+			http.Redirect(w, r, "https://elsewhere.example.com/", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"id": "ch_1"}`))
+	}))
+	defer upstream.Close()
+
+	configuration.ProxyUpstreams = map[string]systemconfig.ProxyUpstream{"payments": {Url: upstream.URL + "/v1"}}
+	configuration.ApiKeys = []systemconfig.ApiKey{
+		{Name: "checkout", Key: "checkout-key", Scopes: []string{ScopeProxy}},
+		{Name: "support", Key: "support-key", Scopes: []string{ScopeDetokenizeMasked}},
+	}
+	defer func() {
+		configuration.ProxyUpstreams = nil
+		configuration.ApiKeys = nil
+		configuration.RequireDetokenizeScope = false
+	}()
+
+	router := gin.New()
+	router.POST("/proxy/:domainId/:upstream/*path", proxyOutbound)
+
+	testScenarios := []struct {
+		requireScope bool
+		authToken    string
+		path         string
+		body         string
+		expectStatus int
+		expectHit    bool
+	}{
+		{false, "", "/proxy/mydomain/payments/charges?expand=card", `{"amount": 150}`, http.StatusAccepted, true},
+		{false, "", "/proxy/mydomain/mailer/send", `{"amount": 150}`, http.StatusNotFound, false},
+		{false, "", "/proxy/mydomain/payments/charges", `{"card": "{{token:not-a-token}}"}`, http.StatusUnprocessableEntity, false},
+		{false, "", "/proxy/mydomain/payments/charges", `{"card": `, http.StatusUnprocessableEntity, false},
+		{false, "", "/proxy/mydomain/payments/redirect", `{}`, http.StatusFound, true},
+		{true, "checkout-key", "/proxy/mydomain/payments/charges", `{"amount": 150}`, http.StatusAccepted, true},
+		{true, "support-key", "/proxy/mydomain/payments/charges", `{"amount": 150}`, http.StatusForbidden, false},
+		{true, "", "/proxy/mydomain/payments/charges", `{"amount": 150}`, http.StatusUnauthorized, false},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			configuration.RequireDetokenizeScope = scenario.requireScope
+			upstreamHits = 0
+			req := httptest.NewRequest("POST", scenario.path, strings.NewReader(scenario.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("x-request-id", "req-1")
+			if len(scenario.authToken) > 0 {
+				req.Header.Set("x-auth-token", scenario.authToken)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if want, got := scenario.expectStatus, w.Code; want != got {
+				t.Fatalf("expect status %d but got %d: %s", want, got, w.Body.String())
+			}
+			if want, got := scenario.expectHit, upstreamHits == 1; want != got {
+				t.Fatalf("expect upstream called %t but got %d calls", want, upstreamHits)
+			}
+			if !scenario.expectHit {
+				return
+			}
+			if len(upstreamRequest.Header.Get("x-auth-token")) > 0 {
+				t.Errorf("expect the api key to stay with the tokenizer")
+			}
+			if want, got := "req-1", upstreamRequest.Header.Get("x-request-id"); want != got {
+				t.Errorf("expect header %s passed on but got %s", want, got)
+			}
+			if want, got := scenario.body, upstreamBody; scenario.expectStatus == http.StatusAccepted && want != got {
+				t.Errorf("expect body %s passed on but got %s", want, got)
+			}
+			if want, got := "", w.Header().Get("Access-Control-Allow-Origin"); scenario.expectStatus == http.StatusAccepted && want != got {
+				t.Errorf("expect the upstream's cors headers dropped but got %s", got)
+			}
+		})
+	}
+}
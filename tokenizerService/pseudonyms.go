@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"tokentarpon/tokenizer"
+
+	"github.com/gin-gonic/gin"
+)
+
+// pseudonyms can be guessed at like hashes, so the scopes
+// that may see hashes may make them
+var pseudonymScopes = []string{ScopeDetokenize, ScopeDetokenizeMasked, ScopeDetokenizeHash, ScopePseudonymize}
+
+func getPseudonyms(c *gin.Context) {
+	domainUuid := c.Param("domainId")
+	addHeaders(c)
+	if !authorizeValueScopes(c, pseudonymScopes, "make pseudonyms") {
+		return
+	}
+
+	var request tokenizer.PseudonymRequest
+	if err := c.BindJSON(&request); err != nil {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Pseudonym request malformed"})
+		return
+	}
+
+	pseudonyms, err := tokenizer.Pseudonymize(domainUuid, request)
+	var fielderr *tokenizer.FieldError
+	if errors.As(err, &fielderr) {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprint(err), "errors": []*tokenizer.FieldError{fielderr}})
+	} else if err == tokenizer.ErrNoPseudonymInput {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprint(err)})
+	} else if err == tokenizer.ErrEpochNotLinkable {
+		c.IndentedJSON(http.StatusForbidden, gin.H{"message": fmt.Sprint(err)})
+	} else if err == tokenizer.ErrDomainShredded {
+		c.IndentedJSON(http.StatusGone, gin.H{"message": fmt.Sprint(err)})
+	} else if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+	} else {
+		c.JSON(http.StatusOK, pseudonyms)
+	}
+}
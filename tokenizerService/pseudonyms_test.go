@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"tokentarpon/tokenizer"
+	"tokentarpon/tokenizer/systemconfig"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGetPseudonyms(t *testing.T) {
+	tokenizer.UnitTest = true
+	gin.SetMode(gin.TestMode)
+	configuration.ApiKeys = []systemconfig.ApiKey{
+		{Name: "analytics", Key: "analytics-key", Scopes: []string{ScopePseudonymize}},
+		{Name: "ops", Key: "ops-key", Scopes: []string{ScopeAdmin}},
+	}
+	configuration.RequireDetokenizeScope = true
+	defer func() {
+		configuration.ApiKeys = nil
+		configuration.RequireDetokenizeScope = false
+	}()
+
+	router := gin.New()
+	router.POST("/tokens/:domainId/pseudonyms", getPseudonyms)
+
+	testScenarios := []struct {
+		authToken    string
+		body         string
+		expectStatus int
+	}{
+		{"analytics-key", `{"values": []}`, http.StatusUnprocessableEntity},
+		{"analytics-key", `{"values": ["42"], "valueType": "shoesize"}`, http.StatusUnprocessableEntity},
+		{"analytics-key", `{"values": ["42"], "epoch": 1}`, http.StatusForbidden},
+		{"ops-key", `{"values": ["42"]}`, http.StatusForbidden},
+		{"", `{"values": ["42"]}`, http.StatusUnauthorized},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/tokens/mydomain/pseudonyms", strings.NewReader(scenario.body))
+			if len(scenario.authToken) > 0 {
+				req.Header.Set("x-auth-token", scenario.authToken)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if want, got := scenario.expectStatus, w.Code; want != got {
+				t.Errorf("expect status %d but got %d: %s", want, got, w.Body.String())
+			}
+		})
+	}
+}
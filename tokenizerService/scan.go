@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"tokentarpon/tokenizer"
+
+	"github.com/gin-gonic/gin"
+)
+
+func scanText(c *gin.Context) {
+	domainUuid := c.Param("domainId")
+	addHeaders(c)
+
+	var request tokenizer.ScanRequest
+	if err := c.BindJSON(&request); err != nil {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Scan request malformed"})
+		return
+	}
+
+	result, err := tokenizer.ScanText(domainUuid, request)
+	var fielderr *tokenizer.FieldError
+	if errors.As(err, &fielderr) {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprint(err), "errors": []*tokenizer.FieldError{fielderr}})
+	} else if err == tokenizer.ErrNoScanText {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprint(err)})
+	} else if err == tokenizer.ErrDomainShredded {
+		c.IndentedJSON(http.StatusGone, gin.H{"message": fmt.Sprint(err)})
+	} else if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+	} else {
+		tokens := make([]tokenizer.Token, len(result.Matches))
+		for idx, match := range result.Matches {
+			tokens[idx] = tokenizer.Token{Uuid: match.Uuid}
+		}
+		setIdempotentTokens(c, tokens)
+		c.IndentedJSON(http.StatusCreated, result)
+	}
+}
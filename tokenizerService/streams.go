@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"tokentarpon/tokenizer"
+
+	"github.com/gin-gonic/gin"
+)
+
+// content type of streamed batches, a JSON value per line
+const ndjsonContentType = "application/x-ndjson"
+
+// lines of a stream are handled this many at a time, so only one batch is held in memory
+var streamBatchItems = 100
+
+// the longest line a stream may have
+const maxStreamLineBytes = 1024 * 1024
+
+var (
+	errEmptyStream       = errors.New("No tokens were provided")
+	errStreamLineTooLong = errors.New("Stream has a line longer than 1MB")
+)
+
+// streamLine is a line of a streamed request, numbered from 1
+type streamLine struct {
+	number int64
+	text   []byte
+}
+
+// streamResult is a line of a streamed response, for the request line it answers
+type streamResult struct {
+	Line  int64            `json:"line"`
+	Uuid  string           `json:"uuid,omitempty"`
+	Value string           `json:"value,omitempty"`
+	Token *tokenizer.Token `json:"token,omitempty"`
+	Error string           `json:"error,omitempty"`
+	Field string           `json:"field,omitempty"`
+	Code  string           `json:"code,omitempty"`
+}
+
+// streamTokenIdLine is a line of a streamed value request
+type streamTokenIdLine struct {
+	Uuid string `json:"uuid"`
+}
+
+// createTokensStream creates a token for each line of an application/x-ndjson
+// body, writing a line back for each as its batch is done. Tokens are created
+// independently, as in the best effort mode; a failed line reports its error
+// but never its value.
+func createTokensStream(c *gin.Context) {
+	domainUuid := c.Param("domainId")
+	addHeaders(c)
+	if c.DefaultQuery("mode", tokenizer.BatchModeBestEffort) != tokenizer.BatchModeBestEffort {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Only best effort batches can be streamed"})
+		return
+	}
+
+	err := streamNDJSON(c, func(lines []streamLine) ([]streamResult, error) {
+		results := make([]streamResult, len(lines))
+		var tokens []tokenizer.Token
+		var tokenIdx []int
+		for idx, line := range lines {
+			results[idx].Line = line.number
+			var tokenObj tokenizer.Token
+			if err := json.Unmarshal(line.text, &tokenObj); err != nil {
+				results[idx].Error = "Token record malformed"
+				continue
+			}
+			tokens = append(tokens, tokenObj)
+			tokenIdx = append(tokenIdx, idx)
+		}
+		if len(tokens) == 0 {
+			return results, nil
+		}
+		for created, result := range tokenizer.CreateTokenResults(domainUuid, tokens) {
+			streamed := &results[tokenIdx[created]]
+			if result.Error != nil {
+				streamed.Error = result.Error.Error
+				streamed.Field = result.Error.Field
+				streamed.Code = result.Error.Code
+			} else {
+				token := result.Token
+				streamed.Token = &token
+			}
+		}
+		return results, nil
+	})
+	if err == errEmptyStream {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprint(err)})
+	} else if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+	}
+}
+
+// getTokenValuesStream returns the value of the token on each line of an
+// application/x-ndjson body, {"uuid": "<id>"}, writing a line back for each
+// as its batch is read, with the same error codes as a batch value request
+func getTokenValuesStream(c *gin.Context) {
+	domainUuid := c.Param("domainId")
+	addHeaders(c)
+	view, ok := authorizeView(c)
+	if !ok {
+		return
+	}
+
+	err := streamNDJSON(c, func(lines []streamLine) ([]streamResult, error) {
+		results := make([]streamResult, len(lines))
+		var uuids []string
+		var uuidIdx []int
+		for idx, line := range lines {
+			results[idx].Line = line.number
+			var tokenId streamTokenIdLine
+			if err := json.Unmarshal(line.text, &tokenId); err != nil || len(tokenId.Uuid) == 0 {
+				results[idx].Error = tokenizer.ErrCodeInvalidId
+				continue
+			}
+			results[idx].Uuid = tokenId.Uuid
+			uuids = append(uuids, tokenId.Uuid)
+			uuidIdx = append(uuidIdx, idx)
+		}
+		if len(uuids) == 0 {
+			return results, nil
+		}
+		tokenValues, err := tokenizer.GetTokenValues(tokenizer.TokenQuery{DomainUuid: domainUuid, Uuids: uuids, View: view})
+		if err != nil {
+			return nil, err
+		}
+		for found, tokenValue := range tokenValues.Results {
+			results[uuidIdx[found]].Value = tokenValue.Value
+			results[uuidIdx[found]].Error = tokenValue.Error
+		}
+		return results, nil
+	})
+	if err == errEmptyStream {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "No token ids were provided"})
+	} else if err == tokenizer.ErrDomainShredded {
+		c.IndentedJSON(http.StatusGone, gin.H{"message": fmt.Sprint(err)})
+	} else if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+	}
+}
+
+// allowFullDuplex lets the stream routes read their request while they write
+// their response. An HTTP/1.x handler otherwise can't count on reading any
+// more of its request once its response has started; HTTP/2 always allows it.
+func allowFullDuplex(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/stream") {
+			http.NewResponseController(w).EnableFullDuplex()
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// streamNDJSON reads an application/x-ndjson body a batch of lines at a
+// time, skipping blank lines, and writes the handler's results for each batch
+// as lines of the response before reading the next. A client that stops
+// reading the response holds up the reading of its request, so memory stays
+// flat however long the stream. An error from the first batch, or a body with
+// no lines, is returned for the caller to answer; once the response has
+// started, an error ends it with a line of {"error"}.
+func streamNDJSON(c *gin.Context, handle func([]streamLine) ([]streamResult, error)) error {
+	if c.ContentType() != ndjsonContentType {
+		c.IndentedJSON(http.StatusUnsupportedMediaType, gin.H{"message": "Streamed batches must be " + ndjsonContentType})
+		return nil
+	}
+
+	scanner := bufio.NewScanner(c.Request.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStreamLineBytes)
+	encoder := json.NewEncoder(c.Writer)
+	encoder.SetEscapeHTML(false)
+	started := false
+	var number int64
+	for {
+		lines, more := readStreamBatch(scanner, &number)
+		if len(lines) > 0 {
+			results, err := handle(lines)
+			if err != nil {
+				if !started {
+					return err
+				}
+				encoder.Encode(streamResult{Line: lines[len(lines)-1].number, Error: fmt.Sprint(err)})
+				return nil
+			}
+			if !started {
+				c.Header("Content-Type", ndjsonContentType)
+				c.Status(http.StatusOK)
+				started = true
+			}
+			for _, result := range results {
+				if err = encoder.Encode(result); err != nil {
+					// the client has gone
+					return nil
+				}
+			}
+			c.Writer.Flush()
+		}
+		if more {
+			continue
+		}
+
+		readerr := scanner.Err()
+		if readerr == bufio.ErrTooLong {
+			readerr = errStreamLineTooLong
+		}
+		if readerr == nil && !started {
+			return errEmptyStream
+		} else if readerr == errStreamLineTooLong && !started {
+			c.IndentedJSON(http.StatusRequestEntityTooLarge, gin.H{"message": fmt.Sprint(readerr)})
+		} else if readerr != nil && !started {
+			return readerr
+		} else if readerr != nil {
+			encoder.Encode(streamResult{Line: number + 1, Error: fmt.Sprint(readerr)})
+		}
+		return nil
+	}
+}
+
+// readStreamBatch reads up to a batch of lines, skipping blank ones, and
+// reports whether there may be more to read
+func readStreamBatch(scanner *bufio.Scanner, number *int64) ([]streamLine, bool) {
+	var lines []streamLine
+	for len(lines) < streamBatchItems {
+		if !scanner.Scan() {
+			return lines, false
+		}
+		*number++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		// the scanner reuses its buffer, so each line is copied
+		lines = append(lines, streamLine{number: *number, text: append([]byte{}, scanner.Bytes()...)})
+	}
+	return lines, true
+}
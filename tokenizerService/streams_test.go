@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"tokentarpon/tokenizer"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readStreamResults decodes each line of a streamed response
+func readStreamResults(t *testing.T, body string) []streamResult {
+	var results []streamResult
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		var result streamResult
+		if err := json.Unmarshal([]byte(line), &result); err != nil {
+			t.Fatalf("expect a JSON line but got %q", line)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func TestCreateTokensStream(t *testing.T) {
+	tokenizer.UnitTest = true
+	gin.SetMode(gin.TestMode)
+	streamBatchItems = 2
+	defer func() { streamBatchItems = 100 }()
+
+	router := gin.New()
+	router.PUT("/tokens/:domainId/stream", createTokensStream)
+
+	testScenarios := []struct {
+		givenBody        string
+		givenContentType string
+		givenMode        string
+		expectStatus     int
+		expectErrors     []string
+	}{
+		{
+			"{\"domainUuid\": \"mydomain\", \"value\": \"one\"}\n\n{\"domainUuid\": \"mydomain\", \"value\": \"\"}\n{\"domainUuid\": \"mydomain\", \"value\": \"three\"}\nnot json\n{\"domainUuid\": \"mydomain\", \"value\": \"five\"}",
+			ndjsonContentType, "", http.StatusOK,
+			[]string{"", "Missing Token Value", "", "Token record malformed", ""},
+		},
+		{"{\"domainUuid\": \"mydomain\", \"value\": \"one\"}\n", "application/json", "", http.StatusUnsupportedMediaType, nil},
+		{"{\"domainUuid\": \"mydomain\", \"value\": \"one\"}\n", ndjsonContentType, "atomic", http.StatusBadRequest, nil},
+		{"\n\n", ndjsonContentType, "", http.StatusUnprocessableEntity, nil},
+		{strings.Repeat("a", maxStreamLineBytes+1), ndjsonContentType, "", http.StatusRequestEntityTooLarge, nil},
+		{"{\"domainUuid\": \"mydomain\", \"value\": \"one\"}\n" + strings.Repeat("a", maxStreamLineBytes+1), ndjsonContentType, "", http.StatusOK, []string{"", errStreamLineTooLong.Error()}},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			path := "/tokens/mydomain/stream"
+			if len(scenario.givenMode) > 0 {
+				path += "?mode=" + scenario.givenMode
+			}
+			req := httptest.NewRequest("PUT", path, strings.NewReader(scenario.givenBody))
+			req.Header.Set("Content-Type", scenario.givenContentType)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if want, got := scenario.expectStatus, w.Code; want != got {
+				t.Fatalf("expect status %d but got %d: %s", want, got, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if want, got := ndjsonContentType, w.Header().Get("Content-Type"); want != got {
+				t.Errorf("expect content type %s but got %s", want, got)
+			}
+			results := readStreamResults(t, w.Body.String())
+			if want, got := len(scenario.expectErrors), len(results); want != got {
+				t.Fatalf("expect %d lines but got %d: %s", want, got, w.Body.String())
+			}
+			for idx, result := range results {
+				if want, got := scenario.expectErrors[idx], result.Error; want != got {
+					t.Errorf("expect line %d error %q but got %q", idx, want, got)
+				}
+				if len(result.Error) == 0 && (result.Token == nil || len(result.Token.Uuid) == 0) {
+					t.Errorf("expect line %d to have its token", idx)
+				}
+			}
+		})
+	}
+}
+
+func TestGetTokenValuesStream(t *testing.T) {
+	tokenizer.UnitTest = true
+	gin.SetMode(gin.TestMode)
+	streamBatchItems = 2
+	defer func() { streamBatchItems = 100 }()
+
+	router := gin.New()
+	router.POST("/tokens/:domainId/values/stream", getTokenValuesStream)
+
+	body := "{\"uuid\": \"a1\"}\n{\"uuid\": \"\"}\n\n{\"uuid\": \"c3\"}\n"
+	req := httptest.NewRequest("POST", "/tokens/mydomain/values/stream", strings.NewReader(body))
+	req.Header.Set("Content-Type", ndjsonContentType)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if want, got := http.StatusOK, w.Code; want != got {
+		t.Fatalf("expect status %d but got %d: %s", want, got, w.Body.String())
+	}
+
+	// unit tests have no stored tokens, so every token is not found
+	expect := []streamResult{
+		{Line: 1, Uuid: "a1", Error: tokenizer.ErrCodeNotFound},
+		{Line: 2, Error: tokenizer.ErrCodeInvalidId},
+		{Line: 4, Uuid: "c3", Error: tokenizer.ErrCodeNotFound},
+	}
+	results := readStreamResults(t, w.Body.String())
+	if want, got := len(expect), len(results); want != got {
+		t.Fatalf("expect %d lines but got %d: %s", want, got, w.Body.String())
+	}
+	for idx, result := range results {
+		if want, got := expect[idx], result; want != got {
+			t.Errorf("expect line %#v but got %#v", want, got)
+		}
+	}
+}
+
+// TestStreamReadsWhileWriting sends a line at a time, reading each line's
+// result before sending the next, over a real connection
+func TestStreamReadsWhileWriting(t *testing.T) {
+	tokenizer.UnitTest = true
+	gin.SetMode(gin.TestMode)
+	streamBatchItems = 1
+	defer func() { streamBatchItems = 100 }()
+
+	router := gin.New()
+	router.PUT("/tokens/:domainId/stream", createTokensStream)
+	server := httptest.NewServer(allowFullDuplex(router))
+	defer server.Close()
+
+	requestBody, requestWriter := io.Pipe()
+	req, _ := http.NewRequest("PUT", server.URL+"/tokens/mydomain/stream", requestBody)
+	req.Header.Set("Content-Type", ndjsonContentType)
+	client := &http.Client{Timeout: 10 * time.Second}
+	// without full duplex the server stops reading, so a blocked send gives up
+	timer := time.AfterFunc(10*time.Second, func() { requestWriter.CloseWithError(errors.New("timed out")) })
+	defer timer.Stop()
+
+	line := "{\"domainUuid\": \"mydomain\", \"value\": \"" + strings.Repeat("v", 200) + "\"}\n"
+	go requestWriter.Write([]byte(line))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("expect a response but got %#v", err)
+	}
+	defer resp.Body.Close()
+	results := bufio.NewScanner(resp.Body)
+	for idx := 1; idx <= 1500; idx++ {
+		if !results.Scan() {
+			t.Fatalf("expect a result for line %d but got %v", idx, results.Err())
+		}
+		var result streamResult
+		json.Unmarshal(results.Bytes(), &result)
+		if want, got := int64(idx), result.Line; want != got {
+			t.Fatalf("expect a result for line %d but got %d", want, got)
+		}
+		if idx < 1500 {
+			if _, err = requestWriter.Write([]byte(line)); err != nil {
+				t.Fatalf("expect line %d sent but got %#v", idx+1, err)
+			}
+		}
+	}
+	requestWriter.Close()
+	if results.Scan() {
+		t.Errorf("expect no more results but got %s", results.Text())
+	}
+}
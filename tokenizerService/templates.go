@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"tokentarpon/tokenizer"
+
+	"github.com/gin-gonic/gin"
+)
+
+// templateSinkScopes may send rendered templates to a sink when RequireDetokenizeScope is set
+var templateSinkScopes = []string{ScopeDetokenize, ScopeRender}
+
+// renderTemplate fills a template in with the values of its tokens and
+// returns the output, when the caller may detokenize in each token's view,
+// or posts it to an allow-listed sink, so the values never reach the caller
+func renderTemplate(c *gin.Context) {
+	domainUuid := c.Param("domainId")
+	addHeaders(c)
+
+	var request tokenizer.TemplateRequest
+	if err := c.BindJSON(&request); err != nil {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Template request malformed"})
+		return
+	}
+
+	sinkUrl, isSink := configuration.TemplateSinks[request.Sink]
+	if len(request.Sink) > 0 && !isSink {
+		fielderr := &tokenizer.FieldError{Field: "sink", Message: "is not an allow-listed sink"}
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fielderr.Error(), "errors": []*tokenizer.FieldError{fielderr}})
+		return
+	}
+	if isSink {
+		if !authorizeValueScopes(c, templateSinkScopes, "render templates to a sink") {
+			return
+		}
+	} else if !authorizeTemplateViews(c, request) {
+		return
+	}
+
+	output, err := tokenizer.RenderTemplate(domainUuid, request)
+	var fielderr *tokenizer.FieldError
+	if errors.As(err, &fielderr) {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprint(err), "errors": []*tokenizer.FieldError{fielderr}})
+		return
+	} else if err == tokenizer.ErrTemplateTooLarge {
+		c.IndentedJSON(http.StatusRequestEntityTooLarge, gin.H{"message": fmt.Sprint(err)})
+		return
+	} else if err == tokenizer.ErrDomainShredded {
+		c.IndentedJSON(http.StatusGone, gin.H{"message": fmt.Sprint(err)})
+		return
+	} else if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+		return
+	}
+
+	contentType := "text/plain; charset=utf-8"
+	if request.Format == tokenizer.TemplateFormatHTML {
+		contentType = "text/html; charset=utf-8"
+	}
+	if !isSink {
+		c.Data(http.StatusOK, contentType, output)
+		return
+	}
+
+	postToSink(c, request.Sink, sinkUrl, contentType, output)
+}
+
+// postToSink sends the rendered output on to the sink, answering the caller
+// with only the sink's status
+func postToSink(c *gin.Context, sink string, sinkUrl string, contentType string, output []byte) {
+	sinkRequest, err := http.NewRequestWithContext(c.Request.Context(), "POST", sinkUrl, bytes.NewReader(output))
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Sink url misconfigured"})
+		return
+	}
+	sinkRequest.Header.Set("Content-Type", contentType)
+	response, err := proxyClient().Do(sinkRequest)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadGateway, gin.H{"message": "Sink unreachable", "sink": sink})
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		c.IndentedJSON(http.StatusBadGateway, gin.H{"message": "Sink refused the output", "sink": sink, "status": response.StatusCode})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"sink": sink, "status": response.StatusCode, "bytes": len(output)})
+}
+
+// authorizeTemplateViews checks the caller may detokenize in the view of
+// every token in the template, answering the request itself when it can't
+func authorizeTemplateViews(c *gin.Context, request tokenizer.TemplateRequest) bool {
+	modes := make(map[string]bool)
+	for name, templateToken := range request.Tokens {
+		view, err := tokenizer.CheckValueView(templateToken.ValueView())
+		if err != nil {
+			fielderr := &tokenizer.FieldError{Field: "tokens." + name, Message: "has an invalid view"}
+			c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fielderr.Error(), "errors": []*tokenizer.FieldError{fielderr}})
+			return false
+		}
+		modes[view.Mode] = true
+	}
+	for mode := range modes {
+		if !authorizeValueScopes(c, viewScopes[mode], "detokenize in the "+mode+" view") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"tokentarpon/tokenizer"
+	"tokentarpon/tokenizer/systemconfig"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	tokenizer.UnitTest = true
+	gin.SetMode(gin.TestMode)
+	configuration.TemplateSinks = map[string]string{"mailer": "http://localhost:1/send"}
+	configuration.ApiKeys = []systemconfig.ApiKey{
+		{Name: "letters", Key: "letters-key", Scopes: []string{ScopeRender}},
+		{Name: "support", Key: "support-key", Scopes: []string{ScopeDetokenizeMasked}},
+	}
+	configuration.RequireDetokenizeScope = true
+	defer func() {
+		configuration.TemplateSinks = nil
+		configuration.ApiKeys = nil
+		configuration.RequireDetokenizeScope = false
+	}()
+
+	router := gin.New()
+	router.POST("/templates/:domainId/render", renderTemplate)
+
+	testScenarios := []struct {
+		authToken    string
+		body         string
+		expectStatus int
+	}{
+		{"support-key", `{"template": "Dear {{.name}}", "tokens": {"name": {"uuid": "a1", "view": "masked"}}}`, http.StatusUnprocessableEntity},
+		{"support-key", `{"template": "Dear {{.name}}", "tokens": {"name": "a1"}}`, http.StatusForbidden},
+		{"support-key", `{"template": "Dear {{.name}}", "tokens": {"name": {"uuid": "a1", "view": "initials"}}}`, http.StatusUnprocessableEntity},
+		{"support-key", `{"template": "Dear {{.name}}", "tokens": {"name": "a1"}, "sink": "mailer"}`, http.StatusForbidden},
+		{"letters-key", `{"template": "Dear {{.name}}", "tokens": {"name": "a1"}, "sink": "printer"}`, http.StatusUnprocessableEntity},
+		{"letters-key", `{"template": "Dear {{.name}}", "tokens": {"name": "a1"}}`, http.StatusForbidden},
+		{"", `{"template": "Dear {{.name}}", "tokens": {"name": "a1"}, "sink": "mailer"}`, http.StatusUnauthorized},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/templates/mydomain/render", strings.NewReader(scenario.body))
+			if len(scenario.authToken) > 0 {
+				req.Header.Set("x-auth-token", scenario.authToken)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if want, got := scenario.expectStatus, w.Code; want != got {
+				t.Errorf("expect status %d but got %d: %s", want, got, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestPostToSink(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var sinkBody, sinkType string
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		sinkBody, sinkType = string(body), r.Header.Get("Content-Type")
+		if strings.HasSuffix(r.URL.Path, "/full") {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer sink.Close()
+
+	testScenarios := []struct {
+		givenUrl     string
+		expectStatus int
+	}{
+		{sink.URL + "/send", http.StatusOK},
+		{sink.URL + "/full", http.StatusBadGateway},
+		{"http://127.0.0.1:1/send", http.StatusBadGateway},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", "/templates/mydomain/render", nil)
+			postToSink(c, "mailer", scenario.givenUrl, "text/html; charset=utf-8", []byte("<p>Dear Jane</p>"))
+			if want, got := scenario.expectStatus, w.Code; want != got {
+				t.Fatalf("expect status %d but got %d: %s", want, got, w.Body.String())
+			}
+			if strings.Contains(w.Body.String(), "Jane") {
+				t.Errorf("expect the output to go only to the sink but got %s", w.Body.String())
+			}
+			if scenario.expectStatus == http.StatusOK && (sinkBody != "<p>Dear Jane</p>" || !strings.HasPrefix(sinkType, "text/html")) {
+				t.Errorf("expect the sink to get the html output but got %s %s", sinkType, sinkBody)
+			}
+		})
+	}
+}
@@ -32,41 +32,144 @@ func main() {
 	if configuration.TokenizerServiceApiMode == "production" {
 		gin.SetMode(gin.ReleaseMode)
 	} else {
-		fmt.Println("API running in %s mode", configuration.TokenizerServiceApiMode)
+		fmt.Printf("API running in %s mode\n", configuration.TokenizerServiceApiMode)
 	}
+	if apikeyerr := checkApiKeys(configuration.ApiKeys); apikeyerr != nil {
+		fmt.Println("Cannot start service, ApiKeys need love:")
+		fmt.Printf("\n%s", fmt.Sprint(apikeyerr))
+		return
+	}
+	if keyerr := tokenizer.CheckEncryptionKey(); keyerr != nil {
+		fmt.Println("Cannot start service, EncryptionKey needs love:")
+		fmt.Printf("\n%s", fmt.Sprint(keyerr))
+		return
+	}
+	if indexerr := tokenizer.EnsureIndexes(); indexerr != nil {
+		fmt.Println("Cannot start service, datastore indexes could not be created:")
+		fmt.Printf("\n%s", fmt.Sprint(indexerr))
+		return
+	}
+
+	go tokenizer.SweepExpiredTokens()
+	go tokenizer.PurgeOnSchedule()
+	go tokenizer.RunJobs()
+
 	router := gin.Default()
+	router.Use(limitRequestBody)
 
 	router.GET("/tokens/:domainId", getTokens)
-	router.PUT("/tokens/:domainId", createTokens)
+	router.PUT("/tokens/:domainId", idempotent, createTokens)
+	router.POST("/tokens/:domainId", idempotent, createToken)
 	router.OPTIONS("/tokens/:domainId", preflight)
 
 	router.POST("/tokens/:domainId/values", getTokenValues)
 	router.OPTIONS("/tokens/:domainId/values", preflight)
 
+	// streams are answered as they are read, so they are never kept for idempotent replay
+	router.PUT("/tokens/:domainId/stream", createTokensStream)
+	router.OPTIONS("/tokens/:domainId/stream", preflight)
+	router.POST("/tokens/:domainId/values/stream", getTokenValuesStream)
+	router.OPTIONS("/tokens/:domainId/values/stream", preflight)
+
+	router.POST("/tokens/:domainId/pseudonyms", getPseudonyms)
+	router.OPTIONS("/tokens/:domainId/pseudonyms", preflight)
+
 	router.GET("/tokens/:domainId/:id", getToken)
-	router.PUT("/tokens/:domainId/:id", createToken)
+	router.PUT("/tokens/:domainId/:id", idempotent, updateToken)
 	router.DELETE("/tokens/:domainId/:id", deleteToken)
 	router.OPTIONS("/tokens/:domainId/:id", preflight)
 
 	router.GET("/tokens/:domainId/:id/value", getTokenValue)
 	router.OPTIONS("/tokens/:domainId/:id/value", preflight)
 
+	router.GET("/tokens/:domainId/:id/versions", getTokenVersions)
+	router.OPTIONS("/tokens/:domainId/:id/versions", preflight)
+
+	router.POST("/tokens/:domainId/:id/verify", verifyToken)
+	router.OPTIONS("/tokens/:domainId/:id/verify", preflight)
+
+	// detokenized documents hold values, so they are never kept for idempotent replay
+	router.POST("/documents/:domainId/tokenize", idempotent, tokenizeDocument)
+	router.OPTIONS("/documents/:domainId/tokenize", preflight)
+	router.POST("/documents/:domainId/detokenize", detokenizeDocument)
+	router.OPTIONS("/documents/:domainId/detokenize", preflight)
+
+	router.POST("/text/:domainId/scan", idempotent, scanText)
+	router.OPTIONS("/text/:domainId/scan", preflight)
+
+	router.POST("/templates/:domainId/render", renderTemplate)
+	router.OPTIONS("/templates/:domainId/render", preflight)
+
+	// job uploads are streamed to disk, so they are never read whole for idempotent replay
+	router.GET("/jobs/:domainId", getJobs)
+	router.OPTIONS("/jobs/:domainId", preflight)
+	router.POST("/jobs/:domainId/tokenize", createTokenizeJob)
+	router.OPTIONS("/jobs/:domainId/tokenize", preflight)
+	router.POST("/jobs/:domainId/export", requireScope(ScopeExport), createExportJob)
+	router.OPTIONS("/jobs/:domainId/export", preflight)
+	router.GET("/jobs/:domainId/:id", getJob)
+	router.DELETE("/jobs/:domainId/:id", deleteJob)
+	router.OPTIONS("/jobs/:domainId/:id", preflight)
+	router.POST("/jobs/:domainId/:id/pause", pauseJob)
+	router.OPTIONS("/jobs/:domainId/:id/pause", preflight)
+	router.POST("/jobs/:domainId/:id/resume", resumeJob)
+	router.OPTIONS("/jobs/:domainId/:id/resume", preflight)
+	router.POST("/jobs/:domainId/:id/retry", retryJob)
+	router.OPTIONS("/jobs/:domainId/:id/retry", preflight)
+	router.GET("/jobs/:domainId/:id/output", getJobOutput)
+	router.OPTIONS("/jobs/:domainId/:id/output", preflight)
+
+	// the proxy passes every method on, values are never kept for idempotent replay
+	for _, method := range []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"} {
+		router.Handle(method, "/proxy/:domainId/:upstream/*path", proxyOutbound)
+	}
+	router.OPTIONS("/proxy/:domainId/:upstream/*path", preflight)
+
+	// inbound routes are called by third parties, their own authentication is passed on to the target
+	for _, method := range []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"} {
+		router.Handle(method, "/inbound/:route/*path", proxyInbound)
+	}
+
+	admin := router.Group("/admin", requireScope(ScopeAdmin))
+	admin.GET("/tokens/:domainId/deleted", getDeletedTokens)
+	admin.POST("/tokens/:domainId/:id/undelete", undeleteToken)
+	admin.POST("/domains/:domainId/shred", shredDomain)
+	admin.POST("/domains/:domainId/erase", eraseDomainValue)
+	admin.POST("/accounts/:accountId/erase", eraseAccountValue)
+	admin.GET("/inbound", getInboundRoutes)
+	admin.GET("/inbound/:name", getInboundRoute)
+	admin.PUT("/inbound/:name", saveInboundRoute)
+	admin.DELETE("/inbound/:name", deleteInboundRoute)
+	admin.POST("/jobs/:domainId/:id/approve", approveJob)
+	router.OPTIONS("/admin/tokens/:domainId/deleted", preflight)
+	router.OPTIONS("/admin/tokens/:domainId/:id/undelete", preflight)
+	router.OPTIONS("/admin/domains/:domainId/shred", preflight)
+	router.OPTIONS("/admin/domains/:domainId/erase", preflight)
+	router.OPTIONS("/admin/accounts/:accountId/erase", preflight)
+	router.OPTIONS("/admin/inbound", preflight)
+	router.OPTIONS("/admin/inbound/:name", preflight)
+	router.OPTIONS("/admin/jobs/:domainId/:id/approve", preflight)
+
 	router.GET("/echo", echoEcho)
 	router.OPTIONS("/echo", preflight)
 
-	router.Run(configuration.TokenizerServiceUrl)
+	// gin's Run, with the stream routes able to read and write at once
+	fmt.Printf("Listening and serving HTTP on %s\n", configuration.TokenizerServiceUrl)
+	if serveerr := http.ListenAndServe(configuration.TokenizerServiceUrl, allowFullDuplex(router)); serveerr != nil {
+		fmt.Printf("Service stopped: %s\n", fmt.Sprint(serveerr))
+	}
 
 }
 
 func addOptionsHeaders(c *gin.Context) {
 	c.Header("Access-Control-Allow-Origin", configuration.CORSAllowOrigin) //"*"
-	c.Header("Access-Control-Allow-Headers", "access-control-allow-origin, access-control-allow-headers,x-auth-token,content-type")
-	c.Header("Access-Control-Allow-Methods", "GET,HEAD,OPTIONS,DELETE,PUT")
+	c.Header("Access-Control-Allow-Headers", "access-control-allow-origin, access-control-allow-headers,x-auth-token,content-type,idempotency-key,if-match")
+	c.Header("Access-Control-Allow-Methods", "GET,HEAD,OPTIONS,DELETE,PUT,POST")
 }
 
 func addHeaders(c *gin.Context) {
 	c.Header("Access-Control-Allow-Origin", configuration.CORSAllowOrigin) //"*"
-	c.Header("Access-Control-Expose-Headers", "x-auth-token")
+	c.Header("Access-Control-Expose-Headers", "x-auth-token,idempotent-replayed,etag,retry-after")
 }
 
 func preflight(c *gin.Context) {
@@ -79,18 +182,24 @@ func getToken(c *gin.Context) {
 	tokenId := c.Param("id")
 	addHeaders(c)
 
+	revision, ok := getVersionParam(c)
+	if !ok {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid version"})
+		return
+	}
+
 	//@todo, here we'd query something to figure out the name of the collection to use,
-	tokenObj, err := tokenizer.GetToken(domainUuid, tokenId)
-	if err != nil {
+	// the token comes back with its metadata but never its value, see getTokenValue
+	tokenObj, err := tokenizer.GetTokenMetadata(domainUuid, tokenId, revision)
+	if err == tokenizer.ErrNoMatchingToken {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "token not found"})
+	} else if err == tokenizer.ErrDomainShredded {
+		c.IndentedJSON(http.StatusGone, gin.H{"message": fmt.Sprint(err)})
+	} else if err != nil {
 		errmsg := fmt.Sprint(err)
-		// if err == datastore.ErrNotFound {
-		// 	c.IndentedJSON(http.StatusNotFound, gin.H{"message": "token not found"})
-		// } else if err == datastore.ErrServerError || err == datastore.ErrDatastoreError {
-		// 	c.IndentedJSON(http.StatusNotAcceptable, gin.H{"message": errmsg})
-		// } else {
 		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
-		//}
 	} else {
+		c.Header("ETag", etagFor(tokenObj.Revision))
 		c.IndentedJSON(http.StatusOK, tokenObj)
 	}
 }
@@ -101,20 +210,34 @@ func getTokenValue(c *gin.Context) {
 
 	addHeaders(c)
 
-	//@todo, here we'd query something to figure out the name of the collection to use,
-	tokenObj, err := tokenizer.GetToken(domainUuid, tokenId)
+	revision, ok := getVersionParam(c)
+	if !ok {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid version"})
+		return
+	}
+	view, ok := authorizeView(c)
+	if !ok {
+		return
+	}
 
-	if err != nil {
+	//@todo, here we'd query something to figure out the name of the collection to use,
+	// reading the value counts against the token's read limit, if it has one
+	var value string
+	var err error
+	if revision > 0 {
+		value, err = tokenizer.GetTokenVersionValue(domainUuid, tokenId, revision, view)
+	} else {
+		value, err = tokenizer.GetTokenValueAs(domainUuid, tokenId, view)
+	}
+	if err == tokenizer.ErrNoMatchingToken {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "token not found"})
+	} else if err == tokenizer.ErrDomainShredded {
+		c.IndentedJSON(http.StatusGone, gin.H{"message": fmt.Sprint(err)})
+	} else if err != nil {
 		errmsg := fmt.Sprint(err)
-		// if err == datastore.ErrNotFound {
-		// 	c.IndentedJSON(http.StatusNotFound, gin.H{"message": "token not found"})
-		// } else if err == datastore.ErrServerError || err == datastore.ErrDatastoreError {
-		// 	c.IndentedJSON(http.StatusNotAcceptable, gin.H{"message": errmsg})
-		// } else {
 		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
-		//}
 	} else {
-		c.IndentedJSON(http.StatusOK, tokenObj.Value)
+		c.IndentedJSON(http.StatusOK, value)
 	}
 }
 
@@ -132,11 +255,22 @@ func createToken(c *gin.Context) {
 	// based on the domain Uuid
 	// e.g. tokenizer.CollectionName = "mycollection"
 	// for now use the shared community store
-	createdToken, dataerr := tokenizer.CreateToken(domainUuid, tokenObj.Value)
-	if dataerr != nil {
+	createdToken, dataerr := tokenizer.CreateTokenFrom(domainUuid, tokenObj)
+	if respondValueSize(c, dataerr) {
+		return
+	}
+	var fielderr *tokenizer.FieldError
+	if errors.As(dataerr, &fielderr) {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprint(dataerr), "errors": []*tokenizer.FieldError{fielderr}})
+	} else if dataerr == tokenizer.ErrInvalidLifetime || dataerr == tokenizer.ErrInvalidMetadata {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprint(dataerr)})
+	} else if dataerr == tokenizer.ErrDomainShredded {
+		c.IndentedJSON(http.StatusGone, gin.H{"message": fmt.Sprint(dataerr)})
+	} else if dataerr != nil {
 		errmsg := fmt.Sprint(dataerr)
 		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
 	} else {
+		setIdempotentTokens(c, []tokenizer.Token{createdToken})
 		c.IndentedJSON(http.StatusCreated, createdToken)
 	}
 }
@@ -154,15 +288,43 @@ func createTokens(c *gin.Context) {
 		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "No tokens were provided"})
 		return
 	}
+	if !checkBatchItems(c, domainUuid, len(tokens)) {
+		return
+	}
+
+	mode := c.DefaultQuery("mode", tokenizer.BatchModeBestEffort)
 
 	//@todo, here we'd query something to figure out the name of the collection to use,
 	// based on the domain Uuid
 	// for now use the shared community store
-	createdTokens, errorTokens := tokenizer.CreateTokens(domainUuid, tokens)
-	if len(errorTokens) > 0 {
-		c.IndentedJSON(http.StatusInternalServerError, errorTokens)
-	} else {
-		c.IndentedJSON(http.StatusCreated, createdTokens)
+	switch mode {
+	case tokenizer.BatchModeAtomic:
+		createdTokens, errorTokens, err := tokenizer.CreateTokensAtomic(domainUuid, tokens)
+		if err == tokenizer.ErrBatchInvalid {
+			c.IndentedJSON(http.StatusUnprocessableEntity, tokenizer.TokenBatch{Created: []tokenizer.Token{}, Errors: errorTokens})
+		} else if err == tokenizer.ErrDomainShredded {
+			c.IndentedJSON(http.StatusGone, gin.H{"message": fmt.Sprint(err)})
+		} else if err != nil {
+			errmsg := fmt.Sprint(err)
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+		} else {
+			setIdempotentTokens(c, createdTokens)
+			c.IndentedJSON(http.StatusCreated, createdTokens)
+		}
+	case tokenizer.BatchModeBestEffort:
+		createdTokens, errorTokens := tokenizer.CreateTokens(domainUuid, tokens)
+		if len(errorTokens) > 0 {
+			if createdTokens == nil {
+				createdTokens = []tokenizer.Token{}
+			}
+			setIdempotentTokens(c, createdTokens)
+			c.IndentedJSON(http.StatusMultiStatus, tokenizer.TokenBatch{Created: createdTokens, Errors: errorTokens})
+		} else {
+			setIdempotentTokens(c, createdTokens)
+			c.IndentedJSON(http.StatusCreated, createdTokens)
+		}
+	default:
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Unknown batch mode"})
 	}
 }
 
@@ -187,32 +349,79 @@ func getTokens(c *gin.Context) {
 	domainUuid := c.Param("domainId")
 	start, limit := getPageParams(c)
 	addHeaders(c)
+	view, ok := authorizeView(c)
+	if !ok {
+		return
+	}
+
+	query := tokenizer.TokenListQuery{
+		DomainUuid:   domainUuid,
+		Cursor:       c.Query("cursor"),
+		Start:        start,
+		Limit:        limit,
+		Sort:         c.Query("sort"),
+		IncludeTotal: c.Query("count") == "true",
+		DataClass:    c.Query("dataClass"),
+		SourceSystem: c.Query("sourceSystem"),
+		Labels:       c.QueryArray("label"),
+		ExternalRef:  c.Query("externalRef"),
+	}
 
 	//@todo, here we'd query something to figure out the name of the collection to use,
-	tokens, err := tokenizer.GetTokens(domainUuid, start, limit)
-	if err != nil {
+	page, err := tokenizer.ListTokens(query)
+	if err == tokenizer.ErrInvalidCursor || err == tokenizer.ErrInvalidSort {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": fmt.Sprint(err)})
+	} else if err == tokenizer.ErrDomainShredded {
+		c.IndentedJSON(http.StatusGone, gin.H{"message": fmt.Sprint(err)})
+	} else if err != nil {
 		errmsg := fmt.Sprint(err)
 		c.IndentedJSON(http.StatusNotAcceptable, gin.H{"message": errmsg})
 	} else {
-		c.JSON(http.StatusOK, tokens)
+		for idx := range page.Tokens {
+			value, presenterr := tokenizer.PresentValue(page.Tokens[idx], view)
+			if presenterr != nil {
+				c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprint(presenterr)})
+				return
+			}
+			page.Tokens[idx].Value = value
+		}
+		c.JSON(http.StatusOK, page)
 	}
 }
 
 func getTokenValues(c *gin.Context) {
-	//domainUuid := c.Param("domainId")
-	//start, limit := getPageParams(c)
+	domainUuid := c.Param("domainId")
 	var tokenQuery tokenizer.TokenQuery
 	addHeaders(c)
+	view, ok := authorizeView(c)
+	if !ok {
+		return
+	}
 	if err := c.BindJSON(&tokenQuery); err != nil {
 		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Token request malformed"})
 		return
 	}
+	tokenQuery.View = view
+
+	if len(tokenQuery.DomainUuid) == 0 {
+		tokenQuery.DomainUuid = domainUuid
+	} else if tokenQuery.DomainUuid != domainUuid {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Invalid Domain ID"})
+		return
+	}
+	if !checkBatchItems(c, domainUuid, len(tokenQuery.Uuids)) {
+		return
+	}
 
 	//@todo here replace community with the user's collection
 	tokenValues, err := tokenizer.GetTokenValues(tokenQuery)
-	if err != nil {
+	if err == tokenizer.ErrDomainShredded {
+		c.IndentedJSON(http.StatusGone, gin.H{"message": fmt.Sprint(err)})
+	} else if err != nil {
 		errmsg := fmt.Sprint(err)
 		c.IndentedJSON(http.StatusNotAcceptable, gin.H{"message": errmsg})
+	} else if tokenValues.Partial {
+		c.JSON(http.StatusMultiStatus, tokenValues)
 	} else {
 		c.JSON(http.StatusOK, tokenValues)
 	}
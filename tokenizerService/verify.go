@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"tokentarpon/tokenizer"
+
+	"github.com/gin-gonic/gin"
+)
+
+// verifyRequest carries the value a user entered, to compare against the token
+type verifyRequest struct {
+	Value string `json:"value"`
+}
+
+// verifyToken answers whether the value matches the token, never the value itself
+func verifyToken(c *gin.Context) {
+	domainUuid := c.Param("domainId")
+	tokenId := c.Param("id")
+	addHeaders(c)
+
+	var request verifyRequest
+	if err := c.BindJSON(&request); err != nil {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Verify request malformed"})
+		return
+	}
+
+	match, retryAfter, err := tokenizer.VerifyTokenValue(domainUuid, tokenId, request.Value)
+	if err == tokenizer.ErrTooManyAttempts {
+		c.Header("Retry-After", strconv.FormatInt(retryAfter, 10))
+		c.IndentedJSON(http.StatusTooManyRequests, gin.H{"message": fmt.Sprint(err)})
+	} else if err == tokenizer.ErrNoCandidateValue {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprint(err)})
+	} else if err == tokenizer.ErrNoMatchingToken {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "token not found"})
+	} else if err == tokenizer.ErrDomainShredded {
+		c.IndentedJSON(http.StatusGone, gin.H{"message": fmt.Sprint(err)})
+	} else if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+	} else {
+		c.IndentedJSON(http.StatusOK, gin.H{"match": match})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"tokentarpon/tokenizer"
+
+	"github.com/gin-gonic/gin"
+)
+
+// updateToken stores a new value for the token, keeping its uuid.
+// An If-Match header holding the token's ETag makes the update conditional,
+// so a caller working from an old read can't overwrite a newer value.
+func updateToken(c *gin.Context) {
+	domainUuid := c.Param("domainId")
+	tokenId := c.Param("id")
+
+	var tokenObj tokenizer.Token
+	addHeaders(c)
+	if err := c.BindJSON(&tokenObj); err != nil {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Token record malformed"})
+		return
+	}
+
+	expectedRevision, ok := parseIfMatch(c.GetHeader("If-Match"))
+	if !ok {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "If-Match must be an ETag returned for this token"})
+		return
+	}
+
+	updatedToken, err := tokenizer.UpdateTokenValue(domainUuid, tokenId, tokenObj.Value, expectedRevision)
+	if respondValueSize(c, err) {
+		return
+	}
+	var fielderr *tokenizer.FieldError
+	if errors.As(err, &fielderr) {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprint(err), "errors": []*tokenizer.FieldError{fielderr}})
+	} else if err == tokenizer.ErrNoMatchingToken {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "token not found"})
+	} else if err == tokenizer.ErrRevisionMismatch {
+		c.IndentedJSON(http.StatusPreconditionFailed, gin.H{"message": fmt.Sprint(err)})
+	} else if err == tokenizer.ErrDomainShredded {
+		c.IndentedJSON(http.StatusGone, gin.H{"message": fmt.Sprint(err)})
+	} else if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+	} else {
+		c.Header("ETag", etagFor(updatedToken.Revision))
+		setIdempotentTokens(c, []tokenizer.Token{updatedToken})
+		c.IndentedJSON(http.StatusOK, updatedToken)
+	}
+}
+
+func getTokenVersions(c *gin.Context) {
+	domainUuid := c.Param("domainId")
+	tokenId := c.Param("id")
+	addHeaders(c)
+
+	versions, err := tokenizer.ListTokenVersions(domainUuid, tokenId)
+	if err == tokenizer.ErrNoMatchingToken {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "token not found"})
+	} else if err == tokenizer.ErrDomainShredded {
+		c.IndentedJSON(http.StatusGone, gin.H{"message": fmt.Sprint(err)})
+	} else if err != nil {
+		errmsg := fmt.Sprint(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": errmsg})
+	} else {
+		c.JSON(http.StatusOK, versions)
+	}
+}
+
+// getVersionParam reads the optional version querystring parameter,
+// returning 0 when it is not given
+func getVersionParam(c *gin.Context) (int64, bool) {
+	versionparam, ok := c.GetQuery("version")
+	if !ok {
+		return 0, true
+	}
+	revision, err := strconv.ParseInt(versionparam, 10, 64)
+	if err != nil || revision < 1 {
+		return 0, false
+	}
+	return revision, true
+}
+
+func etagFor(revision int64) string {
+	return `"` + strconv.FormatInt(revision, 10) + `"`
+}
+
+// parseIfMatch returns the revision in an If-Match header, or 0 when
+// the header is missing or "*", meaning the update is not conditional
+func parseIfMatch(header string) (int64, bool) {
+	header = strings.TrimSpace(header)
+	if len(header) == 0 || header == "*" {
+		return 0, true
+	}
+	header = strings.TrimPrefix(header, "W/")
+	if len(header) < 2 || !strings.HasPrefix(header, `"`) || !strings.HasSuffix(header, `"`) {
+		return 0, false
+	}
+	revision, err := strconv.ParseInt(header[1:len(header)-1], 10, 64)
+	if err != nil || revision < 1 {
+		return 0, false
+	}
+	return revision, true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"tokentarpon/tokenizer"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseIfMatch(t *testing.T) {
+	testScenarios := []struct {
+		givenHeader    string
+		expectRevision int64
+		expectOk       bool
+	}{
+		{"", 0, true},
+		{"*", 0, true},
+		{`"3"`, 3, true},
+		{`W/"3"`, 3, true},
+		{"3", 0, false},
+		{`"abc"`, 0, false},
+		{`"0"`, 0, false},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			revision, ok := parseIfMatch(scenario.givenHeader)
+			if want, got := scenario.expectOk, ok; want != got {
+				t.Fatalf("expect ok %t but got %t", want, got)
+			}
+			if want, got := scenario.expectRevision, revision; want != got {
+				t.Errorf("expect revision %d but got %d", want, got)
+			}
+		})
+	}
+}
+
+func TestUpdateToken(t *testing.T) {
+	tokenizer.UnitTest = true
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.PUT("/tokens/:domainId/:id", updateToken)
+
+	testScenarios := []struct {
+		ifMatch      string
+		body         string
+		expectStatus int
+		expectETag   string
+	}{
+		{"", `{"value": "new value"}`, http.StatusOK, `"2"`},
+		{`"1"`, `{"value": "new value"}`, http.StatusOK, `"2"`},
+		{`"5"`, `{"value": "new value"}`, http.StatusPreconditionFailed, ""},
+		{"garbage", `{"value": "new value"}`, http.StatusBadRequest, ""},
+		{"", `not json`, http.StatusBadRequest, ""},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			req := httptest.NewRequest("PUT", "/tokens/mydomain/abc", strings.NewReader(scenario.body))
+			if len(scenario.ifMatch) > 0 {
+				req.Header.Set("If-Match", scenario.ifMatch)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if want, got := scenario.expectStatus, w.Code; want != got {
+				t.Errorf("expect status %d but got %d: %s", want, got, w.Body.String())
+			}
+			if want, got := scenario.expectETag, w.Header().Get("ETag"); want != got {
+				t.Errorf("expect ETag %s but got %s", want, got)
+			}
+		})
+	}
+}
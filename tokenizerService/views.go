@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"tokentarpon/tokenizer"
+
+	"github.com/gin-gonic/gin"
+)
+
+// the scopes that may detokenize in each view; the detokenize scope allows them all
+var viewScopes = map[string][]string{
+	tokenizer.ViewFull:   {ScopeDetokenize},
+	tokenizer.ViewMasked: {ScopeDetokenize, ScopeDetokenizeMasked},
+	tokenizer.ViewFirst:  {ScopeDetokenize, ScopeDetokenizeMasked},
+	tokenizer.ViewLast:   {ScopeDetokenize, ScopeDetokenizeMasked},
+	tokenizer.ViewHash:   {ScopeDetokenize, ScopeDetokenizeMasked, ScopeDetokenizeHash},
+}
+
+// getViewParam reads the view and n querystring parameters,
+// returning the full view when they are not given
+func getViewParam(c *gin.Context) (tokenizer.ValueView, bool) {
+	view := tokenizer.ValueView{Mode: c.Query("view")}
+	if countparam, ok := c.GetQuery("n"); ok {
+		count, err := strconv.Atoi(countparam)
+		if err != nil {
+			return view, false
+		}
+		view.Count = count
+	}
+	view, err := tokenizer.CheckValueView(view)
+	return view, err == nil
+}
+
+// authorizeView reads the view a request asks for and checks the caller may
+// detokenize in it, answering the request itself when it can't go on
+func authorizeView(c *gin.Context) (tokenizer.ValueView, bool) {
+	view, ok := getViewParam(c)
+	if !ok {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": tokenizer.ErrInvalidView.Error()})
+		return view, false
+	}
+	return view, authorizeValueScopes(c, viewScopes[view.Mode], "detokenize in the "+view.Mode+" view")
+}
+
+// authorizeValueScopes checks the caller holds one of the scopes when
+// RequireDetokenizeScope is set, answering the request itself when it doesn't
+func authorizeValueScopes(c *gin.Context, scopes []string, action string) bool {
+	if !configuration.RequireDetokenizeScope {
+		return true
+	}
+
+	apiKey, found := findApiKey(configuration.ApiKeys, c.GetHeader("x-auth-token"))
+	if !found {
+		c.IndentedJSON(http.StatusUnauthorized, gin.H{"message": "Missing or unknown api key"})
+		return false
+	}
+	for _, scope := range scopes {
+		if hasScope(apiKey, scope) {
+			c.Set(callerKey, apiKey.Name)
+			return true
+		}
+	}
+	c.IndentedJSON(http.StatusForbidden, gin.H{"message": "Api key can't " + action})
+	return false
+}
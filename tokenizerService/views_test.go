@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"tokentarpon/tokenizer"
+	"tokentarpon/tokenizer/systemconfig"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAuthorizeView(t *testing.T) {
+	tokenizer.UnitTest = true
+	gin.SetMode(gin.TestMode)
+	configuration.ApiKeys = []systemconfig.ApiKey{
+		{Name: "backend", Key: "backend-key", Scopes: []string{ScopeDetokenize}},
+		{Name: "support", Key: "support-key", Scopes: []string{ScopeDetokenizeMasked}},
+		{Name: "analytics", Key: "analytics-key", Scopes: []string{ScopeDetokenizeHash}},
+	}
+	defer func() { configuration.ApiKeys = nil }()
+
+	router := gin.New()
+	router.GET("/tokens/:domainId/:id/value", getTokenValue)
+
+	testScenarios := []struct {
+		requireScope bool
+		query        string
+		authToken    string
+		expectStatus int
+	}{
+		{false, "", "", http.StatusOK},
+		{false, "?view=masked", "", http.StatusOK},
+		{false, "?view=plain", "", http.StatusBadRequest},
+		{false, "?view=last&n=x", "", http.StatusBadRequest},
+		{true, "", "backend-key", http.StatusOK},
+		{true, "?view=hash", "backend-key", http.StatusOK},
+		{true, "", "support-key", http.StatusForbidden},
+		{true, "?view=masked", "support-key", http.StatusOK},
+		{true, "?view=last&n=4", "support-key", http.StatusOK},
+		{true, "?view=hash", "analytics-key", http.StatusOK},
+		{true, "?view=masked", "analytics-key", http.StatusForbidden},
+		{true, "?view=masked", "", http.StatusUnauthorized},
+		{true, "?view=masked", "unknown-key", http.StatusUnauthorized},
+	}
+
+	for i, scenario := range testScenarios {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			configuration.RequireDetokenizeScope = scenario.requireScope
+			defer func() { configuration.RequireDetokenizeScope = false }()
+
+			req := httptest.NewRequest("GET", "/tokens/mydomain/abc/value"+scenario.query, nil)
+			if len(scenario.authToken) > 0 {
+				req.Header.Set("x-auth-token", scenario.authToken)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if want, got := scenario.expectStatus, w.Code; want != got {
+				t.Errorf("expect status %d but got %d: %s", want, got, w.Body.String())
+			}
+		})
+	}
+}